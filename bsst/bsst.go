@@ -5,9 +5,12 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"github.com/lotus-web3/ribs/ributil/mmap"
 	"github.com/minio/sha256-simd"
 	"github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
+	"hash/crc32"
 	"io"
 	"math"
 	"math/bits"
@@ -26,9 +29,16 @@ const (
 
 	EntKeyBytes = 24 // with 24 bytes hash (192 bits, plenty enough to not get collisions), 8 for user offset
 
-	BucketHeaderEntries = 1
+	BucketHeaderEntries = 2 // checksum, bloom
 	BucketUserEntries   = EntriesPerBucket - BucketHeaderEntries
 
+	// v1 buckets only have the bloom filter entry
+	BucketHeaderEntriesV1 = 1
+	BucketUserEntriesV1   = EntriesPerBucket - BucketHeaderEntriesV1
+
+	BucketChecksumOff = BucketUserEntries * EntrySize
+	BucketBloomOff    = (EntriesPerBucket - 1) * EntrySize
+
 	BucketBloomFilterSize    = EntrySize
 	BucketBloomFilterEntries = BucketBloomFilterSize * 8
 
@@ -37,7 +47,24 @@ const (
 	LevelFactor = 16384 // could be 24576, but we want to avoid deeper level misses
 )
 
-const BsstMagic = "BSST\x00\x00\x01\x00"
+const (
+	BsstMagicV1 = "BSST\x00\x00\x01\x00"
+	BsstMagic   = "BSST\x00\x00\x02\x00"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError is returned when a bucket read from disk doesn't match its
+// stored checksum.
+type CorruptionError struct {
+	Bucket   uint64
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("bsst bucket %d corrupted (stored checksum %08x, computed %08x)", e.Bucket, e.Stored, e.Computed)
+}
 
 type Source interface {
 	// List calls the callback with multihashes in sorted order.
@@ -48,11 +75,16 @@ type Source interface {
 /**
 BSST file format:
 
-bbst file: [bucketHdr: [header]\0...] [bucket0: [ent...][entHdr: bktHead]] [bucket1: ...
+bbst file: [bucketHdr: [header]\0...] [bucket0: [ent...][entHdr: bktSum][entHdr: bktHead]] [bucket1: ...
 
-header: ["BSST\x00\x00\x01\x00"] {buckets: i64, bucketSize: i64, entries: i64, salt: [32]byte, levels: i64, levelFactor: i64, finalized: bool}:cbormap
+header: ["BSST\x00\x00\x02\x00"] {buckets: i64, bucketSize: i64, entries: i64, salt: [32]byte, levels: i64, levelFactor: i64, finalized: bool}:cbormap
 
-bktHead: [bloom: [64]byte]
+bktSum: [crc32c: le32][\0...] - crc32c of the whole bucket with the checksum field zeroed
+
+bktHead: [bloom: [32]byte]
+
+v1 files ("BSST\x00\x00\x01\x00") don't have the bktSum entry, and have one
+more user entry per bucket instead.
 
 ent: [hash: [32]byte, off: le64]
 
@@ -78,18 +110,33 @@ type BSSTHeader struct {
 type BSST struct {
 	f *os.File
 	h *BSSTHeader
+
+	version     int
+	userEntries int
+
+	// mm is set when the file is memory-mapped
+	mm []byte
+}
+
+func Create(path string, source Source) (*BSST, error) {
+	return create(path, source, 2)
 }
 
-func Create(path string, entries int64, source Source) (*BSST, error) {
+func create(path string, source Source, version int) (*BSST, error) {
+	userEntries := uint64(BucketUserEntries)
+	magic := BsstMagic
+	if version == 1 {
+		userEntries = BucketUserEntriesV1
+		magic = BsstMagicV1
+	}
+
 	f, err := os.Create(path)
 	if err != nil {
 		return nil, xerrors.Errorf("open file: %w", err)
 	}
 
 	header := &BSSTHeader{
-		L0Buckets:  (entries + MeanEntriesPerBucket - 1) / MeanEntriesPerBucket, // ceil entries / MeanEntriesPerBucket
 		BucketSize: BucketSize,
-		Entries:    entries,
 
 		Levels:      1,
 		LevelFactor: LevelFactor,
@@ -99,23 +146,6 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 		return nil, xerrors.Errorf("generate salt: %w", err)
 	}
 
-	var hdrBuf [BucketSize]byte
-
-	copy(hdrBuf[:], BsstMagic)
-
-	if err := header.MarshalCBOR(bytes.NewBuffer(hdrBuf[8:])); err != nil {
-		return nil, xerrors.Errorf("marshal header: %w", err)
-	}
-
-	if _, err := f.Write(hdrBuf[:]); err != nil {
-		return nil, xerrors.Errorf("write header: %w", err)
-	}
-
-	// sync header
-	if err := f.Sync(); err != nil {
-		return nil, xerrors.Errorf("sync header: %w", err)
-	}
-
 	// <todo mhh sorted source>
 
 	// collect buckets
@@ -133,6 +163,32 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 		return nil, xerrors.Errorf("write buckets: %w", err)
 	}
 
+	// size the table based on what the source actually listed, so that sources
+	// don't need to know their entry count upfront
+	entries := int64(len(nextLevel))
+	header.Entries = entries
+	header.L0Buckets = (entries + MeanEntriesPerBucket - 1) / MeanEntriesPerBucket // ceil entries / MeanEntriesPerBucket
+	if header.L0Buckets == 0 {
+		header.L0Buckets = 1
+	}
+
+	var hdrBuf [BucketSize]byte
+
+	copy(hdrBuf[:], magic)
+
+	if err := header.MarshalCBOR(bytes.NewBuffer(hdrBuf[8:])); err != nil {
+		return nil, xerrors.Errorf("marshal header: %w", err)
+	}
+
+	if _, err := f.Write(hdrBuf[:]); err != nil {
+		return nil, xerrors.Errorf("write header: %w", err)
+	}
+
+	// sync header
+	if err := f.Sync(); err != nil {
+		return nil, xerrors.Errorf("sync header: %w", err)
+	}
+
 	// sort buckets
 
 	// todo parallel merge sort
@@ -144,13 +200,14 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 
 	// write buckets
 	bufWriter := bufio.NewWriterSize(f, 4<<20)
-	nullEntry := [EntrySize]byte{}
 	var offBuf [EntrySize - EntKeyBytes]byte
 
 	inBucket := uint64(0)
 	bucketEnts := uint64(0)
 
-	var bloomHead [BucketBloomFilterSize]byte
+	// bucket is assembled in memory, so that the checksum can be computed
+	// before it's written out
+	var bucketBuf [BucketSize]byte
 
 	//bSizes := map[uint64]int64{}
 
@@ -161,22 +218,19 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 
 		//bSizes[bucketEnts]++
 
-		// pad up to BucketUserEntries entries
-		for bucketEnts < BucketUserEntries {
-			if _, err := bufWriter.Write(nullEntry[:]); err != nil {
-				return xerrors.Errorf("write padding entry: %w", err)
-			}
-			bucketEnts++
+		if version > 1 {
+			binary.LittleEndian.PutUint32(bucketBuf[BucketChecksumOff:], crc32.Checksum(bucketBuf[:], crcTable))
 		}
 
-		// write bloom filter / header padding
-		if _, err := bufWriter.Write(bloomHead[:]); err != nil {
-			return xerrors.Errorf("write header entry filter: %w", err)
+		if _, err := bufWriter.Write(bucketBuf[:]); err != nil {
+			return xerrors.Errorf("write bucket: %w", err)
 		}
 
-		// reset temp vars
+		// reset temp vars, this also resets the bloom filter and pads unused
+		// entries with zeroes
 		inBucket++
 		bucketEnts = 0
+		bucketBuf = [BucketSize]byte{}
 
 		return nil
 	}
@@ -202,31 +256,23 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 				if err := flushBucket(bucketIdx); err != nil {
 					return nil, err
 				}
-
-				// reset bloom
-				for i := range bloomHead[:BucketBloomFilterSize] {
-					bloomHead[i] = 0
-				}
 			}
 
 			// update bloom filter first, so that even if this entry won't fit in this level, we know that it doesn't
 			// exist in one i/o if it's not in bloom
-			bloomHead[bloomEntIdx/8] |= 1 << (bloomEntIdx % 8)
+			bucketBuf[BucketBloomOff+bloomEntIdx/8] |= 1 << (bloomEntIdx % 8)
 
 			// check if we have space for this entry
-			if bucketEnts >= BucketUserEntries {
+			if bucketEnts >= userEntries {
 				nextLevel = append(nextLevel, hash)
 				continue
 			}
 
 			// write entry
-			if _, err := bufWriter.Write(hash.mhh[:EntKeyBytes]); err != nil {
-				return nil, xerrors.Errorf("write entry: %w", err)
-			}
+			entOff := bucketEnts * EntrySize
+			copy(bucketBuf[entOff:], hash.mhh[:EntKeyBytes])
 			binary.LittleEndian.PutUint64(offBuf[:], uint64(hash.off))
-			if _, err := bufWriter.Write(offBuf[:]); err != nil {
-				return nil, xerrors.Errorf("write entry offset: %w", err)
-			}
+			copy(bucketBuf[entOff+EntKeyBytes:], offBuf[:])
 
 			bucketEnts++
 			ents++
@@ -237,11 +283,6 @@ func Create(path string, entries int64, source Source) (*BSST, error) {
 			if err := flushBucket(levelBuckets + prevLevelBuckets); err != nil {
 				return nil, err
 			}
-
-			// todo could only do this once
-			for i := range bloomHead[:BucketBloomFilterSize] {
-				bloomHead[i] = 0
-			}
 		}
 
 		level++
@@ -307,7 +348,15 @@ func Open(path string) (*BSST, error) {
 		return nil, xerrors.Errorf("read header: %w", err)
 	}
 
-	if !bytes.Equal(hdrBuf[:8], []byte(BsstMagic)) {
+	var version int
+	userEntries := BucketUserEntries
+	switch string(hdrBuf[:8]) {
+	case BsstMagic:
+		version = 2
+	case BsstMagicV1:
+		version = 1
+		userEntries = BucketUserEntriesV1
+	default:
 		return nil, xerrors.Errorf("invalid magic")
 	}
 
@@ -319,9 +368,77 @@ func Open(path string) (*BSST, error) {
 	return &BSST{
 		f: f,
 		h: &header,
+
+		version:     version,
+		userEntries: userEntries,
 	}, nil
 }
 
+// EnableMmap switches bucket reads to a read-only memory mapping of the file.
+// On error (e.g. not enough address space) reads keep using pread.
+func (h *BSST) EnableMmap() error {
+	if h.mm != nil {
+		return nil
+	}
+
+	mm, err := mmap.Map(h.f)
+	if err != nil {
+		return xerrors.Errorf("mmap bsst: %w", err)
+	}
+
+	// bucket access is random by design
+	if err := mmap.Advise(mm, mmap.AdviceRandom); err != nil {
+		_ = mmap.Unmap(mm)
+		return xerrors.Errorf("madvise bsst: %w", err)
+	}
+
+	h.mm = mm
+	return nil
+}
+
+var zeroSum [4]byte
+
+// readBucket returns the requested bucket, verifying its checksum if the file
+// format has one. When mmapped, the returned slice points into the mapping,
+// otherwise the bucket is read into buf.
+func (h *BSST) readBucket(buf *[BucketSize]byte, bucketIdx uint64) ([]byte, error) {
+	var bkt []byte
+	off := int64(bucketIdx+1) * BucketSize
+
+	if h.mm != nil {
+		if off+BucketSize > int64(len(h.mm)) {
+			return nil, xerrors.Errorf("read bucket %d: out of file bounds", bucketIdx)
+		}
+		bkt = h.mm[off : off+BucketSize]
+	} else {
+		if _, err := h.f.ReadAt(buf[:], off); err != nil {
+			return nil, xerrors.Errorf("read bucket: %w", err)
+		}
+		bkt = buf[:]
+	}
+
+	if h.version < 2 {
+		return bkt, nil
+	}
+
+	stored := binary.LittleEndian.Uint32(bkt[BucketChecksumOff:])
+
+	// checksum is computed with the checksum field zeroed
+	computed := crc32.Update(0, crcTable, bkt[:BucketChecksumOff])
+	computed = crc32.Update(computed, crcTable, zeroSum[:])
+	computed = crc32.Update(computed, crcTable, bkt[BucketChecksumOff+len(zeroSum):])
+
+	if stored != computed {
+		return nil, &CorruptionError{
+			Bucket:   bucketIdx,
+			Stored:   stored,
+			Computed: computed,
+		}
+	}
+
+	return bkt, nil
+}
+
 func bucketInd(k [32]byte, bucketRange, prevLevelBuckets uint64) (uint64, uint64) {
 	hashidx := binary.BigEndian.Uint64(k[:8])
 	bucketIdx := prevLevelBuckets + (hashidx / bucketRange)
@@ -355,7 +472,7 @@ func (h *BSSTHeader) makeMHKey(c multihash.Multihash, i int64) [32]byte {
 func (h *BSST) Has(c []multihash.Multihash) ([]bool, error) {
 	keys := make([][32]byte, len(c))
 	for i, k := range c {
-		keys[i] = h.h.makeMHKey(k, int64(i))
+		keys[i] = h.h.makeMHKey(k, 0)
 	}
 
 	out := make([]bool, len(c))
@@ -371,23 +488,24 @@ top:
 			bucketRange := math.MaxUint64 / levelBuckets
 			bucketIdx, bloomEntIdx := bucketInd(k, bucketRange, prevLevelBuckets)
 
-			if _, err := h.f.ReadAt(bucketBuf[:], int64(bucketIdx+1)*BucketSize); err != nil { // todo use mmap so we get page caching for free
-				return nil, xerrors.Errorf("read bucket: %w", err)
+			bkt, err := h.readBucket(&bucketBuf, bucketIdx)
+			if err != nil {
+				return nil, err
 			}
 
 			// check if exists in bloom
-			bloomOff := uint64(BucketUserEntries * EntrySize)
-			if bucketBuf[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
+			bloomOff := uint64(BucketBloomOff)
+			if bkt[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
 				// definitely not in bucket or next levels
 				continue
 			}
 
 			// calculate minimum possible offset from bloom filter
 			// note: this assumes 32byte bloom
-			b0 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
-			b1 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+8 : bloomOff+16])
-			b2 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+16 : bloomOff+24])
-			b3 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+24 : bloomOff+32])
+			b0 := binary.LittleEndian.Uint64(bkt[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
+			b1 := binary.LittleEndian.Uint64(bkt[bloomOff+8 : bloomOff+16])
+			b2 := binary.LittleEndian.Uint64(bkt[bloomOff+16 : bloomOff+24])
+			b3 := binary.LittleEndian.Uint64(bkt[bloomOff+24 : bloomOff+32])
 
 			// now generate a mask that is bloomEntIdx bits long
 			mLast := uint64(0xffffffffffffffff) >> (63 - (bloomEntIdx % 64))
@@ -427,8 +545,8 @@ top:
 
 			// count bits
 			minOffIdx := (bits.OnesCount64(b0&m0) + bits.OnesCount64(b1&m1) + bits.OnesCount64(b2&m2) + bits.OnesCount64(b3&m3)) - 1
-			for entIdx := minOffIdx; entIdx < BucketUserEntries; entIdx++ {
-				if bytes.Equal(bucketBuf[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
+			for entIdx := minOffIdx; entIdx < h.userEntries; entIdx++ {
+				if bytes.Equal(bkt[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
 					out[i] = true
 					continue top
 				}
@@ -448,7 +566,7 @@ func (h *BSST) Get(c []multihash.Multihash) ([]int64, error) {
 
 	keys := make([][32]byte, len(c))
 	for i, k := range c {
-		keys[i] = h.h.makeMHKey(k, int64(i))
+		keys[i] = h.h.makeMHKey(k, 0)
 	}
 
 	out := make([]int64, len(c))
@@ -464,23 +582,24 @@ top:
 			bucketRange := math.MaxUint64 / levelBuckets
 			bucketIdx, bloomEntIdx := bucketInd(k, bucketRange, prevLevelBuckets)
 
-			if _, err := h.f.ReadAt(bucketBuf[:], int64(bucketIdx+1)*BucketSize); err != nil { // todo use mmap so we get page caching for free
-				return nil, xerrors.Errorf("read bucket: %w", err)
+			bkt, err := h.readBucket(&bucketBuf, bucketIdx)
+			if err != nil {
+				return nil, err
 			}
 
 			// check if exists in bloom
-			bloomOff := uint64(BucketUserEntries * EntrySize)
-			if bucketBuf[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
+			bloomOff := uint64(BucketBloomOff)
+			if bkt[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
 				// definitely not in bucket
 				continue
 			}
 
 			// calculate minimum possible offset from bloom filter
 			// note: this assumes 32byte bloom
-			b0 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
-			b1 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+8 : bloomOff+16])
-			b2 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+16 : bloomOff+24])
-			b3 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+24 : bloomOff+32])
+			b0 := binary.LittleEndian.Uint64(bkt[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
+			b1 := binary.LittleEndian.Uint64(bkt[bloomOff+8 : bloomOff+16])
+			b2 := binary.LittleEndian.Uint64(bkt[bloomOff+16 : bloomOff+24])
+			b3 := binary.LittleEndian.Uint64(bkt[bloomOff+24 : bloomOff+32])
 
 			// now generate a mask that is bloomEntIdx bits long
 			mLast := uint64(0xffffffffffffffff) >> (63 - (bloomEntIdx % 64))
@@ -499,9 +618,9 @@ top:
 
 			// count bits
 			minOffIdx := (bits.OnesCount64(b0&m0) + bits.OnesCount64(b1&m1) + bits.OnesCount64(b2&m2) + bits.OnesCount64(b3&m3)) - 1
-			for entIdx := minOffIdx; entIdx < BucketUserEntries; entIdx++ {
-				if bytes.Equal(bucketBuf[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
-					out[i] = int64(binary.LittleEndian.Uint64(bucketBuf[entIdx*EntrySize+EntKeyBytes : entIdx*EntrySize+EntKeyBytes+8]))
+			for entIdx := minOffIdx; entIdx < h.userEntries; entIdx++ {
+				if bytes.Equal(bkt[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
+					out[i] = int64(binary.LittleEndian.Uint64(bkt[entIdx*EntrySize+EntKeyBytes : entIdx*EntrySize+EntKeyBytes+8]))
 					continue top
 				}
 			}
@@ -515,5 +634,12 @@ top:
 }
 
 func (h *BSST) Close() error {
+	if h.mm != nil {
+		if err := mmap.Unmap(h.mm); err != nil {
+			return xerrors.Errorf("unmap bsst: %w", err)
+		}
+		h.mm = nil
+	}
+
 	return h.f.Close()
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -35,7 +37,7 @@ func TestBSSTCreate(t *testing.T) {
 
 	n := int64(13421280)
 
-	bsst, err := Create("/tmp/a.bsst", n, &testSource{n: n})
+	bsst, err := Create("/tmp/a.bsst", &testSource{n: n})
 	require.NoError(t, err)
 
 	var got int
@@ -56,3 +58,137 @@ func TestBSSTCreate(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestBSSTCorruption(t *testing.T) {
+	n := int64(10000)
+	path := filepath.Join(t.TempDir(), "c.bsst")
+
+	bsst, err := Create(path, &testSource{n: n})
+	require.NoError(t, err)
+	require.NoError(t, bsst.Close())
+
+	// flip a bit in the first bucket
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	var b [1]byte
+	_, err = f.ReadAt(b[:], BucketSize+5)
+	require.NoError(t, err)
+	b[0] ^= 0x10
+	_, err = f.WriteAt(b[:], BucketSize+5)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	bsst, err = Open(path)
+	require.NoError(t, err)
+	defer bsst.Close()
+
+	var corrupted int
+	err = (&testSource{n: n}).List(func(c mh.Multihash, offs []int64) error {
+		_, err := bsst.Get([]mh.Multihash{c})
+		if err != nil {
+			var cerr *CorruptionError
+			require.ErrorAs(t, err, &cerr)
+			require.Equal(t, uint64(0), cerr.Bucket)
+			corrupted++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Greater(t, corrupted, 0)
+}
+
+func TestBSSTMultiKey(t *testing.T) {
+	n := int64(10000)
+	path := filepath.Join(t.TempDir(), "m.bsst")
+
+	bsst, err := Create(path, &testSource{n: n})
+	require.NoError(t, err)
+	defer bsst.Close()
+
+	var keys []mh.Multihash
+	var expect []int64
+	err = (&testSource{n: n}).List(func(c mh.Multihash, offs []int64) error {
+		keys = append(keys, c)
+		expect = append(expect, offs[0])
+		return nil
+	})
+	require.NoError(t, err)
+
+	// every key in a lookup is found, not just the first one
+	missing, err := mh.Sum([]byte("missing"), mh.SHA2_256, -1)
+	require.NoError(t, err)
+
+	for i := 0; i+16 <= len(keys); i += 1000 {
+		batch := append(append([]mh.Multihash{}, keys[i:i+16]...), missing)
+
+		has, err := bsst.Has(batch)
+		require.NoError(t, err)
+		offs, err := bsst.Get(batch)
+		require.NoError(t, err)
+
+		for j := 0; j < 16; j++ {
+			require.True(t, has[j], "key %d", i+j)
+			require.Equal(t, expect[i+j], offs[j], "key %d", i+j)
+		}
+		require.False(t, has[16])
+		require.Equal(t, int64(0), offs[16])
+	}
+}
+
+func TestBSSTReadV1(t *testing.T) {
+	n := int64(10000)
+	path := filepath.Join(t.TempDir(), "v1.bsst")
+
+	bsst, err := create(path, &testSource{n: n}, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, bsst.version)
+	require.NoError(t, bsst.Close())
+
+	bsst, err = Open(path)
+	require.NoError(t, err)
+	defer bsst.Close()
+
+	err = (&testSource{n: n}).List(func(c mh.Multihash, offs []int64) error {
+		r, err := bsst.Get([]mh.Multihash{c})
+		require.NoError(t, err)
+		require.Equal(t, offs[0], r[0])
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func benchmarkBSSTGet(b *testing.B, useMmap bool) {
+	n := int64(1_000_000)
+	path := filepath.Join(b.TempDir(), "b.bsst")
+
+	bsst, err := Create(path, &testSource{n: n})
+	require.NoError(b, err)
+	defer bsst.Close()
+
+	if useMmap {
+		require.NoError(b, bsst.EnableMmap())
+	}
+
+	keys := make([]mh.Multihash, 0, n)
+	err = (&testSource{n: n}).List(func(c mh.Multihash, offs []int64) error {
+		keys = append(keys, c)
+		return nil
+	})
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := bsst.Get(keys[i%len(keys) : i%len(keys)+1])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBSSTGetPread(b *testing.B) {
+	benchmarkBSSTGet(b, false)
+}
+
+func BenchmarkBSSTGetMmap(b *testing.B) {
+	benchmarkBSSTGet(b, true)
+}
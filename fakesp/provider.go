@@ -0,0 +1,473 @@
+// Package fakesp implements an in-process Boost storage provider for end-to-end
+// deal tests. Providers run on any libp2p host, usually a mocknet peer, and
+// publish and activate deals through a mock chain.
+package fakesp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/filecoin-project/boost/retrievalmarket/lp2pimpl"
+	rtypes "github.com/filecoin-project/boost/retrievalmarket/types"
+	"github.com/filecoin-project/boost/storagemarket/types"
+	"github.com/filecoin-project/boost/storagemarket/types/dealcheckpoints"
+	"github.com/filecoin-project/boost/transport/httptransport/util"
+	ttypes "github.com/filecoin-project/boost/transport/types"
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/host"
+	inet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("fakesp")
+
+const (
+	AskProtocolID        = "/fil/storage/ask/1.1.0"
+	DealProtocolID       = "/fil/storage/mk/1.2.0"
+	DealStatusProtocolID = "/fil/storage/status/1.2.0"
+)
+
+// Chain is the part of the mock chain used by providers
+type Chain interface {
+	AddMiner(maddr address.Address, pid peer.ID, addrs []multiaddr.Multiaddr)
+	PublishDeals(provider address.Address, deals []market.ClientDealProposal) (cid.Cid, []abi.DealID, error)
+	ActivateDeal(id abi.DealID) error
+}
+
+// Config is the provider ask and behaviour
+type Config struct {
+	// Price and VerifiedPrice are per GiB per epoch, zero when unset
+	Price         abi.TokenAmount
+	VerifiedPrice abi.TokenAmount
+
+	MinPieceSize abi.PaddedPieceSize
+	MaxPieceSize abi.PaddedPieceSize
+
+	// RejectReason makes the provider reject all deal proposals
+	RejectReason string
+
+	// NoActivate leaves published deals inactive, like a provider which
+	// never seals
+	NoActivate bool
+}
+
+// Provider is a fake storage provider. Accepted deals go through data
+// transfer, commP verification, publishing and activation right away;
+// offline deals do the same once their data is imported.
+type Provider struct {
+	Addr address.Address
+
+	host  host.Host
+	chain Chain
+	cfg   Config
+	tpt   *lp2pimpl.TransportsListener
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lk    sync.Mutex
+	deals map[uuid.UUID]*deal
+}
+
+type deal struct {
+	params   types.DealParams
+	status   types.DealStatus
+	received uint64
+}
+
+// New starts a provider on h, and registers it with the chain as maddr
+func New(h host.Host, chain Chain, maddr address.Address, cfg Config) *Provider {
+	if cfg.Price.Int == nil {
+		cfg.Price = big.Zero()
+	}
+	if cfg.VerifiedPrice.Int == nil {
+		cfg.VerifiedPrice = big.Zero()
+	}
+	if cfg.MinPieceSize == 0 {
+		cfg.MinPieceSize = 256
+	}
+	if cfg.MaxPieceSize == 0 {
+		cfg.MaxPieceSize = 32 << 30
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &Provider{
+		Addr: maddr,
+
+		host:  h,
+		chain: chain,
+		cfg:   cfg,
+		tpt:   lp2pimpl.NewTransportsListener(h, []rtypes.Protocol{{Name: "libp2p", Addresses: h.Addrs()}}),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		deals: map[uuid.UUID]*deal{},
+	}
+
+	h.SetStreamHandler(AskProtocolID, p.handleAsk)
+	h.SetStreamHandler(DealProtocolID, p.handleDeal)
+	h.SetStreamHandler(DealStatusProtocolID, p.handleDealStatus)
+	p.tpt.Start()
+
+	chain.AddMiner(maddr, h.ID(), h.Addrs())
+
+	return p
+}
+
+// Close stops handling requests and aborts running transfers
+func (p *Provider) Close() {
+	p.host.RemoveStreamHandler(AskProtocolID)
+	p.host.RemoveStreamHandler(DealProtocolID)
+	p.host.RemoveStreamHandler(DealStatusProtocolID)
+	p.tpt.Stop()
+	p.cancel()
+}
+
+// DealStatus returns the current status of a deal
+func (p *Provider) DealStatus(id uuid.UUID) (types.DealStatus, bool) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	d, ok := p.deals[id]
+	if !ok {
+		return types.DealStatus{}, false
+	}
+	return d.status, true
+}
+
+// Deals returns UUIDs of all accepted deals
+func (p *Provider) Deals() []uuid.UUID {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	out := make([]uuid.UUID, 0, len(p.deals))
+	for id := range p.deals {
+		out = append(out, id)
+	}
+	return out
+}
+
+func (p *Provider) handleAsk(s inet.Stream) {
+	defer s.Close() // nolint
+
+	var req network.AskRequest
+	if err := cborutil.ReadCborRPC(s, &req); err != nil {
+		log.Errorw("reading ask request", "error", err)
+		return
+	}
+
+	resp := network.AskResponse{
+		Ask: &storagemarket.SignedStorageAsk{
+			Ask: &storagemarket.StorageAsk{
+				Price:         p.cfg.Price,
+				VerifiedPrice: p.cfg.VerifiedPrice,
+				MinPieceSize:  p.cfg.MinPieceSize,
+				MaxPieceSize:  p.cfg.MaxPieceSize,
+				Miner:         p.Addr,
+			},
+		},
+	}
+
+	if err := cborutil.WriteCborRPC(s, &resp); err != nil {
+		log.Errorw("writing ask response", "error", err)
+	}
+}
+
+func (p *Provider) handleDeal(s inet.Stream) {
+	defer s.Close() // nolint
+
+	var params types.DealParams
+	if err := cborutil.ReadCborRPC(s, &params); err != nil {
+		log.Errorw("reading deal proposal", "error", err)
+		return
+	}
+
+	resp := types.DealResponse{Accepted: true}
+	if err := p.checkProposal(params); err != nil {
+		resp = types.DealResponse{Message: err.Error()}
+	}
+
+	if resp.Accepted {
+		propNd, err := cborutil.AsIpld(&params.ClientDealProposal)
+		if err != nil {
+			log.Errorw("getting proposal cid", "error", err)
+			return
+		}
+
+		p.lk.Lock()
+		p.deals[params.DealUUID] = &deal{
+			params: params,
+			status: types.DealStatus{
+				Status:            dealcheckpoints.Accepted.String(),
+				Proposal:          params.ClientDealProposal.Proposal,
+				SignedProposalCid: propNd.Cid(),
+			},
+		}
+		p.lk.Unlock()
+	}
+
+	if err := cborutil.WriteCborRPC(s, &resp); err != nil {
+		log.Errorw("writing deal response", "error", err)
+		return
+	}
+
+	// offline deals wait for ImportData
+	if resp.Accepted && !params.IsOffline {
+		go p.executeDeal(params.DealUUID, func(w io.Writer) error {
+			return p.transfer(params.Transfer, w)
+		})
+	}
+}
+
+func (p *Provider) checkProposal(params types.DealParams) error {
+	prop := params.ClientDealProposal.Proposal
+
+	switch {
+	case p.cfg.RejectReason != "":
+		return xerrors.New(p.cfg.RejectReason)
+	case prop.Provider != p.Addr:
+		return xerrors.Errorf("proposal for provider %s, this is %s", prop.Provider, p.Addr)
+	case prop.PieceSize < p.cfg.MinPieceSize || prop.PieceSize > p.cfg.MaxPieceSize:
+		return xerrors.Errorf("piece size %d outside of ask range %d-%d", prop.PieceSize, p.cfg.MinPieceSize, p.cfg.MaxPieceSize)
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if _, ok := p.deals[params.DealUUID]; ok {
+		return xerrors.Errorf("deal %s already exists", params.DealUUID)
+	}
+	return nil
+}
+
+// ImportData runs an accepted offline deal with data read from r, like
+// boostd import-data
+func (p *Provider) ImportData(id uuid.UUID, r io.Reader) error {
+	p.lk.Lock()
+	d, ok := p.deals[id]
+	if !ok {
+		p.lk.Unlock()
+		return xerrors.Errorf("deal %s not found", id)
+	}
+	if !d.params.IsOffline || d.status.Status != dealcheckpoints.Accepted.String() {
+		p.lk.Unlock()
+		return xerrors.Errorf("deal %s is not an accepted offline deal", id)
+	}
+	// mark the import as started so it can't run twice
+	d.status.Status = dealcheckpoints.Transferred.String()
+	p.lk.Unlock()
+
+	return p.executeDeal(id, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (p *Provider) executeDeal(id uuid.UUID, src func(w io.Writer) error) error {
+	err := p.runDeal(id, src)
+	if err != nil {
+		log.Warnw("deal failed", "deal", id, "error", err)
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	if err != nil {
+		p.deals[id].status.Error = err.Error()
+	}
+	return err
+}
+
+func (p *Provider) runDeal(id uuid.UUID, src func(w io.Writer) error) error {
+	p.lk.Lock()
+	d := p.deals[id]
+	params := d.params
+	p.lk.Unlock()
+
+	prop := params.ClientDealProposal
+
+	// TRANSFER
+
+	cc := new(commp.Calc)
+	if err := src(&countWriter{w: cc, n: &d.received}); err != nil {
+		return xerrors.Errorf("transferring data: %w", err)
+	}
+
+	// offline deals don't know the transfer size
+	if n := atomic.LoadUint64(&d.received); !params.IsOffline && n != params.Transfer.Size {
+		return xerrors.Errorf("received %d bytes, expected %d", n, params.Transfer.Size)
+	}
+
+	// VERIFY COMMP
+
+	rawCommP, pieceSize, err := cc.Digest()
+	if err != nil {
+		return xerrors.Errorf("computing commP: %w", err)
+	}
+
+	if abi.PaddedPieceSize(pieceSize) < prop.Proposal.PieceSize {
+		rawCommP, err = commp.PadCommP(rawCommP, pieceSize, uint64(prop.Proposal.PieceSize))
+		if err != nil {
+			return xerrors.Errorf("padding commP: %w", err)
+		}
+	}
+
+	pieceCid, err := commcid.PieceCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return xerrors.Errorf("converting commP: %w", err)
+	}
+	if pieceCid != prop.Proposal.PieceCID {
+		return xerrors.Errorf("commP mismatch, data %s, proposal %s", pieceCid, prop.Proposal.PieceCID)
+	}
+
+	p.setCheckpoint(id, dealcheckpoints.Transferred)
+
+	// PUBLISH
+
+	pcid, ids, err := p.chain.PublishDeals(p.Addr, []market.ClientDealProposal{prop})
+	if err != nil {
+		return xerrors.Errorf("publishing deal: %w", err)
+	}
+
+	p.lk.Lock()
+	d.status.Status = dealcheckpoints.PublishConfirmed.String()
+	d.status.PublishCid = &pcid
+	d.status.ChainDealID = ids[0]
+	p.lk.Unlock()
+
+	// SEAL
+
+	if p.cfg.NoActivate {
+		return nil
+	}
+
+	if err := p.chain.ActivateDeal(ids[0]); err != nil {
+		return xerrors.Errorf("activating deal: %w", err)
+	}
+
+	p.lk.Lock()
+	d.status.Status = dealcheckpoints.Complete.String()
+	d.status.SealingStatus = "Proving"
+	p.lk.Unlock()
+
+	return nil
+}
+
+// transfer fetches deal data like boost does, over http or libp2p http
+func (p *Provider) transfer(t types.Transfer, w io.Writer) error {
+	var req ttypes.HttpRequest
+	if err := json.Unmarshal(t.Params, &req); err != nil {
+		return xerrors.Errorf("parsing transfer params: %w", err)
+	}
+
+	u, err := util.ParseUrl(req.URL)
+	if err != nil {
+		return err
+	}
+
+	client := http.DefaultClient
+	if u.Scheme == util.Libp2pScheme {
+		if err := p.host.Connect(p.ctx, peer.AddrInfo{ID: u.PeerID, Addrs: []multiaddr.Multiaddr{u.Multiaddr}}); err != nil {
+			return xerrors.Errorf("connecting to client: %w", err)
+		}
+
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return gostream.Dial(ctx, p.host, u.PeerID, ttypes.DataTransferProtocol)
+				},
+			},
+		}
+		u.Url = "http://" + u.PeerID.String()
+	}
+
+	hreq, err := http.NewRequestWithContext(p.ctx, http.MethodGet, u.Url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range req.Headers {
+		hreq.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return xerrors.Errorf("http status %d: %s", resp.StatusCode, msg)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (p *Provider) setCheckpoint(id uuid.UUID, cp dealcheckpoints.Checkpoint) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.deals[id].status.Status = cp.String()
+}
+
+func (p *Provider) handleDealStatus(s inet.Stream) {
+	defer s.Close() // nolint
+
+	// request signatures aren't checked
+	var req types.DealStatusRequest
+	if err := cborutil.ReadCborRPC(s, &req); err != nil {
+		log.Errorw("reading deal status request", "error", err)
+		return
+	}
+
+	resp := types.DealStatusResponse{DealUUID: req.DealUUID}
+
+	p.lk.Lock()
+	if d, ok := p.deals[req.DealUUID]; ok {
+		st := d.status
+		resp.DealStatus = &st
+		resp.TransferSize = d.params.Transfer.Size
+		resp.NBytesReceived = atomic.LoadUint64(&d.received)
+	} else {
+		resp.Error = fmt.Sprintf("deal %s not found", req.DealUUID)
+	}
+	p.lk.Unlock()
+
+	if err := cborutil.WriteCborRPC(s, &resp); err != nil {
+		log.Errorw("writing deal status response", "error", err)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
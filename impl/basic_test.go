@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
 	blocks "github.com/ipfs/go-block-format"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
@@ -52,6 +56,45 @@ func TestBasic(t *testing.T) {
 	require.NoError(t, ri.Close())
 }
 
+func TestCloseWaitsForWorkers(t *testing.T) {
+	h, err := mocknet.New().GenPeer()
+	require.NoError(t, err)
+
+	var events []string
+	r := &ribs{
+		host:          h,
+		close:         make(chan struct{}),
+		workerClosed:  make(chan struct{}),
+		spCrawlClosed: make(chan struct{}),
+		chainCloser: func() {
+			events = append(events, "chain closed")
+		},
+	}
+	close(r.workerClosed)
+	close(r.spCrawlClosed)
+
+	r.workerCtx, r.workerCancel = context.WithCancel(context.Background())
+	r.startWorker(func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		events = append(events, "worker done")
+	})
+
+	// car servers and the stats worker stop too
+	require.NoError(t, r.setupCarServer(h, CarServerConfig{ListenAddr: "127.0.0.1:0"}))
+	require.Len(t, r.carServers, 2)
+
+	require.NoError(t, r.Close())
+	require.Equal(t, []string{"worker done", "chain closed"}, events)
+	require.Empty(t, r.carServers)
+
+	// nothing is left running when the car server fails to start
+	r.workerCtx, r.workerCancel = context.WithCancel(context.Background())
+	err = r.setupCarServer(h, CarServerConfig{ListenAddr: "127.0.0.1:0", TLSCertFile: "nope", TLSKeyFile: "nope"})
+	require.Error(t, err)
+	require.Empty(t, r.carServers)
+}
+
 func TestFullGroup(t *testing.T) {
 	maxGroupSize = 100 << 20
 
@@ -122,3 +165,81 @@ func TestFullGroup(t *testing.T) {
 
 	require.NoError(t, ri.Close())
 }
+
+func TestGroupSizePolicy(t *testing.T) {
+	p := GroupSizePolicy{MaxBlocks: 10, MaxBytes: 1000}
+	require.NoError(t, p.validate())
+	require.True(t, p.fits(10, 1000))
+	require.False(t, p.fits(11, 10))
+	require.False(t, p.fits(1, 1001))
+
+	p = GroupSizePolicy{TargetPieceSize: 1 << 20}
+	require.NoError(t, p.validate())
+
+	// the CAR must fit the unpadded piece
+	unpadded := int64(abi.PaddedPieceSize(1 << 20).Unpadded())
+	require.True(t, p.fits(1, unpadded-carHeaderOverhead-carBlockOverhead))
+	require.False(t, p.fits(1, unpadded-carHeaderOverhead-carBlockOverhead+1))
+	require.False(t, p.fits(unpadded/carBlockOverhead, 1))
+
+	require.Equal(t, unpadded-carHeaderOverhead, p.EffectiveMaxBytes())
+
+	require.Error(t, GroupSizePolicy{TargetPieceSize: 3 << 20}.validate())
+	require.Error(t, GroupSizePolicy{}.validate())
+}
+
+func TestDealPiecePadding(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	cp := new(commp.Calc)
+	_, err := cp.Write(data)
+	require.NoError(t, err)
+	small, size, err := cp.Digest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), size)
+
+	// no padding needed
+	c, ps, err := dealPiece(small, abi.PaddedPieceSize(size), 512)
+	require.NoError(t, err)
+	require.Equal(t, abi.PaddedPieceSize(1024), ps)
+	expect, err := commcid.PieceCommitmentV1ToCID(small)
+	require.NoError(t, err)
+	require.Equal(t, expect, c)
+
+	// padded piece must match the commP of the data followed by zeros
+	cp = new(commp.Calc)
+	_, err = cp.Write(append(data, make([]byte, 1000)...))
+	require.NoError(t, err)
+	padded, size, err := cp.Digest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2048), size)
+
+	c, ps, err = dealPiece(small, 1024, 1500)
+	require.NoError(t, err)
+	require.Equal(t, abi.PaddedPieceSize(2048), ps)
+	expect, err = commcid.PieceCommitmentV1ToCID(padded)
+	require.NoError(t, err)
+	require.Equal(t, expect, c)
+}
+
+func TestGroupSealPolicy(t *testing.T) {
+	now := time.Now()
+	gm := writableGroupMeta{
+		Blocks:      1,
+		CreatedAt:   now.Add(-time.Hour),
+		LastWriteAt: now.Add(-time.Minute),
+	}
+
+	require.False(t, GroupSealPolicy{}.shouldSeal(gm, now))
+	require.True(t, GroupSealPolicy{MaxAge: 30 * time.Minute}.shouldSeal(gm, now))
+	require.False(t, GroupSealPolicy{MaxAge: 2 * time.Hour}.shouldSeal(gm, now))
+	require.True(t, GroupSealPolicy{MaxIdle: 30 * time.Second}.shouldSeal(gm, now))
+	require.False(t, GroupSealPolicy{MaxIdle: 2 * time.Minute}.shouldSeal(gm, now))
+
+	// empty groups are never sealed
+	gm.Blocks = 0
+	require.False(t, GroupSealPolicy{MaxAge: time.Second}.shouldSeal(gm, now))
+}
@@ -0,0 +1,129 @@
+package impl
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// CAR bytes between offset index entries
+var carIndexInterval int64 = 16 << 20
+
+// carOffsetIndex maps deal CAR offsets to writeCar state at the start of jbob
+// entries, so that CARs can be written starting at any offset without
+// regenerating everything before it
+type carOffsetIndex struct {
+	Entries []carOffsetEntry
+}
+
+type carOffsetEntry struct {
+	// CAR offset of the first node written for the jbob entry
+	CarOffset int64
+	// jbob data offset of the entry
+	JbobOffset int64
+
+	// layer writeCar is at, 0 is jbob
+	AtLayer int
+	// nodes written at each layer since the last link node above, index 0 is jbob
+	LayerWrote []int
+	// read offsets in vcar layer files, index 0 is layer 1
+	LayerOffsets []int64
+}
+
+func carIndexPath(groupPath string) string {
+	return filepath.Join(groupPath, "vcar", "offsets")
+}
+
+// loadCarIndex returns nil when the group doesn't have an index, e.g. when it
+// got its commP before indexes were written
+func loadCarIndex(groupPath string) (*carOffsetIndex, error) {
+	b, err := os.ReadFile(carIndexPath(groupPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("read car offset index: %w", err)
+	}
+
+	var idx carOffsetIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, xerrors.Errorf("parse car offset index: %w", err)
+	}
+
+	return &idx, nil
+}
+
+func (c *carOffsetIndex) save(groupPath string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return xerrors.Errorf("marshal car offset index: %w", err)
+	}
+
+	return exportCarFile(carIndexPath(groupPath), func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// entryFor returns the last entry at or before the offset, nil when writing
+// has to start from the CAR header
+func (c *carOffsetIndex) entryFor(offset int64) *carOffsetEntry {
+	if c == nil {
+		return nil
+	}
+
+	i := sort.Search(len(c.Entries), func(i int) bool {
+		return c.Entries[i].CarOffset > offset
+	})
+	if i == 0 {
+		return nil
+	}
+	return &c.Entries[i-1]
+}
+
+// carRangeWriter passes through a byte range of what is written to it
+type carRangeWriter struct {
+	w io.Writer
+
+	skip int64
+	// bytes left to pass through, -1 for no limit
+	left int64
+}
+
+var errCarRangeDone = xerrors.New("car range written")
+
+func (c *carRangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if c.skip > 0 {
+		if int64(len(p)) <= c.skip {
+			c.skip -= int64(len(p))
+			return n, nil
+		}
+		p = p[c.skip:]
+		c.skip = 0
+	}
+
+	if c.left == 0 {
+		return 0, errCarRangeDone
+	}
+	if c.left > 0 && int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+
+	wn, err := c.w.Write(p)
+	if c.left > 0 {
+		c.left -= int64(wn)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if c.left == 0 {
+		return n, errCarRangeDone
+	}
+	return n, nil
+}
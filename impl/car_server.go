@@ -2,9 +2,10 @@ package impl
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/filecoin-project/boost/transport/types"
-	"github.com/gbrlsnchs/jwt/v3"
 	"github.com/google/uuid"
 	gostream "github.com/libp2p/go-libp2p-gostream"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -14,13 +15,68 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 )
 
-func (r *ribs) setupCarServer(ctx context.Context, host host.Host) error {
+// providers which failed fetching over http get libp2p transfers for this long
+var httpTransferRetryAfter = 24 * time.Hour
+
+// how long Close waits for running car requests
+var carServerShutdownTimeout = 10 * time.Second
+
+// upload bandwidth history kept for diagnostics, an hour
+const (
+	transferBandwidthInterval = 10 * time.Second
+	transferBandwidthSamples  = 360
+)
+
+// CarServerConfig configures serving deal data over plain TCP, in addition to
+// libp2p
+type CarServerConfig struct {
+	// ListenAddr is the TCP address to serve on, e.g. ":8443"
+	ListenAddr string
+
+	// TLS certificate and key files, deal data is served over plain http
+	// when empty
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// PublicURLs are the URLs providers fetch deal data from, e.g.
+	// https://ribs.example.com:8443. Deals use libp2p transfers when empty.
+	PublicURLs []string
+}
+
+func (c CarServerConfig) validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return xerrors.Errorf("both TLS certificate and key must be set")
+	}
+	if len(c.PublicURLs) > 0 && c.ListenAddr == "" {
+		return xerrors.Errorf("public URLs set without a listen address")
+	}
+	for _, pu := range c.PublicURLs {
+		u, err := url.Parse(pu)
+		if err != nil {
+			return xerrors.Errorf("parsing public URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return xerrors.Errorf("public URL %s must be http or https", pu)
+		}
+	}
+	return nil
+}
+
+// WithCarServer makes deal data also available over TCP, optionally with TLS
+func WithCarServer(c CarServerConfig) OpenOption {
+	return func(o *openOptions) {
+		o.carServer = c
+	}
+}
+
+func (r *ribs) setupCarServer(host host.Host, cfg CarServerConfig) error {
 	// todo protect incoming streams
 
 	listener, err := gostream.Listen(host, types.DataTransferProtocol)
@@ -28,28 +84,73 @@ func (r *ribs) setupCarServer(ctx context.Context, host host.Host) error {
 		return fmt.Errorf("starting gostream listener: %w", err)
 	}
 
+	r.serveCars(listener, r.handleLibp2pCarRequest)
+
+	if cfg.ListenAddr != "" {
+		tcpListener, err := net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			r.shutdownCarServers()
+			return xerrors.Errorf("car server listen: %w", err)
+		}
+
+		if cfg.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+			if err != nil {
+				_ = tcpListener.Close()
+				r.shutdownCarServers()
+				return xerrors.Errorf("loading car server TLS keys: %w", err)
+			}
+
+			tcpListener = tls.NewListener(tcpListener, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			})
+		}
+
+		log.Infow("serving deal data over tcp", "addr", tcpListener.Addr(), "tls", cfg.TLSCertFile != "", "urls", cfg.PublicURLs)
+
+		r.serveCars(tcpListener, r.handleCarRequest)
+	}
+
+	r.startWorker(r.carStatsWorker)
+
+	return nil
+}
+
+func (r *ribs) serveCars(listener net.Listener, handle http.HandlerFunc) {
 	handler := http.NewServeMux()
-	handler.HandleFunc("/", r.handleCarRequest)
+	handler.HandleFunc("/", handle)
 	server := &http.Server{
 		Handler: handler, // todo gzip handler assuming that it works with boost
 		// This context will be the parent of the context associated with all
-		// incoming requests
+		// incoming requests, it is cancelled on Close
 		BaseContext: func(listener net.Listener) context.Context {
-			return ctx
+			return r.workerCtx
 		},
 	}
+	r.carServers = append(r.carServers, server)
+
 	go func() {
-		if err := server.Serve(listener); err != nil {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 			log.Errorw("car server failed to start", "error", err)
 			return
 		}
 	}()
+}
 
-	go r.carStatsWorker(ctx)
-
-	// todo also serve tcp
+// shutdownCarServers stops accepting car requests, and waits for running ones
+// up to carServerShutdownTimeout
+func (r *ribs) shutdownCarServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), carServerShutdownTimeout)
+	defer cancel()
 
-	return nil
+	for _, server := range r.carServers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorw("shutting down car server", "error", err)
+			_ = server.Close()
+		}
+	}
+	r.carServers = nil
 }
 
 func (r *ribs) carStatsWorker(ctx context.Context) {
@@ -73,6 +174,22 @@ func (r *ribs) updateCarStats() {
 			ActiveRequests:       v.ActiveRequests,
 			Last250MsUploadBytes: atomic.SwapInt64(&v.Last250MsUploadBytes, 0),
 		}
+		r.bandwidthBytes += r.uploadStatsSnap[k].Last250MsUploadBytes
+	}
+
+	now := time.Now()
+	if r.bandwidthStart.IsZero() {
+		r.bandwidthStart = now
+	}
+	if elapsed := now.Sub(r.bandwidthStart); elapsed >= r.bandwidthInterval {
+		r.bandwidth = append(r.bandwidth, iface.BandwidthSample{
+			Time:           r.bandwidthStart.Unix(),
+			BytesPerSecond: int64(float64(r.bandwidthBytes) / elapsed.Seconds()),
+		})
+		if len(r.bandwidth) > r.bandwidthSamples {
+			r.bandwidth = r.bandwidth[len(r.bandwidth)-r.bandwidthSamples:]
+		}
+		r.bandwidthStart, r.bandwidthBytes = now, 0
 	}
 
 	for k, v := range r.uploadStats {
@@ -89,62 +206,61 @@ func (r *ribs) CarUploadStats() map[iface.GroupKey]*iface.UploadStats {
 	return r.uploadStatsSnap
 }
 
-type carStatWriter struct {
-	ctr       *int64
-	w         io.Writer
-	toDiscard int64
+func (r *ribs) TransferBandwidth() []iface.BandwidthSample {
+	r.uploadStatsLk.Lock()
+	defer r.uploadStatsLk.Unlock()
+
+	return append([]iface.BandwidthSample(nil), r.bandwidth...)
 }
 
-func (c *carStatWriter) Write(p []byte) (n int, err error) {
-	var discarded int64
-	if c.toDiscard > 0 {
-		if int64(len(p)) <= c.toDiscard {
-			c.toDiscard -= int64(len(p))
-			return len(p), nil
-		}
-		p = p[c.toDiscard:]
-		discarded = c.toDiscard
-		c.toDiscard = 0
-	}
-	n, err = c.w.Write(p)
-	atomic.AddInt64(c.ctr, int64(n))
-	n += int(discarded)
-	return
+func (r *ribs) DealTransfers(dealUUID string) ([]iface.TransferInfo, error) {
+	return r.db.DealTransfers(dealUUID)
 }
 
-var jwtKey = func() *jwt.HMACSHA { // todo generate / store
-	return jwt.NewHS256([]byte("this is super safe"))
-}()
+// recordTransfer stores a car request in the transfer history
+func (r *ribs) recordTransfer(tok carRequestToken, t iface.TransferInfo) {
+	t.Duration = time.Since(t.Started)
+	if err := r.db.RecordTransfer(tok.DealUUID, tok.Group, t); err != nil {
+		log.Errorw("recording car transfer", "deal", tok.DealUUID, "error", err)
+	}
+}
 
-type carRequestToken struct {
-	Group   int64
-	Timeout int64
-	CarSize int64
+type carStatWriter struct {
+	ctr *int64
+	w   io.Writer
 
-	// todo SP
+	// bytes written, and the error writing to the client
+	sent int64
+	err  error
 }
 
-func (r *ribs) verify(ctx context.Context, token string) (carRequestToken, error) {
-	var payload carRequestToken
-	if _, err := jwt.Verify([]byte(token), jwtKey, &payload); err != nil {
-		return carRequestToken{}, xerrors.Errorf("JWT Verification failed: %w", err)
-	}
-
-	if payload.Timeout < time.Now().Unix() {
-		return carRequestToken{}, xerrors.Errorf("token expired")
+func (c *carStatWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	atomic.AddInt64(c.ctr, int64(n))
+	c.sent += int64(n)
+	if err != nil {
+		c.err = err
 	}
-
-	return payload, nil
+	return
 }
 
-func (r *ribs) makeCarRequestToken(ctx context.Context, group int64, timeout time.Duration, carSize int64) ([]byte, error) {
-	p := carRequestToken{
-		Group:   group,
-		Timeout: time.Now().Add(timeout).Unix(),
-		CarSize: carSize,
+// handleLibp2pCarRequest keeps the libp2p connection of a transfer open while
+// it runs
+func (r *ribs) handleLibp2pCarRequest(w http.ResponseWriter, req *http.Request) {
+	pid, err := peer.Decode(req.RemoteAddr)
+	if err != nil {
+		log.Infow("data transfer request failed: parsing remote address as peer ID",
+			"remote-addr", req.RemoteAddr, "err", err)
+		http.Error(w, "Failed to parse remote address '"+req.RemoteAddr+"' as peer ID", http.StatusBadRequest)
+		return
 	}
 
-	return jwt.Sign(&p, jwtKey)
+	// Protect the libp2p connection for the lifetime of the transfer
+	tag := uuid.New().String()
+	r.host.ConnManager().Protect(pid, tag)
+	defer r.host.ConnManager().Unprotect(pid, tag)
+
+	r.handleCarRequest(w, req.WithContext(context.WithValue(req.Context(), carRequestPeerKey{}, pid)))
 }
 
 func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
@@ -161,52 +277,58 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	pid, err := peer.Decode(req.RemoteAddr)
-	if err != nil {
-		log.Infow("data transfer request failed: parsing remote address as peer ID",
-			"remote-addr", req.RemoteAddr, "err", err)
-		http.Error(w, "Failed to parse remote address '"+req.RemoteAddr+"' as peer ID", http.StatusBadRequest)
-		return
-	}
+	carSize := reqToken.CarSize
 
-	// Protect the libp2p connection for the lifetime of the transfer
-	tag := uuid.New().String()
-	r.host.ConnManager().Protect(pid, tag)
-	defer r.host.ConnManager().Unprotect(pid, tag)
-
-	var toDiscard int64
-	if req.Header.Get("Range") != "" {
-		s1 := strings.Split(req.Header.Get("Range"), "=")
-		if len(s1) != 2 {
-			log.Errorw("invalid content range (1)", "range", req.Header.Get("Content-Range"), "s1", s1)
-			http.Error(w, "invalid content range", http.StatusBadRequest)
+	start, length := int64(0), carSize
+	ranged := false
+	if rh := req.Header.Get("Range"); rh != "" {
+		var satisfiable bool
+		start, length, ranged, satisfiable = parseCarRange(rh, carSize)
+		if !satisfiable {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", carSize))
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
 			return
 		}
-		if !strings.HasPrefix(s1[0], "bytes") {
-			log.Errorw("invalid content range (2)", "range", req.Header.Get("Content-Range"), "s1", s1)
-			http.Error(w, "invalid content range", http.StatusBadRequest)
-			return
+		if !ranged {
+			start, length = 0, carSize
 		}
+	}
 
-		s2 := strings.Split(s1[1], "-")
-		if len(s2) != 2 {
-			log.Errorw("invalid content range (3)", "range", req.Header.Get("Content-Range"), "s2", s2)
-			http.Error(w, "invalid content range", http.StatusBadRequest)
-			return
-		}
+	rec := iface.TransferInfo{
+		Peer:        req.RemoteAddr,
+		RangeStart:  start,
+		RangeLength: length,
+		Started:     time.Now(),
+	}
+	if pid, ok := req.Context().Value(carRequestPeerKey{}).(peer.ID); ok {
+		rec.Peer = pid.String()
+	}
 
-		toDiscard, err = strconv.ParseInt(s2[0], 10, 64)
-		if err != nil {
-			log.Errorw("invalid content range (4)", "range", req.Header.Get("Content-Range"), "s2", s2)
-			http.Error(w, "invalid content range", http.StatusBadRequest)
-			return
-		}
+	if req.Method != http.MethodHead {
+		release, ok := r.carTransfers.acquire()
+		if !ok {
+			rec.Outcome = "busy"
+			r.recordTransfer(reqToken, rec)
 
-		if s2[1] != "" {
-			log.Errorw("invalid content range (5)", "range", req.Header.Get("Content-Range"), "s2", s2)
-			http.Error(w, "invalid content range", http.StatusBadRequest)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many transfers", http.StatusServiceUnavailable)
 			return
 		}
+		defer release()
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, carSize))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if req.Method == http.MethodHead {
+		return
 	}
 
 	r.uploadStatsLk.Lock()
@@ -217,9 +339,8 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	r.uploadStats[reqToken.Group].ActiveRequests++
 
 	sw := &carStatWriter{
-		ctr:       &r.uploadStats[reqToken.Group].Last250MsUploadBytes,
-		w:         w,
-		toDiscard: toDiscard,
+		ctr: &r.uploadStats[reqToken.Group].Last250MsUploadBytes,
+		w:   w,
 	}
 
 	r.uploadStatsLk.Unlock()
@@ -231,15 +352,77 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	}()
 
 	err = r.withReadableGroup(reqToken.Group, func(group *Group) error {
-		// todo range request handling
-		//http.ServeContent(w, req, "deal.car", time.Now(), &carWriter{})
-
-		_, _, err := group.writeCar(sw)
-		return err
+		return r.carTransfers.serve(req.Context(), group, carSize, start, length, sw)
 	})
+
+	rec.BytesSent = sw.sent
+	switch {
+	case err == nil:
+		rec.Outcome = "complete"
+	case sw.err != nil || req.Context().Err() != nil:
+		rec.Outcome = "interrupted"
+		rec.Error = err.Error()
+	default:
+		rec.Outcome = "failed"
+		rec.Error = err.Error()
+	}
+	r.recordTransfer(reqToken, rec)
+
 	if err != nil {
+		// headers are already sent, the short body aborts the transfer
 		log.Errorw("car request: write car", "error", err, "url", req.URL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
+
+// parseCarRange parses a Range header (RFC 7233) for a CAR of the given size.
+// Only single byte ranges are served, other range requests get the whole CAR,
+// which ranged being false signals.
+func parseCarRange(rh string, size int64) (start, length int64, ranged, satisfiable bool) {
+	rh = strings.TrimSpace(rh)
+	if !strings.HasPrefix(rh, "bytes=") || strings.Contains(rh, ",") {
+		return 0, 0, false, true
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(rh, "bytes=")), "-")
+	if !ok {
+		return 0, 0, false, true
+	}
+
+	if first == "" {
+		// suffix range, last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, true
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, true
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	if start >= size {
+		return 0, 0, false, false
+	}
+
+	return start, end - start + 1, true, true
+}
@@ -0,0 +1,344 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	types2 "github.com/filecoin-project/boost/transport/types"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarServerTLS(t *testing.T) {
+	oldInterval := carIndexInterval
+	carIndexInterval = 4 << 10
+	t.Cleanup(func() {
+		carIndexInterval = oldInterval
+	})
+
+	ctx := context.Background()
+	td := t.TempDir()
+
+	certFile, keyFile := writeTestCert(t, td)
+
+	// reserve a port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	r, g := openSealedTestGroup(t, WithCarServer(CarServerConfig{
+		ListenAddr:  addr,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		PublicURLs:  []string{"https://" + addr},
+	}))
+
+	dealInfo, err := r.db.GetDealParams(ctx, 1)
+	require.NoError(t, err)
+
+	// providers get http transfers from the public url
+	dealUUID := uuid.New()
+	token, err := r.makeCarRequestToken(ctx, 1, time.Hour, dealInfo.CarSize, dealUUID, r.host.ID())
+	require.NoError(t, err)
+
+	tr, err := g.carTransfer(r.host, ProviderCandidate{ID: 1000}, token, dealInfo.CarSize)
+	require.NoError(t, err)
+	require.Equal(t, "http", tr.Type)
+
+	var params types2.HttpRequest
+	require.NoError(t, json.Unmarshal(tr.Params, &params))
+	require.Equal(t, "https://"+addr, params.URL)
+
+	// fetch over tls
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	req, err := http.NewRequest(http.MethodGet, params.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", params.Headers["Authorization"])
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, dealInfo.CarSize, len(body))
+
+	var expected bytes.Buffer
+	require.NoError(t, r.withReadableGroup(1, func(group *Group) error {
+		_, _, err := group.writeCar(&expected)
+		return err
+	}))
+	require.Equal(t, expected.Bytes(), body)
+
+	// ranges are written starting from offset index entries
+	idx, err := loadCarIndex(g.path)
+	require.NoError(t, err)
+	require.Greater(t, len(idx.Entries), 10)
+
+	carSize := dealInfo.CarSize
+	for _, rg := range [][2]int64{{0, 10}, {5, -1}, {4 << 10, 100}, {carSize / 2, carSize / 3}, {carSize - 1, 1}, {carSize - 1000, -1}} {
+		var buf bytes.Buffer
+		require.NoError(t, g.writeCarRange(&buf, rg[0], rg[1]))
+
+		end := carSize
+		if rg[1] >= 0 {
+			end = rg[0] + rg[1]
+		}
+		require.Equal(t, expected.Bytes()[rg[0]:end], buf.Bytes(), "range %v", rg)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, params.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", params.Headers["Authorization"])
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", carSize/2, carSize/2+999))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, fmt.Sprintf("bytes %d-%d/%d", carSize/2, carSize/2+999, carSize), resp.Header.Get("Content-Range"))
+	require.Equal(t, expected.Bytes()[carSize/2:carSize/2+1000], body)
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", carSize))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	// served requests are in the deal transfer history, recorded after
+	// responses are written
+	var transfers []iface.TransferInfo
+	require.Eventually(t, func() bool {
+		transfers, err = r.DealTransfers(dealUUID.String())
+		require.NoError(t, err)
+		return len(transfers) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "complete", transfers[0].Outcome)
+	require.Equal(t, dealInfo.CarSize, transfers[0].BytesSent)
+	require.Equal(t, []int64{carSize / 2, 1000, 1000}, []int64{transfers[1].RangeStart, transfers[1].RangeLength, transfers[1].BytesSent})
+	require.Contains(t, transfers[1].Peer, "127.0.0.1:")
+
+	// unauthorized
+	req, err = http.NewRequest(http.MethodGet, params.URL, nil)
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// providers which failed fetching over http fall back to libp2p
+	_, err = r.db.db.Exec(`insert into providers (id, in_market, http_transfer_failed_at) values (1000, 1, ?)`, time.Now().Unix())
+	require.NoError(t, err)
+
+	tr, err = g.carTransfer(r.host, ProviderCandidate{ID: 1000}, token, dealInfo.CarSize)
+	require.NoError(t, err)
+	require.Equal(t, "libp2p", tr.Type)
+}
+
+// openSealedTestGroup opens a store with a mock chain, and seals group 1 with
+// 100 blocks up to having commP
+func openSealedTestGroup(t *testing.T, opts ...OpenOption) (*ribs, *Group) {
+	ctx := context.Background()
+	td := t.TempDir()
+
+	walletPath := filepath.Join(td, "wallet")
+	w, err := ributil.OpenWallet(walletPath)
+	require.NoError(t, err)
+	_, err = w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	mn := mocknet.New()
+	ri, err := Open(filepath.Join(td, "ribs"), append([]OpenOption{
+		WithChainAPI(NewMockChain()),
+		WithWalletPath(walletPath),
+		WithHostGetter(func(...libp2p.Option) (host.Host, error) {
+			return mn.GenPeer()
+		}),
+	}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+	r := ri.(*ribs)
+
+	sess := ri.Session(ctx)
+	wb := sess.Batch(ctx)
+	for i := 0; i < 100; i++ {
+		var data [1000]byte
+		binary.BigEndian.PutUint64(data[:], uint64(i))
+		require.NoError(t, wb.Put(ctx, []blocks.Block{blocks.NewBlock(data[:])}))
+	}
+	require.NoError(t, wb.Flush(ctx))
+	require.NoError(t, ri.Admin().SealGroup(ctx, 1))
+
+	require.Eventually(t, func() bool {
+		gm, err := ri.Diagnostics().GroupMeta(1)
+		require.NoError(t, err)
+		return gm.State >= iface.GroupStateHasCommp
+	}, 10*time.Second, 20*time.Millisecond)
+
+	var g *Group
+	require.NoError(t, r.withReadableGroup(1, func(group *Group) error {
+		g = group
+		return nil
+	}))
+
+	return r, g
+}
+
+func TestTransferBandwidth(t *testing.T) {
+	r := &ribs{
+		uploadStats:       map[iface.GroupKey]*iface.UploadStats{},
+		bandwidthInterval: 10 * time.Millisecond,
+		bandwidthSamples:  2,
+	}
+	r.updateCarStats()
+
+	for i := 0; i < 3; i++ {
+		r.uploadStats[1] = &iface.UploadStats{ActiveRequests: 1, Last250MsUploadBytes: 1000}
+		time.Sleep(20 * time.Millisecond)
+		r.updateCarStats()
+	}
+
+	bw := r.TransferBandwidth()
+	require.Len(t, bw, 2)
+	for _, s := range bw {
+		require.Greater(t, s.BytesPerSecond, int64(0))
+		require.Less(t, s.BytesPerSecond, int64(1000/0.02)+1)
+	}
+}
+
+func TestCarRequestTokens(t *testing.T) {
+	ctx := context.Background()
+	r, _ := openSealedTestGroup(t)
+
+	prov, err := test.RandPeerID()
+	require.NoError(t, err)
+	other, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	dealUUID := uuid.New()
+	token, err := r.makeCarRequestToken(ctx, 1, time.Hour, 1000, dealUUID, prov)
+	require.NoError(t, err)
+
+	peerCtx := func(p peer.ID) context.Context {
+		return context.WithValue(ctx, carRequestPeerKey{}, p)
+	}
+
+	// bound to the provider peer
+	rt, err := r.verify(peerCtx(prov), string(token))
+	require.NoError(t, err)
+	require.Equal(t, dealUUID.String(), rt.DealUUID)
+	_, err = r.verify(peerCtx(other), string(token))
+	require.Error(t, err)
+
+	// keys are persisted, previous keys verify until tokens expire
+	keys, err := openCarTokenKeys(r.root)
+	require.NoError(t, err)
+	require.NoError(t, keys.rotate())
+	r.carTokenKeys = keys
+
+	_, err = r.verify(peerCtx(prov), string(token))
+	require.NoError(t, err)
+
+	newToken, err := r.makeCarRequestToken(ctx, 1, time.Hour, 1000, dealUUID, prov)
+	require.NoError(t, err)
+	_, err = r.verify(peerCtx(prov), string(newToken))
+	require.NoError(t, err)
+
+	old := carTokenLifetime
+	carTokenLifetime = -time.Second
+	require.NoError(t, keys.rotate())
+	carTokenLifetime = old
+	_, err = r.verify(peerCtx(prov), string(token))
+	require.Error(t, err)
+
+	// revoked when the deal fails
+	token, err = r.makeCarRequestToken(ctx, 1, time.Hour, 1000, dealUUID, prov)
+	require.NoError(t, err)
+	_, err = r.db.db.Exec(`insert into deals (uuid, start_time, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, failed) values (?, 0, '', 1000, 1, 0, 0, 1, 0, 0, x'', 1)`, dealUUID.String())
+	require.NoError(t, err)
+	_, err = r.verify(peerCtx(prov), string(token))
+	require.ErrorContains(t, err, "revoked")
+}
+
+func TestParseCarRange(t *testing.T) {
+	for _, tc := range []struct {
+		rh                  string
+		start, length       int64
+		ranged, satisfiable bool
+	}{
+		{"bytes=0-99", 0, 100, true, true},
+		{"bytes=100-", 100, 900, true, true},
+		{"bytes=900-2000", 900, 100, true, true},
+		{"bytes=-100", 900, 100, true, true},
+		{"bytes=-2000", 0, 1000, true, true},
+		{"bytes=1000-", 0, 0, false, false},
+		{"bytes=-0", 0, 0, false, false},
+		{"bytes=0-1,5-6", 0, 0, false, true},
+		{"bytes=5-1", 0, 0, false, true},
+		{"items=0-1", 0, 0, false, true},
+		{"bytes=x-", 0, 0, false, true},
+	} {
+		start, length, ranged, satisfiable := parseCarRange(tc.rh, 1000)
+		require.Equal(t, []any{tc.start, tc.length, tc.ranged, tc.satisfiable}, []any{start, length, ranged, satisfiable}, tc.rh)
+	}
+}
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ribs test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile
+}
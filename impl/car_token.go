@@ -0,0 +1,185 @@
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/xerrors"
+)
+
+const carTokenKeysFile = "car-token-keys.json"
+
+// carTokenLifetime is how long car request tokens are valid; rotated keys are
+// kept for verification until tokens signed with them expire
+var carTokenLifetime = 36 * time.Hour
+
+type carRequestToken struct {
+	Group   int64
+	Timeout int64
+	CarSize int64
+
+	// deal the token was made for, and the libp2p peer of its provider
+	DealUUID string
+	Provider string
+}
+
+type carTokenKey struct {
+	Secret []byte
+	// unix time the key stopped being used for signing, 0 for the current key
+	RotatedAt int64
+}
+
+// carTokenKeys are per-store car request token signing keys, the first one is
+// used for signing
+type carTokenKeys struct {
+	path string
+
+	lk   sync.Mutex
+	keys []carTokenKey
+}
+
+func openCarTokenKeys(root string) (*carTokenKeys, error) {
+	k := &carTokenKeys{path: filepath.Join(root, carTokenKeysFile)}
+
+	b, err := os.ReadFile(k.path)
+	switch {
+	case os.IsNotExist(err):
+		if err := k.rotate(); err != nil {
+			return nil, xerrors.Errorf("generating car token key: %w", err)
+		}
+		return k, nil
+	case err != nil:
+		return nil, xerrors.Errorf("reading car token keys: %w", err)
+	}
+
+	if err := json.Unmarshal(b, &k.keys); err != nil {
+		return nil, xerrors.Errorf("parsing car token keys: %w", err)
+	}
+	if len(k.keys) == 0 {
+		return nil, xerrors.Errorf("no car token keys in %s", k.path)
+	}
+
+	return k, nil
+}
+
+// rotate makes a new signing key, tokens signed with previous keys stay valid
+// until they expire
+func (k *carTokenKeys) rotate() error {
+	k.lk.Lock()
+	defer k.lk.Unlock()
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return xerrors.Errorf("reading random key: %w", err)
+	}
+
+	now := time.Now()
+
+	keys := []carTokenKey{{Secret: secret}}
+	for _, key := range k.keys {
+		if key.RotatedAt == 0 {
+			key.RotatedAt = now.Unix()
+		}
+		if time.Unix(key.RotatedAt, 0).Add(carTokenLifetime).Before(now) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return xerrors.Errorf("marshaling keys: %w", err)
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return xerrors.Errorf("writing keys: %w", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return xerrors.Errorf("replacing keys file: %w", err)
+	}
+
+	k.keys = keys
+	return nil
+}
+
+func (k *carTokenKeys) sign(p *carRequestToken) ([]byte, error) {
+	k.lk.Lock()
+	secret := k.keys[0].Secret
+	k.lk.Unlock()
+
+	return jwt.Sign(p, jwt.NewHS256(secret))
+}
+
+func (k *carTokenKeys) verify(token []byte, p *carRequestToken) error {
+	k.lk.Lock()
+	keys := k.keys
+	k.lk.Unlock()
+
+	var err error
+	for _, key := range keys {
+		if _, err = jwt.Verify(token, jwt.NewHS256(key.Secret), p); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *ribs) verify(ctx context.Context, token string) (carRequestToken, error) {
+	var payload carRequestToken
+	if err := r.carTokenKeys.verify([]byte(token), &payload); err != nil {
+		return carRequestToken{}, xerrors.Errorf("JWT Verification failed: %w", err)
+	}
+
+	if payload.Timeout < time.Now().Unix() {
+		return carRequestToken{}, xerrors.Errorf("token expired")
+	}
+
+	// tokens are bound to the provider peer when it is known, tcp requests
+	// only have the token
+	if pid, ok := ctx.Value(carRequestPeerKey{}).(peer.ID); ok && payload.Provider != pid.String() {
+		return carRequestToken{}, xerrors.Errorf("token for peer %s used by %s", payload.Provider, pid)
+	}
+
+	revoked, err := r.db.DealFailed(payload.DealUUID)
+	if err != nil {
+		return carRequestToken{}, xerrors.Errorf("checking deal: %w", err)
+	}
+	if revoked {
+		return carRequestToken{}, xerrors.Errorf("token revoked, deal %s failed", payload.DealUUID)
+	}
+
+	return payload, nil
+}
+
+func (r *ribs) makeCarRequestToken(ctx context.Context, group int64, timeout time.Duration, carSize int64, dealUUID uuid.UUID, provider peer.ID) ([]byte, error) {
+	p := carRequestToken{
+		Group:    group,
+		Timeout:  time.Now().Add(timeout).Unix(),
+		CarSize:  carSize,
+		DealUUID: dealUUID.String(),
+		Provider: provider.String(),
+	}
+
+	return r.carTokenKeys.sign(&p)
+}
+
+func (r *ribs) RotateCarTokenKey(ctx context.Context) error {
+	if err := r.carTokenKeys.rotate(); err != nil {
+		return xerrors.Errorf("rotating car token key: %w", err)
+	}
+
+	log.Infow("rotated car request token key")
+	return nil
+}
+
+// carRequestPeerKey is the context key of the libp2p peer making a car request
+type carRequestPeerKey struct{}
@@ -0,0 +1,621 @@
+package impl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// how far shared stream producers read ahead of the fastest client
+	carReadAhead int64 = 4 << 20
+
+	carStreamChunkSize = 1 << 20
+)
+
+// CarTransferPolicy controls how deal data uploads are shared and limited.
+// Concurrent requests for the same group CAR share one read of group data.
+type CarTransferPolicy struct {
+	// MaxTransfers is the number of CAR requests served at once, requests
+	// over it are asked to retry later. 0 is unlimited
+	MaxTransfers int
+
+	// MaxUploadBytesPerSecond limits upload bandwidth of all transfers. 0 is
+	// unlimited
+	MaxUploadBytesPerSecond int64
+
+	// MaxLag is how far behind the fastest client on a shared stream a
+	// client can fall before it gets an independent stream
+	MaxLag int64
+
+	// CacheDir keeps materialized deal CARs, which are served without
+	// reading group data again. Empty disables the cache
+	CacheDir string
+	// CacheMaxBytes limits the size of the cache, least recently used CARs
+	// are removed first
+	CacheMaxBytes int64
+}
+
+func defaultCarTransferPolicy() CarTransferPolicy {
+	return CarTransferPolicy{
+		MaxLag: 64 << 20,
+	}
+}
+
+func (p CarTransferPolicy) validate() error {
+	if p.MaxTransfers < 0 || p.MaxUploadBytesPerSecond < 0 {
+		return xerrors.Errorf("transfer limits can't be negative")
+	}
+	if p.MaxLag <= 0 {
+		return xerrors.Errorf("max lag must be positive")
+	}
+	if p.CacheDir != "" && p.CacheMaxBytes <= 0 {
+		return xerrors.Errorf("cache max bytes must be set with a cache dir")
+	}
+	return nil
+}
+
+// WithCarTransferPolicy sets limits and caching of deal data uploads
+func WithCarTransferPolicy(p CarTransferPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.carTransferPolicy = &p
+	}
+}
+
+type carTransfers struct {
+	policy CarTransferPolicy
+
+	slots   chan struct{}
+	limiter *byteLimiter
+
+	lk      sync.Mutex
+	streams map[iface.GroupKey][]*carStream
+	caching map[iface.GroupKey]bool
+
+	cacheLk sync.Mutex
+}
+
+func newCarTransfers(p CarTransferPolicy) (*carTransfers, error) {
+	t := &carTransfers{
+		policy:  p,
+		streams: map[iface.GroupKey][]*carStream{},
+		caching: map[iface.GroupKey]bool{},
+	}
+
+	if p.MaxTransfers > 0 {
+		t.slots = make(chan struct{}, p.MaxTransfers)
+	}
+	if p.MaxUploadBytesPerSecond > 0 {
+		t.limiter = &byteLimiter{perSecond: float64(p.MaxUploadBytesPerSecond)}
+	}
+	if p.CacheDir != "" {
+		if err := os.MkdirAll(p.CacheDir, 0755); err != nil {
+			return nil, xerrors.Errorf("make car cache dir: %w", err)
+		}
+
+		// partial cache files left by a crash, eviction only sees *.car
+		tmps, err := filepath.Glob(filepath.Join(p.CacheDir, "*.tmp"))
+		if err != nil {
+			return nil, xerrors.Errorf("listing partial cached cars: %w", err)
+		}
+		for _, tmp := range tmps {
+			if err := os.Remove(tmp); err != nil {
+				return nil, xerrors.Errorf("removing partial cached car: %w", err)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// acquire takes a transfer slot, false when all are taken
+func (t *carTransfers) acquire() (release func(), ok bool) {
+	if t.slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return func() { <-t.slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// serve writes length bytes of the group CAR starting at start
+func (t *carTransfers) serve(ctx context.Context, g *Group, carSize, start, length int64, w io.Writer) error {
+	if t.limiter != nil {
+		w = &limitedWriter{ctx: ctx, w: w, l: t.limiter}
+	}
+
+	served, err := t.serveCached(g.id, carSize, start, length, w)
+	if served || err != nil {
+		return err
+	}
+
+	for length > 0 {
+		s, c := t.join(g, carSize, start)
+
+		n, err := s.copyTo(c, w, length)
+		start += n
+		length -= n
+
+		if xerrors.Is(err, errCarStreamDetached) {
+			log.Debugw("car transfer fell behind shared stream", "group", g.id, "offset", start)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// join adds a client to a stream of the group which still has data at start
+// buffered, or starts a new stream
+func (t *carTransfers) join(g *Group, carSize, start int64) (*carStream, *carStreamClient) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	for _, s := range t.streams[g.id] {
+		if c := s.tryJoin(start); c != nil {
+			return s, c
+		}
+	}
+
+	s := &carStream{
+		t:        t,
+		group:    g.id,
+		carSize:  carSize,
+		start:    start,
+		bufStart: start,
+		pos:      start,
+		clients:  map[*carStreamClient]struct{}{},
+	}
+	s.cond = sync.NewCond(&s.lk)
+
+	c := &carStreamClient{cursor: start}
+	s.clients[c] = struct{}{}
+
+	t.streams[g.id] = append(t.streams[g.id], s)
+
+	var cache *os.File
+	if start == 0 && t.policy.CacheDir != "" && carSize <= t.policy.CacheMaxBytes && !t.caching[g.id] {
+		f, err := os.Create(t.cachePath(g.id) + ".tmp")
+		if err != nil {
+			log.Errorw("creating car cache file", "group", g.id, "error", err)
+		} else {
+			t.caching[g.id] = true
+			cache = f
+		}
+	}
+
+	go s.run(g, cache)
+
+	return s, c
+}
+
+func (t *carTransfers) streamDone(s *carStream) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	streams := t.streams[s.group]
+	for i, gs := range streams {
+		if gs == s {
+			streams = append(streams[:i], streams[i+1:]...)
+			break
+		}
+	}
+	if len(streams) == 0 {
+		delete(t.streams, s.group)
+	} else {
+		t.streams[s.group] = streams
+	}
+}
+
+// streaming returns whether the group has car streams which haven't finished
+// reading data, streams can outlive the requests which started them
+func (t *carTransfers) streaming(gk iface.GroupKey) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return len(t.streams[gk]) > 0
+}
+
+func (t *carTransfers) cachePath(gk iface.GroupKey) string {
+	return filepath.Join(t.policy.CacheDir, fmt.Sprintf("%d.car", gk))
+}
+
+func (t *carTransfers) serveCached(gk iface.GroupKey, carSize, start, length int64, w io.Writer) (bool, error) {
+	if t.policy.CacheDir == "" {
+		return false, nil
+	}
+
+	t.cacheLk.Lock()
+	f, err := os.Open(t.cachePath(gk))
+	if err != nil {
+		t.cacheLk.Unlock()
+		return false, nil
+	}
+	defer f.Close() // nolint
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != carSize {
+		t.cacheLk.Unlock()
+		return false, nil
+	}
+
+	// mtime tracks use for eviction
+	now := time.Now()
+	if err := os.Chtimes(f.Name(), now, now); err != nil {
+		log.Warnw("touching cached car", "group", gk, "error", err)
+	}
+	t.cacheLk.Unlock()
+
+	if _, err := io.Copy(w, io.NewSectionReader(f, start, length)); err != nil {
+		return true, xerrors.Errorf("serving cached car: %w", err)
+	}
+	return true, nil
+}
+
+// commitCache makes a fully written CAR available in the cache, and evicts
+// least recently used CARs over the size limit
+func (t *carTransfers) commitCache(gk iface.GroupKey, f *os.File, complete bool) {
+	defer func() {
+		t.lk.Lock()
+		delete(t.caching, gk)
+		t.lk.Unlock()
+	}()
+
+	tmp := f.Name()
+	if err := f.Close(); err != nil {
+		log.Errorw("closing car cache file", "group", gk, "error", err)
+		complete = false
+	}
+	if !complete {
+		_ = os.Remove(tmp)
+		return
+	}
+
+	t.cacheLk.Lock()
+	defer t.cacheLk.Unlock()
+
+	if err := os.Rename(tmp, t.cachePath(gk)); err != nil {
+		log.Errorw("committing car cache file", "group", gk, "error", err)
+		return
+	}
+
+	ents, err := os.ReadDir(t.policy.CacheDir)
+	if err != nil {
+		log.Errorw("listing car cache", "error", err)
+		return
+	}
+
+	var cached []os.FileInfo
+	var total int64
+	for _, ent := range ents {
+		if !strings.HasSuffix(ent.Name(), ".car") {
+			continue
+		}
+		fi, err := ent.Info()
+		if err != nil {
+			continue
+		}
+		cached = append(cached, fi)
+		total += fi.Size()
+	}
+
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+
+	for _, fi := range cached {
+		if total <= t.policy.CacheMaxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(t.policy.CacheDir, fi.Name())); err != nil {
+			log.Errorw("evicting cached car", "file", fi.Name(), "error", err)
+			continue
+		}
+		total -= fi.Size()
+	}
+}
+
+var (
+	errCarStreamIdle     = xerrors.New("no clients left on car stream")
+	errCarStreamDetached = xerrors.New("client fell behind car stream")
+)
+
+// carStream is one read of group CAR data shared by clients at nearby offsets
+type carStream struct {
+	t       *carTransfers
+	group   iface.GroupKey
+	carSize int64
+	start   int64
+
+	lk   sync.Mutex
+	cond *sync.Cond
+
+	// buffered data from bufStart to pos
+	chunks   [][]byte
+	bufStart int64
+	pos      int64
+
+	clients map[*carStreamClient]struct{}
+
+	// no more clients can join once closed
+	closed bool
+	done   bool
+	err    error
+}
+
+type carStreamClient struct {
+	cursor   int64
+	detached bool
+}
+
+func (s *carStream) tryJoin(start int64) *carStreamClient {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if s.closed || start < s.bufStart || start > s.pos {
+		return nil
+	}
+
+	c := &carStreamClient{cursor: start}
+	s.clients[c] = struct{}{}
+	return c
+}
+
+func (s *carStream) run(g *Group, cache *os.File) {
+	var out io.Writer = s
+	var tee *cacheTee
+	if cache != nil {
+		tee = &cacheTee{s: s, f: cache}
+		out = tee
+	}
+
+	bw := bufio.NewWriterSize(out, carStreamChunkSize)
+	err := g.writeCarRange(bw, s.start, -1)
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	s.lk.Lock()
+	s.closed = true
+	s.done = true
+	if err != nil && !xerrors.Is(err, errCarStreamIdle) {
+		s.err = err
+		log.Errorw("car stream failed", "group", s.group, "error", err)
+	}
+	written := s.pos
+	s.cond.Broadcast()
+	s.lk.Unlock()
+
+	s.t.streamDone(s)
+
+	if tee != nil {
+		s.t.commitCache(s.group, cache, err == nil && tee.err == nil && written == s.carSize)
+	}
+}
+
+func (s *carStream) Write(p []byte) (int, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	// don't read too far ahead of the fastest client
+	var fastest int64
+	for {
+		if len(s.clients) == 0 {
+			s.closed = true
+			return 0, errCarStreamIdle
+		}
+
+		fastest = s.fastestLocked()
+		if s.pos-fastest < carReadAhead {
+			break
+		}
+
+		s.cond.Wait()
+	}
+
+	for rem := p; len(rem) > 0; {
+		if len(s.chunks) == 0 || len(s.chunks[len(s.chunks)-1]) == carStreamChunkSize {
+			s.chunks = append(s.chunks, make([]byte, 0, carStreamChunkSize))
+		}
+		last := &s.chunks[len(s.chunks)-1]
+
+		n := carStreamChunkSize - len(*last)
+		if n > len(rem) {
+			n = len(rem)
+		}
+		*last = append(*last, rem[:n]...)
+		rem = rem[n:]
+	}
+	s.pos += int64(len(p))
+
+	// clients too far behind the fastest one get independent streams
+	for c := range s.clients {
+		if fastest-c.cursor > s.t.policy.MaxLag {
+			c.detached = true
+			delete(s.clients, c)
+		}
+	}
+
+	s.trimLocked()
+	s.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (s *carStream) fastestLocked() int64 {
+	var fastest int64
+	for c := range s.clients {
+		if c.cursor > fastest {
+			fastest = c.cursor
+		}
+	}
+	return fastest
+}
+
+// trimLocked drops chunks all clients have read
+func (s *carStream) trimLocked() {
+	slowest := s.pos
+	for c := range s.clients {
+		if c.cursor < slowest {
+			slowest = c.cursor
+		}
+	}
+
+	for len(s.chunks) > 0 && s.bufStart+int64(len(s.chunks[0])) <= slowest && len(s.chunks[0]) == carStreamChunkSize {
+		s.bufStart += int64(len(s.chunks[0]))
+		s.chunks = s.chunks[1:]
+	}
+}
+
+// copyTo copies up to n bytes to w from the client cursor, and removes the
+// client from the stream
+func (s *carStream) copyTo(c *carStreamClient, w io.Writer, n int64) (int64, error) {
+	defer s.leave(c)
+
+	var copied int64
+	for copied < n {
+		s.lk.Lock()
+		for c.cursor >= s.pos && !s.done && !c.detached {
+			s.cond.Wait()
+		}
+		if c.detached {
+			s.lk.Unlock()
+			return copied, errCarStreamDetached
+		}
+		if c.cursor >= s.pos {
+			err := s.err
+			s.lk.Unlock()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return copied, xerrors.Errorf("car stream ended at %d: %w", c.cursor, err)
+		}
+
+		// chunk memory isn't modified once written, so it can be used
+		// without the lock
+		ci, off := int((c.cursor-s.bufStart)/int64(carStreamChunkSize)), (c.cursor-s.bufStart)%int64(carStreamChunkSize)
+		data := s.chunks[ci][off:]
+		if int64(len(data)) > n-copied {
+			data = data[:n-copied]
+		}
+		s.lk.Unlock()
+
+		wn, err := w.Write(data)
+		copied += int64(wn)
+
+		s.lk.Lock()
+		c.cursor += int64(wn)
+		s.trimLocked()
+		s.cond.Broadcast()
+		s.lk.Unlock()
+
+		if err != nil {
+			return copied, err
+		}
+	}
+
+	return copied, nil
+}
+
+func (s *carStream) leave(c *carStreamClient) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	delete(s.clients, c)
+	s.trimLocked()
+	s.cond.Broadcast()
+}
+
+// cacheTee writes stream data to a cache file, caching stops on write errors
+type cacheTee struct {
+	s   *carStream
+	f   *os.File
+	err error
+}
+
+func (c *cacheTee) Write(p []byte) (int, error) {
+	n, err := c.s.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if c.err == nil {
+		if _, c.err = c.f.Write(p); c.err != nil {
+			log.Errorw("writing car cache file", "group", c.s.group, "error", c.err)
+		}
+	}
+	return n, nil
+}
+
+// byteLimiter paces writes to a number of bytes per second, with up to one
+// second of burst
+type byteLimiter struct {
+	perSecond float64
+
+	lk   sync.Mutex
+	next time.Time
+}
+
+func (l *byteLimiter) wait(ctx context.Context, n int) error {
+	l.lk.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.perSecond * float64(time.Second)))
+	at := l.next
+	l.lk.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	return nil
+}
+
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *byteLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > 64<<10 {
+			n = 64 << 10
+		}
+		if err := lw.l.wait(lw.ctx, n); err != nil {
+			return written, err
+		}
+
+		wn, err := lw.w.Write(p[:n])
+		written += wn
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
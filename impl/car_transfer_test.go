@@ -0,0 +1,206 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCarTransferSharedStreams(t *testing.T) {
+	oldReadAhead, oldChunk := carReadAhead, carStreamChunkSize
+	carReadAhead, carStreamChunkSize = 2<<10, 1<<10
+	t.Cleanup(func() {
+		carReadAhead, carStreamChunkSize = oldReadAhead, oldChunk
+	})
+
+	ctx := context.Background()
+	_, g := openSealedTestGroup(t)
+
+	var expected bytes.Buffer
+	carSize, _, err := g.writeCar(&expected)
+	require.NoError(t, err)
+
+	ct, err := newCarTransfers(defaultCarTransferPolicy())
+	require.NoError(t, err)
+
+	// clients at nearby offsets share a stream
+	s1, c1 := ct.join(g, carSize, 0)
+	s2, c2 := ct.join(g, carSize, 0)
+	require.Same(t, s1, s2)
+
+	var wg sync.WaitGroup
+	bufs := make([]bytes.Buffer, 2)
+	for i, c := range []*carStreamClient{c1, c2} {
+		i, c := i, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := s1.copyTo(c, &bufs[i], carSize)
+			require.NoError(t, err)
+			require.Equal(t, carSize, n)
+		}()
+	}
+	wg.Wait()
+	for _, b := range bufs {
+		require.Equal(t, expected.Bytes(), b.Bytes())
+	}
+
+	// clients falling behind continue on their own stream
+	ct.policy.MaxLag = 8 << 10
+
+	gate := make(chan struct{})
+	var slow bytes.Buffer
+	slowDone := make(chan error)
+	go func() {
+		slowDone <- ct.serve(ctx, g, carSize, 0, carSize, &gatedWriter{gate: gate, w: &slow})
+	}()
+
+	require.Eventually(t, func() bool {
+		ct.lk.Lock()
+		defer ct.lk.Unlock()
+		return len(ct.streams[g.id]) == 1
+	}, time.Second, time.Millisecond)
+
+	var fast bytes.Buffer
+	require.NoError(t, ct.serve(ctx, g, carSize, 0, carSize, &fast))
+	require.Equal(t, expected.Bytes(), fast.Bytes())
+
+	close(gate)
+	require.NoError(t, <-slowDone)
+	require.Equal(t, expected.Bytes(), slow.Bytes())
+
+	// ranges
+	var rb bytes.Buffer
+	require.NoError(t, ct.serve(ctx, g, carSize, 1000, 5000, &rb))
+	require.Equal(t, expected.Bytes()[1000:6000], rb.Bytes())
+
+	require.Eventually(t, func() bool {
+		ct.lk.Lock()
+		defer ct.lk.Unlock()
+		return len(ct.streams) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCarTransferCacheAndLimits(t *testing.T) {
+	ctx := context.Background()
+	_, g := openSealedTestGroup(t)
+
+	var expected bytes.Buffer
+	carSize, _, err := g.writeCar(&expected)
+	require.NoError(t, err)
+
+	cacheDir := t.TempDir()
+
+	// older cached car which gets evicted
+	old := filepath.Join(cacheDir, "99.car")
+	require.NoError(t, os.WriteFile(old, make([]byte, 1000), 0644))
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	// partial car from before a crash
+	partial := filepath.Join(cacheDir, "98.car.tmp")
+	require.NoError(t, os.WriteFile(partial, make([]byte, 1000), 0644))
+
+	ct, err := newCarTransfers(CarTransferPolicy{
+		MaxTransfers:            1,
+		MaxUploadBytesPerSecond: carSize,
+		MaxLag:                  64 << 20,
+		CacheDir:                cacheDir,
+		CacheMaxBytes:           carSize,
+	})
+	require.NoError(t, err)
+
+	_, err = os.Stat(partial)
+	require.True(t, os.IsNotExist(err))
+
+	var b bytes.Buffer
+	require.NoError(t, ct.serve(ctx, g, carSize, 0, carSize, &b))
+	require.Equal(t, expected.Bytes(), b.Bytes())
+
+	require.Eventually(t, func() bool {
+		fi, err := os.Stat(ct.cachePath(g.id))
+		return err == nil && fi.Size() == carSize
+	}, time.Second, time.Millisecond)
+	_, err = os.Stat(old)
+	require.True(t, os.IsNotExist(err))
+
+	// served from the cache, paced by the bandwidth limit
+	start := time.Now()
+	b.Reset()
+	served, err := ct.serveCached(g.id, carSize, 10, carSize-10, &limitedWriter{ctx: ctx, w: &b, l: ct.limiter})
+	require.NoError(t, err)
+	require.True(t, served)
+	require.Equal(t, expected.Bytes()[10:], b.Bytes())
+	require.Greater(t, time.Since(start), 500*time.Millisecond)
+
+	release, ok := ct.acquire()
+	require.True(t, ok)
+	_, ok = ct.acquire()
+	require.False(t, ok)
+	release()
+	release, ok = ct.acquire()
+	require.True(t, ok)
+	release()
+}
+
+func TestOffloadSkipsStreamingGroups(t *testing.T) {
+	oldReadAhead, oldChunk := carReadAhead, carStreamChunkSize
+	carReadAhead, carStreamChunkSize = 2<<10, 1<<10
+	t.Cleanup(func() {
+		carReadAhead, carStreamChunkSize = oldReadAhead, oldChunk
+	})
+
+	ctx := context.Background()
+	r, _ := testChainRibs(t, NewMockChain())
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.Seal(ctx))
+	require.NoError(t, g.Finalize(ctx))
+	require.NoError(t, g.GenTopCar(ctx))
+	require.NoError(t, g.GenCommP())
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsDone))
+	for i := 0; i < targetReplicaCount; i++ {
+		insertTestDeal(t, r.db, testDeal{UUID: fmt.Sprintf("sealed-%d", i), Group: g.id, Provider: int64(1000 + i), Sealed: true})
+	}
+
+	var carBuf bytes.Buffer
+	carSize, _, err := g.writeCar(&carBuf)
+	require.NoError(t, err)
+
+	r.offloadPolicy = OffloadPolicy{MinSealedDeals: 1}
+	r.uploadStats = map[iface.GroupKey]*iface.UploadStats{}
+	r.carTransfers, err = newCarTransfers(defaultCarTransferPolicy())
+	require.NoError(t, err)
+
+	// a stream still reading with no car requests left
+	s, c := r.carTransfers.join(g, carSize, 0)
+
+	require.NoError(t, r.offloadGroups(ctx))
+	require.Equal(t, iface.GroupStateDealsDone, g.state)
+
+	s.leave(c)
+	require.Eventually(t, func() bool {
+		return !r.carTransfers.streaming(g.id)
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, r.offloadGroups(ctx))
+	require.Equal(t, iface.GroupStateOffloaded, g.state)
+}
+
+// gatedWriter blocks writes until the gate is closed
+type gatedWriter struct {
+	gate chan struct{}
+	w    *bytes.Buffer
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	<-g.gate
+	return g.w.Write(p)
+}
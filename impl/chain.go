@@ -0,0 +1,332 @@
+package impl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// DefaultChainURL is the lotus gateway used when no ChainAPI is given to Open
+var DefaultChainURL = "http://api.chain.love/rpc/v1"
+
+var (
+	// limits of calls made through the shared ChainAPI
+	chainCallsPerSecond = 20
+	chainCallBurst      = 50
+
+	chainHeadCacheTTL        = 5 * time.Second
+	collateralBoundsCacheTTL = 30 * time.Minute
+)
+
+// ChainAPI is the part of the lotus gateway API used by ribs. It is shared by
+// all subsystems; api.Gateway implements it.
+type ChainAPI interface {
+	ChainHead(ctx context.Context) (*types.TipSet, error)
+	ChainGetGenesis(ctx context.Context) (*types.TipSet, error)
+	ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error)
+	ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error)
+	ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message, error)
+
+	// chain blockstore, used for loading actor state
+	ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error)
+	ChainHasObj(ctx context.Context, c cid.Cid) (bool, error)
+	ChainPutObj(ctx context.Context, b blocks.Block) error
+
+	GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error)
+	MpoolPush(ctx context.Context, sm *types.SignedMessage) (cid.Cid, error)
+	StateWaitMsg(ctx context.Context, msg cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error)
+	StateSearchMsg(ctx context.Context, from types.TipSetKey, msg cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error)
+
+	StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error)
+	StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error)
+	StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error)
+	StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error)
+
+	StateMarketBalance(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MarketBalance, error)
+	StateMarketStorageDeal(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error)
+	StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool, tsk types.TipSetKey) (api.DealCollateralBounds, error)
+	StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error)
+
+	WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error)
+}
+
+var _ ChainAPI = api.Gateway(nil)
+
+// WithChainAPI replaces the public lotus gateway with the given chain API
+func WithChainAPI(c ChainAPI) OpenOption {
+	return func(o *openOptions) {
+		o.chain = c
+	}
+}
+
+// NewGatewayChainAPI connects to a lotus gateway
+func NewGatewayChainAPI(ctx context.Context, url string) (ChainAPI, func(), error) {
+	gw, closer, err := client.NewGatewayRPCV1(ctx, url, nil)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	return gw, closer, nil
+}
+
+// rateLimiter lets burst calls through at once, then one every interval
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	lk   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(perSecond, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+		burst:    burst,
+	}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.lk.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Duration(l.burst-1) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.lk.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	return nil
+}
+
+type boundsKey struct {
+	size     abi.PaddedPieceSize
+	verified bool
+}
+
+type cachedBounds struct {
+	bounds api.DealCollateralBounds
+	at     time.Time
+}
+
+// chainClient rate-limits calls to a ChainAPI, and caches the chain head and
+// collateral bounds
+type chainClient struct {
+	api     ChainAPI
+	limiter *rateLimiter
+
+	lk     sync.Mutex
+	head   *types.TipSet
+	headAt time.Time
+	bounds map[boundsKey]cachedBounds
+}
+
+func newChainClient(c ChainAPI) *chainClient {
+	return &chainClient{
+		api:     c,
+		limiter: newRateLimiter(chainCallsPerSecond, chainCallBurst),
+		bounds:  map[boundsKey]cachedBounds{},
+	}
+}
+
+func (c *chainClient) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	c.lk.Lock()
+	if c.head != nil && time.Since(c.headAt) < chainHeadCacheTTL {
+		defer c.lk.Unlock()
+		return c.head, nil
+	}
+	c.lk.Unlock()
+
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	head, err := c.api.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lk.Lock()
+	c.head, c.headAt = head, time.Now()
+	c.lk.Unlock()
+
+	return head, nil
+}
+
+func (c *chainClient) StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool, tsk types.TipSetKey) (api.DealCollateralBounds, error) {
+	key := boundsKey{size: size, verified: verified}
+
+	if tsk == types.EmptyTSK {
+		c.lk.Lock()
+		cb, ok := c.bounds[key]
+		c.lk.Unlock()
+		if ok && time.Since(cb.at) < collateralBoundsCacheTTL {
+			return cb.bounds, nil
+		}
+	}
+
+	if err := c.limiter.wait(ctx); err != nil {
+		return api.DealCollateralBounds{}, err
+	}
+	b, err := c.api.StateDealProviderCollateralBounds(ctx, size, verified, tsk)
+	if err != nil {
+		return api.DealCollateralBounds{}, err
+	}
+
+	if tsk == types.EmptyTSK {
+		c.lk.Lock()
+		c.bounds[key] = cachedBounds{bounds: b, at: time.Now()}
+		c.lk.Unlock()
+	}
+
+	return b, nil
+}
+
+func (c *chainClient) ChainGetGenesis(ctx context.Context) (*types.TipSet, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.ChainGetGenesis(ctx)
+}
+
+func (c *chainClient) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.ChainGetTipSet(ctx, tsk)
+}
+
+func (c *chainClient) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.ChainGetTipSetByHeight(ctx, h, tsk)
+}
+
+func (c *chainClient) ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.ChainGetMessage(ctx, mc)
+}
+
+func (c *chainClient) ChainReadObj(ctx context.Context, obj cid.Cid) ([]byte, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.ChainReadObj(ctx, obj)
+}
+
+func (c *chainClient) ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return false, err
+	}
+	return c.api.ChainHasObj(ctx, obj)
+}
+
+func (c *chainClient) ChainPutObj(ctx context.Context, b blocks.Block) error {
+	if err := c.limiter.wait(ctx); err != nil {
+		return err
+	}
+	return c.api.ChainPutObj(ctx, b)
+}
+
+func (c *chainClient) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.GasEstimateMessageGas(ctx, msg, spec, tsk)
+}
+
+func (c *chainClient) MpoolPush(ctx context.Context, sm *types.SignedMessage) (cid.Cid, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return cid.Undef, err
+	}
+	return c.api.MpoolPush(ctx, sm)
+}
+
+func (c *chainClient) StateWaitMsg(ctx context.Context, msg cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.StateWaitMsg(ctx, msg, confidence, limit, allowReplaced)
+}
+
+func (c *chainClient) StateSearchMsg(ctx context.Context, from types.TipSetKey, msg cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.StateSearchMsg(ctx, from, msg, limit, allowReplaced)
+}
+
+func (c *chainClient) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return 0, err
+	}
+	return c.api.StateNetworkVersion(ctx, tsk)
+}
+
+func (c *chainClient) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.StateGetActor(ctx, actor, tsk)
+}
+
+func (c *chainClient) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return address.Undef, err
+	}
+	return c.api.StateLookupID(ctx, addr, tsk)
+}
+
+func (c *chainClient) StateMinerInfo(ctx context.Context, actor address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return api.MinerInfo{}, err
+	}
+	return c.api.StateMinerInfo(ctx, actor, tsk)
+}
+
+func (c *chainClient) StateMarketBalance(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MarketBalance, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return api.MarketBalance{}, err
+	}
+	return c.api.StateMarketBalance(ctx, addr, tsk)
+}
+
+func (c *chainClient) StateMarketStorageDeal(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.StateMarketStorageDeal(ctx, dealID, tsk)
+}
+
+func (c *chainClient) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.api.StateVerifiedClientStatus(ctx, addr, tsk)
+}
+
+func (c *chainClient) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return types.BigInt{}, err
+	}
+	return c.api.WalletBalance(ctx, addr)
+}
+
+var _ ChainAPI = &chainClient{}
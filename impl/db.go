@@ -3,10 +3,12 @@ package impl
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"encoding/json"
 	"github.com/filecoin-project/boost/storagemarket/types"
+	"github.com/filecoin-project/boost/storagemarket/types/dealcheckpoints"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
 	types2 "github.com/filecoin-project/lotus/chain/types"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
@@ -14,6 +16,8 @@ import (
 	"golang.org/x/xerrors"
 	"path/filepath"
 	"sort"
+	"strings"
+	"time"
 )
 
 const mFil = 1_000_000_000_000_000
@@ -24,8 +28,8 @@ var (
 	// 2 mFil/gib/mo is roughly cloud cost currently
 	maxPrice float64 = (1 * mFil) / 2 / 60 / 24 / 30.436875
 
-	// piece size range ribs is aiming for
-	minPieceSize = 4 << 30
+	// largest piece ribs pads to, providers only accepting larger pieces
+	// aren't used
 	maxPieceSize = 8 << 30
 
 	dealPublishFinality abi.ChainEpoch = 60
@@ -68,6 +72,19 @@ create table if not exists groups
     
     /* jbob */
     jb_recorded_head integer not null,
+
+    /* unix timestamps, used by the group seal policy */
+    created_at integer not null default 0,
+    last_write_at integer not null default 0,
+
+    /* unix timestamp until which the group must be kept, 0 uses the renewal policy default */
+    retain_until integer not null default 0,
+
+    /* json DealPolicy overriding the store default, null when not set */
+    deal_policy text,
+
+    /* 1 while the offloaded group is being rehydrated, resumed on start */
+    rehydrating integer not null default 0,
     
     /* vrcar */
     piece_size integer,
@@ -85,7 +102,7 @@ create index if not exists groups_g_state_index
 /* deals */
 create table if not exists deals (
     uuid text not null constraint deals_pk primary key,
-    start_time integer default (strftime('%%s','now')) not null,
+    start_time integer default (strftime('%s','now')) not null,
 
     client_addr text not null,
     provider_addr integer not null,
@@ -99,10 +116,18 @@ create table if not exists deals (
     end_epoch integer not null,
 
     signed_proposal_bytes blob not null,
+    offline integer not null default 0, /* 1 when the provider imports data from an exported car */
+    transfer_type text not null default 'libp2p', /* how the provider fetches the car, libp2p or http */
+
+    /* json DealPolicy the deal was made with */
+    deal_policy text,
+    provider_collateral text,
 
     deal_id integer,
     deal_pub_ts text,
     sector_start_epoch integer,
+    sealed_at integer, /* unix timestamp when the deal was seen active */
+    failed_at integer, /* unix timestamp when the deal was marked failed */
 
     /* deal state */
     published integer not null default 0, /* publish cid is set, and we have validated the message is landed on chain with some finality */
@@ -111,7 +136,12 @@ create table if not exists deals (
     failed integer not null default 0, /* 1 when the deal is unsuccessful for ANY reason */
     rejected integer not null default 0,
 
-    failed_expired integer not null default 0, /* 1 when the deal is failed AND the proposal start has passed TODO */
+    failed_expired integer not null default 0, /* 1 when the deal failed by not sealing before its start epoch */
+    failed_kind text, /* why an active deal failed, see dealFailureKind */
+
+    /* renewal */
+    renewed integer not null default 0, /* 1 when replacement deals were requested because this one is about to expire */
+    claim_id integer not null default 0, /* verified claim extended in place of the deal */
 
     /* sp deal state */
     sp_status text, /* boost checkpoint name */
@@ -133,6 +163,51 @@ create table if not exists deals (
     retrieval_probes_fail integer not null default 0
 );
 
+/* escrow ledger */
+create table if not exists escrow_ledger (
+    id integer not null constraint escrow_ledger_pk primary key autoincrement,
+    ts integer not null default (strftime('%s','now')),
+
+    /* add_balance - market escrow top-up, deal - accepted deal client balance requirement */
+    kind text not null,
+    group_id integer,
+    deal_uuid text,
+    msg_cid text,
+    /* add_balance messages not yet seen on chain */
+    msg_pending integer not null default 0,
+
+    /* attoFIL */
+    amount text not null
+);
+
+create index if not exists escrow_ledger_ts_index
+    on escrow_ledger (ts);
+
+/* car requests served to providers, one row per request */
+create table if not exists transfers (
+    id integer not null constraint transfers_pk primary key autoincrement,
+    deal_uuid text not null,
+    group_id integer not null,
+
+    /* libp2p peer ID, or remote address of tcp requests */
+    peer text not null,
+
+    range_start integer not null,
+    range_length integer not null,
+    bytes_sent integer not null,
+
+    /* unix millis */
+    started_at integer not null,
+    duration_ms integer not null,
+
+    /* complete, interrupted, failed or busy */
+    outcome text not null,
+    error text
+);
+
+create index if not exists transfers_deal_uuid_index
+    on transfers (deal_uuid);
+
 /* SP tracker */
 create table if not exists providers (
     id integer not null constraint providers_pk primary key,
@@ -144,6 +219,10 @@ create table if not exists providers (
     boost_deals integer not null default 0,
     booster_http integer not null default 0,
     booster_bitswap integer not null default 0,
+
+    /* json lists of retrieval endpoints */
+    booster_http_urls text not null default '[]',
+    booster_bitswap_addrs text not null default '[]',
     
     indexed_success integer not null default 0,
     indexed_fail integer not null default 0,
@@ -157,15 +236,25 @@ create table if not exists providers (
     ask_price integer not null default 0,
     ask_verif_price integer not null default 0,
     ask_min_piece_size integer not null default 0,
-    ask_max_piece_size integer not null default 0
+    ask_max_piece_size integer not null default 0,
+
+    /* reputation, see providerReputation */
+    reputation real not null default 0.5,
+    quarantined_until integer not null default 0,
+
+    /* unix time of the last failed fetch from the tcp car server */
+    http_transfer_failed_at integer not null default 0
 );
 
-create view if not exists good_providers_view as 
+/* deal terms are checked by the provider selector */
+drop view if exists good_providers_view;
+create view good_providers_view as 
 	select id, ping_ok, boost_deals, booster_http, booster_bitswap,
        indexed_success, indexed_fail,
        retrprobe_success, retrprobe_fail, retrprobe_blocks, retrprobe_bytes,
-       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size
-    from providers where in_market = 1 and ping_ok = 1 and ask_ok = 1 and ask_verif_price <= %f and ask_price <= %f and ask_min_piece_size <= %d and ask_max_piece_size >= %d
+       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size,
+       reputation, quarantined_until
+    from providers where in_market = 1 and ping_ok = 1 and ask_ok = 1
     order by (booster_bitswap+booster_http) asc, boost_deals asc, id desc;
 
 /* top level index */
@@ -189,6 +278,33 @@ create index if not exists index_hash_index
 
 `
 
+// dbMigrations bring databases created by older versions up to the current
+// schema. Statements must be safe to re-run; "duplicate column" errors are
+// ignored.
+var dbMigrations = []string{
+	`alter table groups add column created_at integer not null default 0`,
+	`alter table groups add column last_write_at integer not null default 0`,
+	`update groups set created_at = strftime('%s','now') where created_at = 0`,
+	`alter table providers add column booster_http_urls text not null default '[]'`,
+	`alter table providers add column booster_bitswap_addrs text not null default '[]'`,
+	`alter table groups add column retain_until integer not null default 0`,
+	`alter table deals add column renewed integer not null default 0`,
+	`alter table deals add column claim_id integer not null default 0`,
+	`alter table deals add column sealed_at integer`,
+	`alter table providers add column reputation real not null default 0.5`,
+	`alter table providers add column quarantined_until integer not null default 0`,
+	`alter table groups add column deal_policy text`,
+	`alter table deals add column deal_policy text`,
+	`alter table deals add column provider_collateral text`,
+	`alter table deals add column offline integer not null default 0`,
+	`alter table deals add column transfer_type text not null default 'libp2p'`,
+	`alter table providers add column http_transfer_failed_at integer not null default 0`,
+	`alter table groups add column rehydrating integer not null default 0`,
+	`alter table deals add column failed_at integer`,
+	`alter table escrow_ledger add column msg_pending integer not null default 0`,
+	`alter table deals add column failed_kind text`,
+}
+
 type ribsDB struct {
 	db *sql.DB
 }
@@ -206,11 +322,17 @@ func openRibsDB(root string) (*ribsDB, error) {
 		}
 	}
 
-	_, err = db.Exec(fmt.Sprintf(dbSchema, maxVerifPrice, maxPrice, minPieceSize, maxPieceSize))
+	_, err = db.Exec(dbSchema)
 	if err != nil {
 		return nil, xerrors.Errorf("exec schema: %w", err)
 	}
 
+	for _, m := range dbMigrations {
+		if _, err := db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return nil, xerrors.Errorf("exec migration '%s': %w", m, err)
+		}
+	}
+
 	return &ribsDB{
 		db: db,
 	}, nil
@@ -220,7 +342,8 @@ func (r *ribsDB) ReachableProviders() []iface.ProviderMeta {
 	res, err := r.db.Query(`select id, ping_ok, boost_deals, booster_http, booster_bitswap,
        indexed_success, indexed_fail,
        retrprobe_success, retrprobe_fail, retrprobe_blocks, retrprobe_bytes,
-       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size
+       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size,
+       reputation, quarantined_until
     from good_providers_view`)
 
 	if err != nil {
@@ -235,7 +358,8 @@ func (r *ribsDB) ReachableProviders() []iface.ProviderMeta {
 		err := res.Scan(&pm.ID, &pm.PingOk, &pm.BoostDeals, &pm.BoosterHttp, &pm.BoosterBitswap,
 			&pm.IndexedSuccess, &pm.IndexedFail, // &pm.DealAttempts, &pm.DealSuccess, &pm.DealFail,
 			&pm.RetrProbeSuccess, &pm.RetrProbeFail, &pm.RetrProbeBlocks, &pm.RetrProbeBytes,
-			&pm.AskPrice, &pm.AskVerifiedPrice, &pm.AskMinPieceSize, &pm.AskMaxPieceSize)
+			&pm.AskPrice, &pm.AskVerifiedPrice, &pm.AskMinPieceSize, &pm.AskMaxPieceSize,
+			&pm.Reputation, &pm.QuarantinedUntil)
 		if err != nil {
 			log.Errorw("scanning provider", "error", err)
 			return nil
@@ -284,135 +408,116 @@ func (r *ribsDB) ReachableProviders() []iface.ProviderMeta {
 	return out
 }
 
-type dealProvider struct {
-	id              int64
-	ask_price       int64
-	ask_verif_price int64
-}
-
-func (r *ribsDB) SelectDealProviders(group iface.GroupKey) ([]dealProvider, error) {
-	// only reachable, with boost_deals, only ones that don't have deals for this group
-	// 6 at random
-	// 2 of them with booster_http
-	// 2 of them with booster_bitswap
-
-	var withHttp []dealProvider
-	var withBitswap []dealProvider
-	var random []dealProvider
-
-	res, err := r.db.Query(`select id, ask_price, ask_verif_price from good_providers_view where id not in (select provider_addr from deals where group_id = ?) order by random() limit 12`, group)
+// DealCandidates returns reachable, not quarantined providers with a valid ask
+// which don't have deals for the group (other than ones being renewed)
+func (r *ribsDB) DealCandidates(group iface.GroupKey) ([]ProviderCandidate, error) {
+	res, err := r.db.Query(`select p.id, p.ask_price, p.ask_verif_price, p.ask_min_piece_size, p.ask_max_piece_size,
+       p.booster_http, p.booster_bitswap, p.retrprobe_success, p.retrprobe_fail, p.reputation,
+       count(d.uuid),
+       coalesce(sum(case when d.sealed = 1 then 1 else 0 end), 0),
+       coalesce(sum(case when d.rejected != 1 and d.failed = 1 then 1 else 0 end), 0),
+       coalesce(sum(case when d.rejected = 1 then 1 else 0 end), 0)
+    from good_providers_view p left join deals d on d.provider_addr = p.id
+    where p.id not in (select provider_addr from deals where group_id = ? and renewed = 0)
+      and p.quarantined_until <= ?
+    group by p.id`, group, time.Now().Unix())
 	if err != nil {
 		return nil, xerrors.Errorf("querying providers: %w", err)
 	}
+	defer res.Close() // nolint
 
+	var out []ProviderCandidate
 	for res.Next() {
-		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
+		var pc ProviderCandidate
+		err := res.Scan(&pc.ID, &pc.AskPrice, &pc.AskVerifiedPrice, &pc.AskMinPieceSize, &pc.AskMaxPieceSize,
+			&pc.BoosterHttp, &pc.BoosterBitswap, &pc.RetrProbeSuccess, &pc.RetrProbeFail, &pc.Reputation,
+			&pc.DealStarted, &pc.DealSuccess, &pc.DealFail, &pc.DealRejected)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning provider: %w", err)
 		}
 
-		random = append(random, id)
+		out = append(out, pc)
 	}
 
 	if err := res.Err(); err != nil {
 		return nil, xerrors.Errorf("iterating providers: %w", err)
 	}
 
-	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
+	return out, nil
+}
+
+// GetNonFailedDealCount counts deals of the group which aren't failed, and
+// aren't about to expire with replacements requested
+func (r *ribsDB) GetNonFailedDealCount(group iface.GroupKey) (int, error) {
+	var count int
+	err := r.db.QueryRow(`select count(*) from deals where group_id = ? and failed = 0 and renewed = 0`, group).Scan(&count)
+	if err != nil {
+		return 0, xerrors.Errorf("querying deal count: %w", err)
 	}
 
-	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers_view where id not in (select provider_addr from deals where group_id = ?) and booster_http = 1 order by random() limit 5`, group)
+	return count, nil
+}
+
+// OffloadCandidates returns groups with deals in progress or done which have
+// at least minSealed sealed, non-failed deals. Groups below the replica target
+// are left out, repair would have to rehydrate them again to make more deals.
+func (r *ribsDB) OffloadCandidates(minSealed, target int) ([]iface.GroupKey, error) {
+	res, err := r.db.Query(`select g.id from groups g where g.g_state in (?, ?) and
+		(select count(*) from deals d where d.group_id = g.id and d.sealed = 1 and d.failed = 0) >= ? and
+		(select count(*) from deals d where d.group_id = g.id and d.failed = 0 and d.renewed = 0) >= ?`,
+		iface.GroupStateDealsInProgress, iface.GroupStateDealsDone, minSealed, target)
 	if err != nil {
-		return nil, xerrors.Errorf("querying providers: %w", err)
+		return nil, xerrors.Errorf("querying offload candidates: %w", err)
 	}
 
+	var out []iface.GroupKey
 	for res.Next() {
-		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
-		if err != nil {
-			return nil, xerrors.Errorf("scanning provider: %w", err)
+		var id iface.GroupKey
+		if err := res.Scan(&id); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
 		}
 
-		withHttp = append(withHttp, id)
+		out = append(out, id)
 	}
 
 	if err := res.Err(); err != nil {
-		return nil, xerrors.Errorf("iterating providers: %w", err)
+		return nil, xerrors.Errorf("iterating groups: %w", err)
 	}
-
 	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
+		return nil, xerrors.Errorf("closing group iterator: %w", err)
 	}
 
-	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers_view where id not in (select provider_addr from deals where group_id = ?) and booster_bitswap = 1 order by random() limit 5`, group)
+	return out, nil
+}
+
+// GroupsWithSealedDeals returns groups with deals in progress which have at
+// least minSealed sealed, non-failed deals
+func (r *ribsDB) GroupsWithSealedDeals(minSealed int) ([]iface.GroupKey, error) {
+	res, err := r.db.Query(`select g.id from groups g where g.g_state = ? and
+		(select count(*) from deals d where d.group_id = g.id and d.sealed = 1 and d.failed = 0) >= ?`,
+		iface.GroupStateDealsInProgress, minSealed)
 	if err != nil {
-		return nil, xerrors.Errorf("querying providers: %w", err)
+		return nil, xerrors.Errorf("querying groups: %w", err)
 	}
+	defer res.Close() // nolint
 
+	var out []iface.GroupKey
 	for res.Next() {
-		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
-		if err != nil {
-			return nil, xerrors.Errorf("scanning provider: %w", err)
+		var id iface.GroupKey
+		if err := res.Scan(&id); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
 		}
 
-		withBitswap = append(withBitswap, id)
+		out = append(out, id)
 	}
 
 	if err := res.Err(); err != nil {
-		return nil, xerrors.Errorf("iterating providers: %w", err)
-	}
-
-	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
-	}
-
-	out := make([]dealProvider, 0, 14)
-	out = append(out, withHttp...)
-	out = append(out, withBitswap...)
-	out = append(out, random...)
-
-	// dedup
-	seen := make(map[int64]dealProvider)
-	for _, p := range out {
-		if _, ok := seen[p.id]; ok {
-			continue
-		}
-		seen[p.id] = p
-	}
-
-	out = make([]dealProvider, 0, 9)
-	for _, p := range seen {
-		out = append(out, p)
-		// trim to 9
-		if len(out) == 9 {
-			break
-		}
+		return nil, xerrors.Errorf("iterating groups: %w", err)
 	}
 
-	/*	out = []dealProvider{{
-		id:              2620,
-		ask_price:       0,
-		ask_verif_price: 0,
-	}}*/
-
-	fmt.Printf("SELECTED PROVIDERS: %#v\n", out)
-
 	return out, nil
 }
 
-func (r *ribsDB) GetNonFailedDealCount(group iface.GroupKey) (int, error) {
-	var count int
-	err := r.db.QueryRow(`select count(*) from deals where group_id = ? and failed = 0`, group).Scan(&count)
-	if err != nil {
-		return 0, xerrors.Errorf("querying deal count: %w", err)
-	}
-
-	return count, nil
-}
-
 type dbDealInfo struct {
 	DealUUID string
 	GroupID  iface.GroupKey
@@ -423,16 +528,26 @@ type dbDealInfo struct {
 	PricePerEpoch int64
 	Verified      bool
 	KeepUnsealed  bool
+	Offline       bool
+	TransferType  string
 
 	StartEpoch abi.ChainEpoch
 	EndEpoch   abi.ChainEpoch
 
+	DealPolicy         iface.DealPolicy
+	ProviderCollateral string
+
 	SignedProposalBytes []byte
 }
 
 func (r *ribsDB) StoreProposedDeal(d dbDealInfo) error {
-	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes) values
-                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes)
+	policy, err := json.Marshal(d.DealPolicy)
+	if err != nil {
+		return xerrors.Errorf("marshaling deal policy: %w", err)
+	}
+
+	_, err = r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, offline, transfer_type, start_epoch, end_epoch, deal_policy, provider_collateral, signed_proposal_bytes) values
+                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.Offline, d.TransferType, d.StartEpoch, d.EndEpoch, string(policy), d.ProviderCollateral, d.SignedProposalBytes)
 	if err != nil {
 		return xerrors.Errorf("inserting deal: %w", err)
 	}
@@ -444,8 +559,13 @@ func (r *ribsDB) StoreRejectedDeal(d dbDealInfo, emsg string) error {
 	failed, rejected := 1, 1
 	state := "Rejected"
 
-	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, failed, rejected, sp_status, error_msg) values
-                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes, failed, rejected, state, emsg)
+	policy, err := json.Marshal(d.DealPolicy)
+	if err != nil {
+		return xerrors.Errorf("marshaling deal policy: %w", err)
+	}
+
+	_, err = r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, offline, transfer_type, start_epoch, end_epoch, deal_policy, provider_collateral, signed_proposal_bytes, failed, rejected, sp_status, error_msg) values
+                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.Offline, d.TransferType, d.StartEpoch, d.EndEpoch, string(policy), d.ProviderCollateral, d.SignedProposalBytes, failed, rejected, state, emsg)
 	if err != nil {
 		return xerrors.Errorf("inserting deal: %w", err)
 	}
@@ -464,6 +584,7 @@ func (r *ribsDB) UpdateSPDealState(id uuid.UUID, stresp types.DealStatusResponse
 
 	_, err := r.db.Exec(`update deals set
 	failed = ?,
+	failed_at = case when ? then coalesce(failed_at, strftime('%s','now')) end,
 	sp_status = ?,
 	error_msg = ?,
 	sp_sealing_status = ?,
@@ -471,16 +592,54 @@ func (r *ribsDB) UpdateSPDealState(id uuid.UUID, stresp types.DealStatusResponse
 	sp_pub_msg_cid = ?,
 	sp_recv_bytes = ?,
 	sp_txsize = ?
-	where uuid = ?`, failed, stresp.DealStatus.Status, stresp.DealStatus.Error, stresp.DealStatus.SealingStatus,
+	where uuid = ?`, failed, failed, stresp.DealStatus.Status, stresp.DealStatus.Error, stresp.DealStatus.SealingStatus,
 		stresp.DealStatus.SignedProposalCid.String(), pubCid,
 		stresp.NBytesReceived, stresp.TransferSize, id)
 	if err != nil {
 		return xerrors.Errorf("update sp tracker: %w", err)
 	}
 
+	// deals failing before the data is transferred failed the fetch
+	if failed && stresp.DealStatus.Status == dealcheckpoints.Accepted.String() {
+		_, err = r.db.Exec(`update providers set http_transfer_failed_at = ?
+		where id = (select provider_addr from deals where uuid = ? and transfer_type = 'http' and offline = 0)`, time.Now().Unix(), id)
+		if err != nil {
+			return xerrors.Errorf("update provider http transfer failure: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// DealFailed tells whether a deal failed, deals not stored yet didn't
+func (r *ribsDB) DealFailed(dealUUID string) (bool, error) {
+	var failed bool
+	err := r.db.QueryRow(`select failed from deals where uuid = ?`, dealUUID).Scan(&failed)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, xerrors.Errorf("querying deal: %w", err)
+	}
+
+	return failed, nil
+}
+
+// HttpTransferFailedSince tells whether the provider failed fetching deal data
+// from the tcp car server after the given time
+func (r *ribsDB) HttpTransferFailedSince(provider int64, since time.Time) (bool, error) {
+	var failedAt int64
+	err := r.db.QueryRow(`select http_transfer_failed_at from providers where id = ?`, provider).Scan(&failedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, xerrors.Errorf("querying provider: %w", err)
+	}
+
+	return failedAt > since.Unix(), nil
+}
+
 type inactiveDealMeta struct {
 	DealUUID     string
 	ProviderAddr int64
@@ -576,7 +735,7 @@ func (r *ribsDB) PublishedDeals() ([]publishedDealMeta, error) {
 }
 
 func (r *ribsDB) UpdateActivatedDeal(id string, sectorStart abi.ChainEpoch) error {
-	_, err := r.db.Exec(`update deals set sector_start_epoch = ?, sealed = 1 where uuid = ?`, sectorStart, id)
+	_, err := r.db.Exec(`update deals set sector_start_epoch = ?, sealed = 1, sealed_at = strftime('%s','now') where uuid = ?`, sectorStart, id)
 	if err != nil {
 		return xerrors.Errorf("update activated deal: %w", err)
 	}
@@ -584,6 +743,496 @@ func (r *ribsDB) UpdateActivatedDeal(id string, sectorStart abi.ChainEpoch) erro
 	return nil
 }
 
+type unsealedDealMeta struct {
+	DealUUID string
+	// 0 when the deal wasn't published
+	DealID abi.DealID
+}
+
+// UnsealedDealsPastStart returns non-failed deals not seen sealed by the deal
+// tracker, with start epochs before the given epoch
+func (r *ribsDB) UnsealedDealsPastStart(before abi.ChainEpoch) ([]unsealedDealMeta, error) {
+	res, err := r.db.Query(`select uuid, coalesce(deal_id, 0) from deals where sealed = 0 and failed = 0 and start_epoch < ?`, before)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deals: %w", err)
+	}
+	defer res.Close()
+
+	var out []unsealedDealMeta
+	for res.Next() {
+		var dm unsealedDealMeta
+		if err := res.Scan(&dm.DealUUID, &dm.DealID); err != nil {
+			return nil, xerrors.Errorf("scanning deal: %w", err)
+		}
+		out = append(out, dm)
+	}
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating deals: %w", err)
+	}
+
+	return out, nil
+}
+
+// ExpireUnsealedDeal marks a deal which didn't seal before its start epoch as
+// failed, it can't be activated on chain anymore
+func (r *ribsDB) ExpireUnsealedDeal(id string) error {
+	_, err := r.db.Exec(`update deals set error_msg = 'not sealed before start epoch', failed = 1, failed_expired = 1, failed_at = strftime('%s','now')
+		where uuid = ? and sealed = 0 and failed = 0`, id)
+	if err != nil {
+		return xerrors.Errorf("expiring deal: %w", err)
+	}
+
+	return nil
+}
+
+type activeDealMeta struct {
+	DealUUID     string
+	ProviderAddr int64
+	GroupID      iface.GroupKey
+	DealID       abi.DealID
+	ClaimID      uint64
+	EndEpoch     abi.ChainEpoch
+}
+
+// ActiveDealsToCheck returns sealed, non-failed deals whose market state
+// wasn't checked since checkedBefore
+func (r *ribsDB) ActiveDealsToCheck(checkedBefore time.Time) ([]activeDealMeta, error) {
+	res, err := r.db.Query(`select uuid, provider_addr, group_id, deal_id, claim_id, end_epoch from deals where sealed = 1 and failed = 0 and deal_id is not null and last_deal_state_check < ?`, checkedBefore.Unix())
+	if err != nil {
+		return nil, xerrors.Errorf("querying deals: %w", err)
+	}
+	defer res.Close() // nolint
+
+	out := make([]activeDealMeta, 0)
+
+	for res.Next() {
+		var dm activeDealMeta
+		err := res.Scan(&dm.DealUUID, &dm.ProviderAddr, &dm.GroupID, &dm.DealID, &dm.ClaimID, &dm.EndEpoch)
+		if err != nil {
+			return nil, xerrors.Errorf("scanning deal: %w", err)
+		}
+
+		out = append(out, dm)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating deals: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) UpdateDealStateChecked(id string) error {
+	_, err := r.db.Exec(`update deals set last_deal_state_check = ? where uuid = ?`, time.Now().Unix(), id)
+	if err != nil {
+		return xerrors.Errorf("update deal state check: %w", err)
+	}
+
+	return nil
+}
+
+// MarkDealFailed marks an active deal as failed, e.g. when it was slashed or
+// expired on chain
+func (r *ribsDB) MarkDealFailed(id string, kind dealFailureKind, emsg string) error {
+	now := time.Now().Unix()
+	_, err := r.db.Exec(`update deals set failed = 1, failed_at = ?, failed_kind = ?, error_msg = ?, last_deal_state_check = ? where uuid = ?`, now, kind, emsg, now, id)
+	if err != nil {
+		return xerrors.Errorf("marking deal failed: %w", err)
+	}
+
+	return nil
+}
+
+type expiringDealMeta struct {
+	DealUUID     string
+	ProviderAddr int64
+	Verified     bool
+	EndEpoch     abi.ChainEpoch
+	Proposal     []byte
+
+	GroupID    iface.GroupKey
+	GroupState iface.GroupState
+
+	// unix timestamps
+	GroupCreatedAt   int64
+	GroupRetainUntil int64
+
+	// nil when the group uses the default policy
+	GroupDealPolicy *iface.DealPolicy
+}
+
+// ExpiringDeals returns healthy deals ending before the given epoch, for which
+// no replacements were requested yet
+func (r *ribsDB) ExpiringDeals(before abi.ChainEpoch) ([]expiringDealMeta, error) {
+	res, err := r.db.Query(`select d.uuid, d.provider_addr, d.verified, d.end_epoch, d.signed_proposal_bytes, g.id, g.g_state, g.created_at, g.retain_until, g.deal_policy
+		from deals d join groups g on g.id = d.group_id where d.sealed = 1 and d.failed = 0 and d.renewed = 0 and d.end_epoch < ?`, before)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deals: %w", err)
+	}
+	defer res.Close() // nolint
+
+	var out []expiringDealMeta
+	for res.Next() {
+		var dm expiringDealMeta
+		var policy sql.NullString
+		err := res.Scan(&dm.DealUUID, &dm.ProviderAddr, &dm.Verified, &dm.EndEpoch, &dm.Proposal, &dm.GroupID, &dm.GroupState, &dm.GroupCreatedAt, &dm.GroupRetainUntil, &policy)
+		if err != nil {
+			return nil, xerrors.Errorf("scanning deal: %w", err)
+		}
+
+		dm.GroupDealPolicy, err = parseDealPolicy(policy)
+		if err != nil {
+			return nil, xerrors.Errorf("group %d: %w", dm.GroupID, err)
+		}
+
+		out = append(out, dm)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating deals: %w", err)
+	}
+
+	return out, nil
+}
+
+// RecordEscrowTopUp adds a market escrow AddBalance message to the ledger,
+// pending until EscrowTopUpLanded
+func (r *ribsDB) RecordEscrowTopUp(amt abi.TokenAmount, msg cid.Cid) error {
+	_, err := r.db.Exec(`insert into escrow_ledger (kind, msg_cid, amount, msg_pending) values ('add_balance', ?, ?, 1)`, msg.String(), amt.String())
+	if err != nil {
+		return xerrors.Errorf("inserting ledger entry: %w", err)
+	}
+	return nil
+}
+
+type escrowTopUp struct {
+	Msg    cid.Cid
+	Amount abi.TokenAmount
+	Sent   time.Time
+}
+
+// PendingEscrowTopUps returns AddBalance messages not yet seen on chain
+func (r *ribsDB) PendingEscrowTopUps() ([]escrowTopUp, error) {
+	res, err := r.db.Query(`select msg_cid, amount, ts from escrow_ledger where kind = 'add_balance' and msg_pending = 1`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying ledger: %w", err)
+	}
+	defer res.Close() // nolint
+
+	var out []escrowTopUp
+	for res.Next() {
+		var ms, as string
+		var ts int64
+		if err := res.Scan(&ms, &as, &ts); err != nil {
+			return nil, xerrors.Errorf("scanning ledger entry: %w", err)
+		}
+
+		var tu escrowTopUp
+		if tu.Msg, err = cid.Parse(ms); err != nil {
+			return nil, xerrors.Errorf("parsing message cid: %w", err)
+		}
+		if tu.Amount, err = big.FromString(as); err != nil {
+			return nil, xerrors.Errorf("parsing ledger amount: %w", err)
+		}
+		tu.Sent = time.Unix(ts, 0)
+
+		out = append(out, tu)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating ledger: %w", err)
+	}
+
+	return out, nil
+}
+
+// EscrowTopUpLanded marks an AddBalance message as executed or given up on
+func (r *ribsDB) EscrowTopUpLanded(msg cid.Cid) error {
+	_, err := r.db.Exec(`update escrow_ledger set msg_pending = 0 where kind = 'add_balance' and msg_cid = ?`, msg.String())
+	if err != nil {
+		return xerrors.Errorf("updating ledger entry: %w", err)
+	}
+	return nil
+}
+
+// RecordDealSpending adds the client balance requirement of a deal to the
+// ledger, before the deal is proposed. Until the deal is stored the entry is
+// a reservation, counted for escrowReservationTimeout.
+func (r *ribsDB) RecordDealSpending(group iface.GroupKey, dealUUID string, amt abi.TokenAmount) error {
+	_, err := r.db.Exec(`insert into escrow_ledger (kind, group_id, deal_uuid, amount) values ('deal', ?, ?, ?)`, group, dealUUID, amt.String())
+	if err != nil {
+		return xerrors.Errorf("inserting ledger entry: %w", err)
+	}
+	return nil
+}
+
+// CancelDealSpending removes the ledger entry of a deal which wasn't made
+func (r *ribsDB) CancelDealSpending(dealUUID string) error {
+	_, err := r.db.Exec(`delete from escrow_ledger where kind = 'deal' and deal_uuid = ?`, dealUUID)
+	if err != nil {
+		return xerrors.Errorf("deleting ledger entry: %w", err)
+	}
+	return nil
+}
+
+// DealSpending sums deal spending since the given time, for one group or all
+// groups with UndefGroupKey. Deals failed before publishing aren't counted.
+func (r *ribsDB) DealSpending(group iface.GroupKey, since time.Time) (abi.TokenAmount, error) {
+	return r.sumLedger(`select l.amount from escrow_ledger l left join deals d on d.uuid = l.deal_uuid
+		where l.kind = 'deal' and l.ts >= ? and (? = -1 or l.group_id = ?) and not (coalesce(d.failed, 0) = 1 and coalesce(d.published, 0) = 0)
+		  and (d.uuid is not null or l.ts >= ?)`,
+		since.Unix(), group, group, time.Now().Add(-escrowReservationTimeout).Unix())
+}
+
+// PendingDealSpending sums spending of reserved and accepted deals which
+// aren't published yet, so their funds aren't locked in escrow
+func (r *ribsDB) PendingDealSpending() (abi.TokenAmount, error) {
+	return r.sumLedger(`select l.amount from escrow_ledger l left join deals d on d.uuid = l.deal_uuid
+		where l.kind = 'deal' and coalesce(d.published, 0) = 0 and coalesce(d.failed, 0) = 0
+		  and (d.uuid is not null or l.ts >= ?)`, time.Now().Add(-escrowReservationTimeout).Unix())
+}
+
+func (r *ribsDB) sumLedger(q string, args ...interface{}) (abi.TokenAmount, error) {
+	res, err := r.db.Query(q, args...)
+	if err != nil {
+		return big.Zero(), xerrors.Errorf("querying ledger: %w", err)
+	}
+	defer res.Close() // nolint
+
+	sum := big.Zero()
+	for res.Next() {
+		var as string
+		if err := res.Scan(&as); err != nil {
+			return big.Zero(), xerrors.Errorf("scanning ledger entry: %w", err)
+		}
+
+		amt, err := big.FromString(as)
+		if err != nil {
+			return big.Zero(), xerrors.Errorf("parsing ledger amount: %w", err)
+		}
+		sum = big.Add(sum, amt)
+	}
+
+	if err := res.Err(); err != nil {
+		return big.Zero(), xerrors.Errorf("iterating ledger: %w", err)
+	}
+
+	return sum, nil
+}
+
+// MarkDealRenewed excludes a deal from replica counts, so that replacement
+// deals get made
+func (r *ribsDB) MarkDealRenewed(id string) error {
+	_, err := r.db.Exec(`update deals set renewed = 1 where uuid = ?`, id)
+	if err != nil {
+		return xerrors.Errorf("marking deal renewed: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateDealClaimExtended records a verified claim extension, the deal is
+// tracked through the claim until the new term end
+func (r *ribsDB) UpdateDealClaimExtended(id string, claimID uint64, termEnd abi.ChainEpoch) error {
+	_, err := r.db.Exec(`update deals set claim_id = ?, end_epoch = ? where uuid = ?`, claimID, termEnd, id)
+	if err != nil {
+		return xerrors.Errorf("updating deal claim: %w", err)
+	}
+
+	return nil
+}
+
+// SetGroupRetention sets the unix timestamp until which group data is kept
+// on chain, 0 means the renewal policy default
+func (r *ribsDB) SetGroupRetention(id iface.GroupKey, until int64) error {
+	res, err := r.db.Exec(`update groups set retain_until = ? where id = ?`, until, id)
+	if err != nil {
+		return xerrors.Errorf("setting group retention: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return xerrors.Errorf("getting affected rows: %w", err)
+	}
+	if n == 0 {
+		return xerrors.Errorf("group %d not found", id)
+	}
+
+	return nil
+}
+
+// SetGroupRehydrating records whether an offloaded group is being rehydrated
+func (r *ribsDB) SetGroupRehydrating(id iface.GroupKey, rehydrating bool) error {
+	_, err := r.db.Exec(`update groups set rehydrating = ? where id = ?`, rehydrating, id)
+	if err != nil {
+		return xerrors.Errorf("setting group rehydrating: %w", err)
+	}
+
+	return nil
+}
+
+// RehydratingGroups returns groups with rehydration started and not done
+func (r *ribsDB) RehydratingGroups() (map[iface.GroupKey]bool, error) {
+	res, err := r.db.Query(`select id from groups where rehydrating = 1`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying rehydrating groups: %w", err)
+	}
+	defer res.Close()
+
+	out := map[iface.GroupKey]bool{}
+	for res.Next() {
+		var id iface.GroupKey
+		if err := res.Scan(&id); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
+		}
+		out[id] = true
+	}
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating groups: %w", err)
+	}
+
+	return out, nil
+}
+
+// SetGroupDealPolicy overrides the default deal policy for a group, nil
+// clears the override
+func (r *ribsDB) SetGroupDealPolicy(id iface.GroupKey, p *iface.DealPolicy) error {
+	var policy *string
+	if p != nil {
+		pb, err := json.Marshal(p)
+		if err != nil {
+			return xerrors.Errorf("marshaling deal policy: %w", err)
+		}
+		ps := string(pb)
+		policy = &ps
+	}
+
+	res, err := r.db.Exec(`update groups set deal_policy = ? where id = ?`, policy, id)
+	if err != nil {
+		return xerrors.Errorf("setting group deal policy: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return xerrors.Errorf("getting affected rows: %w", err)
+	}
+	if n == 0 {
+		return xerrors.Errorf("group %d not found", id)
+	}
+
+	return nil
+}
+
+func parseDealPolicy(s sql.NullString) (*iface.DealPolicy, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+
+	var p iface.DealPolicy
+	if err := json.Unmarshal([]byte(s.String), &p); err != nil {
+		return nil, xerrors.Errorf("unmarshaling deal policy: %w", err)
+	}
+	return &p, nil
+}
+
+// ProviderHistories returns deal outcomes, oldest first, and retrieval probe
+// counters of all providers ribs made deals with
+func (r *ribsDB) ProviderHistories() (map[int64]*providerHistory, error) {
+	res, err := r.db.Query(`select provider_addr, start_time, coalesce(sealed_at, 0), coalesce(failed_at, start_time), sealed, failed, rejected, coalesce(failed_kind, '') = ? from deals order by start_time asc`, dealFailureExpired)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deals: %w", err)
+	}
+	defer res.Close() // nolint
+
+	out := map[int64]*providerHistory{}
+	for res.Next() {
+		var prov int64
+		var d dealOutcome
+		if err := res.Scan(&prov, &d.Started, &d.SealedAt, &d.FailedAt, &d.Sealed, &d.Failed, &d.Rejected, &d.Expired); err != nil {
+			return nil, xerrors.Errorf("scanning deal: %w", err)
+		}
+
+		if out[prov] == nil {
+			out[prov] = &providerHistory{}
+		}
+		out[prov].Deals = append(out[prov].Deals, d)
+	}
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating deals: %w", err)
+	}
+
+	res, err = r.db.Query(`select id, retrprobe_success, retrprobe_fail from providers where retrprobe_success > 0 or retrprobe_fail > 0`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying providers: %w", err)
+	}
+	defer res.Close() // nolint
+
+	for res.Next() {
+		var prov, success, fail int64
+		if err := res.Scan(&prov, &success, &fail); err != nil {
+			return nil, xerrors.Errorf("scanning provider: %w", err)
+		}
+
+		if out[prov] == nil {
+			out[prov] = &providerHistory{}
+		}
+		out[prov].RetrSuccess, out[prov].RetrFail = success, fail
+	}
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating providers: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) UpdateProviderReputation(id int64, score float64, quarantinedUntil time.Time) error {
+	var qu int64
+	if !quarantinedUntil.IsZero() {
+		qu = quarantinedUntil.Unix()
+	}
+
+	_, err := r.db.Exec(`update providers set reputation = ?, quarantined_until = ? where id = ?`, score, qu, id)
+	if err != nil {
+		return xerrors.Errorf("updating provider reputation: %w", err)
+	}
+
+	return nil
+}
+
+type repairGroupMeta struct {
+	ID      iface.GroupKey
+	State   iface.GroupState
+	Healthy int
+}
+
+// GroupsBelowReplicaTarget returns groups with deals which have fewer than
+// target non-failed, non-renewed deals
+func (r *ribsDB) GroupsBelowReplicaTarget(target int) ([]repairGroupMeta, error) {
+	res, err := r.db.Query(`select g.id, g.g_state, (select count(*) from deals d where d.group_id = g.id and d.failed = 0 and d.renewed = 0) as healthy
+		from groups g where g.g_state in (?, ?, ?) and healthy < ?`,
+		iface.GroupStateDealsInProgress, iface.GroupStateDealsDone, iface.GroupStateOffloaded, target)
+	if err != nil {
+		return nil, xerrors.Errorf("querying groups: %w", err)
+	}
+	defer res.Close() // nolint
+
+	var out []repairGroupMeta
+	for res.Next() {
+		var gm repairGroupMeta
+		if err := res.Scan(&gm.ID, &gm.State, &gm.Healthy); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
+		}
+
+		out = append(out, gm)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating groups: %w", err)
+	}
+
+	return out, nil
+}
+
 func (r *ribsDB) GetWritableGroup() (selected iface.GroupKey, blocks, bytes int64, state iface.GroupState, err error) {
 	res, err := r.db.Query("select id, blocks, bytes, g_state from groups where g_state = 0")
 	if err != nil {
@@ -611,8 +1260,49 @@ func (r *ribsDB) GetWritableGroup() (selected iface.GroupKey, blocks, bytes int6
 	return selectedGroup, blocks, bytes, state, nil
 }
 
+type writableGroupMeta struct {
+	ID     iface.GroupKey
+	Blocks int64
+
+	CreatedAt   time.Time
+	LastWriteAt time.Time
+}
+
+func (r *ribsDB) WritableGroups() ([]writableGroupMeta, error) {
+	res, err := r.db.Query("select id, blocks, created_at, last_write_at from groups where g_state = 0")
+	if err != nil {
+		return nil, xerrors.Errorf("finding writable groups: %w", err)
+	}
+
+	var out []writableGroupMeta
+	for res.Next() {
+		var gm writableGroupMeta
+		var created, lastWrite int64
+		if err := res.Scan(&gm.ID, &gm.Blocks, &created, &lastWrite); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
+		}
+
+		gm.CreatedAt = time.Unix(created, 0)
+		gm.LastWriteAt = time.Unix(lastWrite, 0)
+		if lastWrite == 0 {
+			gm.LastWriteAt = gm.CreatedAt
+		}
+
+		out = append(out, gm)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating groups: %w", err)
+	}
+	if err := res.Close(); err != nil {
+		return nil, xerrors.Errorf("closing group iterator: %w", err)
+	}
+
+	return out, nil
+}
+
 func (r *ribsDB) CreateGroup() (out iface.GroupKey, err error) {
-	err = r.db.QueryRow("insert into groups (blocks, bytes, g_state, jb_recorded_head) values (0, 0, 0, 0) returning id").Scan(&out)
+	err = r.db.QueryRow("insert into groups (blocks, bytes, g_state, jb_recorded_head, created_at) values (0, 0, 0, 0, strftime('%s','now')) returning id").Scan(&out)
 	if err != nil {
 		return iface.UndefGroupKey, xerrors.Errorf("creating group entry: %w", err)
 	}
@@ -683,7 +1373,7 @@ func (r *ribsDB) GroupStates() (gs map[iface.GroupKey]iface.GroupState, err erro
 
 func (r *ribsDB) SetGroupHead(ctx context.Context, id iface.GroupKey, state iface.GroupState, commBlk, commSz, at int64) error {
 	_, err := r.db.ExecContext(ctx, `begin transaction;
-		update groups set blocks = ?, bytes = ?, g_state = ?, jb_recorded_head = ? where id = ?;
+		update groups set blocks = ?, bytes = ?, g_state = ?, jb_recorded_head = ?, last_write_at = strftime('%s','now') where id = ?;
 		commit;`, commBlk, commSz, state, at, id)
 	if err != nil {
 		return xerrors.Errorf("update group head: %w", err)
@@ -716,10 +1406,17 @@ type dealParams struct {
 	Root      cid.Cid
 	PieceSize int64
 	CarSize   int64
+
+	// unix timestamps
+	CreatedAt   int64
+	RetainUntil int64
+
+	// nil when the group uses the default policy
+	DealPolicy *iface.DealPolicy
 }
 
 func (r *ribsDB) GetDealParams(ctx context.Context, id iface.GroupKey) (out dealParams, err error) {
-	res, err := r.db.QueryContext(ctx, "select commp, root, piece_size, car_size from groups where id = ?", id)
+	res, err := r.db.QueryContext(ctx, "select commp, root, piece_size, car_size, created_at, retain_until, deal_policy from groups where id = ?", id)
 	if err != nil {
 		return dealParams{}, xerrors.Errorf("finding writable groups: %w", err)
 	}
@@ -729,11 +1426,17 @@ func (r *ribsDB) GetDealParams(ctx context.Context, id iface.GroupKey) (out deal
 	for res.Next() {
 		var commp, root []byte
 		var pieceSize, carSize int64
-		err := res.Scan(&commp, &root, &pieceSize, &carSize)
+		var policy sql.NullString
+		err := res.Scan(&commp, &root, &pieceSize, &carSize, &out.CreatedAt, &out.RetainUntil, &policy)
 		if err != nil {
 			return dealParams{}, xerrors.Errorf("scanning group: %w", err)
 		}
 
+		out.DealPolicy, err = parseDealPolicy(policy)
+		if err != nil {
+			return dealParams{}, err
+		}
+
 		out.CommP = commp
 		_, out.Root, err = cid.CidFromBytes(root)
 		out.PieceSize = pieceSize
@@ -823,7 +1526,7 @@ func (r *ribsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 
 	var dealMeta []iface.DealMeta
 
-	res, err = r.db.Query("select uuid, provider_addr, sealed, failed, rejected, sp_status, sp_sealing_status, error_msg, sp_recv_bytes, sp_txsize, sp_pub_msg_cid from deals where group_id = ?", gk)
+	res, err = r.db.Query("select uuid, provider_addr, sealed, failed, rejected, sp_status, sp_sealing_status, error_msg, sp_recv_bytes, sp_txsize, sp_pub_msg_cid, offline from deals where group_id = ?", gk)
 	if err != nil {
 		return iface.GroupMeta{}, xerrors.Errorf("getting group meta: %w", err)
 	}
@@ -838,8 +1541,9 @@ func (r *ribsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 		var bytesRecv *int64
 		var txSize *int64
 		var pubCid *string
+		var offline bool
 
-		err := res.Scan(&dealUuid, &provider, &sealed, &failed, &rejected, &status, &sealStatus, &errMsg, &bytesRecv, &txSize, &pubCid)
+		err := res.Scan(&dealUuid, &provider, &sealed, &failed, &rejected, &status, &sealStatus, &errMsg, &bytesRecv, &txSize, &pubCid, &offline)
 		if err != nil {
 			return iface.GroupMeta{}, xerrors.Errorf("scanning deal: %w", err)
 		}
@@ -857,6 +1561,7 @@ func (r *ribsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 			BytesRecv: derefOr(bytesRecv, 0),
 			TxSize:    derefOr(txSize, 0),
 			PubCid:    derefOr(pubCid, ""),
+			Offline:   offline,
 		})
 	}
 
@@ -875,9 +1580,6 @@ func (r *ribsDB) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 	return iface.GroupMeta{
 		State: state,
 
-		MaxBlocks: maxGroupBlocks,
-		MaxBytes:  maxGroupSize,
-
 		Blocks: blocks,
 		Bytes:  bytes,
 
@@ -933,9 +1635,18 @@ func (r *ribsDB) UpsertMarketActors(actors []int64) error {
 }
 
 func (r *ribsDB) UpdateProviderProtocols(provider int64, pres providerResult) error {
-	_, err := r.db.Exec(`
-	update providers set ping_ok = ?, boost_deals = ?, booster_http = ?, booster_bitswap = ? where id = ?;
-	`, pres.PingOk, pres.BoostDeals, pres.BoosterHttp, pres.BoosterBitswap, provider)
+	httpURLs, err := json.Marshal(nonNil(pres.HttpURLs))
+	if err != nil {
+		return xerrors.Errorf("marshal http urls: %w", err)
+	}
+	bitswapAddrs, err := json.Marshal(nonNil(pres.BitswapAddrs))
+	if err != nil {
+		return xerrors.Errorf("marshal bitswap addrs: %w", err)
+	}
+
+	_, err = r.db.Exec(`
+	update providers set ping_ok = ?, boost_deals = ?, booster_http = ?, booster_bitswap = ?, booster_http_urls = ?, booster_bitswap_addrs = ? where id = ?;
+	`, pres.PingOk, pres.BoostDeals, pres.BoosterHttp, pres.BoosterBitswap, string(httpURLs), string(bitswapAddrs), provider)
 	if err != nil {
 		return xerrors.Errorf("update provider: %w", err)
 	}
@@ -943,6 +1654,136 @@ func (r *ribsDB) UpdateProviderProtocols(provider int64, pres providerResult) er
 	return nil
 }
 
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+type retrievalCandidate struct {
+	id int64
+
+	httpURLs     []string
+	bitswapAddrs []string
+}
+
+// RetrievalCandidates returns providers with sealed deals for the group which
+// serve retrievals, best retrieval success ratio first
+func (r *ribsDB) RetrievalCandidates(group iface.GroupKey) ([]retrievalCandidate, error) {
+	res, err := r.db.Query(`select id, booster_http_urls, booster_bitswap_addrs from providers
+		where id in (select provider_addr from deals where group_id = ? and sealed = 1 and failed = 0)
+		  and (booster_http = 1 or booster_bitswap = 1)
+		order by (retrprobe_success + 1.0) / (retrprobe_success + retrprobe_fail + 2.0) desc, random()`, group)
+	if err != nil {
+		return nil, xerrors.Errorf("querying retrieval candidates: %w", err)
+	}
+
+	var out []retrievalCandidate
+	for res.Next() {
+		var rc retrievalCandidate
+		var httpURLs, bitswapAddrs string
+		if err := res.Scan(&rc.id, &httpURLs, &bitswapAddrs); err != nil {
+			return nil, xerrors.Errorf("scanning provider: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(httpURLs), &rc.httpURLs); err != nil {
+			return nil, xerrors.Errorf("unmarshal http urls: %w", err)
+		}
+		if err := json.Unmarshal([]byte(bitswapAddrs), &rc.bitswapAddrs); err != nil {
+			return nil, xerrors.Errorf("unmarshal bitswap addrs: %w", err)
+		}
+
+		out = append(out, rc)
+	}
+
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating providers: %w", err)
+	}
+	if err := res.Close(); err != nil {
+		return nil, xerrors.Errorf("closing providers: %w", err)
+	}
+
+	return out, nil
+}
+
+// SealedDealProposal returns the signed proposal of a sealed deal with the
+// provider for the group
+func (r *ribsDB) SealedDealProposal(group iface.GroupKey, provider int64) ([]byte, error) {
+	var out []byte
+	err := r.db.QueryRow(`select signed_proposal_bytes from deals where group_id = ? and provider_addr = ? and sealed = 1 and failed = 0 limit 1`, group, provider).Scan(&out)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deal proposal: %w", err)
+	}
+
+	return out, nil
+}
+
+// RecordTransfer stores a served car request
+func (r *ribsDB) RecordTransfer(dealUUID string, group iface.GroupKey, t iface.TransferInfo) error {
+	var emsg *string
+	if t.Error != "" {
+		emsg = &t.Error
+	}
+
+	_, err := r.db.Exec(`insert into transfers (deal_uuid, group_id, peer, range_start, range_length, bytes_sent, started_at, duration_ms, outcome, error)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		dealUUID, group, t.Peer, t.RangeStart, t.RangeLength, t.BytesSent, t.Started.UnixMilli(), t.Duration.Milliseconds(), t.Outcome, emsg)
+	if err != nil {
+		return xerrors.Errorf("insert transfer: %w", err)
+	}
+
+	return nil
+}
+
+// DealTransfers returns car requests served for a deal, oldest first
+func (r *ribsDB) DealTransfers(dealUUID string) ([]iface.TransferInfo, error) {
+	res, err := r.db.Query(`select peer, range_start, range_length, bytes_sent, started_at, duration_ms, outcome, error
+		from transfers where deal_uuid = ? order by id`, dealUUID)
+	if err != nil {
+		return nil, xerrors.Errorf("querying transfers: %w", err)
+	}
+	defer res.Close()
+
+	var out []iface.TransferInfo
+	for res.Next() {
+		var t iface.TransferInfo
+		var started, durMs int64
+		var emsg sql.NullString
+		if err := res.Scan(&t.Peer, &t.RangeStart, &t.RangeLength, &t.BytesSent, &started, &durMs, &t.Outcome, &emsg); err != nil {
+			return nil, xerrors.Errorf("scanning transfer: %w", err)
+		}
+		t.Started = time.UnixMilli(started)
+		t.Duration = time.Duration(durMs) * time.Millisecond
+		t.Error = emsg.String
+		out = append(out, t)
+	}
+	if err := res.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating transfers: %w", err)
+	}
+
+	return out, nil
+}
+
+// RecordRetrieval updates provider retrieval stats
+func (r *ribsDB) RecordRetrieval(provider int64, success bool, blocks, bytes int64) error {
+	var ok, fail int
+	if success {
+		ok = 1
+	} else {
+		fail = 1
+	}
+
+	_, err := r.db.Exec(`update providers set retrprobe_success = retrprobe_success + ?, retrprobe_fail = retrprobe_fail + ?,
+		retrprobe_blocks = retrprobe_blocks + ?, retrprobe_bytes = retrprobe_bytes + ? where id = ?`,
+		ok, fail, blocks, bytes, provider)
+	if err != nil {
+		return xerrors.Errorf("update provider retrieval stats: %w", err)
+	}
+
+	return nil
+}
+
 func (r *ribsDB) UpdateProviderStorageAsk(provider int64, ask *storagemarket.StorageAsk) error {
 	_, err := r.db.Exec(`
 	update providers set ask_price = ?, ask_verif_price = ?, ask_min_piece_size = ?, ask_max_piece_size = ?, ask_ok = 1 where id = ?;
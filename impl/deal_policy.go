@@ -0,0 +1,126 @@
+package impl
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/lotus/api"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+const epochDuration = time.Duration(builtin.EpochDurationSeconds) * time.Second
+
+// drives need to be shipped and imported before offline deals start
+const defaultOfflineStartDelay = 14 * 24 * time.Hour
+
+func defaultDealPolicy() iface.DealPolicy {
+	return iface.DealPolicy{
+		MinDuration:          400 * 24 * time.Hour,
+		MaxDuration:          400 * 24 * time.Hour,
+		MinStartDelay:        2 * 24 * time.Hour,
+		MaxStartDelay:        2 * 24 * time.Hour,
+		OfflineStartDelay:    defaultOfflineStartDelay,
+		CollateralMultiplier: 1.2,
+		KeepUnsealed:         true,
+	}
+}
+
+// WithDealPolicy sets the default terms of new deals, see
+// Admin.SetGroupDealPolicy for per-group overrides
+func WithDealPolicy(p iface.DealPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.dealPolicy = &p
+	}
+}
+
+func validateDealPolicy(p iface.DealPolicy) error {
+	minDur, maxDur := market.DealDurationBounds(0)
+
+	switch {
+	case p.MinDuration > p.MaxDuration:
+		return xerrors.Errorf("min duration above max duration")
+	case toEpochs(p.MinDuration) < minDur:
+		return xerrors.Errorf("min duration must be at least %d epochs", minDur)
+	case toEpochs(p.MaxDuration) > maxDur:
+		return xerrors.Errorf("max duration must be at most %d epochs", maxDur)
+	case p.MinStartDelay <= 0 || p.MinStartDelay > p.MaxStartDelay:
+		return xerrors.Errorf("start delay range must be positive and ordered")
+	case p.OfflineStartDelay < 0:
+		return xerrors.Errorf("negative offline start delay")
+	case p.CollateralMultiplier < 1:
+		return xerrors.Errorf("collateral multiplier must be at least 1")
+	case p.MaxPrice < 0:
+		return xerrors.Errorf("negative max price")
+	}
+	return nil
+}
+
+func toEpochs(d time.Duration) abi.ChainEpoch {
+	return abi.ChainEpoch(d / epochDuration)
+}
+
+// startDelay is scaled with the piece size, bigger pieces take longer to
+// transfer and seal. Offline deals wait for data to be shipped instead.
+func dealStartDelay(p iface.DealPolicy, pieceSize abi.PaddedPieceSize, offline bool) abi.ChainEpoch {
+	if offline {
+		// unset in policies stored before offline deals
+		if p.OfflineStartDelay == 0 {
+			return toEpochs(defaultOfflineStartDelay)
+		}
+		return toEpochs(p.OfflineStartDelay)
+	}
+
+	frac := float64(pieceSize) / float64(maxPieceSize)
+	if frac > 1 {
+		frac = 1
+	}
+
+	return toEpochs(p.MinStartDelay + time.Duration(frac*float64(p.MaxStartDelay-p.MinStartDelay)))
+}
+
+// dealDuration covers group retention within the policy range, zero
+// retainUntil means the group is kept forever
+func dealDuration(p iface.DealPolicy, start time.Time, retainUntil time.Time) abi.ChainEpoch {
+	d := p.MaxDuration
+	if !retainUntil.IsZero() && retainUntil.Sub(start) < d {
+		d = retainUntil.Sub(start)
+		if d < p.MinDuration {
+			d = p.MinDuration
+		}
+	}
+
+	return toEpochs(d)
+}
+
+// dealCollateral applies the policy multiplier to the market minimum, capped
+// at the market maximum
+func dealCollateral(p iface.DealPolicy, bounds api.DealCollateralBounds) abi.TokenAmount {
+	c := big.Div(big.Mul(bounds.Min, big.NewInt(int64(p.CollateralMultiplier*1000))), big.NewInt(1000))
+	if c.GreaterThan(bounds.Max) {
+		return bounds.Max
+	}
+	return c
+}
+
+// checkDealPiece makes sure the provider ask accepts the piece
+func checkDealPiece(prov ProviderCandidate, pieceSize abi.PaddedPieceSize) error {
+	if int64(pieceSize) < prov.AskMinPieceSize || int64(pieceSize) > prov.AskMaxPieceSize {
+		return xerrors.Errorf("piece size %d outside of provider ask range %d-%d", pieceSize, prov.AskMinPieceSize, prov.AskMaxPieceSize)
+	}
+	return nil
+}
+
+func (r *ribs) SetGroupDealPolicy(ctx context.Context, gk iface.GroupKey, p *iface.DealPolicy) error {
+	if p != nil {
+		if err := validateDealPolicy(*p); err != nil {
+			return xerrors.Errorf("invalid deal policy: %w", err)
+		}
+	}
+
+	return r.db.SetGroupDealPolicy(gk, p)
+}
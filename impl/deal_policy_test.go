@@ -0,0 +1,100 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealPolicy(t *testing.T) {
+	day := 24 * time.Hour
+
+	p := defaultDealPolicy()
+	require.NoError(t, validateDealPolicy(p))
+
+	bad := p
+	bad.MinDuration = 100 * day
+	require.Error(t, validateDealPolicy(bad))
+	bad = p
+	bad.MaxDuration = 600 * day
+	require.Error(t, validateDealPolicy(bad))
+	bad = p
+	bad.CollateralMultiplier = 0.5
+	require.Error(t, validateDealPolicy(bad))
+	bad = p
+	bad.MinStartDelay = 3 * day
+	require.Error(t, validateDealPolicy(bad))
+	bad = p
+	bad.OfflineStartDelay = -day
+	require.Error(t, validateDealPolicy(bad))
+
+	// start delay scales with piece size
+	p.MinStartDelay, p.MaxStartDelay = day, 3*day
+	require.Equal(t, toEpochs(day), dealStartDelay(p, 0, false))
+	require.Equal(t, toEpochs(2*day), dealStartDelay(p, abi.PaddedPieceSize(maxPieceSize/2), false))
+	require.Equal(t, toEpochs(3*day), dealStartDelay(p, abi.PaddedPieceSize(2*maxPieceSize), false))
+
+	// offline deals wait for shipped data
+	require.Equal(t, toEpochs(defaultOfflineStartDelay), dealStartDelay(p, 0, true))
+	p.OfflineStartDelay = 30 * day
+	require.Equal(t, toEpochs(30*day), dealStartDelay(p, abi.PaddedPieceSize(maxPieceSize), true))
+	p.OfflineStartDelay = 0
+	require.Equal(t, toEpochs(defaultOfflineStartDelay), dealStartDelay(p, 0, true))
+
+	// duration covers retention within range
+	p.MinDuration, p.MaxDuration = 200*day, 500*day
+	now := time.Now()
+	require.Equal(t, toEpochs(500*day), dealDuration(p, now, time.Time{}))
+	require.Equal(t, toEpochs(300*day), dealDuration(p, now, now.Add(300*day)))
+	require.Equal(t, toEpochs(200*day), dealDuration(p, now, now.Add(10*day)))
+
+	bounds := api.DealCollateralBounds{Min: big.NewInt(1000), Max: big.NewInt(1500)}
+	require.Equal(t, big.NewInt(1200), dealCollateral(p, bounds))
+	p.CollateralMultiplier = 2
+	require.Equal(t, big.NewInt(1500), dealCollateral(p, bounds))
+
+	prov := ProviderCandidate{AskMinPieceSize: 1 << 20, AskMaxPieceSize: 1 << 30}
+	require.NoError(t, checkDealPiece(prov, 1<<20))
+	require.Error(t, checkDealPiece(prov, 2<<30))
+}
+
+func TestGroupDealPolicy(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	gk, err := db.CreateGroup()
+	require.NoError(t, err)
+	require.NoError(t, db.SetCommP(context.Background(), gk, iface.GroupStateHasCommp, []byte{1}, 1<<20, cid.MustParse("bafkqaaa"), 1000))
+
+	dp, err := db.GetDealParams(context.Background(), gk)
+	require.NoError(t, err)
+	require.Nil(t, dp.DealPolicy)
+
+	p := defaultDealPolicy()
+	p.MaxPrice = 10
+	require.NoError(t, db.SetGroupDealPolicy(gk, &p))
+	require.Error(t, db.SetGroupDealPolicy(gk+1, &p))
+
+	dp, err = db.GetDealParams(context.Background(), gk)
+	require.NoError(t, err)
+	require.Equal(t, &p, dp.DealPolicy)
+
+	require.NoError(t, db.SetGroupDealPolicy(gk, nil))
+	dp, err = db.GetDealParams(context.Background(), gk)
+	require.NoError(t, err)
+	require.Nil(t, dp.DealPolicy)
+
+	// policy price limits apply to any selector
+	table := fakeProviderTable{{ID: 1, AskPrice: 5, AskMaxPieceSize: 1 << 30}, {ID: 2, AskPrice: 50, AskMaxPieceSize: 1 << 30}}
+	sel := &WeightedSelector{MaxPrice: 100}
+	ps, err := selectDealProviders(context.Background(), table, sel, DealRequest{Group: gk, PieceSize: 1 << 20, MaxPrice: 10})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1}, selectedIDs(ps))
+}
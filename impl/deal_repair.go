@@ -0,0 +1,268 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
+	types2 "github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var (
+	DealRepairInterval = 30 * time.Minute
+
+	// how often market state of each active deal is re-checked
+	dealStateCheckInterval = 24 * time.Hour
+
+	// epochs past the start epoch after which deals not seen sealed are
+	// checked on chain, and expired if they didn't activate
+	dealExpireMargin abi.ChainEpoch = 10
+)
+
+// dealNotFoundErr starts the error lotus returns for deals which aren't in
+// market state, see stmgr.GetStorageDeal
+const dealNotFoundErr = "deal %d not found - deal may not have completed sealing"
+
+// isDealNotFound tells deals missing from market state apart from failed
+// requests, which may mention something not being found too
+func isDealNotFound(err error, id abi.DealID) bool {
+	return strings.Contains(err.Error(), fmt.Sprintf(dealNotFoundErr, id))
+}
+
+// dealRepairWorker periodically checks deals of groups with deals against the
+// chain, and restores targetReplicaCount when deals fail, expire or get
+// slashed
+func (r *ribs) dealRepairWorker(ctx context.Context) {
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(DealRepairInterval):
+		}
+
+		if err := r.repairDeals(ctx); err != nil {
+			log.Errorw("deal repair failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) repairDeals(ctx context.Context) error {
+	gw := r.chain
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	/* UNSEALED DEALS */
+	/* Deals which didn't seal before start epoch will never activate */
+
+	if err := r.expireUnsealedDeals(ctx, gw, head); err != nil {
+		return xerrors.Errorf("expiring unsealed deals: %w", err)
+	}
+
+	/* ACTIVE DEALS */
+	/* Make sure sealed deals are still healthy on chain */
+
+	if err := r.checkActiveDeals(ctx, gw, head); err != nil {
+		return xerrors.Errorf("checking active deals: %w", err)
+	}
+
+	/* REPAIR */
+
+	groups, err := r.db.GroupsBelowReplicaTarget(targetReplicaCount)
+	if err != nil {
+		return xerrors.Errorf("getting groups to repair: %w", err)
+	}
+
+	for _, gm := range groups {
+		log.Warnw("repairing group deals", "group", gm.ID, "state", gm.State, "healthy", gm.Healthy, "target", targetReplicaCount)
+
+		if gm.State == iface.GroupStateOffloaded {
+			// deals need local data, bring it back first, once rehydrated the
+			// group is repaired like any other
+			if err := r.RehydrateGroup(ctx, gm.ID); err != nil {
+				log.Errorw("starting rehydration for deal repair", "group", gm.ID, "error", err)
+			}
+			continue
+		}
+
+		// MakeMoreDeals only selects providers which don't have deals for the
+		// group yet
+		if err := r.requestMoreDeals(gm.ID); err != nil {
+			log.Errorw("requesting deals for repair", "group", gm.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// requestMoreDeals queues a MakeMoreDeals task for the group
+func (r *ribs) requestMoreDeals(gk iface.GroupKey) error {
+	// make sure the group is open, task workers only work on open groups
+	if err := r.withReadableGroup(gk, func(g *Group) error {
+		return nil
+	}); err != nil {
+		return xerrors.Errorf("opening group: %w", err)
+	}
+
+	go func() {
+		r.tasks <- task{
+			tt:    taskTypeMakeMoreDeals,
+			group: gk,
+		}
+	}()
+
+	return nil
+}
+
+// expireUnsealedDeals fails deals which didn't activate by their start epoch.
+// The local sealed flag is only updated periodically by the deal tracker, so
+// published deals are checked in market state first.
+func (r *ribs) expireUnsealedDeals(ctx context.Context, gw ChainAPI, head *types2.TipSet) error {
+	deals, err := r.db.UnsealedDealsPastStart(head.Height() - dealExpireMargin)
+	if err != nil {
+		return xerrors.Errorf("get unsealed deals: %w", err)
+	}
+
+	var expired int
+	for _, deal := range deals {
+		if deal.DealID != 0 {
+			dealInfo, err := gw.StateMarketStorageDeal(ctx, deal.DealID, head.Key())
+			switch {
+			case err != nil && isDealNotFound(err, deal.DealID):
+				// never activated, or already gone; checkActiveDeals handles
+				// deals which activated
+			case err != nil:
+				log.Errorw("checking unsealed deal state", "deal", deal.DealUUID, "dealid", deal.DealID, "error", err)
+				continue
+			case dealInfo.State.SectorStartEpoch > 0:
+				if err := r.db.UpdateActivatedDeal(deal.DealUUID, dealInfo.State.SectorStartEpoch); err != nil {
+					return xerrors.Errorf("marking deal as active: %w", err)
+				}
+				continue
+			}
+		}
+
+		if err := r.db.ExpireUnsealedDeal(deal.DealUUID); err != nil {
+			return err
+		}
+		expired++
+	}
+
+	if expired > 0 {
+		log.Warnw("deals expired before sealing", "count", expired, "head", head.Height())
+	}
+
+	return nil
+}
+
+func (r *ribs) checkActiveDeals(ctx context.Context, gw ChainAPI, head *types2.TipSet) error {
+	toCheck, err := r.db.ActiveDealsToCheck(time.Now().Add(-dealStateCheckInterval))
+	if err != nil {
+		return xerrors.Errorf("get active deals: %w", err)
+	}
+
+	var vst verifreg.State
+
+	for _, deal := range toCheck {
+		var kind dealFailureKind
+		var failure string
+
+		if deal.ClaimID != 0 {
+			// deals with extended claims outlive their market deal, the claim
+			// is what keeps the data stored
+			if vst == nil {
+				vst, err = loadVerifregState(ctx, gw, head.Key())
+				if err != nil {
+					return xerrors.Errorf("loading verifreg state: %w", err)
+				}
+			}
+
+			kind, failure, err = claimFailure(vst, head.Height(), deal)
+		} else {
+			kind, failure, err = marketDealFailure(ctx, gw, head, deal)
+		}
+		if err != nil {
+			log.Errorw("checking deal state", "deal", deal.DealUUID, "dealid", deal.DealID, "error", err)
+			continue
+		}
+
+		if kind == "" {
+			if err := r.db.UpdateDealStateChecked(deal.DealUUID); err != nil {
+				return xerrors.Errorf("updating deal state check: %w", err)
+			}
+			continue
+		}
+
+		log.Warnw("active deal failed", "deal", deal.DealUUID, "dealid", deal.DealID, "provider", deal.ProviderAddr, "group", deal.GroupID, "kind", kind, "reason", failure)
+
+		if err := r.db.MarkDealFailed(deal.DealUUID, kind, failure); err != nil {
+			return xerrors.Errorf("marking deal failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// dealFailureKind is why an active deal failed, deals which ran until their
+// end epoch aren't held against the provider
+type dealFailureKind string
+
+const (
+	dealFailureSlashed dealFailureKind = "slashed"
+	dealFailureExpired dealFailureKind = "expired"
+
+	// gone from chain state before the deal ended
+	dealFailureMissing dealFailureKind = "missing"
+)
+
+// marketDealFailure returns why a deal isn't healthy in market state, or an
+// empty kind for healthy deals
+func marketDealFailure(ctx context.Context, gw ChainAPI, head *types2.TipSet, deal activeDealMeta) (dealFailureKind, string, error) {
+	dealInfo, err := gw.StateMarketStorageDeal(ctx, deal.DealID, head.Key())
+	switch {
+	case err != nil && isDealNotFound(err, deal.DealID):
+		// deals are removed from market state when they expire or get slashed
+		if deal.EndEpoch <= head.Height() {
+			return dealFailureExpired, fmt.Sprintf("deal expired at epoch %d", deal.EndEpoch), nil
+		}
+		return dealFailureMissing, "deal not found in market state", nil
+	case err != nil:
+		return "", "", xerrors.Errorf("get deal info: %w", err)
+	case dealInfo.State.SlashEpoch > -1:
+		return dealFailureSlashed, fmt.Sprintf("deal slashed at epoch %d", dealInfo.State.SlashEpoch), nil
+	case dealInfo.Proposal.EndEpoch <= head.Height():
+		return dealFailureExpired, fmt.Sprintf("deal expired at epoch %d", dealInfo.Proposal.EndEpoch), nil
+	}
+
+	return "", "", nil
+}
+
+func claimFailure(vst verifreg.State, head abi.ChainEpoch, deal activeDealMeta) (dealFailureKind, string, error) {
+	maddr, err := address.NewIDAddress(uint64(deal.ProviderAddr))
+	if err != nil {
+		return "", "", xerrors.Errorf("new id address: %w", err)
+	}
+
+	claim, found, err := vst.GetClaim(maddr, verifregtypes.ClaimId(deal.ClaimID))
+	if err != nil {
+		return "", "", xerrors.Errorf("get claim: %w", err)
+	}
+
+	switch {
+	case !found:
+		return dealFailureMissing, fmt.Sprintf("claim %d not found in verifreg state", deal.ClaimID), nil
+	case claim.TermStart+claim.TermMax <= head:
+		return dealFailureExpired, fmt.Sprintf("claim %d expired at epoch %d", deal.ClaimID, claim.TermStart+claim.TermMax), nil
+	}
+
+	return "", "", nil
+}
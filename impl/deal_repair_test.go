@@ -0,0 +1,522 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// testDeal is a deal row inserted directly, without going through deal making
+type testDeal struct {
+	UUID     string
+	Group    iface.GroupKey
+	Provider int64
+
+	// 0 for deals which weren't published
+	DealID abi.DealID
+
+	StartEpoch, EndEpoch abi.ChainEpoch
+	Sealed, Verified     bool
+
+	// signed proposal bytes, a placeholder when nil
+	Proposal []byte
+}
+
+func insertTestDeal(t *testing.T, db *ribsDB, d testDeal) {
+	prop := d.Proposal
+	if prop == nil {
+		prop = []byte{0}
+	}
+
+	var dealID *abi.DealID
+	if d.DealID != 0 {
+		dealID = &d.DealID
+	}
+
+	_, err := db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, sealed, deal_id)
+		values (?, 'f01', ?, ?, 0, ?, 1, ?, ?, ?, ?, ?)`, d.UUID, d.Provider, d.Group, d.Verified, d.StartEpoch, d.EndEpoch, prop, d.Sealed, dealID)
+	require.NoError(t, err)
+}
+
+// testChainRibs returns ribs with what deal repair and renewal need, backed by
+// the mock chain, and the default wallet address
+func testChainRibs(t *testing.T, mc *MockChain) (*ribs, address.Address) {
+	root := t.TempDir()
+
+	db, err := openRibsDB(root)
+	require.NoError(t, err)
+
+	w, err := ributil.OpenWallet(filepath.Join(root, "wallet"))
+	require.NoError(t, err)
+	client, err := w.WalletNew(context.Background(), types.KTSecp256k1)
+	require.NoError(t, err)
+	require.NoError(t, w.SetDefault(client))
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	r := &ribs{
+		root:   root,
+		db:     db,
+		index:  NewIndex(db.db),
+		wallet: w,
+		sender: &messageSender{wallet: w},
+		chain:  mc,
+
+		rehydratePolicy: RehydratePolicy{BytesPerSecond: 10 << 20},
+		renewalPolicy:   defaultRenewalPolicy(),
+
+		groupOpts: groupOptions{
+			sizing:     defaultGroupSizePolicy(),
+			dealPolicy: defaultDealPolicy(),
+		},
+
+		writableGroups: map[iface.GroupKey]*Group{},
+		openGroups:     map[iface.GroupKey]*Group{},
+
+		rehydrating: map[iface.GroupKey]*iface.RehydrateProgress{},
+		remoteReads: map[iface.GroupKey]int64{},
+
+		tasks: make(chan task, 16),
+	}
+
+	r.workerCtx, r.workerCancel = context.WithCancel(context.Background())
+
+	t.Cleanup(func() {
+		r.workerCancel()
+		r.workers.Wait()
+
+		for _, g := range r.openGroups {
+			_, err := g.jb.Close()
+			require.NoError(t, err)
+		}
+	})
+
+	return r, client
+}
+
+// testOpenGroup creates an open group with some data
+func testOpenGroup(t *testing.T, r *ribs) *Group {
+	ctx := context.Background()
+
+	gk, err := r.db.CreateGroup()
+	require.NoError(t, err)
+
+	g, err := OpenGroup(r.db, r.index, gk, 0, 0, r.root, iface.GroupStateWritable, true, r.groupOpts)
+	require.NoError(t, err)
+	r.openGroups[gk] = g
+
+	var bs []blocks.Block
+	for i := 0; i < 1000; i++ {
+		bs = append(bs, blocks.NewBlock([]byte(fmt.Sprintf("group %d block %d", gk, i))))
+	}
+	_, err = g.Put(ctx, bs)
+	require.NoError(t, err)
+
+	return g
+}
+
+// publishTestDeal publishes a deal for the piece on the mock chain, returning
+// the deal ID and signed proposal bytes
+func publishTestDeal(t *testing.T, mc *MockChain, client address.Address, provider int64, piece cid.Cid, start, end abi.ChainEpoch) (abi.DealID, []byte) {
+	prov, err := address.NewIDAddress(uint64(provider))
+	require.NoError(t, err)
+	label, err := market.NewLabelFromString("test")
+	require.NoError(t, err)
+
+	prop := market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             piece,
+			PieceSize:            1 << 20,
+			Client:               client,
+			Provider:             prov,
+			Label:                label,
+			StartEpoch:           start,
+			EndEpoch:             end,
+			StoragePricePerEpoch: big.Zero(),
+			ProviderCollateral:   big.Zero(),
+			ClientCollateral:     big.Zero(),
+		},
+		ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1},
+	}
+
+	_, ids, err := mc.PublishDeals(prov, []market.ClientDealProposal{prop})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	var pb bytes.Buffer
+	require.NoError(t, prop.MarshalCBOR(&pb))
+
+	return ids[0], pb.Bytes()
+}
+
+func requireTask(t *testing.T, r *ribs, expect task) {
+	select {
+	case tk := <-r.tasks:
+		require.Equal(t, expect, tk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no task queued")
+	}
+}
+
+var testPieceCid = cid.MustParse("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+
+func TestDealRepairDB(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	gk, err := db.CreateGroup()
+	require.NoError(t, err)
+	require.NoError(t, db.SetGroupState(context.Background(), gk, iface.GroupStateDealsInProgress))
+
+	addDeal := func(i int, startEpoch abi.ChainEpoch, sealed bool) {
+		insertTestDeal(t, db, testDeal{
+			UUID:       fmt.Sprintf("deal-%d", i),
+			Group:      gk,
+			Provider:   int64(1000 + i),
+			DealID:     abi.DealID(i),
+			StartEpoch: startEpoch,
+			EndEpoch:   1000,
+			Sealed:     sealed,
+		})
+	}
+
+	for i := 1; i <= targetReplicaCount-2; i++ {
+		addDeal(i, 100, true)
+	}
+	addDeal(10, 100, false) // never sealed
+	addDeal(11, 300, false) // still has time
+	addDeal(12, 100, false) // rejected
+	require.NoError(t, db.MarkDealFailed("deal-12", dealFailureSlashed, "rejected"))
+
+	groups, err := db.GroupsBelowReplicaTarget(targetReplicaCount)
+	require.NoError(t, err)
+	require.Empty(t, groups)
+
+	unsealed, err := db.UnsealedDealsPastStart(200)
+	require.NoError(t, err)
+	require.Equal(t, []unsealedDealMeta{{DealUUID: "deal-10", DealID: 10}}, unsealed)
+
+	require.NoError(t, db.ExpireUnsealedDeal("deal-12"))
+	require.NoError(t, db.ExpireUnsealedDeal("deal-10"))
+
+	var failed, expired int
+	require.NoError(t, db.db.QueryRow(`select failed, failed_expired from deals where uuid = 'deal-10'`).Scan(&failed, &expired))
+	require.Equal(t, 1, failed)
+	require.Equal(t, 1, expired)
+
+	// deals failed for other reasons keep their error
+	var errMsg string
+	require.NoError(t, db.db.QueryRow(`select failed_expired, error_msg from deals where uuid = 'deal-12'`).Scan(&expired, &errMsg))
+	require.Equal(t, 0, expired)
+	require.Equal(t, "rejected", errMsg)
+
+	groups, err = db.GroupsBelowReplicaTarget(targetReplicaCount)
+	require.NoError(t, err)
+	require.Equal(t, []repairGroupMeta{{ID: gk, State: iface.GroupStateDealsInProgress, Healthy: targetReplicaCount - 1}}, groups)
+
+	// slashed deal found by the chain check
+	active, err := db.ActiveDealsToCheck(time.Now())
+	require.NoError(t, err)
+	require.Len(t, active, targetReplicaCount-2)
+
+	require.NoError(t, db.MarkDealFailed(active[0].DealUUID, dealFailureSlashed, "deal slashed at epoch 150"))
+	require.NoError(t, db.UpdateDealStateChecked(active[1].DealUUID))
+
+	active, err = db.ActiveDealsToCheck(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Len(t, active, targetReplicaCount-4)
+
+	groups, err = db.GroupsBelowReplicaTarget(targetReplicaCount)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	require.Equal(t, targetReplicaCount-2, groups[0].Healthy)
+}
+
+func TestRepairDeals(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	mc.Advance(200)
+
+	r, client := testChainRibs(t, mc)
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsInProgress))
+
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+	h := head.Height()
+
+	addDeal := func(uuid string, provider int64, start abi.ChainEpoch, publish, activate, sealed bool) abi.DealID {
+		var id abi.DealID
+		var prop []byte
+		if publish {
+			id, prop = publishTestDeal(t, mc, client, provider, testPieceCid, start, h+100000)
+		}
+		if activate {
+			require.NoError(t, mc.ActivateDeal(id))
+		}
+
+		insertTestDeal(t, r.db, testDeal{
+			UUID:       uuid,
+			Group:      g.id,
+			Provider:   provider,
+			DealID:     id,
+			StartEpoch: start,
+			EndEpoch:   h + 100000,
+			Sealed:     sealed,
+			Proposal:   prop,
+		})
+		return id
+	}
+
+	addDeal("healthy", 1000, h-100, true, true, true)
+	slashed := addDeal("slashed", 1001, h-100, true, true, true)
+	require.NoError(t, mc.SlashDeal(slashed))
+	addDeal("missed-start", 1002, h-100, true, false, false)
+	// the deal tracker didn't see the deal activate yet
+	addDeal("late-seal", 1003, h-100, true, true, false)
+	// start epoch passed, but not by dealExpireMargin
+	addDeal("in-margin", 1004, h-dealExpireMargin/2, false, false, false)
+	// gone from market state, after and before the end epoch
+	insertTestDeal(t, r.db, testDeal{UUID: "ended", Group: g.id, Provider: 1005, DealID: 9000, StartEpoch: h - 200, EndEpoch: h - 1, Sealed: true})
+	insertTestDeal(t, r.db, testDeal{UUID: "gone", Group: g.id, Provider: 1006, DealID: 9001, StartEpoch: h - 200, EndEpoch: h + 100000, Sealed: true})
+
+	require.NoError(t, r.repairDeals(ctx))
+
+	requireDeal := func(uuid string, sealed, failed bool, emsg string) {
+		var s, f bool
+		var e string
+		require.NoError(t, r.db.db.QueryRow(`select sealed, failed, coalesce(error_msg, '') from deals where uuid = ?`, uuid).Scan(&s, &f, &e))
+		require.Equal(t, []bool{sealed, failed}, []bool{s, f}, uuid)
+		require.Contains(t, e, emsg, uuid)
+	}
+
+	requireDeal("healthy", true, false, "")
+	requireDeal("slashed", true, true, "slashed")
+	requireDeal("missed-start", false, true, "not sealed before start epoch")
+	requireDeal("late-seal", true, false, "")
+	requireDeal("in-margin", false, false, "")
+	requireDeal("ended", true, true, "expired")
+	requireDeal("gone", true, true, "not found")
+
+	// providers are only held responsible for deals which didn't run until
+	// their end epoch
+	requireKind := func(uuid string, kind dealFailureKind) {
+		var k string
+		require.NoError(t, r.db.db.QueryRow(`select coalesce(failed_kind, '') from deals where uuid = ?`, uuid).Scan(&k))
+		require.Equal(t, kind, dealFailureKind(k), uuid)
+	}
+	requireKind("healthy", "")
+	requireKind("slashed", dealFailureSlashed)
+	requireKind("ended", dealFailureExpired)
+	requireKind("gone", dealFailureMissing)
+
+	// three healthy deals left
+	requireTask(t, r, task{tt: taskTypeMakeMoreDeals, group: g.id})
+
+	// deals which don't activate within the margin expire
+	mc.Advance(int(dealExpireMargin))
+	require.NoError(t, r.repairDeals(ctx))
+	requireDeal("in-margin", false, true, "not sealed before start epoch")
+	requireTask(t, r, task{tt: taskTypeMakeMoreDeals, group: g.id})
+}
+
+// failingDealChain fails market deal queries like a broken gateway would
+type failingDealChain struct {
+	*MockChain
+}
+
+func (c *failingDealChain) StateMarketStorageDeal(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+	return nil, xerrors.Errorf("RPC client error: sendRequest failed: method handler not found")
+}
+
+func TestRepairDealsRPCFailure(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	mc.Advance(200)
+
+	r, client := testChainRibs(t, mc)
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsInProgress))
+
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+	h := head.Height()
+
+	active, prop := publishTestDeal(t, mc, client, 1000, testPieceCid, h-100, h+100000)
+	require.NoError(t, mc.ActivateDeal(active))
+	insertTestDeal(t, r.db, testDeal{UUID: "active", Group: g.id, Provider: 1000, DealID: active, StartEpoch: h - 100, EndEpoch: h + 100000, Sealed: true, Proposal: prop})
+
+	// activated, but not seen sealed by the deal tracker yet
+	late, prop := publishTestDeal(t, mc, client, 1001, testPieceCid, h-100, h+100000)
+	require.NoError(t, mc.ActivateDeal(late))
+	insertTestDeal(t, r.db, testDeal{UUID: "late-seal", Group: g.id, Provider: 1001, DealID: late, StartEpoch: h - 100, EndEpoch: h + 100000, Proposal: prop})
+
+	// errors which aren't about the deal don't fail it
+	r.chain = &failingDealChain{MockChain: mc}
+	require.NoError(t, r.repairDeals(ctx))
+
+	var failed int
+	require.NoError(t, r.db.db.QueryRow(`select count(*) from deals where failed = 1`).Scan(&failed))
+	require.Zero(t, failed)
+
+	// both deals get checked again
+	r.chain = mc
+	require.NoError(t, r.repairDeals(ctx))
+
+	var sealed int
+	require.NoError(t, r.db.db.QueryRow(`select count(*) from deals where sealed = 1 and failed = 0`).Scan(&sealed))
+	require.Equal(t, 2, sealed)
+}
+
+func TestRepairOffloadedGroup(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	mc.Advance(200)
+
+	r, client := testChainRibs(t, mc)
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.Seal(ctx))
+	require.NoError(t, g.Finalize(ctx))
+	require.NoError(t, g.GenTopCar(ctx))
+	require.NoError(t, g.GenCommP())
+
+	var carBuf bytes.Buffer
+	_, _, err := g.writeCar(&carBuf)
+	require.NoError(t, err)
+
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsDone))
+	require.NoError(t, g.Offload(ctx))
+
+	// the one remaining provider serves the piece over http
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "piece", time.Time{}, bytes.NewReader(carBuf.Bytes()))
+	}))
+	defer srv.Close()
+
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+
+	id, prop := publishTestDeal(t, mc, client, 1000, testPieceCid, head.Height()-100, head.Height()+100000)
+	require.NoError(t, mc.ActivateDeal(id))
+	addTestRetrievalProvider(t, r.db, 1000, g.id, 0, srv.URL)
+	_, err = r.db.db.Exec(`update deals set deal_id = ?, signed_proposal_bytes = ? where provider_addr = 1000`, id, prop)
+	require.NoError(t, err)
+
+	// offloaded groups are rehydrated first
+	require.NoError(t, r.repairDeals(ctx))
+
+	rh, err := r.db.RehydratingGroups()
+	require.NoError(t, err)
+	require.True(t, rh[g.id])
+
+	require.Eventually(t, func() bool {
+		return r.rehydrateProgress(g.id) == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, iface.GroupStateDealsDone, g.state)
+
+	rh, err = r.db.RehydratingGroups()
+	require.NoError(t, err)
+	require.Empty(t, rh)
+
+	// then repaired like any other group
+	require.NoError(t, r.repairDeals(ctx))
+	requireTask(t, r, task{tt: taskTypeMakeMoreDeals, group: g.id})
+}
+
+func TestRehydratedGroupNotOffloadedAgain(t *testing.T) {
+	oldOffload, oldRepair := offloadCheckInterval, DealRepairInterval
+	offloadCheckInterval, DealRepairInterval = 10*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		offloadCheckInterval, DealRepairInterval = oldOffload, oldRepair
+	})
+
+	ctx := context.Background()
+	mc := NewMockChain()
+	mc.Advance(200)
+
+	r, client := testChainRibs(t, mc)
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.Seal(ctx))
+	require.NoError(t, g.Finalize(ctx))
+	require.NoError(t, g.GenTopCar(ctx))
+	require.NoError(t, g.GenCommP())
+
+	var carBuf bytes.Buffer
+	_, _, err := g.writeCar(&carBuf)
+	require.NoError(t, err)
+
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsDone))
+	require.NoError(t, g.Offload(ctx))
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, req, "piece", time.Time{}, bytes.NewReader(carBuf.Bytes()))
+	}))
+	defer srv.Close()
+
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+
+	// a single sealed deal is enough for offloading, but below the replica
+	// target, so repair rehydrates the group
+	id, prop := publishTestDeal(t, mc, client, 1000, testPieceCid, head.Height()-100, head.Height()+100000)
+	require.NoError(t, mc.ActivateDeal(id))
+	addTestRetrievalProvider(t, r.db, 1000, g.id, 0, srv.URL)
+	_, err = r.db.db.Exec(`update deals set deal_id = ?, signed_proposal_bytes = ? where provider_addr = 1000`, id, prop)
+	require.NoError(t, err)
+
+	r.offloadPolicy = OffloadPolicy{MinSealedDeals: 1}
+	r.carTransfers, err = newCarTransfers(defaultCarTransferPolicy())
+	require.NoError(t, err)
+
+	r.close = make(chan struct{})
+	t.Cleanup(func() {
+		close(r.close)
+	})
+
+	r.startWorker(r.offloadWorker)
+	r.startWorker(r.dealRepairWorker)
+
+	// rehydration requests deals for the group
+	requireTask(t, r, task{tt: taskTypeMakeMoreDeals, group: g.id})
+
+	require.Eventually(t, func() bool {
+		rh, err := r.db.RehydratingGroups()
+		require.NoError(t, err)
+		return len(rh) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.WithinDuration(t, time.Now(), time.Unix(0, atomic.LoadInt64(&g.lastAccess)), 10*time.Second)
+
+	// many offload and repair rounds later the piece was downloaded once
+	time.Sleep(50 * offloadCheckInterval)
+
+	require.NoError(t, r.withReadableGroup(g.id, func(g *Group) error {
+		require.Equal(t, iface.GroupStateDealsDone, g.state)
+		return nil
+	}))
+	require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/filecoin-project/go-fil-markets/shared"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/api/client"
 	types2 "github.com/filecoin-project/lotus/chain/types"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
@@ -28,12 +27,6 @@ const clientWriteDeadline = 10 * time.Second
 var DealCheckInterval = 10 * time.Second
 
 func (r *ribs) dealTracker(ctx context.Context) {
-	gw, closer, err := client.NewGatewayRPCV1(ctx, "http://api.chain.love/rpc/v1", nil)
-	if err != nil {
-		panic(err)
-	}
-	defer closer()
-
 	for {
 		checkStart := time.Now()
 		select {
@@ -42,7 +35,7 @@ func (r *ribs) dealTracker(ctx context.Context) {
 		default:
 		}
 
-		err := r.runDealCheckLoop(ctx, gw)
+		err := r.runDealCheckLoop(ctx, r.chain)
 		if err != nil {
 			log.Errorw("deal check loop failed", "error", err)
 		}
@@ -58,13 +51,7 @@ func (r *ribs) dealTracker(ctx context.Context) {
 	}
 }
 
-func (r *ribs) runDealCheckLoop(ctx context.Context, gw api.Gateway) error {
-	gw, closer, err := client.NewGatewayRPCV1(ctx, "http://api.chain.love/rpc/v1", nil)
-	if err != nil {
-		return xerrors.Errorf("creating gateway rpc client: %w", err)
-	}
-	defer closer()
-
+func (r *ribs) runDealCheckLoop(ctx context.Context, gw ChainAPI) error {
 	/* PUBLISHED DEAL CHECKS */
 	/* Wait for published deals to become active (or expire) */
 
@@ -89,6 +76,26 @@ func (r *ribs) runDealCheckLoop(ctx context.Context, gw api.Gateway) error {
 		}
 	}
 
+	/* DONE GROUPS */
+	/* Groups with enough sealed deals don't need more deals */
+
+	{
+		groups, err := r.db.GroupsWithSealedDeals(targetReplicaCount)
+		if err != nil {
+			return xerrors.Errorf("get groups with sealed deals: %w", err)
+		}
+
+		for _, gk := range groups {
+			err := r.withReadableGroup(gk, func(g *Group) error {
+				return g.MarkDealsDone(ctx)
+			})
+			if err != nil {
+				return xerrors.Errorf("marking group deals done: %w", err)
+			}
+			log.Infow("group deals done", "group", gk)
+		}
+	}
+
 	/* PUBLISHING DEAL CHECKS */
 	/* Wait for publish at "good-enough" finality */
 
@@ -164,16 +171,12 @@ func (r *ribs) runDealCheckLoop(ctx context.Context, gw api.Gateway) error {
 		}
 	}
 
-	/* Active deal checks */
-
-	// get deals with deal id, active, not checked in last 24 hours
-
-	// check market deal state
+	// active deals are checked by the deal repair loop
 
 	return nil
 }
 
-func (r *ribs) runDealCheckQuery(ctx context.Context, gw api.Gateway, walletAddr address.Address, deal inactiveDealMeta) error {
+func (r *ribs) runDealCheckQuery(ctx context.Context, gw ChainAPI, walletAddr address.Address, deal inactiveDealMeta) error {
 	maddr, err := address.NewIDAddress(uint64(deal.ProviderAddr))
 	if err != nil {
 		return xerrors.Errorf("new id address: %w", err)
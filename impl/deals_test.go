@@ -0,0 +1,326 @@
+package impl
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/boost/retrievalmarket/lp2pimpl"
+	"github.com/filecoin-project/boost/storagemarket/types/dealcheckpoints"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/fakesp"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealsWithFakeProviders(t *testing.T) {
+	oldTarget, oldInterval, oldHeadTTL := targetReplicaCount, DealCheckInterval, chainHeadCacheTTL
+	targetReplicaCount, DealCheckInterval, chainHeadCacheTTL = 3, 50*time.Millisecond, 0
+	t.Cleanup(func() {
+		targetReplicaCount, DealCheckInterval, chainHeadCacheTTL = oldTarget, oldInterval, oldHeadTTL
+	})
+
+	ctx := context.Background()
+	td := t.TempDir()
+
+	mn := mocknet.New()
+	mc := NewMockChain()
+
+	var provs []*fakesp.Provider
+	var provIDs []int64
+	for i := 0; i < targetReplicaCount; i++ {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+
+		id := int64(2000 + i)
+		maddr, err := address.NewIDAddress(uint64(id))
+		require.NoError(t, err)
+
+		p := fakesp.New(h, mc, maddr, fakesp.Config{})
+		t.Cleanup(p.Close)
+
+		provs = append(provs, p)
+		provIDs = append(provIDs, id)
+	}
+
+	walletPath := filepath.Join(td, "wallet")
+	w, err := ributil.OpenWallet(walletPath)
+	require.NoError(t, err)
+	client, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	ri, err := Open(filepath.Join(td, "ribs"),
+		WithChainAPI(mc),
+		WithWalletPath(walletPath),
+		WithHostGetter(func(...libp2p.Option) (host.Host, error) {
+			return mn.GenPeer()
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, ri.Close())
+	})
+
+	require.NoError(t, mn.LinkAll())
+
+	// the crawler can't list market participants from the mock chain, query
+	// the providers directly
+	r := ri.(*ribs)
+	require.NoError(t, r.db.UpsertMarketActors(provIDs))
+
+	tpt := lp2pimpl.NewTransportsClient(r.host)
+	for _, id := range provIDs {
+		res, err := r.queryProvider(ctx, r.chain, r.host, tpt, id)
+		require.NoError(t, err)
+		require.NoError(t, r.db.UpdateProviderProtocols(id, res))
+	}
+	require.Len(t, r.db.ReachableProviders(), targetReplicaCount)
+
+	// write and seal a group
+	sess := ri.Session(ctx)
+	wb := sess.Batch(ctx)
+	for i := 0; i < 100; i++ {
+		var data [1000]byte
+		binary.BigEndian.PutUint64(data[:], uint64(i))
+		require.NoError(t, wb.Put(ctx, []blocks.Block{blocks.NewBlock(data[:])}))
+	}
+	require.NoError(t, wb.Flush(ctx))
+	require.NoError(t, ri.Admin().SealGroup(ctx, 1))
+
+	groupState := func() iface.GroupState {
+		gm, err := ri.Diagnostics().GroupMeta(1)
+		require.NoError(t, err)
+		return gm.State
+	}
+
+	// providers fetch the CAR, verify commP, and publish
+	require.Eventually(t, func() bool {
+		for _, p := range provs {
+			deals := p.Deals()
+			if len(deals) != 1 {
+				return false
+			}
+			st, _ := p.DealStatus(deals[0])
+			require.Empty(t, st.Error)
+			if st.Status != dealcheckpoints.Complete.String() {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+	require.Equal(t, iface.GroupStateDealsInProgress, groupState())
+
+	// publish messages are picked up from deal status
+	require.Eventually(t, func() bool {
+		pd, err := r.db.PublishingDeals()
+		require.NoError(t, err)
+		return len(pd) == targetReplicaCount
+	}, 10*time.Second, 20*time.Millisecond)
+
+	mc.Advance(int(dealPublishFinality) + 2)
+
+	require.Eventually(t, func() bool {
+		return groupState() == iface.GroupStateDealsDone
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// offline deal with an extra provider, data shipped as an exported CAR
+	oh, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+
+	offID := int64(2000 + targetReplicaCount)
+	offAddr, err := address.NewIDAddress(uint64(offID))
+	require.NoError(t, err)
+	offProv := fakesp.New(oh, mc, offAddr, fakesp.Config{})
+	t.Cleanup(offProv.Close)
+
+	require.NoError(t, r.db.UpsertMarketActors([]int64{offID}))
+	res, err := r.queryProvider(ctx, r.chain, r.host, tpt, offID)
+	require.NoError(t, err)
+	require.NoError(t, r.db.UpdateProviderProtocols(offID, res))
+
+	exportDir := filepath.Join(td, "export")
+	exp, err := ri.Admin().ExportGroupCar(ctx, 1, exportDir)
+	require.NoError(t, err)
+
+	mb, err := os.ReadFile(filepath.Join(exportDir, carManifestName))
+	require.NoError(t, err)
+	var manifest []iface.CarExport
+	require.NoError(t, json.Unmarshal(mb, &manifest))
+	require.Equal(t, []iface.CarExport{exp}, manifest)
+
+	fi, err := os.Stat(filepath.Join(exportDir, exp.File))
+	require.NoError(t, err)
+	require.Equal(t, exp.CarSize, fi.Size())
+
+	require.NoError(t, ri.Admin().MakeOfflineDeals(ctx, 1, []int64{offID}))
+
+	offDeals := offProv.Deals()
+	require.Len(t, offDeals, 1)
+	st, _ := offProv.DealStatus(offDeals[0])
+	require.Equal(t, dealcheckpoints.Accepted.String(), st.Status)
+	require.Equal(t, exp.PieceCid, st.Proposal.PieceCID.String())
+
+	// shipping takes longer than online deals get to start, the deal isn't
+	// expired while the drive is on its way
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+	onlineStart := dealStartDelay(defaultDealPolicy(), st.Proposal.PieceSize, false)
+	require.Greater(t, st.Proposal.StartEpoch, head.Height()+onlineStart)
+
+	mc.Advance(int(onlineStart + 2*dealExpireMargin))
+	require.NoError(t, r.repairDeals(ctx))
+
+	var offFailed bool
+	require.NoError(t, r.db.db.QueryRow(`select failed from deals where provider_addr = ?`, offID).Scan(&offFailed))
+	require.False(t, offFailed)
+
+	f, err := os.Open(filepath.Join(exportDir, exp.File))
+	require.NoError(t, err)
+	require.NoError(t, offProv.ImportData(offDeals[0], f))
+	require.NoError(t, f.Close())
+
+	// tracked like online deals
+	require.Eventually(t, func() bool {
+		pd, err := r.db.PublishingDeals()
+		require.NoError(t, err)
+		return len(pd) == 1
+	}, 10*time.Second, 20*time.Millisecond)
+
+	mc.Advance(int(dealPublishFinality) + 2)
+
+	require.Eventually(t, func() bool {
+		gm, err := ri.Diagnostics().GroupMeta(1)
+		require.NoError(t, err)
+		for _, d := range gm.Deals {
+			if d.Provider == offID {
+				return d.Offline && d.Sealed
+			}
+		}
+		return false
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+// stubSelector accepts all candidates for verified deals, and for unverified
+// deals only when unverifiedOK is set
+type stubSelector struct {
+	unverifiedOK bool
+}
+
+func (s *stubSelector) SelectProviders(ctx context.Context, req DealRequest, cands []ProviderCandidate) ([]ProviderCandidate, error) {
+	if !req.Verified && !s.unverifiedOK {
+		return nil, nil
+	}
+	return cands, nil
+}
+
+func TestVerifiedDeals(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	mn := mocknet.New()
+
+	r, client := testChainRibs(t, mc)
+
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	// providers 3001 and 3002 only take pieces padded to 1MiB
+	minPiece := map[int64]abi.PaddedPieceSize{3000: 256, 3001: 1 << 20, 3002: 1 << 20}
+	provs := map[int64]*fakesp.Provider{}
+	for id, mp := range minPiece {
+		ph, err := mn.GenPeer()
+		require.NoError(t, err)
+		maddr, err := address.NewIDAddress(uint64(id))
+		require.NoError(t, err)
+
+		p := fakesp.New(ph, mc, maddr, fakesp.Config{MinPieceSize: mp})
+		t.Cleanup(p.Close)
+		provs[id] = p
+	}
+	require.NoError(t, mn.LinkAll())
+
+	ep := defaultEscrowPolicy()
+	require.NoError(t, ep.validate())
+
+	sel := &stubSelector{unverifiedOK: true}
+	r.groupOpts.verifiedDeals = true
+	r.groupOpts.chain = mc
+	r.groupOpts.providerSelector = sel
+	r.groupOpts.escrow = &escrowManager{db: r.db, wallet: r.wallet, sender: r.sender, policy: ep}
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.Seal(ctx))
+	require.NoError(t, g.Finalize(ctx))
+	require.NoError(t, g.GenTopCar(ctx))
+	require.NoError(t, g.GenCommP())
+
+	dp, err := r.db.GetDealParams(ctx, g.id)
+	require.NoError(t, err)
+	require.Less(t, dp.PieceSize, int64(1<<20))
+
+	// enough for one deal with the group piece, not for a padded one
+	mc.SetDataCap(client, big.NewInt(2*dp.PieceSize))
+
+	wi, err := r.WalletInfo()
+	require.NoError(t, err)
+	require.Equal(t, types.SizeStr(big.NewInt(2*dp.PieceSize)), wi.DataCap)
+
+	propose := func(dr *dealRound, id int64) (bool, error) {
+		cand := ProviderCandidate{ID: id, AskMinPieceSize: int64(minPiece[id]), AskMaxPieceSize: 32 << 30}
+		if err := g.proposeDeal(ctx, h, r.wallet, dr, cand, nil, true); err != nil {
+			return false, err
+		}
+
+		deals := provs[id].Deals()
+		require.Len(t, deals, 1)
+		st, _ := provs[id].DealStatus(deals[0])
+
+		var verified bool
+		require.NoError(t, r.db.db.QueryRow(`select verified from deals where provider_addr = ?`, id).Scan(&verified))
+		require.Equal(t, st.Proposal.VerifiedDeal, verified)
+
+		return verified, nil
+	}
+
+	dr, err := g.startDealRound(ctx, r.wallet)
+	require.NoError(t, err)
+	require.True(t, dr.verified)
+
+	// DataCap covers the padded piece
+	verified, err := propose(dr, 3000)
+	require.NoError(t, err)
+	require.True(t, verified)
+	require.Equal(t, big.NewInt(dp.PieceSize), dr.dataCap)
+
+	// not for the piece padded to the provider minimum, the deal is made
+	// unverified
+	verified, err = propose(dr, 3001)
+	require.NoError(t, err)
+	require.False(t, verified)
+	require.Equal(t, big.NewInt(dp.PieceSize), dr.dataCap)
+
+	// unless the selector doesn't accept the provider for unverified deals
+	sel.unverifiedOK = false
+	_, err = propose(dr, 3002)
+	require.ErrorContains(t, err, "not enough datacap")
+	require.Empty(t, provs[3002].Deals())
+
+	// DataCap is reported with wallet info
+	mc.SetDataCap(client, big.NewInt(1<<30))
+	r.cachedWalletInfo = nil
+	wi, err = r.WalletInfo()
+	require.NoError(t, err)
+	require.Equal(t, "1 GiB", wi.DataCap)
+}
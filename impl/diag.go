@@ -2,7 +2,6 @@ package impl
 
 import (
 	"context"
-	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/chain/types"
 	iface "github.com/lotus-web3/ribs"
 	"golang.org/x/xerrors"
@@ -24,6 +23,9 @@ func (r *ribs) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 		return iface.GroupMeta{}, xerrors.Errorf("get group meta: %w", err)
 	}
 
+	m.MaxBlocks = r.groupOpts.sizing.EffectiveMaxBlocks()
+	m.MaxBytes = r.groupOpts.sizing.EffectiveMaxBytes()
+
 	r.lk.Lock()
 	g, ok := r.openGroups[gk]
 	r.lk.Unlock()
@@ -33,6 +35,8 @@ func (r *ribs) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 		m.ReadBytes = atomic.LoadInt64(&g.readSize)
 	}
 
+	m.Rehydrate = r.rehydrateProgress(gk)
+
 	return m, nil
 }
 
@@ -59,11 +63,7 @@ func (r *ribs) WalletInfo() (iface.WalletInfo, error) {
 
 	ctx := context.TODO()
 
-	gw, closer, err := client.NewGatewayRPCV1(ctx, "http://api.chain.love/rpc/v1", nil)
-	if err != nil {
-		panic(err)
-	}
-	defer closer()
+	gw := r.chain
 
 	b, err := gw.WalletBalance(ctx, addr)
 	if err != nil {
@@ -75,11 +75,30 @@ func (r *ribs) WalletInfo() (iface.WalletInfo, error) {
 		return iface.WalletInfo{}, xerrors.Errorf("get market balance: %w", err)
 	}
 
+	dc, err := clientDataCap(ctx, gw, addr)
+	if err != nil {
+		return iface.WalletInfo{}, xerrors.Errorf("get datacap: %w", err)
+	}
+
+	spentDay, err := r.db.DealSpending(iface.UndefGroupKey, time.Now().Add(-budgetDay))
+	if err != nil {
+		return iface.WalletInfo{}, xerrors.Errorf("get daily spending: %w", err)
+	}
+	spentMonth, err := r.db.DealSpending(iface.UndefGroupKey, time.Now().Add(-budgetMonth))
+	if err != nil {
+		return iface.WalletInfo{}, xerrors.Errorf("get monthly spending: %w", err)
+	}
+
 	wi := iface.WalletInfo{
 		Addr:          addr.String(),
 		Balance:       types.FIL(b).Short(),
 		MarketBalance: types.FIL(mb.Escrow).Short(),
 		MarketLocked:  types.FIL(mb.Locked).Short(),
+		DataCap:       types.SizeStr(dc),
+
+		SpentDay:     types.FIL(spentDay).Short(),
+		SpentMonth:   types.FIL(spentMonth).Short(),
+		DealsBlocked: r.groupOpts.escrow.blockedStatus(),
 	}
 
 	r.cachedWalletInfo = &wi
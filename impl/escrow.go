@@ -0,0 +1,313 @@
+package impl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"golang.org/x/xerrors"
+)
+
+// ErrBudgetExhausted is returned when a deal would exceed a spending budget
+var ErrBudgetExhausted = xerrors.New("spending budget exhausted")
+
+const (
+	budgetDay   = 24 * time.Hour
+	budgetMonth = 30 * budgetDay
+)
+
+// escrowReservationTimeout is how long a reservation without a stored deal
+// counts, proposals interrupted by a restart never cancel theirs
+var escrowReservationTimeout = time.Hour
+
+// escrowTopUpTimeout is how long an AddBalance message counts as available
+// escrow; messages not on chain after this are assumed lost
+var escrowTopUpTimeout = 30 * time.Minute
+
+// EscrowPolicy controls market escrow top-ups and limits deal spending.
+// Spending is the client balance requirement of accepted deals (storage fees
+// and client collateral); deals which failed before publishing don't count.
+type EscrowPolicy struct {
+	// TopUpBuffer is added to each AddBalance on top of the projected need,
+	// so that not every deal needs a message
+	TopUpBuffer abi.TokenAmount
+
+	// Rolling day and 30 day windows, and total per group. Zero means no
+	// limit.
+	DailyBudget   abi.TokenAmount
+	MonthlyBudget abi.TokenAmount
+	GroupBudget   abi.TokenAmount
+}
+
+func defaultEscrowPolicy() EscrowPolicy {
+	return EscrowPolicy{
+		TopUpBuffer: big.NewInt(mFil * 100), // 0.1 FIL
+	}
+}
+
+// WithEscrowPolicy sets escrow top-ups and spending budgets
+func WithEscrowPolicy(p EscrowPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.escrowPolicy = &p
+	}
+}
+
+func (p *EscrowPolicy) validate() error {
+	for _, v := range []*abi.TokenAmount{&p.TopUpBuffer, &p.DailyBudget, &p.MonthlyBudget, &p.GroupBudget} {
+		if v.Int == nil {
+			*v = big.Zero()
+		}
+		if v.LessThan(big.Zero()) {
+			return xerrors.Errorf("negative values not allowed")
+		}
+	}
+	return nil
+}
+
+// escrowManager keeps market escrow funded for new deals, and enforces
+// spending budgets
+type escrowManager struct {
+	db     *ribsDB
+	wallet *ributil.LocalWallet
+	sender *messageSender
+	policy EscrowPolicy
+
+	lk sync.Mutex
+	// why deal-making is blocked, empty when it isn't
+	status string
+
+	// serializes top-ups, so that concurrent proposals don't each add the
+	// missing balance
+	topUpLk sync.Mutex
+}
+
+// checkBudgets returns ErrBudgetExhausted when spending cost for the group
+// would go over a budget
+func (e *escrowManager) checkBudgets(group iface.GroupKey, cost abi.TokenAmount) error {
+	now := time.Now()
+
+	for _, b := range []struct {
+		name   string
+		budget abi.TokenAmount
+		group  iface.GroupKey
+		since  time.Time
+	}{
+		{"daily", e.policy.DailyBudget, iface.UndefGroupKey, now.Add(-budgetDay)},
+		{"monthly", e.policy.MonthlyBudget, iface.UndefGroupKey, now.Add(-budgetMonth)},
+		{"group", e.policy.GroupBudget, group, time.Time{}},
+	} {
+		if b.budget.IsZero() {
+			continue
+		}
+
+		spent, err := e.db.DealSpending(b.group, b.since)
+		if err != nil {
+			return xerrors.Errorf("getting %s spending: %w", b.name, err)
+		}
+
+		if big.Add(spent, cost).GreaterThan(b.budget) {
+			err := xerrors.Errorf("%s budget of %s, spent %s: %w", b.name, types.FIL(b.budget).Short(), types.FIL(spent).Short(), ErrBudgetExhausted)
+			e.setStatus(err.Error())
+			return err
+		}
+	}
+
+	e.setStatus("")
+	return nil
+}
+
+// reserve checks budgets and records the deal in the ledger, then makes sure
+// market escrow covers it, on top of deals which were accepted but didn't lock
+// funds yet. The reservation must be cancelled if the deal isn't made.
+func (e *escrowManager) reserve(ctx context.Context, gw ChainAPI, group iface.GroupKey, dealUUID string, cost abi.TokenAmount) error {
+	e.lk.Lock()
+	if err := e.checkBudgets(group, cost); err != nil {
+		e.lk.Unlock()
+		return err
+	}
+	err := e.db.RecordDealSpending(group, dealUUID, cost)
+	e.lk.Unlock()
+	if err != nil {
+		return xerrors.Errorf("recording deal spending: %w", err)
+	}
+
+	if err := e.topUp(ctx, gw); err != nil {
+		if cerr := e.cancel(dealUUID); cerr != nil {
+			log.Errorw("cancelling escrow reservation", "deal", dealUUID, "error", cerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// topUp adds market escrow when it doesn't cover reserved and accepted deals.
+// AddBalance messages which didn't land yet count as available, so top-ups
+// don't wait for them; only a top-up which needs another message while one is
+// pending waits for it to land.
+func (e *escrowManager) topUp(ctx context.Context, gw ChainAPI) error {
+	for {
+		err := e.tryTopUp(ctx, gw)
+		if err != errSenderBusy {
+			return err
+		}
+
+		// not holding topUpLk, covered reservations don't wait for this
+		e.sender.waitIdle()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// tryTopUp pushes an AddBalance message when escrow is short, returns
+// errSenderBusy when the message can't be sent yet
+func (e *escrowManager) tryTopUp(ctx context.Context, gw ChainAPI) error {
+	e.topUpLk.Lock()
+	defer e.topUpLk.Unlock()
+
+	addr, err := e.wallet.GetDefault()
+	if err != nil {
+		return xerrors.Errorf("get wallet address: %w", err)
+	}
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	mb, err := gw.StateMarketBalance(ctx, addr, head.Key())
+	if err != nil {
+		return xerrors.Errorf("get market balance: %w", err)
+	}
+
+	inFlight, err := e.inFlightTopUps(ctx, gw, head.Key())
+	if err != nil {
+		return xerrors.Errorf("checking pending top-ups: %w", err)
+	}
+
+	need, err := e.db.PendingDealSpending()
+	if err != nil {
+		return xerrors.Errorf("getting pending deal spending: %w", err)
+	}
+
+	avail := big.Add(big.Sub(mb.Escrow, mb.Locked), inFlight)
+	if avail.GreaterThanEqual(need) {
+		return nil
+	}
+
+	amt := big.Add(big.Sub(need, avail), e.policy.TopUpBuffer)
+
+	err = e.sender.tryPush(ctx, gw, market.Address, market.Methods.AddBalance, amt, &addr, func(mcid cid.Cid) error {
+		log.Infow("adding market escrow", "amount", types.FIL(amt), "msg", mcid)
+
+		if err := e.db.RecordEscrowTopUp(amt, mcid); err != nil {
+			return xerrors.Errorf("recording top-up: %w", err)
+		}
+		return nil
+	}, escrowTopUpTimeout, e.topUpLanded)
+	if err == errSenderBusy {
+		return err
+	}
+	if err != nil {
+		e.topUpFailed(err)
+		return xerrors.Errorf("adding market balance: %w", err)
+	}
+
+	return nil
+}
+
+// topUpLanded is called once waiting for an AddBalance message is done.
+// Messages which weren't seen landing are checked again by inFlightTopUps.
+func (e *escrowManager) topUpLanded(lookup *api.MsgLookup, err error) {
+	if err != nil {
+		log.Warnw("waiting for add balance message", "error", err)
+		e.topUpFailed(err)
+		return
+	}
+
+	if err := e.db.EscrowTopUpLanded(lookup.Message); err != nil {
+		log.Errorw("recording top-up", "msg", lookup.Message, "error", err)
+	}
+}
+
+// inFlightTopUps sums AddBalance messages not on chain at tsk, which were sent
+// less than escrowTopUpTimeout ago
+func (e *escrowManager) inFlightTopUps(ctx context.Context, gw ChainAPI, tsk types.TipSetKey) (abi.TokenAmount, error) {
+	pending, err := e.db.PendingEscrowTopUps()
+	if err != nil {
+		return big.Zero(), err
+	}
+
+	sum := big.Zero()
+	for _, tu := range pending {
+		lookup, err := gw.StateSearchMsg(ctx, tsk, tu.Msg, api.LookbackNoLimit, true)
+		if err != nil {
+			return big.Zero(), xerrors.Errorf("searching message %s: %w", tu.Msg, err)
+		}
+
+		switch {
+		case lookup != nil:
+			if lookup.Receipt.ExitCode.IsError() {
+				log.Warnw("add balance message failed", "msg", tu.Msg, "exitCode", lookup.Receipt.ExitCode)
+			}
+		case time.Since(tu.Sent) > escrowTopUpTimeout:
+			log.Warnw("add balance message not on chain, assuming it was lost", "msg", tu.Msg, "sent", tu.Sent)
+		default:
+			sum = big.Add(sum, tu.Amount)
+			continue
+		}
+
+		if err := e.db.EscrowTopUpLanded(tu.Msg); err != nil {
+			return big.Zero(), err
+		}
+	}
+
+	return sum, nil
+}
+
+func (e *escrowManager) topUpFailed(err error) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	e.setStatus("escrow top-up failed: " + err.Error())
+}
+
+// cancel removes the reservation of a deal which wasn't made
+func (e *escrowManager) cancel(dealUUID string) error {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	return e.db.CancelDealSpending(dealUUID)
+}
+
+func (e *escrowManager) setStatus(s string) {
+	if s != e.status && s != "" {
+		log.Warnw("deal-making blocked", "reason", s)
+	}
+	e.status = s
+}
+
+// canSpend is checkBudgets for callers not holding the lock
+func (e *escrowManager) canSpend(group iface.GroupKey) error {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	return e.checkBudgets(group, big.Zero())
+}
+
+func (e *escrowManager) blockedStatus() string {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+
+	return e.status
+}
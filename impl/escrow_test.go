@@ -0,0 +1,255 @@
+package impl
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestEscrowBudgets(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	p := EscrowPolicy{GroupBudget: big.NewInt(100)}
+	require.NoError(t, p.validate())
+	require.True(t, p.DailyBudget.IsZero())
+	require.Error(t, (&EscrowPolicy{DailyBudget: big.NewInt(-1)}).validate())
+
+	e := &escrowManager{db: db, policy: p}
+
+	for i, published := range []int{0, 1} {
+		_, err = db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, published)
+			values (?, 'f01', 1000, 1, 0, 0, 1, 0, 0, x'00', ?)`, []string{"pending", "published"}[i], published)
+		require.NoError(t, err)
+		require.NoError(t, db.RecordDealSpending(1, []string{"pending", "published"}[i], big.NewInt(40)))
+	}
+	require.NoError(t, db.RecordEscrowTopUp(big.NewInt(1000), cid.MustParse("bafkqaaa")))
+
+	spent, err := db.DealSpending(iface.UndefGroupKey, time.Now().Add(-budgetDay))
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(80), spent)
+
+	pending, err := db.PendingDealSpending()
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(40), pending)
+
+	require.NoError(t, e.canSpend(1))
+	require.NoError(t, e.checkBudgets(1, big.NewInt(20)))
+	require.True(t, xerrors.Is(e.checkBudgets(1, big.NewInt(21)), ErrBudgetExhausted))
+	require.Contains(t, e.blockedStatus(), "group budget")
+
+	// other groups have their own budget
+	require.NoError(t, e.checkBudgets(2, big.NewInt(21)))
+	require.Empty(t, e.blockedStatus())
+
+	// deals failed before publishing don't count
+	_, err = db.db.Exec(`update deals set failed = 1 where uuid = 'pending'`)
+	require.NoError(t, err)
+	require.NoError(t, e.checkBudgets(1, big.NewInt(60)))
+
+	// daily budget covers all groups
+	e.policy.DailyBudget = big.NewInt(50)
+	require.True(t, xerrors.Is(e.checkBudgets(2, big.NewInt(11)), ErrBudgetExhausted))
+}
+
+// blockingWaitChain holds StateWaitMsg until release is closed
+type blockingWaitChain struct {
+	*MockChain
+	waiting, release chan struct{}
+}
+
+func (c *blockingWaitChain) StateWaitMsg(ctx context.Context, mc cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	close(c.waiting)
+	<-c.release
+	return c.MockChain.StateWaitMsg(ctx, mc, confidence, limit, allowReplaced)
+}
+
+func TestEscrowReservations(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	w, err := ributil.OpenWallet(t.TempDir())
+	require.NoError(t, err)
+	client, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	mc := NewMockChain()
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	p := EscrowPolicy{GroupBudget: big.NewInt(100), TopUpBuffer: big.NewInt(40)}
+	require.NoError(t, p.validate())
+	e := &escrowManager{db: db, wallet: w, sender: &messageSender{wallet: w}, policy: p}
+
+	// reserving doesn't wait for the top-up to land
+	gw := &blockingWaitChain{MockChain: mc, waiting: make(chan struct{}), release: make(chan struct{})}
+	require.NoError(t, e.reserve(ctx, gw, 1, "a", big.NewInt(60)))
+
+	<-gw.waiting
+	require.Empty(t, e.blockedStatus())
+	require.NoError(t, e.canSpend(1))
+
+	// reservations covered by the pending top-up don't wait for it either
+	done := make(chan error)
+	go func() {
+		done <- e.reserve(ctx, gw, 1, "b", big.NewInt(30))
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reservation waited for the pending top-up")
+	}
+
+	// the reservations count towards budgets before the deals are stored
+	require.True(t, xerrors.Is(e.reserve(ctx, mc, 1, "c", big.NewInt(20)), ErrBudgetExhausted))
+
+	close(gw.release)
+	require.Eventually(t, func() bool {
+		tus, err := db.PendingEscrowTopUps()
+		require.NoError(t, err)
+		return len(tus) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mb, err := mc.StateMarketBalance(ctx, client, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(100), mb.Escrow)
+
+	// rejected deals give the budget back
+	require.NoError(t, e.cancel("a"))
+	require.NoError(t, e.reserve(ctx, mc, 1, "c", big.NewInt(60)))
+
+	// escrow covers the new reservation, no top-up needed
+	mb, err = mc.StateMarketBalance(ctx, client, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(100), mb.Escrow)
+
+	// reservations of deals never stored expire
+	_, err = db.db.Exec(`update escrow_ledger set ts = ? where deal_uuid in ('b', 'c')`, time.Now().Add(-escrowReservationTimeout-time.Minute).Unix())
+	require.NoError(t, err)
+
+	pending, err := db.PendingDealSpending()
+	require.NoError(t, err)
+	require.True(t, pending.IsZero())
+	require.NoError(t, e.checkBudgets(1, big.NewInt(100)))
+}
+
+// stuckWaitChain never sees messages land before the wait times out
+type stuckWaitChain struct {
+	*MockChain
+}
+
+func (c *stuckWaitChain) StateWaitMsg(ctx context.Context, mc cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestEscrowTopUpInFlight(t *testing.T) {
+	oldTimeout := escrowTopUpTimeout
+	escrowTopUpTimeout = 500 * time.Millisecond
+	t.Cleanup(func() {
+		escrowTopUpTimeout = oldTimeout
+	})
+
+	ctx := context.Background()
+
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	w, err := ributil.OpenWallet(t.TempDir())
+	require.NoError(t, err)
+	client, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	mc := NewMockChain()
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	p := defaultEscrowPolicy()
+	require.NoError(t, p.validate())
+	e := &escrowManager{db: db, wallet: w, sender: &messageSender{wallet: w}, policy: p}
+	gw := &stuckWaitChain{MockChain: mc}
+
+	sent := func() uint64 {
+		act, err := mc.StateGetActor(ctx, client, types.EmptyTSK)
+		require.NoError(t, err)
+		return act.Nonce
+	}
+
+	// the top-up is pushed without waiting for it
+	require.NoError(t, e.reserve(ctx, gw, 1, "a", big.NewInt(60)))
+	require.Equal(t, uint64(1), sent())
+
+	// the pending top-up covers the next deal, no second message
+	require.NoError(t, e.reserve(ctx, gw, 1, "b", big.NewInt(60)))
+	require.Equal(t, uint64(1), sent())
+
+	// the wait gives up, but the message may still land
+	require.Eventually(t, func() bool {
+		return strings.Contains(e.blockedStatus(), "top-up failed")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// landed top-ups are counted through the market balance
+	mc.Advance(1)
+	require.NoError(t, e.reserve(ctx, gw, 1, "c", big.NewInt(60)))
+	require.Equal(t, uint64(1), sent())
+
+	tus, err := db.PendingEscrowTopUps()
+	require.NoError(t, err)
+	require.Empty(t, tus)
+}
+
+func TestMessageSenderSerializes(t *testing.T) {
+	ctx := context.Background()
+
+	w, err := ributil.OpenWallet(t.TempDir())
+	require.NoError(t, err)
+	client, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	mc := NewMockChain()
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	s := &messageSender{wallet: w}
+	gw := &blockingWaitChain{MockChain: mc, waiting: make(chan struct{}), release: make(chan struct{})}
+
+	done := make(chan error)
+	go func() {
+		_, err := s.send(ctx, gw, client, 0, big.NewInt(1), nil, nil)
+		done <- err
+	}()
+	<-gw.waiting
+
+	// the second message isn't sent until the first one landed
+	second := make(chan error)
+	go func() {
+		_, err := s.send(ctx, mc, client, 0, big.NewInt(1), nil, nil)
+		second <- err
+	}()
+
+	select {
+	case <-second:
+		t.Fatal("message sent while another was pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gw.release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-second)
+
+	act, err := mc.StateGetActor(ctx, client, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), act.Nonce)
+}
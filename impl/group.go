@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/filecoin-project/boost/storagemarket/types"
@@ -11,12 +12,11 @@ import (
 	"github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
-	"github.com/filecoin-project/go-state-types/builtin"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/api/client"
 	chain_types "github.com/filecoin-project/lotus/chain/types"
 	"github.com/google/uuid"
 	blocks "github.com/ipfs/go-block-format"
@@ -25,11 +25,14 @@ import (
 	"github.com/ipld/go-car"
 	carutil "github.com/ipld/go-car/util"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/bsst"
 	"github.com/lotus-web3/ribs/jbob"
 	"github.com/lotus-web3/ribs/ributil"
 	mh "github.com/multiformats/go-multihash"
 	"io"
+	"math/bits"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -43,20 +46,47 @@ import (
 const DealProtocolv120 = "/fil/storage/mk/1.2.0"
 
 var (
-	// 100MB for now
-	// TODO: make this configurable
+	// default group size policy limits, see GroupSizePolicy
 	maxGroupSize int64 = 8000 << 20
 
-	// todo enforce this
 	maxGroupBlocks int64 = 20 << 20
 
 	targetReplicaCount = 5
 )
 
+// groupOptions are store-wide settings applied to every opened group
+type groupOptions struct {
+	// mmapReads enables memory-mapped reads for finalized groups
+	mmapReads bool
+
+	// verifiedDeals makes deals verified while the wallet has DataCap
+	verifiedDeals bool
+
+	chain            ChainAPI
+	providerSelector ProviderSelector
+	escrow           *escrowManager
+
+	// dealPolicy is used for groups without their own deal policy
+	dealPolicy iface.DealPolicy
+	// renewalPolicy gives default group retention, deal durations cover it
+	renewalPolicy RenewalPolicy
+
+	sizing GroupSizePolicy
+
+	// remoteRetrieval serves reads of offloaded groups
+	remoteRetrieval RemoteRetrievalFunc
+
+	// carURLs are public URLs of the tcp car server, deal data is sent
+	// over libp2p when empty
+	carURLs []string
+}
+
 type Group struct {
 	db    *ribsDB
 	index iface.Index
 
+	opts groupOptions
+
 	path string
 	id   int64
 
@@ -81,11 +111,18 @@ type Group struct {
 	readBlocks int64
 	readSize   int64
 
+	// unix nanos of the last read (or group open), used by the offload policy
+	lastAccess int64
+
 	jb *jbob.JBOB
 }
 
-func OpenGroup(db *ribsDB, index iface.Index, id, committedBlocks, committedSize int64, path string, state iface.GroupState, create bool) (*Group, error) {
-	groupPath := filepath.Join(path, "grp", strconv.FormatInt(id, 32))
+func groupDir(root string, id int64) string {
+	return filepath.Join(root, "grp", strconv.FormatInt(id, 32))
+}
+
+func OpenGroup(db *ribsDB, index iface.Index, id, committedBlocks, committedSize int64, path string, state iface.GroupState, create bool, opts groupOptions) (*Group, error) {
+	groupPath := groupDir(path, id)
 
 	if err := os.MkdirAll(groupPath, 0755); err != nil {
 		return nil, xerrors.Errorf("create group directory: %w", err)
@@ -97,6 +134,9 @@ func OpenGroup(db *ribsDB, index iface.Index, id, committedBlocks, committedSize
 	if create {
 		jbOpenFunc = jbob.Create
 	}
+	if state == iface.GroupStateOffloaded {
+		jbOpenFunc = jbob.OpenOffloaded
+	}
 
 	// todo read group head, replay log if needed
 
@@ -105,10 +145,12 @@ func OpenGroup(db *ribsDB, index iface.Index, id, committedBlocks, committedSize
 		return nil, xerrors.Errorf("open jbob: %w", err)
 	}
 
-	return &Group{
+	g := &Group{
 		db:    db,
 		index: index,
 
+		opts: opts,
+
 		jb: jb,
 
 		committedBlocks: committedBlocks,
@@ -117,7 +159,34 @@ func OpenGroup(db *ribsDB, index iface.Index, id, committedBlocks, committedSize
 		path:  groupPath,
 		id:    id,
 		state: state,
-	}, nil
+
+		lastAccess: time.Now().UnixNano(),
+	}
+
+	if state == iface.GroupStateOffloaded {
+		// finish offload interrupted after the state was persisted
+		if err := g.removeLocalData(); err != nil {
+			return nil, xerrors.Errorf("removing offloaded data: %w", err)
+		}
+	}
+
+	if state >= iface.GroupStateBSSTExists {
+		g.maybeEnableMmap()
+	}
+
+	return g, nil
+}
+
+// maybeEnableMmap switches a finalized group to mmap reads if enabled; falls
+// back to pread on failure
+func (m *Group) maybeEnableMmap() {
+	if !m.opts.mmapReads {
+		return
+	}
+
+	if err := m.jb.EnableMmap(); err != nil {
+		log.Warnw("enabling mmap reads, falling back to pread", "group", m.id, "error", err)
+	}
 }
 
 func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
@@ -136,19 +205,25 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	}
 
 	// reserve space
-	availSpace := maxGroupSize - m.committedSize - m.inflightSize // todo async - inflight
+	curBlocks := m.committedBlocks + m.inflightBlocks // todo async - inflight
+	curSize := m.committedSize + m.inflightSize
 
 	var writeSize int64
 	var writeBlocks int
 
 	for _, blk := range b {
-		if int64(len(blk.RawData()))+writeSize > availSpace {
+		if !m.opts.sizing.fits(curBlocks+int64(writeBlocks)+1, curSize+writeSize+int64(len(blk.RawData()))) {
 			break
 		}
 		writeSize += int64(len(blk.RawData()))
 		writeBlocks++
 	}
 
+	if writeBlocks == 0 && curBlocks == 0 {
+		// would never fit in any group
+		return 0, xerrors.Errorf("block of size %d exceeds group size policy", len(b[0].RawData()))
+	}
+
 	if writeBlocks < len(b) {
 		// this group is full
 		m.state = iface.GroupStateFull
@@ -186,21 +261,47 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	// 3.5 mark as read-only if full
 	// todo is this the right place to do this?
 	if m.state == iface.GroupStateFull {
-		if err := m.sync(ctx); err != nil {
-			// todo handle properly (abort, close, check disk space / resources, repopen)
-			return 0, xerrors.Errorf("sync full group: %w", err)
-		}
-
-		if err := m.jb.MarkReadOnly(); err != nil {
-			// todo handle properly (abort, close, check disk space / resources, repopen)
-			// todo combine with commit?
-			return 0, xerrors.Errorf("mark jbob read-only: %w", err)
+		if err := m.markFull(ctx); err != nil {
+			return 0, err
 		}
 	}
 
 	return writeBlocks, nil
 }
 
+// Seal marks a partially filled writable group as full, making it go through
+// finalization with whatever data it already holds
+func (m *Group) Seal(ctx context.Context) error {
+	m.jblk.Lock()
+	defer m.jblk.Unlock()
+
+	if m.state != iface.GroupStateWritable {
+		return xerrors.Errorf("group %d not writable, state %d", m.id, m.state)
+	}
+
+	if m.committedBlocks+m.inflightBlocks == 0 {
+		return xerrors.Errorf("group %d is empty", m.id)
+	}
+
+	m.state = iface.GroupStateFull
+	return m.markFull(ctx)
+}
+
+func (m *Group) markFull(ctx context.Context) error {
+	if err := m.sync(ctx); err != nil {
+		// todo handle properly (abort, close, check disk space / resources, repopen)
+		return xerrors.Errorf("sync full group: %w", err)
+	}
+
+	if err := m.jb.MarkReadOnly(); err != nil {
+		// todo handle properly (abort, close, check disk space / resources, repopen)
+		// todo combine with commit?
+		return xerrors.Errorf("mark jbob read-only: %w", err)
+	}
+
+	return nil
+}
+
 func (m *Group) Sync(ctx context.Context) error {
 	m.jblk.Lock()
 	defer m.jblk.Unlock()
@@ -249,6 +350,46 @@ func (m *Group) Unlink(ctx context.Context, c []mh.Multihash) error {
 }
 
 func (m *Group) View(ctx context.Context, c []mh.Multihash, cb func(cidx int, data []byte)) error {
+	atomic.StoreInt64(&m.lastAccess, time.Now().UnixNano())
+
+	err := m.view(c, cb)
+	if xerrors.Is(err, jbob.ErrOffloaded) {
+		return m.remoteView(ctx, c, cb)
+	}
+
+	// index lookups happen before any callbacks are called, so it's safe to
+	// retry the whole read after rebuilding the index
+	var cerr *bsst.CorruptionError
+	if xerrors.As(err, &cerr) {
+		log.Errorw("group bsst index corrupted, rebuilding from log", "group", m.id, "bucket", cerr.Bucket, "error", err)
+
+		if err := m.RebuildIndex(ctx); err != nil {
+			return xerrors.Errorf("rebuilding corrupted index: %w", err)
+		}
+
+		return m.view(c, cb)
+	}
+
+	return err
+}
+
+func (m *Group) remoteView(ctx context.Context, c []mh.Multihash, cb func(cidx int, data []byte)) error {
+	if m.opts.remoteRetrieval == nil {
+		return xerrors.Errorf("group %d is offloaded and remote retrieval is not configured", m.id)
+	}
+
+	return m.opts.remoteRetrieval(ctx, m.id, c, func(cidx int, data []byte) {
+		atomic.AddInt64(&m.readBlocks, 1)
+		atomic.AddInt64(&m.readSize, int64(len(data)))
+
+		cb(cidx, data)
+	})
+}
+
+func (m *Group) view(c []mh.Multihash, cb func(cidx int, data []byte)) error {
+	// jbob reads are safe to run concurrently with Put, so no need for jblk;
+	// not-yet-flushed writes are served from the jbob write buffer
+
 	// right now we just read from jbob
 	return m.jb.View(c, func(cidx int, found bool, data []byte) error {
 		// TODO: handle not found better?
@@ -292,12 +433,30 @@ func (m *Group) Finalize(ctx context.Context) error {
 		return xerrors.Errorf("mark level index dropped: %w", err)
 	}
 
+	m.maybeEnableMmap()
+
+	return nil
+}
+
+// RebuildIndex re-creates the BSST index of a finalized group from blk.jblog
+func (m *Group) RebuildIndex(ctx context.Context) error {
+	m.jblk.Lock()
+	defer m.jblk.Unlock()
+
+	if m.state < iface.GroupStateBSSTExists {
+		return xerrors.Errorf("group not in state for rebuilding bsst: %d", m.state)
+	}
+
+	if err := m.jb.RebuildBSST(); err != nil {
+		return xerrors.Errorf("rebuild jbob bsst: %w", err)
+	}
+
 	return nil
 }
 
 func (m *Group) GenTopCar(ctx context.Context) error {
 	m.jblk.RLock()
-	defer m.jblk.RLock()
+	defer m.jblk.RUnlock()
 
 	if err := os.Mkdir(filepath.Join(m.path, "vcar"), 0755); err != nil {
 		return xerrors.Errorf("make vcar dir: %w", err)
@@ -307,6 +466,20 @@ func (m *Group) GenTopCar(ctx context.Context) error {
 		return xerrors.Errorf("group not in state for generating top CAR: %d", m.state)
 	}
 
+	if err := m.writeVCARLayers(); err != nil {
+		return err
+	}
+
+	if err := m.advanceState(ctx, iface.GroupStateVRCARDone); err != nil {
+		return xerrors.Errorf("mark level index dropped: %w", err)
+	}
+
+	return nil
+}
+
+// writeVCARLayers writes the vcar link layers over jbob data into the vcar
+// directory
+func (m *Group) writeVCARLayers() error {
 	level := 1
 	const arity = 2048
 	var links []cid.Cid
@@ -424,10 +597,6 @@ func (m *Group) GenTopCar(ctx context.Context) error {
 		return xerrors.Errorf("write arity file: %w", err)
 	}
 
-	if err := m.advanceState(ctx, iface.GroupStateVRCARDone); err != nil {
-		return xerrors.Errorf("mark level index dropped: %w", err)
-	}
-
 	return nil
 }
 
@@ -440,11 +609,16 @@ func (m *Group) GenCommP() error {
 
 	start := time.Now()
 
-	carSize, root, err := m.writeCar(cc)
+	carIdx := &carOffsetIndex{}
+	carSize, root, err := m.writeCarAt(cc, 0, nil, carIdx)
 	if err != nil {
 		return xerrors.Errorf("write car: %w", err)
 	}
 
+	if err := carIdx.save(m.path); err != nil {
+		return xerrors.Errorf("save car offset index: %w", err)
+	}
+
 	sum, err := cc.Sum()
 	if err != nil {
 		panic(err)
@@ -461,8 +635,6 @@ func (m *Group) GenCommP() error {
 	return nil
 }
 
-var verified = false
-
 type ErrRejected struct {
 	Reason string
 }
@@ -471,8 +643,72 @@ func (e ErrRejected) Error() string {
 	return fmt.Sprintf("deal proposal rejected: %s", e.Reason)
 }
 
-func (m *Group) MakeMoreDeals(ctx context.Context, h host.Host, w *ributil.LocalWallet, reqToken []byte) error {
-	provs, err := m.db.SelectDealProviders(m.id)
+// dealRound is state shared by deals proposed together
+type dealRound struct {
+	dealInfo    dealParams
+	policy      iface.DealPolicy
+	retainUntil time.Time
+
+	walletAddr address.Address
+
+	// verified deals are made while the wallet has enough DataCap
+	verified bool
+	dataCap  abi.StoragePower
+}
+
+func (m *Group) startDealRound(ctx context.Context, w *ributil.LocalWallet) (*dealRound, error) {
+	dealInfo, err := m.db.GetDealParams(ctx, m.id)
+	if err != nil {
+		return nil, xerrors.Errorf("get deal params: %w", err)
+	}
+
+	dr := &dealRound{
+		dealInfo:    dealInfo,
+		policy:      m.opts.dealPolicy,
+		retainUntil: m.opts.renewalPolicy.retainUntil(dealInfo.CreatedAt, dealInfo.RetainUntil),
+		dataCap:     big.Zero(),
+	}
+	if dealInfo.DealPolicy != nil {
+		dr.policy = *dealInfo.DealPolicy
+	}
+
+	dr.walletAddr, err = w.GetDefault()
+	if err != nil {
+		return nil, xerrors.Errorf("get wallet address: %w", err)
+	}
+
+	if m.opts.verifiedDeals {
+		dr.dataCap, err = clientDataCap(ctx, m.opts.chain, dr.walletAddr)
+		if err != nil {
+			return nil, xerrors.Errorf("getting datacap: %w", err)
+		}
+	}
+	dr.verified = m.opts.verifiedDeals && dr.dataCap.GreaterThanEqual(big.NewInt(dealInfo.PieceSize))
+	if m.opts.verifiedDeals && !dr.verified {
+		log.Warnw("not enough datacap for verified deals, making unverified deals", "group", m.id, "datacap", dr.dataCap, "piece", dealInfo.PieceSize)
+	}
+
+	return dr, nil
+}
+
+// MakeMoreDeals proposes deals to selected providers, mkToken makes car
+// request tokens for each deal
+func (m *Group) MakeMoreDeals(ctx context.Context, h host.Host, w *ributil.LocalWallet, mkToken func(dealUUID uuid.UUID, provider peer.ID) ([]byte, error)) error {
+	if err := m.opts.escrow.canSpend(m.id); err != nil {
+		return err
+	}
+
+	dr, err := m.startDealRound(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	provs, err := selectDealProviders(ctx, m.db, m.opts.providerSelector, DealRequest{
+		Group:     m.id,
+		PieceSize: abi.PaddedPieceSize(dr.dealInfo.PieceSize),
+		Verified:  dr.verified,
+		MaxPrice:  dr.policy.MaxPrice,
+	})
 	if err != nil {
 		return xerrors.Errorf("select deal providers: %w", err)
 	}
@@ -483,193 +719,371 @@ func (m *Group) MakeMoreDeals(ctx context.Context, h host.Host, w *ributil.Local
 		return xerrors.Errorf("getting non-failed deal count: %w", err)
 	}
 
-	gw, closer, err := client.NewGatewayRPCV1(ctx, "http://api.chain.love/rpc/v1", nil)
-	if err != nil {
-		return xerrors.Errorf("creating gateway rpc client: %w", err)
+	var budgetErr error
+
+	// make deals with candidates
+	for _, prov := range provs {
+		prov := prov
+		transfer := func(dealUUID uuid.UUID, pid peer.ID) (types.Transfer, error) {
+			reqToken, err := mkToken(dealUUID, pid)
+			if err != nil {
+				return types.Transfer{}, xerrors.Errorf("making car request token: %w", err)
+			}
+
+			return m.carTransfer(h, prov, reqToken, dr.dealInfo.CarSize)
+		}
+
+		err = m.proposeDeal(ctx, h, w, dr, prov, transfer, false)
+		if err == nil {
+			notFailed++
+
+			if notFailed >= targetReplicaCount {
+				// enough
+				break
+			}
+
+			// deal made
+			continue
+		}
+		if xerrors.Is(err, ErrBudgetExhausted) {
+			budgetErr = err
+			break
+		}
+		/*if re, ok := err.(ErrRejected); ok {
+			// deal rejected
+			continue
+		}*/
+
+		log.Errorw("failed to make deal with provider", "provider", prov, "error", err)
 	}
-	defer closer()
 
-	walletAddr, err := w.GetDefault()
-	if err != nil {
-		return xerrors.Errorf("get wallet address: %w", err)
+	// move to deals made state
+	if err := m.advanceState(ctx, iface.GroupStateDealsInProgress); err != nil {
+		return xerrors.Errorf("mark level index dropped: %w", err)
 	}
 
-	dealInfo, err := m.db.GetDealParams(ctx, m.id)
-	if err != nil {
-		return xerrors.Errorf("get deal params: %w", err)
+	return budgetErr
+}
+
+// carTransfer picks how a provider fetches the deal CAR: over http from one
+// of the public car server URLs, unless the provider recently failed to, and
+// over libp2p otherwise
+func (m *Group) carTransfer(h host.Host, prov ProviderCandidate, reqToken []byte, carSize int64) (types.Transfer, error) {
+	transferParams := &types2.HttpRequest{
+		Headers: map[string]string{
+			"Authorization": string(reqToken),
+		},
+	}
+	ttype := "libp2p"
+
+	useHttp := len(m.opts.carURLs) > 0
+	if useHttp {
+		failed, err := m.db.HttpTransferFailedSince(prov.ID, time.Now().Add(-httpTransferRetryAfter))
+		if err != nil {
+			return types.Transfer{}, err
+		}
+		useHttp = !failed
 	}
 
-	transferParams := &types2.HttpRequest{URL: "libp2p://" + h.Addrs()[0].String() + "/p2p/" + h.ID().String()} // todo get from autonat / config
-	transferParams.Headers = map[string]string{
-		"Authorization": string(reqToken),
+	if useHttp {
+		// spread providers over the public addresses
+		transferParams.URL = m.opts.carURLs[int(prov.ID%int64(len(m.opts.carURLs)))]
+		ttype = "http"
+	} else {
+		addr, err := transferAddr(h)
+		if err != nil {
+			return types.Transfer{}, xerrors.Errorf("getting transfer address: %w", err)
+		}
+		transferParams.URL = "libp2p://" + addr.String() + "/p2p/" + h.ID().String()
 	}
 
 	paramsBytes, err := json.Marshal(transferParams)
 	if err != nil {
-		return fmt.Errorf("marshalling request parameters: %w", err)
+		return types.Transfer{}, fmt.Errorf("marshalling request parameters: %w", err)
 	}
 
-	transfer := types.Transfer{
-		Type:   "libp2p",
+	return types.Transfer{
+		Type:   ttype,
 		Params: paramsBytes,
-		Size:   uint64(dealInfo.CarSize),
+		Size:   uint64(carSize),
+	}, nil
+}
+
+// MakeOfflineDeals proposes offline deals to the given providers, which get
+// the group CAR out of band
+func (m *Group) MakeOfflineDeals(ctx context.Context, h host.Host, w *ributil.LocalWallet, providers []int64) error {
+	if m.state < iface.GroupStateHasCommp || m.state == iface.GroupStateOffloaded {
+		return xerrors.Errorf("group not in state for making deals: %d", m.state)
 	}
 
-	pieceCid, err := commcid.PieceCommitmentV1ToCID(dealInfo.CommP)
+	if err := m.opts.escrow.canSpend(m.id); err != nil {
+		return err
+	}
+
+	dr, err := m.startDealRound(ctx, w)
 	if err != nil {
-		return fmt.Errorf("failed to convert commP to cid: %w", err)
+		return err
 	}
 
-	makeDealWith := func(prov dealProvider) error {
-		maddr, err := address.NewIDAddress(uint64(prov.id))
-		if err != nil {
-			return xerrors.Errorf("new id address: %w", err)
-		}
+	cands, err := m.db.DealCandidates(m.id)
+	if err != nil {
+		return xerrors.Errorf("getting deal candidates: %w", err)
+	}
+	byID := map[int64]ProviderCandidate{}
+	for _, c := range cands {
+		byID[c.ID] = c
+	}
 
-		addrInfo, err := GetAddrInfo(ctx, gw, maddr)
-		if err != nil {
-			return xerrors.Errorf("get addr info: %w", err)
-		}
+	var made int
+	var lastErr error
 
-		if err := h.Connect(ctx, *addrInfo); err != nil {
-			return xerrors.Errorf("connect to miner: %w", err)
+	for _, id := range providers {
+		prov, ok := byID[id]
+		if !ok {
+			lastErr = xerrors.Errorf("provider f0%d isn't a deal candidate for the group (unreachable, no ask, quarantined or already has a deal)", id)
+			log.Errorw("failed to make offline deal", "provider", id, "error", lastErr)
+			continue
 		}
 
-		x, err := h.Peerstore().FirstSupportedProtocol(addrInfo.ID, DealProtocolv120)
+		err := m.proposeDeal(ctx, h, w, dr, prov, nil, true)
 		if err != nil {
-			return fmt.Errorf("getting protocols for peer %s: %w", addrInfo.ID, err)
+			lastErr = err
+			log.Errorw("failed to make offline deal", "provider", id, "error", err)
+			if xerrors.Is(err, ErrBudgetExhausted) {
+				break
+			}
+			continue
 		}
 
-		if len(x) == 0 {
-			return fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", maddr)
+		made++
+	}
+
+	if made > 0 {
+		if err := m.advanceState(ctx, iface.GroupStateDealsInProgress); err != nil {
+			return xerrors.Errorf("mark deals in progress: %w", err)
 		}
+	}
 
-		var providerCollateral abi.TokenAmount
+	if lastErr != nil {
+		return xerrors.Errorf("%d of %d offline deals failed: %w", len(providers)-made, len(providers), lastErr)
+	}
 
-		bounds, err := gw.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(dealInfo.PieceSize), verified, chain_types.EmptyTSK)
-		if err != nil {
-			return fmt.Errorf("node error getting collateral bounds: %w", err)
-		}
-		providerCollateral = big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)) // add 20%
+	return nil
+}
 
-		head, err := gw.ChainHead(ctx)
-		if err != nil {
-			return fmt.Errorf("getting chain head: %w", err)
-		}
+// proposeDeal sends a deal proposal to a provider and records the deal,
+// transfer makes the data transfer params for online deals
+func (m *Group) proposeDeal(ctx context.Context, h host.Host, w *ributil.LocalWallet, dr *dealRound, prov ProviderCandidate, transfer func(dealUUID uuid.UUID, pid peer.ID) (types.Transfer, error), offline bool) error {
+	gw := m.opts.chain
+	policy := dr.policy
 
-		startEpoch := head.Height() + abi.ChainEpoch(5760) // head + 2 days
+	maddr, err := address.NewIDAddress(uint64(prov.ID))
+	if err != nil {
+		return xerrors.Errorf("new id address: %w", err)
+	}
 
-		dealUuid := uuid.New()
+	addrInfo, err := GetAddrInfo(ctx, gw, maddr)
+	if err != nil {
+		return xerrors.Errorf("get addr info: %w", err)
+	}
 
-		duration := 400 * builtin.EpochsInDay
+	if err := h.Connect(ctx, *addrInfo); err != nil {
+		return xerrors.Errorf("connect to miner: %w", err)
+	}
 
-		price := big.NewInt(prov.ask_price)
-		if verified {
-			price = big.NewInt(prov.ask_verif_price)
-		}
+	x, err := h.Peerstore().FirstSupportedProtocol(addrInfo.ID, DealProtocolv120)
+	if err != nil {
+		return fmt.Errorf("getting protocols for peer %s: %w", addrInfo.ID, err)
+	}
 
-		if price.GreaterThan(big.NewInt(int64(maxPrice))) {
-			// this check is probably redundant, buuut..
-			return fmt.Errorf("price %d is greater than max price %f", price, maxPrice)
-		}
+	if len(x) == 0 {
+		return fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", maddr)
+	}
+
+	// groups sealed early may be smaller than what the provider accepts
+	pieceCid, pieceSize, err := dealPiece(dr.dealInfo.CommP, abi.PaddedPieceSize(dr.dealInfo.PieceSize), abi.PaddedPieceSize(prov.AskMinPieceSize))
+	if err != nil {
+		return xerrors.Errorf("getting deal piece: %w", err)
+	}
+	if err := checkDealPiece(prov, pieceSize); err != nil {
+		return err
+	}
 
-		dealProposal, err := dealProposal(ctx, w, walletAddr, dealInfo.Root, abi.PaddedPieceSize(dealInfo.PieceSize), pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
+	// datacap is spent on the padded piece, it may not be enough for
+	// this provider
+	verified := dr.verified && dr.dataCap.GreaterThanEqual(big.NewInt(int64(pieceSize)))
+	if m.opts.verifiedDeals && !verified {
+		sel, err := m.opts.providerSelector.SelectProviders(ctx, DealRequest{Group: m.id, PieceSize: pieceSize, MaxPrice: policy.MaxPrice}, []ProviderCandidate{prov})
 		if err != nil {
-			return fmt.Errorf("failed to create a deal proposal: %w", err)
+			return xerrors.Errorf("checking provider for unverified deal: %w", err)
 		}
-
-		var proposalBuf bytes.Buffer
-		if err := dealProposal.MarshalCBOR(&proposalBuf); err != nil {
-			return fmt.Errorf("failed to marshal deal proposal: %w", err)
+		if len(sel) == 0 {
+			return xerrors.Errorf("not enough datacap for a verified deal, and the provider isn't acceptable for unverified deals")
 		}
+	}
 
-		dealParams := types.DealParams{
-			DealUUID:           dealUuid,
-			ClientDealProposal: *dealProposal,
-			DealDataRoot:       dealInfo.Root,
-			IsOffline:          false,
-			Transfer:           transfer,
-		}
+	// price limits are enforced by the provider selector
+	price := big.NewInt(prov.AskPrice)
+	if verified {
+		price = big.NewInt(prov.AskVerifiedPrice)
+	}
+	if policy.MaxPrice > 0 && price.GreaterThan(big.NewInt(policy.MaxPrice)) {
+		return xerrors.Errorf("provider price %s above policy max %d", price, policy.MaxPrice)
+	}
+
+	bounds, err := gw.StateDealProviderCollateralBounds(ctx, pieceSize, verified, chain_types.EmptyTSK)
+	if err != nil {
+		return fmt.Errorf("node error getting collateral bounds: %w", err)
+	}
+	providerCollateral := dealCollateral(policy, bounds)
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return fmt.Errorf("getting chain head: %w", err)
+	}
+
+	startDelay := dealStartDelay(policy, pieceSize, offline)
+	startEpoch := head.Height() + startDelay
+	duration := dealDuration(policy, time.Now().Add(time.Duration(startDelay)*epochDuration), dr.retainUntil)
 
-		// MAKE THE DEAL
+	dealUuid := uuid.New()
 
-		s, err := h.NewStream(ctx, addrInfo.ID, DealProtocolv120)
+	var dealTransfer types.Transfer
+	if transfer != nil {
+		dealTransfer, err = transfer(dealUuid, addrInfo.ID)
 		if err != nil {
-			return fmt.Errorf("failed to open stream to peer %s: %w", addrInfo.ID, err)
+			return xerrors.Errorf("making transfer params: %w", err)
 		}
-		defer s.Close()
+	}
 
-		var resp types.DealResponse
-		if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
-			return fmt.Errorf("send proposal rpc: %w", err)
-		}
+	dealProposal, err := dealProposal(ctx, w, dr.walletAddr, dr.dealInfo.Root, pieceSize, pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
+	if err != nil {
+		return fmt.Errorf("failed to create a deal proposal: %w", err)
+	}
 
-		di := dbDealInfo{
-			DealUUID:            dealUuid.String(),
-			GroupID:             m.id,
-			ClientAddr:          walletAddr.String(),
-			ProviderAddr:        prov.id,
-			PricePerEpoch:       price.Int64(),
-			Verified:            verified,
-			KeepUnsealed:        true,
-			StartEpoch:          startEpoch,
-			EndEpoch:            startEpoch + abi.ChainEpoch(duration),
-			SignedProposalBytes: proposalBuf.Bytes(),
+	cost := dealProposal.Proposal.ClientBalanceRequirement()
+	if err := m.opts.escrow.reserve(ctx, gw, m.id, dealUuid.String(), cost); err != nil {
+		return xerrors.Errorf("reserving escrow: %w", err)
+	}
+
+	// the reservation is kept once the deal is stored as accepted
+	accepted := false
+	defer func() {
+		if accepted {
+			return
 		}
+		if err := m.opts.escrow.cancel(dealUuid.String()); err != nil {
+			log.Errorw("cancelling escrow reservation", "deal", dealUuid, "error", err)
+		}
+	}()
 
-		if !resp.Accepted {
-			err = m.db.StoreRejectedDeal(di, resp.Message)
-			if err != nil {
-				return fmt.Errorf("saving rejected deal info: %w", err)
-			}
+	var proposalBuf bytes.Buffer
+	if err := dealProposal.MarshalCBOR(&proposalBuf); err != nil {
+		return fmt.Errorf("failed to marshal deal proposal: %w", err)
+	}
 
-			return ErrRejected{Reason: resp.Message}
-		}
+	dealParams := types.DealParams{
+		DealUUID:           dealUuid,
+		ClientDealProposal: *dealProposal,
+		DealDataRoot:       dr.dealInfo.Root,
+		IsOffline:          offline,
+		Transfer:           dealTransfer,
+	}
 
-		// SAVE DETAILS
+	// MAKE THE DEAL
 
-		err = m.db.StoreProposedDeal(di)
+	s, err := h.NewStream(ctx, addrInfo.ID, DealProtocolv120)
+	if err != nil {
+		return fmt.Errorf("failed to open stream to peer %s: %w", addrInfo.ID, err)
+	}
+	defer s.Close()
+
+	var resp types.DealResponse
+	if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
+		return fmt.Errorf("send proposal rpc: %w", err)
+	}
+
+	di := dbDealInfo{
+		DealUUID:            dealUuid.String(),
+		GroupID:             m.id,
+		ClientAddr:          dr.walletAddr.String(),
+		ProviderAddr:        prov.ID,
+		PricePerEpoch:       price.Int64(),
+		Verified:            verified,
+		KeepUnsealed:        policy.KeepUnsealed,
+		Offline:             offline,
+		TransferType:        dealTransfer.Type,
+		StartEpoch:          startEpoch,
+		EndEpoch:            startEpoch + duration,
+		DealPolicy:          policy,
+		ProviderCollateral:  providerCollateral.String(),
+		SignedProposalBytes: proposalBuf.Bytes(),
+	}
+
+	if !resp.Accepted {
+		err = m.db.StoreRejectedDeal(di, resp.Message)
 		if err != nil {
-			return fmt.Errorf("saving deal info: %w", err)
+			return fmt.Errorf("saving rejected deal info: %w", err)
 		}
 
-		log.Warnf("Deal %s with %s accepted for group %d!!!", dealUuid, maddr, m.id)
+		return ErrRejected{Reason: resp.Message}
+	}
 
-		return nil
+	// SAVE DETAILS
+
+	err = m.db.StoreProposedDeal(di)
+	if err != nil {
+		return fmt.Errorf("saving deal info: %w", err)
 	}
 
-	// make deals with candidates
-	for _, prov := range provs {
-		err := makeDealWith(prov)
-		if err == nil {
-			notFailed++
+	accepted = true
 
-			if notFailed >= targetReplicaCount {
-				// enough
-				break
-			}
+	if verified {
+		dr.dataCap = big.Sub(dr.dataCap, big.NewInt(int64(pieceSize)))
+	}
 
-			// deal made
-			continue
+	log.Warnf("Deal %s with %s accepted for group %d!!!", dealUuid, maddr, m.id)
+
+	return nil
+}
+
+// clientDataCap returns DataCap of a verified client, zero for other addresses
+func clientDataCap(ctx context.Context, gw ChainAPI, addr address.Address) (abi.StoragePower, error) {
+	dc, err := gw.StateVerifiedClientStatus(ctx, addr, chain_types.EmptyTSK)
+	if err != nil {
+		return big.Zero(), xerrors.Errorf("getting verified client status: %w", err)
+	}
+	if dc == nil {
+		return big.Zero(), nil
+	}
+	return *dc, nil
+}
+
+// dealPiece returns the piece CID and size to propose to a provider. Pieces
+// below the provider's minimum piece size are padded with zeros up to it; the
+// provider applies the same padding when verifying the received CAR.
+func dealPiece(commP []byte, pieceSize, minPieceSize abi.PaddedPieceSize) (cid.Cid, abi.PaddedPieceSize, error) {
+	if minPieceSize > pieceSize {
+		target := abi.PaddedPieceSize(1) << bits.Len64(uint64(minPieceSize-1))
+
+		padded, err := commp.PadCommP(commP, uint64(pieceSize), uint64(target))
+		if err != nil {
+			return cid.Undef, 0, xerrors.Errorf("padding commP: %w", err)
 		}
-		/*if re, ok := err.(ErrRejected); ok {
-			// deal rejected
-			continue
-		}*/
 
-		log.Errorw("failed to make deal with provider", "provider", prov, "error", err)
+		commP, pieceSize = padded, target
 	}
 
-	// move to deals made state
-	if err := m.advanceState(ctx, iface.GroupStateDealsInProgress); err != nil {
-		return xerrors.Errorf("mark level index dropped: %w", err)
+	pieceCid, err := commcid.PieceCommitmentV1ToCID(commP)
+	if err != nil {
+		return cid.Undef, 0, xerrors.Errorf("failed to convert commP to cid: %w", err)
 	}
 
-	return nil
+	return pieceCid, pieceSize, nil
 }
 
-func dealProposal(ctx context.Context, w *ributil.LocalWallet, clientAddr address.Address, rootCid cid.Cid, pieceSize abi.PaddedPieceSize, pieceCid cid.Cid, minerAddr address.Address, startEpoch abi.ChainEpoch, duration int, verified bool, providerCollateral abi.TokenAmount, storagePrice abi.TokenAmount) (*market.ClientDealProposal, error) {
-	endEpoch := startEpoch + abi.ChainEpoch(duration)
+func dealProposal(ctx context.Context, w *ributil.LocalWallet, clientAddr address.Address, rootCid cid.Cid, pieceSize abi.PaddedPieceSize, pieceCid cid.Cid, minerAddr address.Address, startEpoch abi.ChainEpoch, duration abi.ChainEpoch, verified bool, providerCollateral abi.TokenAmount, storagePrice abi.TokenAmount) (*market.ClientDealProposal, error) {
+	endEpoch := startEpoch + duration
 	// deal proposal expects total storage price for deal per epoch, therefore we
 	// multiply pieceSize * storagePrice (which is set per epoch per GiB) and divide by 2^30
 	storagePricePerEpochForDeal := big.Div(big.Mul(big.NewInt(int64(pieceSize)), storagePrice), big.NewInt(int64(1<<30)))
@@ -688,6 +1102,7 @@ func dealProposal(ctx context.Context, w *ributil.LocalWallet, clientAddr addres
 		EndEpoch:             endEpoch,
 		StoragePricePerEpoch: storagePricePerEpochForDeal,
 		ProviderCollateral:   providerCollateral,
+		ClientCollateral:     big.Zero(),
 	}
 
 	buf, err := cborutil.Dump(&proposal)
@@ -706,6 +1121,125 @@ func dealProposal(ctx context.Context, w *ributil.LocalWallet, clientAddr addres
 	}, nil
 }
 
+// ExportCar writes the deal CAR of a group with local data
+func (m *Group) ExportCar(w io.Writer) (int64, cid.Cid, error) {
+	m.jblk.RLock()
+	defer m.jblk.RUnlock()
+
+	if m.state < iface.GroupStateHasCommp || m.state == iface.GroupStateOffloaded {
+		return 0, cid.Undef, xerrors.Errorf("group not in state for exporting: %d", m.state)
+	}
+
+	return m.writeCar(w)
+}
+
+// MarkDealsDone moves a group with enough sealed deals out of deal-making
+func (m *Group) MarkDealsDone(ctx context.Context) error {
+	m.jblk.Lock()
+	defer m.jblk.Unlock()
+
+	if m.state != iface.GroupStateDealsInProgress {
+		return nil
+	}
+
+	return m.advanceState(ctx, iface.GroupStateDealsDone)
+}
+
+// Offload removes local block data and vcar layers of a group with deals,
+// keeping the bsst index and metadata
+func (m *Group) Offload(ctx context.Context) error {
+	m.jblk.Lock()
+	defer m.jblk.Unlock()
+
+	if m.state != iface.GroupStateDealsInProgress && m.state != iface.GroupStateDealsDone {
+		return xerrors.Errorf("group not in state for offloading: %d", m.state)
+	}
+
+	// persist the state first, OpenGroup finishes removal if we crash below
+	if err := m.advanceState(ctx, iface.GroupStateOffloaded); err != nil {
+		return xerrors.Errorf("marking group as offloaded: %w", err)
+	}
+
+	return m.removeLocalData()
+}
+
+// Rehydrate restores local data of an offloaded group from its deal CAR,
+// which must already be verified against the group commP
+func (m *Group) Rehydrate(ctx context.Context, carData io.Reader) error {
+	m.jblk.Lock()
+	defer m.jblk.Unlock()
+
+	if m.state != iface.GroupStateOffloaded {
+		return xerrors.Errorf("group not offloaded, state %d", m.state)
+	}
+
+	cr, err := car.NewCarReader(bufio.NewReaderSize(carData, 4<<20))
+	if err != nil {
+		return xerrors.Errorf("reading car header: %w", err)
+	}
+
+	// the deal car has jbob blocks in log order, interleaved with vcar link
+	// blocks which jbob skips as they aren't in its index
+	err = m.jb.Rehydrate(func(cb func(c mh.Multihash, data []byte) error) error {
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return xerrors.Errorf("reading car block: %w", err)
+			}
+
+			if err := cb(blk.Cid().Hash(), blk.RawData()); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return xerrors.Errorf("rehydrating jbob: %w", err)
+	}
+
+	vcarDir := filepath.Join(m.path, "vcar")
+	if err := os.RemoveAll(vcarDir); err != nil {
+		return xerrors.Errorf("removing old vcar layers: %w", err)
+	}
+	if err := os.Mkdir(vcarDir, 0755); err != nil {
+		return xerrors.Errorf("make vcar dir: %w", err)
+	}
+	if err := m.writeVCARLayers(); err != nil {
+		return xerrors.Errorf("writing vcar layers: %w", err)
+	}
+
+	// repair and renewal deals of rehydrated groups fetch car ranges
+	carIdx := &carOffsetIndex{}
+	if _, _, err := m.writeCarAt(io.Discard, 0, nil, carIdx); err != nil {
+		return xerrors.Errorf("rebuilding car offset index: %w", err)
+	}
+	if err := carIdx.save(m.path); err != nil {
+		return xerrors.Errorf("save car offset index: %w", err)
+	}
+
+	m.maybeEnableMmap()
+
+	// not cold anymore, the group shouldn't be offloaded before repair deals
+	// get made
+	atomic.StoreInt64(&m.lastAccess, time.Now().UnixNano())
+
+	return m.advanceState(ctx, iface.GroupStateDealsDone)
+}
+
+func (m *Group) removeLocalData() error {
+	if err := m.jb.Offload(); err != nil {
+		return xerrors.Errorf("offloading jbob: %w", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(m.path, "vcar")); err != nil {
+		return xerrors.Errorf("removing vcar layers: %w", err)
+	}
+
+	return nil
+}
+
 func (m *Group) advanceState(ctx context.Context, st iface.GroupState) error {
 	m.dblk.Lock()
 	defer m.dblk.Unlock()
@@ -746,6 +1280,33 @@ func (s *sizerWriter) Write(p []byte) (int, error) {
 
 // returns car size and root cid
 func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
+	return m.writeCarAt(w, 0, nil, nil)
+}
+
+// writeCarRange writes length bytes of the CAR starting at offset, -1 length
+// writes to the end. Uses the offset index to skip regenerating data before
+// the range when available.
+func (m *Group) writeCarRange(w io.Writer, offset, length int64) error {
+	idx, err := loadCarIndex(m.path)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = m.writeCarAt(&carRangeWriter{w: w, left: length}, offset, idx, nil)
+	if err != nil && !xerrors.Is(err, errCarRangeDone) {
+		return err
+	}
+	return nil
+}
+
+// writeCarAt writes the CAR from offset, using idx to skip to it when not nil.
+// Offset index entries are collected into build when not nil, which requires
+// writing from the start.
+func (m *Group) writeCarAt(w io.Writer, offset int64, idx, build *carOffsetIndex) (int64, cid.Cid, error) {
+	if build != nil && offset != 0 {
+		return 0, cid.Undef, xerrors.Errorf("can only build car offset index writing from the start")
+	}
+
 	// read layers file
 	ls, err := os.ReadFile(filepath.Join(m.path, "vcar", "layers"))
 	if err != nil {
@@ -799,37 +1360,75 @@ func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
 
 	// todo consider buffering the writes
 
-	sw := &sizerWriter{w: w}
-	w = sw
-
-	if err := car.WriteHeader(&car.CarHeader{
-		Roots:   []cid.Cid{rcid},
-		Version: 1,
-	}, w); err != nil {
-		return 0, cid.Undef, xerrors.Errorf("write car header: %w", err)
-	}
-	_, err = layers[len(layers)-1].f.Seek(0, io.SeekStart)
-	if err != nil {
-		return 0, cid.Undef, xerrors.Errorf("seeking to start of last layer: %w", err)
+	ent := idx.entryFor(offset)
+	if ent != nil && (len(ent.LayerWrote) != layerCount+1 || len(ent.LayerOffsets) != layerCount) {
+		return 0, cid.Undef, xerrors.Errorf("car offset index doesn't match vcar layers")
 	}
-	layers[len(layers)-1].br.Reset(layers[len(layers)-1].f)
 
 	// write depth first, starting from top layer
 	atLayer := layerCount
-
 	layerWrote := make([]int, layerCount+1)
+	var jbobStart int64
+
+	sw := &sizerWriter{w: &carRangeWriter{w: w, skip: offset, left: -1}}
+
+	if ent != nil {
+		sw.s = ent.CarOffset
+		sw.w = &carRangeWriter{w: w, skip: offset - ent.CarOffset, left: -1}
+
+		for i, l := range layers {
+			l.pos = ent.LayerOffsets[i]
+			if _, err := l.f.Seek(l.pos, io.SeekStart); err != nil {
+				return 0, cid.Undef, xerrors.Errorf("seeking layer %d: %w", i+1, err)
+			}
+			l.br.Reset(l.f)
+		}
+
+		atLayer = ent.AtLayer
+		copy(layerWrote, ent.LayerWrote)
+		jbobStart = ent.JbobOffset
+	} else {
+		if err := car.WriteHeader(&car.CarHeader{
+			Roots:   []cid.Cid{rcid},
+			Version: 1,
+		}, sw); err != nil {
+			return 0, cid.Undef, xerrors.Errorf("write car header: %w", err)
+		}
+		_, err = layers[len(layers)-1].f.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, cid.Undef, xerrors.Errorf("seeking to start of last layer: %w", err)
+		}
+		layers[len(layers)-1].br.Reset(layers[len(layers)-1].f)
+	}
+
+	var lastIndexed int64 = -carIndexInterval
+
+	err = m.jb.IterateFrom(jbobStart, func(at int64, c mh.Multihash, data []byte) error {
+		if build != nil && sw.s-lastIndexed >= carIndexInterval {
+			e := carOffsetEntry{
+				CarOffset:    sw.s,
+				JbobOffset:   at,
+				AtLayer:      atLayer,
+				LayerWrote:   append([]int{}, layerWrote...),
+				LayerOffsets: make([]int64, len(layers)),
+			}
+			for i, l := range layers {
+				e.LayerOffsets[i] = l.pos
+			}
+			build.Entries = append(build.Entries, e)
+			lastIndexed = sw.s
+		}
 
-	err = m.jb.Iterate(func(c mh.Multihash, data []byte) error {
 		// get down to layer 0 (jbob)
 		for atLayer > 0 {
 			// read next block from current layer
-			c, data, err := carutil.ReadNode(layers[atLayer-1].br)
+			c, data, err := layers[atLayer-1].readNode()
 			if err != nil {
 				return xerrors.Errorf("reading node from layer %d (wrote %d at that layer): %w", atLayer, layerWrote[atLayer], err)
 			}
 
 			// write block
-			if err := carutil.LdWrite(w, c.Bytes(), data); err != nil {
+			if err := carutil.LdWrite(sw, c.Bytes(), data); err != nil {
 				return xerrors.Errorf("writing node from layer %d: %w", atLayer, err)
 			}
 
@@ -838,7 +1437,7 @@ func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
 		}
 
 		// write block
-		if err := carutil.LdWrite(w, mhToRawCid(c).Bytes(), data); err != nil {
+		if err := carutil.LdWrite(sw, mhToRawCid(c).Bytes(), data); err != nil {
 			return xerrors.Errorf("writing jbob block: %w", err)
 		}
 
@@ -863,6 +1462,21 @@ type cardata struct {
 	f *os.File
 
 	br *bufio.Reader
+	// read offset of br in f
+	pos int64
+}
+
+func (c *cardata) readNode() (cid.Cid, []byte, error) {
+	ci, data, err := carutil.ReadNode(c.br)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+
+	n := uint64(len(ci.Bytes()) + len(data))
+	var lenBuf [binary.MaxVarintLen64]byte
+	c.pos += int64(binary.PutUvarint(lenBuf[:], n)) + int64(n)
+
+	return ci, data, nil
 }
 
 func (c *cardata) writeBlock(ci cid.Cid, data []byte) error {
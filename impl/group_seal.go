@@ -0,0 +1,121 @@
+package impl
+
+import (
+	"context"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var sealCheckInterval = time.Minute
+
+// GroupSealPolicy decides when partially filled groups are sealed and sent
+// through finalize, vcar, commP and deals without waiting for them to fill up.
+// Zero durations disable the respective check.
+type GroupSealPolicy struct {
+	// MaxAge seals groups which were created more than MaxAge ago
+	MaxAge time.Duration
+
+	// MaxIdle seals groups which didn't receive writes for MaxIdle
+	MaxIdle time.Duration
+}
+
+func (p GroupSealPolicy) validate() error {
+	if p.MaxAge < 0 || p.MaxIdle < 0 {
+		return xerrors.Errorf("negative durations not allowed")
+	}
+	return nil
+}
+
+func (p GroupSealPolicy) enabled() bool {
+	return p.MaxAge > 0 || p.MaxIdle > 0
+}
+
+func (p GroupSealPolicy) shouldSeal(gm writableGroupMeta, now time.Time) bool {
+	if gm.Blocks == 0 {
+		return false
+	}
+
+	if p.MaxAge > 0 && now.Sub(gm.CreatedAt) > p.MaxAge {
+		return true
+	}
+	if p.MaxIdle > 0 && now.Sub(gm.LastWriteAt) > p.MaxIdle {
+		return true
+	}
+	return false
+}
+
+func (r *ribs) Admin() iface.Admin {
+	return r
+}
+
+func (r *ribs) SealGroup(ctx context.Context, gk iface.GroupKey) error {
+	// make sure the group is open
+	if err := r.withReadableGroup(gk, func(*Group) error { return nil }); err != nil {
+		return xerrors.Errorf("opening group: %w", err)
+	}
+
+	// hold the ribs lock so that writers don't pick the group while it's
+	// being sealed
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	g, ok := r.writableGroups[gk]
+	if !ok {
+		return xerrors.Errorf("group %d is not writable", gk)
+	}
+
+	if err := g.Seal(ctx); err != nil {
+		return xerrors.Errorf("sealing group: %w", err)
+	}
+
+	delete(r.writableGroups, gk)
+
+	r.tasks <- task{
+		tt:    taskTypeFinalize,
+		group: gk,
+	}
+
+	return nil
+}
+
+func (r *ribs) groupSealWorker(ctx context.Context) {
+	if !r.sealPolicy.enabled() {
+		return
+	}
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(sealCheckInterval):
+		}
+
+		if err := r.sealExpiredGroups(ctx); err != nil {
+			log.Errorw("sealing expired groups", "error", err)
+		}
+	}
+}
+
+func (r *ribs) sealExpiredGroups(ctx context.Context) error {
+	groups, err := r.db.WritableGroups()
+	if err != nil {
+		return xerrors.Errorf("listing writable groups: %w", err)
+	}
+
+	now := time.Now()
+	for _, gm := range groups {
+		if !r.sealPolicy.shouldSeal(gm, now) {
+			continue
+		}
+
+		log.Infow("sealing partially filled group", "group", gm.ID, "blocks", gm.Blocks, "created", gm.CreatedAt, "lastWrite", gm.LastWriteAt)
+
+		if err := r.SealGroup(ctx, gm.ID); err != nil {
+			log.Errorw("sealing group", "group", gm.ID, "error", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package impl
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+)
+
+// estimated CAR overhead, used to fit groups into a target piece size
+const (
+	// header with a single root
+	carHeaderOverhead = 64
+
+	// per block: length varint (up to 5 bytes) + raw sha256 cidv1 (36 bytes),
+	// plus the link to it in the vcar layer above (~38 bytes), rounded up
+	carBlockOverhead = 96
+)
+
+// GroupSizePolicy decides how much data goes into a single group
+type GroupSizePolicy struct {
+	// MaxBytes is the maximum number of block data bytes in a group, 0 means
+	// no limit
+	MaxBytes int64
+
+	// MaxBlocks is the maximum number of blocks in a group, 0 means no limit
+	MaxBlocks int64
+
+	// TargetPieceSize, when set, makes groups fill up to what fits in a padded
+	// piece of this size, including CAR overhead. This avoids deals with
+	// pieces which are mostly padding.
+	TargetPieceSize abi.PaddedPieceSize
+}
+
+func defaultGroupSizePolicy() GroupSizePolicy {
+	return GroupSizePolicy{
+		MaxBytes:  maxGroupSize,
+		MaxBlocks: maxGroupBlocks,
+	}
+}
+
+func (p GroupSizePolicy) validate() error {
+	if p.MaxBytes < 0 || p.MaxBlocks < 0 {
+		return xerrors.Errorf("group size limits must not be negative")
+	}
+
+	if p.TargetPieceSize != 0 {
+		if err := p.TargetPieceSize.Validate(); err != nil {
+			return xerrors.Errorf("invalid target piece size: %w", err)
+		}
+
+		if p.maxCarSize() <= 0 {
+			return xerrors.Errorf("target piece size %d too small", p.TargetPieceSize)
+		}
+	}
+
+	if p.MaxBytes == 0 && p.MaxBlocks == 0 && p.TargetPieceSize == 0 {
+		return xerrors.Errorf("group size policy must set at least one limit")
+	}
+
+	return nil
+}
+
+// maxCarSize is the largest CAR which fits in the target piece, 0 if there is
+// no target piece size
+func (p GroupSizePolicy) maxCarSize() int64 {
+	if p.TargetPieceSize == 0 {
+		return 0
+	}
+
+	return int64(p.TargetPieceSize.Unpadded()) - carHeaderOverhead
+}
+
+// fits returns whether a group with the given number of blocks and data bytes
+// is within the policy limits
+func (p GroupSizePolicy) fits(blocks, bytes int64) bool {
+	if p.MaxBlocks > 0 && blocks > p.MaxBlocks {
+		return false
+	}
+
+	if p.MaxBytes > 0 && bytes > p.MaxBytes {
+		return false
+	}
+
+	if mcs := p.maxCarSize(); mcs > 0 && bytes+blocks*carBlockOverhead > mcs {
+		return false
+	}
+
+	return true
+}
+
+// EffectiveMaxBytes returns the data byte limit implied by the policy
+func (p GroupSizePolicy) EffectiveMaxBytes() int64 {
+	mb := p.MaxBytes
+	if mcs := p.maxCarSize(); mcs > 0 && (mb == 0 || mcs < mb) {
+		mb = mcs
+	}
+
+	return mb
+}
+
+// EffectiveMaxBlocks returns the block count limit implied by the policy
+func (p GroupSizePolicy) EffectiveMaxBlocks() int64 {
+	mb := p.MaxBlocks
+	if mcs := p.maxCarSize(); mcs > 0 && (mb == 0 || mcs/carBlockOverhead < mb) {
+		mb = mcs / carBlockOverhead
+	}
+
+	return mb
+}
@@ -0,0 +1,187 @@
+package impl
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/xerrors"
+)
+
+// hostKeyFile holds the libp2p identity of the store, providers fetch deal
+// data from the peer ID in transfer URLs, so it must not change on restart
+const hostKeyFile = "libp2p.key"
+
+// Libp2pConfig configures the libp2p host used for deal making, serving deal
+// data and retrievals
+type Libp2pConfig struct {
+	// ListenAddrs are multiaddrs to listen on, libp2p defaults when empty
+	ListenAddrs []string
+
+	// AnnounceAddrs replace the listen addresses announced to peers and used
+	// in transfer URLs, e.g. when behind a NAT with port forwarding
+	AnnounceAddrs []string
+
+	// NoAnnounceAddrs are never announced; addresses starting with one of
+	// them, e.g. /ip4/172.17.0.1, are filtered too
+	NoAnnounceAddrs []string
+
+	// EnableRelay enables the circuit relay transport, EnableHolePunching
+	// additionally upgrades relayed connections to direct ones
+	EnableRelay        bool
+	EnableHolePunching bool
+}
+
+func (c Libp2pConfig) validate() error {
+	for _, as := range [][]string{c.ListenAddrs, c.AnnounceAddrs, c.NoAnnounceAddrs} {
+		if _, err := parseMultiaddrs(as); err != nil {
+			return err
+		}
+	}
+	if c.EnableHolePunching && !c.EnableRelay {
+		return xerrors.Errorf("hole punching requires relay")
+	}
+	return nil
+}
+
+// WithLibp2pConfig sets libp2p host listen and announce addresses
+func WithLibp2pConfig(c Libp2pConfig) OpenOption {
+	return func(o *openOptions) {
+		o.libp2p = c
+	}
+}
+
+func parseMultiaddrs(as []string) ([]multiaddr.Multiaddr, error) {
+	out := make([]multiaddr.Multiaddr, 0, len(as))
+	for _, a := range as {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing multiaddr %q: %w", a, err)
+		}
+		out = append(out, ma)
+	}
+	return out, nil
+}
+
+// loadHostKey reads the host identity from the store root, generating it on
+// first start
+func loadHostKey(root string) (crypto.PrivKey, error) {
+	path := filepath.Join(root, hostKeyFile)
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		k, err := crypto.UnmarshalPrivateKey(b)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing host key: %w", err)
+		}
+		return k, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("reading host key: %w", err)
+	}
+
+	k, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generating host key: %w", err)
+	}
+	b, err = crypto.MarshalPrivateKey(k)
+	if err != nil {
+		return nil, xerrors.Errorf("marshaling host key: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return nil, xerrors.Errorf("writing host key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, xerrors.Errorf("replacing host key file: %w", err)
+	}
+
+	return k, nil
+}
+
+func hostOptions(root string, cfg Libp2pConfig) ([]libp2p.Option, error) {
+	k, err := loadHostKey(root)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []libp2p.Option{libp2p.Identity(k)}
+
+	if len(cfg.ListenAddrs) > 0 {
+		opts = append(opts, libp2p.ListenAddrStrings(cfg.ListenAddrs...))
+	}
+
+	announce, err := parseMultiaddrs(cfg.AnnounceAddrs)
+	if err != nil {
+		return nil, err
+	}
+	noAnnounce, err := parseMultiaddrs(cfg.NoAnnounceAddrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(announce) > 0 || len(noAnnounce) > 0 {
+		opts = append(opts, libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+			if len(announce) > 0 {
+				addrs = announce
+			}
+			return filterNoAnnounce(addrs, noAnnounce)
+		}))
+	}
+
+	if cfg.EnableRelay {
+		opts = append(opts, libp2p.EnableRelay())
+	} else {
+		opts = append(opts, libp2p.DisableRelay())
+	}
+	if cfg.EnableHolePunching {
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+
+	return opts, nil
+}
+
+func filterNoAnnounce(addrs, noAnnounce []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	out := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		as := a.String()
+		skip := false
+		for _, na := range noAnnounce {
+			if as == na.String() || strings.HasPrefix(as, na.String()+"/") {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// transferAddr picks the announced host address providers dial for libp2p
+// transfers, preferring public addresses
+func transferAddr(h host.Host) (multiaddr.Multiaddr, error) {
+	addrs := h.Addrs()
+	if len(addrs) == 0 {
+		return nil, xerrors.Errorf("host has no announced addresses")
+	}
+
+	for _, a := range addrs {
+		if manet.IsPublicAddr(a) {
+			return a, nil
+		}
+	}
+	for _, a := range addrs {
+		if !manet.IsIPLoopback(a) {
+			return a, nil
+		}
+	}
+	return addrs[0], nil
+}
@@ -0,0 +1,43 @@
+package impl
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostIdentityAndAnnounce(t *testing.T) {
+	root := t.TempDir()
+
+	cfg := Libp2pConfig{
+		ListenAddrs:     []string{"/ip4/127.0.0.1/tcp/0"},
+		AnnounceAddrs:   []string{"/ip4/10.1.2.3/tcp/4001", "/ip4/1.2.3.4/tcp/4001", "/ip4/172.17.0.1/tcp/4001"},
+		NoAnnounceAddrs: []string{"/ip4/172.17.0.1"},
+	}
+	require.NoError(t, cfg.validate())
+
+	newHost := func() peer.ID {
+		opts, err := hostOptions(root, cfg)
+		require.NoError(t, err)
+		h, err := libp2p.New(opts...)
+		require.NoError(t, err)
+		defer h.Close()
+
+		require.Len(t, h.Addrs(), 2)
+
+		addr, err := transferAddr(h)
+		require.NoError(t, err)
+		require.Equal(t, multiaddr.StringCast("/ip4/1.2.3.4/tcp/4001"), addr)
+
+		return h.ID()
+	}
+
+	// same identity after restart
+	require.Equal(t, newHost(), newHost())
+
+	require.Error(t, Libp2pConfig{ListenAddrs: []string{"nope"}}.validate())
+	require.Error(t, Libp2pConfig{EnableHolePunching: true}.validate())
+}
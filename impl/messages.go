@@ -0,0 +1,158 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// confidence used when waiting for messages sent by ribs
+var messageConfidence uint64 = 5
+
+// messageSender sends messages from the ribs wallet one at a time. The
+// gateway doesn't track pending nonces, so the nonce is read from chain state
+// and a message must land before the next one is sent.
+type messageSender struct {
+	wallet *ributil.LocalWallet
+
+	lk sync.Mutex
+}
+
+// send pushes a message and waits for it to execute successfully. pushed, when
+// set, is called with the message CID before waiting.
+func (s *messageSender) send(ctx context.Context, gw ChainAPI, to address.Address, method abi.MethodNum, value abi.TokenAmount, params cbg.CBORMarshaler, pushed func(cid.Cid) error) (*api.MsgLookup, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	mcid, err := sendMessage(ctx, gw, s.wallet, to, method, value, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if pushed != nil {
+		if err := pushed(mcid); err != nil {
+			return nil, err
+		}
+	}
+
+	return waitMessage(ctx, gw, mcid)
+}
+
+// errSenderBusy is returned by tryPush while an earlier message didn't land
+var errSenderBusy = xerrors.New("waiting for a pending message")
+
+// tryPush pushes a message without waiting for it to land. pushed, when set,
+// is called with the message CID before returning. The sender stays busy until
+// the message lands, ctx is cancelled or wait passes, then landed is called
+// from a background goroutine. When another message is pending tryPush returns
+// errSenderBusy instead of waiting.
+func (s *messageSender) tryPush(ctx context.Context, gw ChainAPI, to address.Address, method abi.MethodNum, value abi.TokenAmount, params cbg.CBORMarshaler, pushed func(cid.Cid) error, wait time.Duration, landed func(*api.MsgLookup, error)) error {
+	if !s.lk.TryLock() {
+		return errSenderBusy
+	}
+
+	mcid, err := sendMessage(ctx, gw, s.wallet, to, method, value, params)
+	if err == nil && pushed != nil {
+		err = pushed(mcid)
+	}
+	if err != nil {
+		s.lk.Unlock()
+		return err
+	}
+
+	go func() {
+		defer s.lk.Unlock()
+
+		wctx, cancel := context.WithTimeout(ctx, wait)
+		defer cancel()
+
+		landed(waitMessage(wctx, gw, mcid))
+	}()
+
+	return nil
+}
+
+// waitIdle waits until no message is pending
+func (s *messageSender) waitIdle() {
+	s.lk.Lock()
+	s.lk.Unlock() // nolint
+}
+
+// sendMessage signs a message with the ribs wallet and pushes it to the
+// mpool, with the nonce of the wallet actor. Use messageSender.
+func sendMessage(ctx context.Context, gw ChainAPI, w *ributil.LocalWallet, to address.Address, method abi.MethodNum, value abi.TokenAmount, params cbg.CBORMarshaler) (cid.Cid, error) {
+	from, err := w.GetDefault()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("get wallet address: %w", err)
+	}
+
+	var enc []byte
+	if params != nil {
+		var buf bytes.Buffer
+		if err := params.MarshalCBOR(&buf); err != nil {
+			return cid.Undef, xerrors.Errorf("serializing params: %w", err)
+		}
+		enc = buf.Bytes()
+	}
+
+	act, err := gw.StateGetActor(ctx, from, types.EmptyTSK)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("get wallet actor: %w", err)
+	}
+
+	msg := &types.Message{
+		From:   from,
+		To:     to,
+		Method: method,
+		Value:  value,
+		Params: enc,
+		Nonce:  act.Nonce,
+	}
+
+	msg, err = gw.GasEstimateMessageGas(ctx, msg, nil, types.EmptyTSK)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("estimating gas: %w", err)
+	}
+
+	mb, err := msg.ToStorageBlock()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("serializing message: %w", err)
+	}
+
+	sig, err := w.WalletSign(ctx, from, mb.Cid().Bytes(), api.MsgMeta{Type: api.MTChainMsg, Extra: mb.RawData()})
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("signing message: %w", err)
+	}
+
+	mcid, err := gw.MpoolPush(ctx, &types.SignedMessage{Message: *msg, Signature: *sig})
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("pushing message: %w", err)
+	}
+
+	return mcid, nil
+}
+
+// waitMessage waits for a message to land on chain, and checks that it
+// executed successfully
+func waitMessage(ctx context.Context, gw ChainAPI, mcid cid.Cid) (*api.MsgLookup, error) {
+	lookup, err := gw.StateWaitMsg(ctx, mcid, messageConfidence, api.LookbackNoLimit, true)
+	if err != nil {
+		return nil, xerrors.Errorf("waiting for message %s: %w", mcid, err)
+	}
+
+	if lookup.Receipt.ExitCode.IsError() {
+		return nil, xerrors.Errorf("message %s failed with exit code %s", mcid, lookup.Receipt.ExitCode)
+	}
+
+	return lookup, nil
+}
@@ -0,0 +1,768 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	adt9 "github.com/filecoin-project/go-state-types/builtin/v9/util/adt"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	lmarket "github.com/filecoin-project/lotus/chain/actors/builtin/market"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
+	"github.com/filecoin-project/lotus/chain/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// mock chain actor IDs are assigned from here
+const mockFirstActorID = 1000
+
+// MockChain is an in-memory ChainAPI for running ribs offline, mostly in
+// tests. It keeps balances, market escrow, DataCap, miner info, deals and
+// verified claims, and executes AddBalance, ExtendClaimTerms and plain send
+// messages. Messages are included in the next tipset; StateWaitMsg mines
+// tipsets until the wait is satisfied. Other chain progress is driven with
+// Advance, and deals are moved through their lifecycle with PublishDeals,
+// ActivateDeal and SlashDeal.
+//
+// Publish messages are sent from the provider address and don't advance its
+// nonce, so lookups of the publish tipset always end at the chain head.
+// Only verifreg actor state can be loaded through ChainReadObj.
+type MockChain struct {
+	lk sync.Mutex
+
+	tipsets []*types.TipSet // by height, no null rounds
+	byKey   map[types.TipSetKey]*types.TipSet
+
+	ids    map[address.Address]address.Address // key to ID addresses
+	nextID uint64
+	actors map[address.Address]*types.Actor // by ID address
+
+	escrow  map[address.Address]abi.TokenAmount
+	locked  map[address.Address]abi.TokenAmount
+	dataCap map[address.Address]abi.StoragePower
+	miners  map[address.Address]api.MinerInfo
+
+	deals    map[abi.DealID]*api.MarketDeal
+	nextDeal abi.DealID
+
+	claims    map[abi.ActorID]map[verifregtypes.ClaimId]verifregtypes.Claim // by provider
+	nextClaim verifregtypes.ClaimId
+
+	msgs map[cid.Cid]*mockMessage
+	objs mockObjs
+}
+
+// mockObjs is the mock chain blockstore, lk must be held when used directly
+type mockObjs map[cid.Cid]blocks.Block
+
+func (o mockObjs) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	b, ok := o[c]
+	if !ok {
+		return nil, xerrors.Errorf("object %s not found", c)
+	}
+	return b, nil
+}
+
+func (o mockObjs) Put(ctx context.Context, b blocks.Block) error {
+	o[b.Cid()] = b
+	return nil
+}
+
+type mockMessage struct {
+	msg     *types.Message
+	receipt types.MessageReceipt
+	height  abi.ChainEpoch
+}
+
+func NewMockChain() *MockChain {
+	m := &MockChain{
+		byKey:    map[types.TipSetKey]*types.TipSet{},
+		ids:      map[address.Address]address.Address{},
+		nextID:   mockFirstActorID,
+		actors:   map[address.Address]*types.Actor{},
+		escrow:   map[address.Address]abi.TokenAmount{},
+		locked:   map[address.Address]abi.TokenAmount{},
+		dataCap:  map[address.Address]abi.StoragePower{},
+		miners:   map[address.Address]api.MinerInfo{},
+		deals:    map[abi.DealID]*api.MarketDeal{},
+		nextDeal: 1,
+
+		claims:    map[abi.ActorID]map[verifregtypes.ClaimId]verifregtypes.Claim{},
+		nextClaim: 1,
+
+		msgs: map[cid.Cid]*mockMessage{},
+		objs: mockObjs{},
+	}
+
+	m.mine(uint64(time.Now().Unix()))
+	return m
+}
+
+var mockCid = func() cid.Cid {
+	h, err := multihash.Sum([]byte("ribs-mockchain"), multihash.IDENTITY, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, h)
+}()
+
+// mine appends a tipset, lk must be held
+func (m *MockChain) mine(genesisTime uint64) {
+	var parents []cid.Cid
+	height := abi.ChainEpoch(len(m.tipsets))
+	ts := genesisTime
+	if height > 0 {
+		parents = m.tipsets[height-1].Cids()
+		ts = m.tipsets[0].MinTimestamp() + uint64(height)*builtin.EpochDurationSeconds
+	}
+
+	miner, _ := address.NewIDAddress(mockFirstActorID - 1)
+	tipset, err := types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 miner,
+		Ticket:                &types.Ticket{VRFProof: []byte("mock")},
+		Parents:               parents,
+		ParentWeight:          big.NewInt(int64(height)),
+		Height:                height,
+		ParentStateRoot:       mockCid,
+		ParentMessageReceipts: mockCid,
+		Messages:              mockCid,
+		Timestamp:             ts,
+		ParentBaseFee:         big.NewInt(100),
+	}})
+	if err != nil {
+		panic(err)
+	}
+
+	m.tipsets = append(m.tipsets, tipset)
+	m.byKey[tipset.Key()] = tipset
+}
+
+func (m *MockChain) head() *types.TipSet {
+	return m.tipsets[len(m.tipsets)-1]
+}
+
+// Advance mines n tipsets
+func (m *MockChain) Advance(n int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for i := 0; i < n; i++ {
+		m.mine(0)
+	}
+}
+
+// resolve returns the ID address for addr, assigning one to unknown key
+// addresses when create is set. lk must be held.
+func (m *MockChain) resolve(addr address.Address, create bool) (address.Address, error) {
+	if addr.Protocol() == address.ID {
+		return addr, nil
+	}
+	if id, ok := m.ids[addr]; ok {
+		return id, nil
+	}
+	if !create {
+		return address.Undef, xerrors.Errorf("actor %s not found", addr)
+	}
+
+	id, err := address.NewIDAddress(m.nextID)
+	if err != nil {
+		return address.Undef, err
+	}
+	m.nextID++
+	m.ids[addr] = id
+	return id, nil
+}
+
+// actor returns the actor at addr, creating it when create is set. lk must be
+// held.
+func (m *MockChain) actor(addr address.Address, create bool) (*types.Actor, error) {
+	id, err := m.resolve(addr, create)
+	if err != nil {
+		return nil, err
+	}
+
+	act, ok := m.actors[id]
+	if !ok {
+		if !create {
+			return nil, xerrors.Errorf("actor %s not found", addr)
+		}
+		act = &types.Actor{Code: mockCid, Head: mockCid, Balance: big.Zero()}
+		m.actors[id] = act
+	}
+	return act, nil
+}
+
+// SetBalance sets the wallet balance of addr
+func (m *MockChain) SetBalance(addr address.Address, bal abi.TokenAmount) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	act, _ := m.actor(addr, true)
+	act.Balance = bal
+}
+
+// SetDataCap makes addr a verified client with the given DataCap
+func (m *MockChain) SetDataCap(addr address.Address, dc abi.StoragePower) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	id, _ := m.resolve(addr, true)
+	m.dataCap[id] = dc
+}
+
+// AddMiner registers a storage provider reachable at the given addresses
+func (m *MockChain) AddMiner(maddr address.Address, pid peer.ID, addrs []multiaddr.Multiaddr) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	info := api.MinerInfo{
+		Owner:      maddr,
+		Worker:     maddr,
+		PeerId:     &pid,
+		SectorSize: abi.SectorSize(32 << 30),
+	}
+	for _, a := range addrs {
+		info.Multiaddrs = append(info.Multiaddrs, a.Bytes())
+	}
+
+	_, _ = m.actor(maddr, true)
+	m.miners[maddr] = info
+}
+
+// PublishDeals publishes deal proposals in a message sent by the provider,
+// locking client escrow. The message is included in the next tipset.
+func (m *MockChain) PublishDeals(provider address.Address, deals []market.ClientDealProposal) (cid.Cid, []abi.DealID, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, err := m.actor(provider, true); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	ret := market.PublishStorageDealsReturn{ValidDeals: bitfield.New()}
+	for i, d := range deals {
+		client, err := m.resolve(d.Proposal.Client, false)
+		if err != nil {
+			return cid.Undef, nil, xerrors.Errorf("deal %d: %w", i, err)
+		}
+
+		need := d.Proposal.ClientBalanceRequirement()
+		avail := big.Sub(m.balanceOr(m.escrow, client), m.balanceOr(m.locked, client))
+		if avail.LessThan(need) {
+			return cid.Undef, nil, xerrors.Errorf("deal %d: client escrow %s below %s", i, avail, need)
+		}
+		m.locked[client] = big.Add(m.balanceOr(m.locked, client), need)
+
+		id := m.nextDeal
+		m.nextDeal++
+		m.deals[id] = &api.MarketDeal{
+			Proposal: d.Proposal,
+			State: market.DealState{
+				SectorStartEpoch: -1,
+				LastUpdatedEpoch: -1,
+				SlashEpoch:       -1,
+			},
+		}
+
+		ret.IDs = append(ret.IDs, id)
+		ret.ValidDeals.Set(uint64(i))
+	}
+
+	var params, rbuf bytes.Buffer
+	if err := (&market.PublishStorageDealsParams{Deals: deals}).MarshalCBOR(&params); err != nil {
+		return cid.Undef, nil, err
+	}
+	if err := ret.MarshalCBOR(&rbuf); err != nil {
+		return cid.Undef, nil, err
+	}
+
+	msg := &types.Message{
+		From:   provider,
+		To:     lmarket.Address,
+		Method: lmarket.Methods.PublishStorageDeals,
+		Value:  big.Zero(),
+		Params: params.Bytes(),
+		// keep distinct messages distinct
+		Nonce: uint64(len(m.msgs)),
+	}
+
+	mc := msg.Cid()
+	m.msgs[mc] = &mockMessage{
+		msg:     msg,
+		receipt: types.MessageReceipt{ExitCode: exitcode.Ok, Return: rbuf.Bytes()},
+		height:  m.head().Height() + 1,
+	}
+
+	return mc, ret.IDs, nil
+}
+
+// ActivateDeal marks a deal as sealed in the next tipset, like messages
+func (m *MockChain) ActivateDeal(id abi.DealID) error {
+	return m.updateDeal(id, func(st *market.DealState, h abi.ChainEpoch) {
+		st.SectorStartEpoch = h + 1
+	})
+}
+
+// SlashDeal marks a deal as slashed at the current head
+func (m *MockChain) SlashDeal(id abi.DealID) error {
+	return m.updateDeal(id, func(st *market.DealState, h abi.ChainEpoch) {
+		st.SlashEpoch = h
+	})
+}
+
+// AddClaim records a verified claim, like the one made when a verified deal
+// activates
+func (m *MockChain) AddClaim(claim verifregtypes.Claim) verifregtypes.ClaimId {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	id := m.nextClaim
+	m.nextClaim++
+
+	if m.claims[claim.Provider] == nil {
+		m.claims[claim.Provider] = map[verifregtypes.ClaimId]verifregtypes.Claim{}
+	}
+	m.claims[claim.Provider][id] = claim
+	return id
+}
+
+func (m *MockChain) updateDeal(id abi.DealID, cb func(st *market.DealState, h abi.ChainEpoch)) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	d, ok := m.deals[id]
+	if !ok {
+		return xerrors.Errorf("deal %d not found", id)
+	}
+
+	h := m.head().Height()
+	cb(&d.State, h)
+	d.State.LastUpdatedEpoch = h
+	return nil
+}
+
+func (m *MockChain) balanceOr(tbl map[address.Address]abi.TokenAmount, id address.Address) abi.TokenAmount {
+	if v, ok := tbl[id]; ok {
+		return v
+	}
+	return big.Zero()
+}
+
+// execute applies a message to the mock state, lk must be held
+func (m *MockChain) execute(msg *types.Message) types.MessageReceipt {
+	from, err := m.actor(msg.From, false)
+	if err != nil {
+		return types.MessageReceipt{ExitCode: exitcode.SysErrSenderInvalid}
+	}
+	if from.Balance.LessThan(msg.Value) {
+		return types.MessageReceipt{ExitCode: exitcode.SysErrInsufficientFunds}
+	}
+
+	var ret []byte
+
+	switch {
+	case msg.Method == builtin.MethodSend:
+		to, err := m.actor(msg.To, true)
+		if err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.SysErrInvalidReceiver}
+		}
+		to.Balance = big.Add(to.Balance, msg.Value)
+	case msg.To == lmarket.Address && msg.Method == lmarket.Methods.AddBalance:
+		var addr address.Address
+		if err := addr.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.ErrSerialization}
+		}
+		id, err := m.resolve(addr, true)
+		if err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.ErrIllegalArgument}
+		}
+		m.escrow[id] = big.Add(m.balanceOr(m.escrow, id), msg.Value)
+	case msg.To == verifreg.Address && msg.Method == verifreg.Methods.ExtendClaimTerms:
+		var params verifregtypes.ExtendClaimTermsParams
+		if err := params.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.ErrSerialization}
+		}
+		ext, err := m.extendClaims(msg.From, params.Terms)
+		if err != nil {
+			return types.MessageReceipt{ExitCode: exitcode.ErrSerialization}
+		}
+		ret = ext
+	default:
+		return types.MessageReceipt{ExitCode: exitcode.SysErrInvalidMethod}
+	}
+
+	from.Balance = big.Sub(from.Balance, msg.Value)
+	return types.MessageReceipt{ExitCode: exitcode.Ok, Return: ret}
+}
+
+// extendClaims applies claim term extensions by a client, returning the
+// marshaled ExtendClaimTermsReturn. lk must be held.
+func (m *MockChain) extendClaims(client address.Address, terms []verifregtypes.ClaimTerm) ([]byte, error) {
+	clientID, err := m.resolve(client, false)
+	if err != nil {
+		return nil, err
+	}
+	id, err := address.IDFromAddress(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret verifregtypes.ExtendClaimTermsReturn
+	for i, term := range terms {
+		claim, ok := m.claims[term.Provider][term.ClaimId]
+		switch {
+		case !ok:
+			ret.FailCodes = append(ret.FailCodes, verifregtypes.FailCode{Idx: uint64(i), Code: exitcode.ErrNotFound})
+		case claim.Client != abi.ActorID(id):
+			ret.FailCodes = append(ret.FailCodes, verifregtypes.FailCode{Idx: uint64(i), Code: exitcode.ErrForbidden})
+		case term.TermMax < claim.TermMax:
+			ret.FailCodes = append(ret.FailCodes, verifregtypes.FailCode{Idx: uint64(i), Code: exitcode.ErrIllegalArgument})
+		default:
+			claim.TermMax = term.TermMax
+			m.claims[term.Provider][term.ClaimId] = claim
+			ret.SuccessCount++
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ret.MarshalCBOR(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// verifregActor stores verifreg state holding the current claims, lk must be
+// held
+func (m *MockChain) verifregActor() (*types.Actor, error) {
+	store := adt9.WrapStore(context.TODO(), cbor.NewCborStore(m.objs))
+
+	st, err := verifregtypes.ConstructState(store, builtin.SystemActorAddr)
+	if err != nil {
+		return nil, xerrors.Errorf("constructing verifreg state: %w", err)
+	}
+
+	claims, err := adt9.MakeEmptyMap(store, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	for prov, pc := range m.claims {
+		inner, err := adt9.MakeEmptyMap(store, builtin.DefaultHamtBitwidth)
+		if err != nil {
+			return nil, err
+		}
+		for id, claim := range pc {
+			claim := claim
+			if err := inner.Put(id, &claim); err != nil {
+				return nil, xerrors.Errorf("putting claim: %w", err)
+			}
+		}
+
+		innerRoot, err := inner.Root()
+		if err != nil {
+			return nil, err
+		}
+		paddr, err := address.NewIDAddress(uint64(prov))
+		if err != nil {
+			return nil, err
+		}
+		ic := cbg.CborCid(innerRoot)
+		if err := claims.Put(abi.IdAddrKey(paddr), &ic); err != nil {
+			return nil, xerrors.Errorf("putting provider claims: %w", err)
+		}
+	}
+	if st.Claims, err = claims.Root(); err != nil {
+		return nil, err
+	}
+
+	head, err := store.Put(store.Context(), st)
+	if err != nil {
+		return nil, xerrors.Errorf("storing verifreg state: %w", err)
+	}
+
+	code, ok := actors.GetActorCodeID(actorstypes.Version9, actors.VerifregKey)
+	if !ok {
+		return nil, xerrors.Errorf("no verifreg actor code")
+	}
+
+	return &types.Actor{Code: code, Head: head, Balance: big.Zero()}, nil
+}
+
+// lookup returns the lookup of an included message, lk must be held
+func (m *MockChain) lookup(mc cid.Cid) (*api.MsgLookup, bool, error) {
+	mm, ok := m.msgs[mc]
+	if !ok {
+		return nil, false, xerrors.Errorf("message %s not found", mc)
+	}
+	if mm.height > m.head().Height() {
+		return nil, false, nil
+	}
+
+	return &api.MsgLookup{
+		Message: mc,
+		Receipt: mm.receipt,
+		TipSet:  m.tipsets[mm.height].Key(),
+		Height:  mm.height,
+	}, true, nil
+}
+
+func (m *MockChain) tipset(tsk types.TipSetKey) (*types.TipSet, error) {
+	if tsk == types.EmptyTSK {
+		return m.head(), nil
+	}
+	ts, ok := m.byKey[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+func (m *MockChain) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.head(), nil
+}
+
+func (m *MockChain) ChainGetGenesis(ctx context.Context) (*types.TipSet, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.tipsets[0], nil
+}
+
+func (m *MockChain) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.tipset(tsk)
+}
+
+func (m *MockChain) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	from, err := m.tipset(tsk)
+	if err != nil {
+		return nil, err
+	}
+	if h > from.Height() {
+		return nil, xerrors.Errorf("looking for tipset with height greater than start point")
+	}
+	if h < 0 {
+		h = 0
+	}
+	return m.tipsets[h], nil
+}
+
+func (m *MockChain) ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	mm, ok := m.msgs[mc]
+	if !ok {
+		return nil, xerrors.Errorf("message %s not found", mc)
+	}
+	return mm.msg, nil
+}
+
+func (m *MockChain) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	b, err := m.objs.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return b.RawData(), nil
+}
+
+func (m *MockChain) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	_, ok := m.objs[c]
+	return ok, nil
+}
+
+func (m *MockChain) ChainPutObj(ctx context.Context, b blocks.Block) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.objs[b.Cid()] = b
+	return nil
+}
+
+func (m *MockChain) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	out := *msg
+	out.GasLimit = 1_000_000
+	out.GasFeeCap = big.NewInt(200)
+	out.GasPremium = big.NewInt(100)
+	return &out, nil
+}
+
+func (m *MockChain) MpoolPush(ctx context.Context, sm *types.SignedMessage) (cid.Cid, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	from, err := m.actor(sm.Message.From, false)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("sender: %w", err)
+	}
+	if sm.Message.Nonce != from.Nonce {
+		return cid.Undef, xerrors.Errorf("bad nonce %d, expected %d", sm.Message.Nonce, from.Nonce)
+	}
+	from.Nonce++
+
+	// signatures aren't checked
+	mc := sm.Cid()
+	m.msgs[mc] = &mockMessage{
+		msg:     &sm.Message,
+		receipt: m.execute(&sm.Message),
+		height:  m.head().Height() + 1,
+	}
+
+	return mc, nil
+}
+
+func (m *MockChain) StateWaitMsg(ctx context.Context, mc cid.Cid, confidence uint64, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	mm, ok := m.msgs[mc]
+	if !ok {
+		return nil, xerrors.Errorf("message %s not found", mc)
+	}
+	for m.head().Height() < mm.height+abi.ChainEpoch(confidence) {
+		m.mine(0)
+	}
+
+	l, _, err := m.lookup(mc)
+	return l, err
+}
+
+func (m *MockChain) StateSearchMsg(ctx context.Context, from types.TipSetKey, mc cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	l, found, err := m.lookup(mc)
+	if err != nil || !found {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (m *MockChain) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	return network.Version17, nil
+}
+
+func (m *MockChain) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if addr == verifreg.Address {
+		return m.verifregActor()
+	}
+
+	act, err := m.actor(addr, false)
+	if err != nil {
+		return nil, err
+	}
+	cp := *act
+	return &cp, nil
+}
+
+func (m *MockChain) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	return m.resolve(addr, false)
+}
+
+func (m *MockChain) StateMinerInfo(ctx context.Context, maddr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	mi, ok := m.miners[maddr]
+	if !ok {
+		return api.MinerInfo{}, xerrors.Errorf("miner %s not found", maddr)
+	}
+	return mi, nil
+}
+
+func (m *MockChain) StateMarketBalance(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MarketBalance, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	id, err := m.resolve(addr, false)
+	if err != nil {
+		return api.MarketBalance{Escrow: big.Zero(), Locked: big.Zero()}, nil
+	}
+	return api.MarketBalance{Escrow: m.balanceOr(m.escrow, id), Locked: m.balanceOr(m.locked, id)}, nil
+}
+
+func (m *MockChain) StateMarketStorageDeal(ctx context.Context, dealID abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	d, ok := m.deals[dealID]
+	if !ok {
+		return nil, xerrors.Errorf(dealNotFoundErr+" before deal proposal start epoch, or deal may have been slashed", dealID)
+	}
+	cp := *d
+	return &cp, nil
+}
+
+// StateDealProviderCollateralBounds asks for 1 attoFIL per byte, up to 2
+func (m *MockChain) StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool, tsk types.TipSetKey) (api.DealCollateralBounds, error) {
+	return api.DealCollateralBounds{
+		Min: big.NewInt(int64(size)),
+		Max: big.NewInt(2 * int64(size)),
+	}, nil
+}
+
+func (m *MockChain) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	id, err := m.resolve(addr, false)
+	if err != nil {
+		return nil, nil
+	}
+	dc, ok := m.dataCap[id]
+	if !ok {
+		return nil, nil
+	}
+	return &dc, nil
+}
+
+func (m *MockChain) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	act, err := m.actor(addr, false)
+	if err != nil {
+		return big.Zero(), nil
+	}
+	return act.Balance, nil
+}
+
+var _ ChainAPI = &MockChain{}
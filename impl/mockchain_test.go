@@ -0,0 +1,150 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainClientCache(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	c := newChainClient(mc)
+
+	h1, err := c.ChainHead(ctx)
+	require.NoError(t, err)
+	mc.Advance(1)
+
+	// head is cached
+	h2, err := c.ChainHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, h1.Height(), h2.Height())
+
+	c.lk.Lock()
+	c.headAt = c.headAt.Add(-chainHeadCacheTTL)
+	c.lk.Unlock()
+
+	h2, err = c.ChainHead(ctx)
+	require.NoError(t, err)
+	require.Equal(t, h1.Height()+1, h2.Height())
+
+	b, err := c.StateDealProviderCollateralBounds(ctx, 1<<20, false, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(1<<20), b.Min)
+	require.Len(t, c.bounds, 1)
+
+	// the limiter allows bursts, then waits
+	l := newRateLimiter(1, 2)
+	require.NoError(t, l.wait(ctx))
+	require.NoError(t, l.wait(ctx))
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, l.wait(cctx))
+}
+
+func TestMockChainDealLifecycle(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	w, err := ributil.OpenWallet(t.TempDir())
+	require.NoError(t, err)
+	client, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	mc.SetBalance(client, big.NewInt(1e18))
+
+	r := &ribs{db: db, chain: mc, wallet: w}
+
+	// escrow top-up
+	p := defaultEscrowPolicy()
+	require.NoError(t, p.validate())
+	e := &escrowManager{db: db, wallet: w, sender: &messageSender{wallet: w}, policy: p}
+	require.NoError(t, e.reserve(ctx, mc, 1, "deal", big.NewInt(1000)))
+
+	mb, err := mc.StateMarketBalance(ctx, client, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, big.Add(big.NewInt(1000), e.policy.TopUpBuffer), mb.Escrow)
+
+	// propose and publish a deal
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+
+	prov, err := address.NewIDAddress(2000)
+	require.NoError(t, err)
+	label, err := market.NewLabelFromString("test")
+	require.NoError(t, err)
+
+	prop := market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             cid.MustParse("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq"),
+			PieceSize:            1 << 20,
+			Client:               client,
+			Provider:             prov,
+			Label:                label,
+			StartEpoch:           head.Height() + 100,
+			EndEpoch:             head.Height() + 100 + toEpochs(defaultDealPolicy().MinDuration),
+			StoragePricePerEpoch: big.Zero(),
+			ProviderCollateral:   big.NewInt(1 << 20),
+			ClientCollateral:     big.Zero(),
+		},
+		ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1},
+	}
+
+	var pb bytes.Buffer
+	require.NoError(t, prop.MarshalCBOR(&pb))
+
+	require.NoError(t, db.StoreProposedDeal(dbDealInfo{
+		DealUUID:            "deal",
+		GroupID:             1,
+		ClientAddr:          client.String(),
+		ProviderAddr:        2000,
+		StartEpoch:          prop.Proposal.StartEpoch,
+		EndEpoch:            prop.Proposal.EndEpoch,
+		SignedProposalBytes: pb.Bytes(),
+	}))
+
+	pcid, ids, err := mc.PublishDeals(prov, []market.ClientDealProposal{prop})
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	_, err = db.db.Exec(`update deals set sp_pub_msg_cid = ? where uuid = 'deal'`, pcid.String())
+	require.NoError(t, err)
+
+	requireDeal := func(published, sealed, failed bool) {
+		var p, s, f bool
+		require.NoError(t, db.db.QueryRow(`select published, sealed, failed from deals where uuid = 'deal'`).Scan(&p, &s, &f))
+		require.Equal(t, []bool{published, sealed, failed}, []bool{p, s, f})
+	}
+
+	// published after finality
+	mc.Advance(1)
+	require.NoError(t, r.runDealCheckLoop(ctx, mc))
+	requireDeal(false, false, false)
+
+	mc.Advance(int(dealPublishFinality) + 1)
+	require.NoError(t, r.runDealCheckLoop(ctx, mc))
+	requireDeal(true, false, false)
+
+	require.NoError(t, mc.ActivateDeal(ids[0]))
+	require.NoError(t, r.runDealCheckLoop(ctx, mc))
+	requireDeal(true, true, false)
+
+	// slashed deals are failed by the repair check
+	require.NoError(t, mc.SlashDeal(ids[0]))
+	head, err = mc.ChainHead(ctx)
+	require.NoError(t, err)
+	require.NoError(t, r.checkActiveDeals(ctx, mc, head))
+	requireDeal(true, true, true)
+}
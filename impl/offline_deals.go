@@ -0,0 +1,155 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+// carManifestName is the manifest of CARs exported to a directory
+const carManifestName = "manifest.json"
+
+// carManifestLk serializes manifest updates
+var carManifestLk sync.Mutex
+
+func (r *ribs) ExportGroupCar(ctx context.Context, gk iface.GroupKey, dir string) (iface.CarExport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return iface.CarExport{}, xerrors.Errorf("make export dir: %w", err)
+	}
+
+	var exp iface.CarExport
+
+	err := r.withReadableGroup(gk, func(g *Group) error {
+		if g.state < iface.GroupStateHasCommp || g.state == iface.GroupStateOffloaded {
+			return xerrors.Errorf("group not in state for exporting: %d", g.state)
+		}
+
+		dealInfo, err := r.db.GetDealParams(ctx, gk)
+		if err != nil {
+			return xerrors.Errorf("get deal params: %w", err)
+		}
+
+		pieceCid, err := commcid.PieceCommitmentV1ToCID(dealInfo.CommP)
+		if err != nil {
+			return xerrors.Errorf("converting commP: %w", err)
+		}
+
+		exp = iface.CarExport{
+			Group:     gk,
+			PieceCid:  pieceCid.String(),
+			PieceSize: dealInfo.PieceSize,
+			Root:      dealInfo.Root.String(),
+			CarSize:   dealInfo.CarSize,
+			File:      pieceCid.String() + ".car",
+		}
+
+		return exportCarFile(filepath.Join(dir, exp.File), func(w io.Writer) error {
+			carSize, root, err := g.ExportCar(w)
+			if err != nil {
+				return err
+			}
+			if carSize != dealInfo.CarSize || root != dealInfo.Root {
+				return xerrors.Errorf("exported car doesn't match group commP: size %d, root %s, expected %d, %s", carSize, root, dealInfo.CarSize, dealInfo.Root)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return iface.CarExport{}, err
+	}
+
+	if err := updateCarManifest(dir, exp); err != nil {
+		return iface.CarExport{}, xerrors.Errorf("updating manifest: %w", err)
+	}
+
+	log.Infow("exported group car", "group", gk, "piece", exp.PieceCid, "size", exp.CarSize, "dir", dir)
+
+	return exp, nil
+}
+
+// exportCarFile writes a file through a temp file, so that partial exports
+// never have the final name
+func exportCarFile(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return xerrors.Errorf("create car file: %w", err)
+	}
+
+	if err := write(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return xerrors.Errorf("writing car: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("sync car file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("close car file: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// updateCarManifest adds an export to the directory manifest, replacing
+// earlier exports of the same group
+func updateCarManifest(dir string, exp iface.CarExport) error {
+	carManifestLk.Lock()
+	defer carManifestLk.Unlock()
+
+	mpath := filepath.Join(dir, carManifestName)
+
+	var entries []iface.CarExport
+
+	mb, err := os.ReadFile(mpath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return xerrors.Errorf("reading manifest: %w", err)
+	default:
+		if err := json.Unmarshal(mb, &entries); err != nil {
+			return xerrors.Errorf("parsing manifest: %w", err)
+		}
+	}
+
+	replaced := false
+	for i := range entries {
+		if entries[i].Group == exp.Group {
+			entries[i] = exp
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, exp)
+	}
+
+	mb, err = json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("marshaling manifest: %w", err)
+	}
+
+	return exportCarFile(mpath, func(w io.Writer) error {
+		_, err := w.Write(mb)
+		return err
+	})
+}
+
+func (r *ribs) MakeOfflineDeals(ctx context.Context, gk iface.GroupKey, providers []int64) error {
+	if len(providers) == 0 {
+		return xerrors.Errorf("no providers given")
+	}
+
+	return r.withReadableGroup(gk, func(g *Group) error {
+		return g.MakeOfflineDeals(ctx, r.host, r.wallet, providers)
+	})
+}
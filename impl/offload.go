@@ -0,0 +1,106 @@
+package impl
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var offloadCheckInterval = 10 * time.Minute
+
+// RemoteRetrievalFunc fetches blocks of offloaded groups, e.g. from storage
+// providers holding deals for the group. The callback contract is the same as
+// in Group.View.
+type RemoteRetrievalFunc func(ctx context.Context, group iface.GroupKey, c []mh.Multihash, cb func(cidx int, data []byte)) error
+
+// OffloadPolicy decides when local data of groups with deals is removed.
+// Offloaded groups keep their index and metadata, block reads are served by
+// the remote retrieval hook.
+type OffloadPolicy struct {
+	// MinSealedDeals is the number of sealed, on-chain verified deals a group
+	// needs before it can be offloaded. 0 disables offloading.
+	MinSealedDeals int
+
+	// ColdFor is how long a group must not be read before it gets offloaded
+	ColdFor time.Duration
+}
+
+func (p OffloadPolicy) validate() error {
+	if p.MinSealedDeals < 0 || p.ColdFor < 0 {
+		return xerrors.Errorf("negative values not allowed")
+	}
+	return nil
+}
+
+// WithOffloadPolicy enables removal of local data for groups with enough deals
+func WithOffloadPolicy(p OffloadPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.offloadPolicy = p
+	}
+}
+
+// WithRemoteRetrieval sets the hook used to read blocks of offloaded groups. By
+// default blocks are retrieved from providers with deals for the group.
+func WithRemoteRetrieval(f RemoteRetrievalFunc) OpenOption {
+	return func(o *openOptions) {
+		o.remoteRetrieval = f
+	}
+}
+
+func (r *ribs) offloadWorker(ctx context.Context) {
+	if r.offloadPolicy.MinSealedDeals == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(offloadCheckInterval):
+		}
+
+		if err := r.offloadGroups(ctx); err != nil {
+			log.Errorw("offloading groups", "error", err)
+		}
+	}
+}
+
+func (r *ribs) offloadGroups(ctx context.Context) error {
+	groups, err := r.db.OffloadCandidates(r.offloadPolicy.MinSealedDeals, targetReplicaCount)
+	if err != nil {
+		return xerrors.Errorf("finding offload candidates: %w", err)
+	}
+
+	for _, gk := range groups {
+		err := r.withReadableGroup(gk, func(g *Group) error {
+			lastAccess := time.Unix(0, atomic.LoadInt64(&g.lastAccess))
+			if time.Since(lastAccess) < r.offloadPolicy.ColdFor {
+				return nil
+			}
+
+			// hold the upload stats lock so that no car transfers start while
+			// data is being removed
+			r.uploadStatsLk.Lock()
+			defer r.uploadStatsLk.Unlock()
+
+			if us := r.uploadStats[gk]; us != nil && us.ActiveRequests > 0 {
+				return nil
+			}
+			if r.carTransfers.streaming(gk) {
+				return nil
+			}
+
+			log.Infow("offloading group", "group", gk, "lastAccess", lastAccess)
+			return g.Offload(ctx)
+		})
+		if err != nil {
+			log.Errorw("offloading group", "group", gk, "error", err)
+		}
+	}
+
+	return nil
+}
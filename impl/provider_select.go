@@ -0,0 +1,225 @@
+package impl
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+// at most this many providers get proposals in one MakeMoreDeals round, some
+// extra over targetReplicaCount as proposals may get rejected
+var dealCandidateLimit = 9
+
+// ProviderCandidate is a storage provider which could get a deal for a group
+type ProviderCandidate struct {
+	ID int64
+
+	// ask, prices in attoFIL/GiB/epoch
+	AskPrice         int64
+	AskVerifiedPrice int64
+	AskMinPieceSize  int64
+	AskMaxPieceSize  int64
+
+	BoosterHttp    bool
+	BoosterBitswap bool
+
+	// deal history with ribs
+	DealStarted  int64
+	DealSuccess  int64
+	DealFail     int64
+	DealRejected int64
+
+	RetrProbeSuccess int64
+	RetrProbeFail    int64
+
+	// see providerReputation
+	Reputation float64
+}
+
+// DealRequest describes deals about to be made
+type DealRequest struct {
+	Group     iface.GroupKey
+	PieceSize abi.PaddedPieceSize
+	Verified  bool
+
+	// deal policy limit in attoFIL/GiB/epoch, candidates asking more are
+	// dropped before selection. 0 means no limit
+	MaxPrice int64
+}
+
+// ProviderSelector picks storage providers for new deals
+type ProviderSelector interface {
+	// SelectProviders filters and orders candidates, best first. Candidates
+	// are reachable providers with a valid ask which don't hold the group.
+	SelectProviders(ctx context.Context, req DealRequest, cands []ProviderCandidate) ([]ProviderCandidate, error)
+}
+
+// WithProviderSelector replaces the default deal provider selection
+func WithProviderSelector(s ProviderSelector) OpenOption {
+	return func(o *openOptions) {
+		o.providerSelector = s
+	}
+}
+
+// providerTable is where deal candidates come from, ribsDB in practice
+type providerTable interface {
+	DealCandidates(group iface.GroupKey) ([]ProviderCandidate, error)
+}
+
+func selectDealProviders(ctx context.Context, pt providerTable, sel ProviderSelector, req DealRequest) ([]ProviderCandidate, error) {
+	cands, err := pt.DealCandidates(req.Group)
+	if err != nil {
+		return nil, xerrors.Errorf("getting deal candidates: %w", err)
+	}
+
+	if req.MaxPrice > 0 {
+		affordable := cands[:0]
+		for _, c := range cands {
+			price := c.AskPrice
+			if req.Verified {
+				price = c.AskVerifiedPrice
+			}
+			if price <= req.MaxPrice {
+				affordable = append(affordable, c)
+			}
+		}
+		cands = affordable
+	}
+
+	out, err := sel.SelectProviders(ctx, req, cands)
+	if err != nil {
+		return nil, xerrors.Errorf("selecting providers: %w", err)
+	}
+
+	if len(out) > dealCandidateLimit {
+		out = out[:dealCandidateLimit]
+	}
+
+	return out, nil
+}
+
+// WeightedSelector is the default ProviderSelector. It drops providers which
+// are too expensive, can't take the piece, or aren't allowed, then orders the
+// rest by a weighted score. Score components are in [0, 1]:
+//   - price: 1 for free, 0 at the max price
+//   - deal success: smoothed ratio of sealed deals to attempts
+//   - retrieval: smoothed ratio of successful retrieval probes
+//   - protocols: half for booster-http, half for booster-bitswap
+//   - reputation: decayed score from deal history, time to seal and retrievals
+type WeightedSelector struct {
+	// attoFIL/GiB/epoch, providers asking more are not used
+	MaxPrice         int64
+	MaxVerifiedPrice int64
+
+	// when non-empty only these providers are used
+	Allow []int64
+	// never used
+	Deny []int64
+
+	PriceWeight       float64
+	DealSuccessWeight float64
+	RetrievalWeight   float64
+	ProtocolWeight    float64
+	ReputationWeight  float64
+
+	// random noise added to scores, spreads deals between similar providers
+	Jitter float64
+}
+
+func DefaultProviderSelector() *WeightedSelector {
+	return &WeightedSelector{
+		MaxPrice:         int64(maxPrice),
+		MaxVerifiedPrice: int64(maxVerifPrice),
+
+		// reputation covers deal success and retrievals
+		PriceWeight:      1,
+		ProtocolWeight:   1,
+		ReputationWeight: 3,
+
+		Jitter: 0.5,
+	}
+}
+
+func (s *WeightedSelector) SelectProviders(ctx context.Context, req DealRequest, cands []ProviderCandidate) ([]ProviderCandidate, error) {
+	allow := make(map[int64]struct{}, len(s.Allow))
+	for _, id := range s.Allow {
+		allow[id] = struct{}{}
+	}
+	deny := make(map[int64]struct{}, len(s.Deny))
+	for _, id := range s.Deny {
+		deny[id] = struct{}{}
+	}
+
+	type scored struct {
+		p     ProviderCandidate
+		score float64
+	}
+	var ok []scored
+
+	for _, p := range cands {
+		if _, denied := deny[p.ID]; denied {
+			continue
+		}
+		if _, allowed := allow[p.ID]; len(allow) > 0 && !allowed {
+			continue
+		}
+
+		price, max := p.AskPrice, s.MaxPrice
+		if req.Verified {
+			price, max = p.AskVerifiedPrice, s.MaxVerifiedPrice
+		}
+		if price > max {
+			continue
+		}
+
+		// small pieces get padded up to the provider minimum
+		if p.AskMaxPieceSize < int64(req.PieceSize) || p.AskMinPieceSize > int64(maxPieceSize) {
+			continue
+		}
+
+		ok = append(ok, scored{p: p, score: s.score(p, price, max)})
+	}
+
+	sort.SliceStable(ok, func(i, j int) bool {
+		return ok[i].score > ok[j].score
+	})
+
+	out := make([]ProviderCandidate, len(ok))
+	for i, sp := range ok {
+		out[i] = sp.p
+	}
+
+	return out, nil
+}
+
+func (s *WeightedSelector) score(p ProviderCandidate, price, max int64) float64 {
+	priceScore := 1.0
+	if max > 0 {
+		priceScore = 1 - float64(price)/float64(max)
+	}
+
+	dealScore := float64(p.DealSuccess+1) / float64(p.DealSuccess+p.DealFail+p.DealRejected+2)
+	retrScore := float64(p.RetrProbeSuccess+1) / float64(p.RetrProbeSuccess+p.RetrProbeFail+2)
+
+	var protoScore float64
+	if p.BoosterHttp {
+		protoScore += 0.5
+	}
+	if p.BoosterBitswap {
+		protoScore += 0.5
+	}
+
+	score := s.PriceWeight*priceScore + s.DealSuccessWeight*dealScore + s.RetrievalWeight*retrScore + s.ProtocolWeight*protoScore +
+		s.ReputationWeight*p.Reputation
+	if s.Jitter > 0 {
+		score += s.Jitter * rand.Float64()
+	}
+
+	return score
+}
+
+var _ ProviderSelector = &WeightedSelector{}
@@ -0,0 +1,141 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeProviderTable []ProviderCandidate
+
+func (f fakeProviderTable) DealCandidates(group iface.GroupKey) ([]ProviderCandidate, error) {
+	return append([]ProviderCandidate{}, f...), nil
+}
+
+func selectedIDs(ps []ProviderCandidate) []int64 {
+	out := make([]int64, len(ps))
+	for i, p := range ps {
+		out[i] = p.ID
+	}
+	return out
+}
+
+func TestWeightedSelector(t *testing.T) {
+	ctx := context.Background()
+
+	prov := func(id int64, price int64, success, fail int64) ProviderCandidate {
+		return ProviderCandidate{
+			ID:              id,
+			AskPrice:        price,
+			AskMinPieceSize: 256,
+			AskMaxPieceSize: 32 << 30,
+			DealStarted:     success + fail,
+			DealSuccess:     success,
+			DealFail:        fail,
+		}
+	}
+
+	table := fakeProviderTable{
+		prov(1, 0, 0, 0),
+		prov(2, 0, 10, 0),
+		prov(3, 0, 0, 10),
+		prov(4, 1000, 10, 0), // too expensive
+		prov(5, 0, 5, 0),
+	}
+	table[4].BoosterHttp = true
+	table[4].BoosterBitswap = true
+
+	sel := &WeightedSelector{
+		MaxPrice:          100,
+		DealSuccessWeight: 1,
+		ProtocolWeight:    1,
+	}
+	req := DealRequest{Group: 1, PieceSize: 1 << 30}
+
+	ps, err := selectDealProviders(ctx, table, sel, req)
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 2, 1, 3}, selectedIDs(ps))
+
+	// verified deals use the verified price
+	table[0].AskVerifiedPrice = 1
+	ps, err = selectDealProviders(ctx, table, sel, DealRequest{Group: 1, PieceSize: 1 << 30, Verified: true})
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 2, 4, 3}, selectedIDs(ps))
+
+	// piece too large for the provider
+	table[1].AskMaxPieceSize = 512 << 20
+	ps, err = selectDealProviders(ctx, table, sel, req)
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 1, 3}, selectedIDs(ps))
+
+	// allow and deny lists
+	sel.Deny = []int64{5}
+	ps, err = selectDealProviders(ctx, table, sel, req)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 3}, selectedIDs(ps))
+
+	sel.Allow = []int64{3, 5}
+	ps, err = selectDealProviders(ctx, table, sel, req)
+	require.NoError(t, err)
+	require.Equal(t, []int64{3}, selectedIDs(ps))
+
+	// results are capped
+	var many fakeProviderTable
+	for i := 0; i < 2*dealCandidateLimit; i++ {
+		many = append(many, prov(int64(100+i), 0, 0, 0))
+	}
+	ps, err = selectDealProviders(ctx, many, DefaultProviderSelector(), req)
+	require.NoError(t, err)
+	require.Len(t, ps, dealCandidateLimit)
+}
+
+func TestDealCandidates(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	for _, id := range []int64{1000, 1001} {
+		_, err := db.db.Exec(`insert into providers (id, in_market, ping_ok, ask_ok, booster_http, ask_price, ask_max_piece_size) values (?, 1, 1, 1, 1, 10, 1000)`, id)
+		require.NoError(t, err)
+	}
+	_, err = db.db.Exec(`insert into providers (id, in_market, ping_ok, ask_ok) values (1002, 1, 0, 1)`)
+	require.NoError(t, err)
+
+	for i, d := range []struct {
+		group            int64
+		sealed, rejected int
+	}{{1, 1, 0}, {2, 0, 1}} {
+		_, err = db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, sealed, rejected, failed)
+			values (?, 'f01', 1000, ?, 0, 0, 1, 0, 0, x'00', ?, ?, ?)`, i, d.group, d.sealed, d.rejected, d.rejected)
+		require.NoError(t, err)
+	}
+
+	cands, err := db.DealCandidates(1)
+	require.NoError(t, err)
+	require.Len(t, cands, 1)
+	require.Equal(t, int64(1001), cands[0].ID)
+	require.True(t, cands[0].BoosterHttp)
+
+	cands, err = db.DealCandidates(3)
+	require.NoError(t, err)
+	require.Len(t, cands, 2)
+	require.Equal(t, ProviderCandidate{
+		ID:              1000,
+		AskPrice:        10,
+		AskMaxPieceSize: 1000,
+		BoosterHttp:     true,
+		DealStarted:     2,
+		DealSuccess:     1,
+		DealRejected:    1,
+		Reputation:      0.5,
+	}, cands[0])
+
+	// quarantined providers aren't candidates
+	require.NoError(t, db.UpdateProviderReputation(1001, 0.1, time.Now().Add(time.Hour)))
+	cands, err = db.DealCandidates(3)
+	require.NoError(t, err)
+	require.Len(t, cands, 1)
+	require.Equal(t, int64(1000), cands[0].ID)
+}
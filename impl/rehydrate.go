@@ -0,0 +1,442 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// partial piece download, kept across restarts so that downloads can resume
+const rehydrateFile = "rehydrate.car"
+
+const (
+	rehydrateStageStarting    = "starting"
+	rehydrateStageDownloading = "downloading"
+	rehydrateStageVerifying   = "verifying"
+	rehydrateStageRebuilding  = "rebuilding"
+)
+
+// piece download timeouts; there is no overall limit as pieces can be many
+// GiB, downloads which stop receiving data for rehydrateIdleTimeout fail
+var (
+	rehydrateIdleTimeout = time.Minute
+
+	rehydrateClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+)
+
+// RehydratePolicy controls bringing offloaded groups back to local storage
+type RehydratePolicy struct {
+	// HotReads is the number of remote block reads after which an offloaded
+	// group gets rehydrated. 0 disables automatic rehydration.
+	HotReads int64
+
+	// BytesPerSecond limits piece download speed, 0 means no limit
+	BytesPerSecond int64
+}
+
+func (p RehydratePolicy) validate() error {
+	if p.HotReads < 0 || p.BytesPerSecond < 0 {
+		return xerrors.Errorf("negative values not allowed")
+	}
+	return nil
+}
+
+// WithRehydratePolicy sets when and how fast offloaded groups are rehydrated
+func WithRehydratePolicy(p RehydratePolicy) OpenOption {
+	return func(o *openOptions) {
+		o.rehydratePolicy = p
+	}
+}
+
+func (r *ribs) RehydrateGroup(ctx context.Context, gk iface.GroupKey) error {
+	err := r.withReadableGroup(gk, func(g *Group) error {
+		// state changes are made under dblk, jblk is held for the whole
+		// rebuild of a running rehydration
+		g.dblk.Lock()
+		defer g.dblk.Unlock()
+
+		if g.state != iface.GroupStateOffloaded {
+			return xerrors.Errorf("group not offloaded, state %d", g.state)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.rehydrateLk.Lock()
+	defer r.rehydrateLk.Unlock()
+
+	if p, ok := r.rehydrating[gk]; ok && p.Error == "" {
+		return nil // already running
+	}
+
+	// resumed on restart until done
+	if err := r.db.SetGroupRehydrating(gk, true); err != nil {
+		return err
+	}
+
+	p := &iface.RehydrateProgress{Stage: rehydrateStageStarting}
+	r.rehydrating[gk] = p
+
+	r.startWorker(func(ctx context.Context) {
+		err := r.rehydrate(ctx, gk, p)
+		if err == nil {
+			err = r.db.SetGroupRehydrating(gk, false)
+		}
+
+		r.rehydrateLk.Lock()
+		if err != nil {
+			log.Errorw("rehydrating group", "group", gk, "error", err)
+			p.Error = err.Error()
+
+			// retried once the group gets hot again
+			delete(r.remoteReads, gk)
+			r.rehydrateLk.Unlock()
+			return
+		}
+
+		log.Infow("group rehydrated", "group", gk)
+		delete(r.rehydrating, gk)
+		delete(r.remoteReads, gk)
+		r.rehydrateLk.Unlock()
+
+		// groups are mostly rehydrated by repair or renewal, make the deals
+		// they need now, before the group can get offloaded again
+		if err := r.requestMoreDeals(gk); err != nil {
+			log.Errorw("requesting deals for rehydrated group", "group", gk, "error", err)
+		}
+	})
+
+	return nil
+}
+
+func (r *ribs) updateRehydrate(p *iface.RehydrateProgress, cb func(p *iface.RehydrateProgress)) {
+	r.rehydrateLk.Lock()
+	cb(p)
+	r.rehydrateLk.Unlock()
+}
+
+func (r *ribs) rehydrateProgress(gk iface.GroupKey) *iface.RehydrateProgress {
+	r.rehydrateLk.Lock()
+	defer r.rehydrateLk.Unlock()
+
+	p, ok := r.rehydrating[gk]
+	if !ok {
+		return nil
+	}
+	cp := *p
+	return &cp
+}
+
+func (r *ribs) rehydrate(ctx context.Context, gk iface.GroupKey, p *iface.RehydrateProgress) error {
+	var g *Group
+	if err := r.withReadableGroup(gk, func(gr *Group) error {
+		g = gr
+		return nil
+	}); err != nil {
+		return xerrors.Errorf("opening group: %w", err)
+	}
+
+	dp, err := r.db.GetDealParams(ctx, gk)
+	if err != nil {
+		return xerrors.Errorf("getting deal params: %w", err)
+	}
+
+	cands, err := r.db.RetrievalCandidates(gk)
+	if err != nil {
+		return xerrors.Errorf("getting retrieval candidates: %w", err)
+	}
+
+	partPath := filepath.Join(g.path, rehydrateFile)
+	lastErr := xerrors.Errorf("no providers serving pieces over http")
+
+	for _, cand := range cands {
+		if len(cand.httpURLs) == 0 {
+			continue
+		}
+
+		// the provider may have a padded piece, so get the cid from its deal
+		pieceCid, err := r.dealPieceCid(gk, cand.id)
+		if err != nil {
+			lastErr = xerrors.Errorf("getting piece cid of %d: %w", cand.id, err)
+			log.Warnw("rehydrate candidate skipped", "group", gk, "error", lastErr)
+			continue
+		}
+
+		for _, u := range cand.httpURLs {
+			r.updateRehydrate(p, func(p *iface.RehydrateProgress) {
+				p.Provider = cand.id
+				p.Stage = rehydrateStageDownloading
+				p.Total = dp.CarSize
+			})
+
+			if err := r.downloadPiece(ctx, u, pieceCid, partPath, dp.CarSize, p); err != nil {
+				lastErr = xerrors.Errorf("downloading piece from %d (%s): %w", cand.id, u, err)
+				log.Warnw("rehydrate download failed", "group", gk, "error", lastErr)
+				continue
+			}
+
+			r.updateRehydrate(p, func(p *iface.RehydrateProgress) {
+				p.Stage = rehydrateStageVerifying
+			})
+
+			if err := verifyPieceFile(partPath, dp); err != nil {
+				lastErr = xerrors.Errorf("verifying piece from %d: %w", cand.id, err)
+				log.Warnw("rehydrate verification failed", "group", gk, "error", lastErr)
+
+				if err := os.Remove(partPath); err != nil {
+					return xerrors.Errorf("removing bad piece: %w", err)
+				}
+				continue
+			}
+
+			r.updateRehydrate(p, func(p *iface.RehydrateProgress) {
+				p.Stage = rehydrateStageRebuilding
+			})
+
+			f, err := os.Open(partPath)
+			if err != nil {
+				return xerrors.Errorf("opening piece: %w", err)
+			}
+
+			err = g.Rehydrate(ctx, io.LimitReader(f, dp.CarSize))
+			_ = f.Close()
+			if err != nil {
+				// keep the verified piece, retrying won't need to download it
+				return xerrors.Errorf("rebuilding group data: %w", err)
+			}
+
+			return os.Remove(partPath)
+		}
+	}
+
+	return lastErr
+}
+
+func (r *ribs) dealPieceCid(gk iface.GroupKey, provider int64) (cid.Cid, error) {
+	pb, err := r.db.SealedDealProposal(gk, provider)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	var prop market.ClientDealProposal
+	if err := prop.UnmarshalCBOR(bytes.NewReader(pb)); err != nil {
+		return cid.Undef, xerrors.Errorf("unmarshaling proposal: %w", err)
+	}
+
+	return prop.Proposal.PieceCID, nil
+}
+
+// downloadPiece fetches the first carSize bytes of a piece from booster-http
+// into path, resuming from what's already there
+func (r *ribs) downloadPiece(ctx context.Context, baseURL string, pieceCid cid.Cid, path string, carSize int64, p *iface.RehydrateProgress) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return xerrors.Errorf("opening piece file: %w", err)
+	}
+	defer f.Close() // nolint
+
+	st, err := f.Stat()
+	if err != nil {
+		return xerrors.Errorf("stat piece file: %w", err)
+	}
+
+	have := st.Size()
+	if have > carSize {
+		have = 0
+	}
+	if have == carSize {
+		return nil
+	}
+
+	// cancelled when no data arrives for rehydrateIdleTimeout
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(rehydrateIdleTimeout, cancel)
+	defer idle.Stop()
+
+	u := fmt.Sprintf("%s/piece/%s", strings.TrimSuffix(baseURL, "/"), pieceCid)
+	req, err := http.NewRequestWithContext(dctx, http.MethodGet, u, nil)
+	if err != nil {
+		return xerrors.Errorf("creating request: %w", err)
+	}
+	// only fetch the car, deal pieces may be zero-padded
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", have, carSize-1))
+
+	resp, err := rehydrateClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// range not supported, start over
+		have = 0
+	default:
+		return xerrors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if err := f.Truncate(have); err != nil {
+		return xerrors.Errorf("truncating piece file: %w", err)
+	}
+	if _, err := f.Seek(have, io.SeekStart); err != nil {
+		return xerrors.Errorf("seeking piece file: %w", err)
+	}
+
+	r.updateRehydrate(p, func(p *iface.RehydrateProgress) {
+		p.Downloaded = have
+	})
+
+	src := &rateLimitedReader{
+		r:     io.LimitReader(&idleReader{r: resp.Body, t: idle}, carSize-have),
+		rate:  r.rehydratePolicy.BytesPerSecond,
+		start: time.Now(),
+		onRead: func(n int) {
+			r.updateRehydrate(p, func(p *iface.RehydrateProgress) {
+				p.Downloaded += int64(n)
+			})
+		},
+	}
+
+	n, err := io.Copy(f, src)
+	if err != nil {
+		if dctx.Err() != nil && ctx.Err() == nil {
+			return xerrors.Errorf("no data received for %s: %w", rehydrateIdleTimeout, err)
+		}
+		return xerrors.Errorf("downloading: %w", err)
+	}
+	if have+n != carSize {
+		return xerrors.Errorf("piece too short, got %d of %d bytes", have+n, carSize)
+	}
+
+	return f.Sync()
+}
+
+// verifyPieceFile checks downloaded car data against the group commP
+func verifyPieceFile(path string, dp dealParams) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return xerrors.Errorf("opening piece: %w", err)
+	}
+	defer f.Close() // nolint
+
+	cc := new(ributil.DataCidWriter)
+	if _, err := io.Copy(cc, io.LimitReader(f, dp.CarSize)); err != nil {
+		return xerrors.Errorf("computing commP: %w", err)
+	}
+
+	sum, err := cc.Sum()
+	if err != nil {
+		return xerrors.Errorf("computing commP: %w", err)
+	}
+
+	expect, err := commcid.PieceCommitmentV1ToCID(dp.CommP)
+	if err != nil {
+		return xerrors.Errorf("converting commP to cid: %w", err)
+	}
+
+	if sum.PieceCID != expect || int64(sum.PieceSize) != dp.PieceSize {
+		return xerrors.Errorf("commP mismatch, expected %s (size %d), got %s (size %d)", expect, dp.PieceSize, sum.PieceCID, sum.PieceSize)
+	}
+
+	return nil
+}
+
+// idleReader pushes back the idle timer on every read which returns data
+type idleReader struct {
+	r io.Reader
+	t *time.Timer
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.t.Reset(rehydrateIdleTimeout)
+	}
+	return n, err
+}
+
+type rateLimitedReader struct {
+	r      io.Reader
+	rate   int64 // bytes per second, 0 means no limit
+	start  time.Time
+	read   int64
+	onRead func(n int)
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if l.rate > 0 && int64(len(p)) > l.rate/10+1 {
+		// small reads so that sleeps stay short
+		p = p[:l.rate/10+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.onRead != nil && n > 0 {
+		l.onRead(n)
+	}
+
+	if l.rate > 0 {
+		expect := time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second))
+		if el := time.Since(l.start); el < expect {
+			time.Sleep(expect - el)
+		}
+	}
+
+	return n, err
+}
+
+// trackRemoteReads wraps remote retrieval, starting rehydration of groups
+// which get read remotely often
+func (r *ribs) trackRemoteReads(rr RemoteRetrievalFunc) RemoteRetrievalFunc {
+	return func(ctx context.Context, group iface.GroupKey, c []mh.Multihash, cb func(cidx int, data []byte)) error {
+		err := rr(ctx, group, c, cb)
+
+		if r.rehydratePolicy.HotReads == 0 {
+			return err
+		}
+
+		r.rehydrateLk.Lock()
+		r.remoteReads[group] += int64(len(c))
+		hot := r.remoteReads[group] >= r.rehydratePolicy.HotReads
+		p, ok := r.rehydrating[group]
+		running := ok && p.Error == ""
+		r.rehydrateLk.Unlock()
+
+		if hot && !running {
+			if err := r.RehydrateGroup(ctx, group); err != nil {
+				log.Errorw("starting rehydration of hot group", "group", group, "error", err)
+			}
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,167 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupRehydrate(t *testing.T) {
+	oldInterval := carIndexInterval
+	carIndexInterval = 4 << 10
+	t.Cleanup(func() {
+		carIndexInterval = oldInterval
+	})
+
+	ctx := context.Background()
+	root := t.TempDir()
+
+	db, err := openRibsDB(root)
+	require.NoError(t, err)
+
+	gk, err := db.CreateGroup()
+	require.NoError(t, err)
+
+	g, err := OpenGroup(db, NewIndex(db.db), gk, 0, 0, root, iface.GroupStateWritable, true, groupOptions{sizing: defaultGroupSizePolicy()})
+	require.NoError(t, err)
+
+	var bs []blocks.Block
+	var hs []mh.Multihash
+	for i := 0; i < 5000; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("rehydrate block %d", i)))
+		bs = append(bs, b)
+		hs = append(hs, b.Cid().Hash())
+	}
+
+	_, err = g.Put(ctx, bs)
+	require.NoError(t, err)
+	require.NoError(t, g.Seal(ctx))
+
+	require.NoError(t, g.Finalize(ctx))
+	require.NoError(t, g.GenTopCar(ctx))
+	require.NoError(t, g.GenCommP())
+
+	var carBuf bytes.Buffer
+	_, _, err = g.writeCar(&carBuf)
+	require.NoError(t, err)
+
+	dp, err := db.GetDealParams(ctx, gk)
+	require.NoError(t, err)
+	require.Equal(t, int64(carBuf.Len()), dp.CarSize)
+
+	// stand-in booster-http serving the piece, zero-padded like in a deal
+	piece := append(append([]byte{}, carBuf.Bytes()...), make([]byte, 1000)...)
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "piece", time.Time{}, bytes.NewReader(piece))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsInProgress))
+	require.NoError(t, g.Offload(ctx))
+
+	err = g.View(ctx, hs[:1], func(int, []byte) {})
+	require.Error(t, err)
+
+	// resume a partial download
+	partPath := filepath.Join(g.path, rehydrateFile)
+	require.NoError(t, os.WriteFile(partPath, carBuf.Bytes()[:carBuf.Len()/2], 0644))
+
+	r := &ribs{
+		rehydratePolicy: RehydratePolicy{BytesPerSecond: 10 << 20},
+		rehydrating:     map[iface.GroupKey]*iface.RehydrateProgress{},
+	}
+	p := &iface.RehydrateProgress{}
+	require.NoError(t, r.downloadPiece(ctx, srv.URL, cid.Undef, partPath, dp.CarSize, p))
+	require.Equal(t, dp.CarSize, p.Downloaded)
+	require.Equal(t, int64(1), atomic.LoadInt64(&requests))
+
+	require.NoError(t, verifyPieceFile(partPath, dp))
+
+	f, err := os.Open(partPath)
+	require.NoError(t, err)
+	require.NoError(t, g.Rehydrate(ctx, f))
+	require.NoError(t, f.Close())
+	require.Equal(t, iface.GroupStateDealsDone, g.state)
+
+	var n int
+	err = g.View(ctx, hs, func(i int, data []byte) {
+		require.Equal(t, bs[i].RawData(), data)
+		n++
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(hs), n)
+
+	// vcar layers are back, producing the same car
+	var carBuf2 bytes.Buffer
+	_, _, err = g.writeCar(&carBuf2)
+	require.NoError(t, err)
+	require.Equal(t, carBuf.Bytes(), carBuf2.Bytes())
+
+	// and the car offset index, so ranges don't start from the car header
+	idx, err := loadCarIndex(g.path)
+	require.NoError(t, err)
+	require.NotNil(t, idx)
+	require.Greater(t, len(idx.Entries), 1)
+
+	var rangeBuf bytes.Buffer
+	require.NoError(t, g.writeCarRange(&rangeBuf, int64(carBuf.Len()/2), 1000))
+	require.Equal(t, carBuf.Bytes()[carBuf.Len()/2:carBuf.Len()/2+1000], rangeBuf.Bytes())
+
+	// rehydration is resumed after restarts until done
+	require.NoError(t, db.SetGroupRehydrating(gk, true))
+	rh, err := db.RehydratingGroups()
+	require.NoError(t, err)
+	require.True(t, rh[gk])
+	require.NoError(t, db.SetGroupRehydrating(gk, false))
+	rh, err = db.RehydratingGroups()
+	require.NoError(t, err)
+	require.Empty(t, rh)
+
+	// corrupted downloads don't pass verification
+	bad := append([]byte{}, carBuf.Bytes()...)
+	bad[len(bad)-10] ^= 0xff
+	require.NoError(t, os.WriteFile(partPath, bad, 0644))
+	require.Error(t, verifyPieceFile(partPath, dp))
+
+	_, err = g.jb.Close()
+	require.NoError(t, err)
+}
+
+func TestRehydrateStalledDownload(t *testing.T) {
+	oldIdle := rehydrateIdleTimeout
+	rehydrateIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		rehydrateIdleTimeout = oldIdle
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	r := &ribs{rehydrating: map[iface.GroupKey]*iface.RehydrateProgress{}}
+	p := &iface.RehydrateProgress{}
+
+	partPath := filepath.Join(t.TempDir(), rehydrateFile)
+	err := r.downloadPiece(context.Background(), srv.URL, cid.Undef, partPath, 1000, p)
+	require.ErrorContains(t, err, "no data received")
+	require.Equal(t, int64(100), p.Downloaded)
+}
@@ -0,0 +1,261 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors/adt"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
+	types2 "github.com/filecoin-project/lotus/chain/types"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var renewalCheckInterval = time.Hour
+
+// replacement deals need time to get published and sealed
+const minRenewalMargin = 7 * 24 * time.Hour
+
+// RenewalPolicy decides when deals approaching their end epoch get renewed.
+// Verified claims are extended where possible, otherwise fresh deals for the
+// same piece are made with the same or new providers.
+type RenewalPolicy struct {
+	// Margin is how long before the end of a deal renewal starts. 0 disables
+	// renewal.
+	Margin time.Duration
+
+	// DefaultRetention is how long groups are kept, counted from group
+	// creation, unless set per group with Admin.SetGroupRetention. Deals
+	// ending after the retention period aren't renewed. 0 keeps groups forever.
+	DefaultRetention time.Duration
+}
+
+func defaultRenewalPolicy() RenewalPolicy {
+	return RenewalPolicy{
+		Margin: 30 * 24 * time.Hour,
+	}
+}
+
+func (p RenewalPolicy) validate() error {
+	if p.Margin < 0 || p.DefaultRetention < 0 {
+		return xerrors.Errorf("negative values not allowed")
+	}
+	if p.Margin > 0 && p.Margin < minRenewalMargin {
+		return xerrors.Errorf("margin must be at least %s", minRenewalMargin)
+	}
+	return nil
+}
+
+// retainUntil returns when group data can be dropped, zero time means never
+func (p RenewalPolicy) retainUntil(createdAt, retainUntil int64) time.Time {
+	switch {
+	case retainUntil != 0:
+		return time.Unix(retainUntil, 0)
+	case p.DefaultRetention > 0:
+		return time.Unix(createdAt, 0).Add(p.DefaultRetention)
+	}
+	return time.Time{}
+}
+
+// WithRenewalPolicy overrides when deals get renewed, and how long groups are
+// retained by default
+func WithRenewalPolicy(p RenewalPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.renewalPolicy = &p
+	}
+}
+
+func (r *ribs) SetGroupRetention(ctx context.Context, gk iface.GroupKey, until time.Time) error {
+	var ts int64
+	if !until.IsZero() {
+		ts = until.Unix()
+	}
+
+	return r.db.SetGroupRetention(gk, ts)
+}
+
+func (r *ribs) renewalWorker(ctx context.Context) {
+	if r.renewalPolicy.Margin == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(renewalCheckInterval):
+		}
+
+		if err := r.renewDeals(ctx); err != nil {
+			log.Errorw("deal renewal failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) renewDeals(ctx context.Context) error {
+	gw := r.chain
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	gen, err := gw.ChainGetGenesis(ctx)
+	if err != nil {
+		return xerrors.Errorf("get genesis: %w", err)
+	}
+
+	epochTime := func(e abi.ChainEpoch) time.Time {
+		return time.Unix(int64(gen.MinTimestamp()), 0).Add(time.Duration(e) * epochDuration)
+	}
+
+	deals, err := r.db.ExpiringDeals(head.Height() + abi.ChainEpoch(r.renewalPolicy.Margin/epochDuration))
+	if err != nil {
+		return xerrors.Errorf("getting expiring deals: %w", err)
+	}
+
+	toRenew := map[iface.GroupKey]struct{}{}
+
+	for _, deal := range deals {
+		retainUntil := r.renewalPolicy.retainUntil(deal.GroupCreatedAt, deal.GroupRetainUntil)
+		if !retainUntil.IsZero() && !retainUntil.After(epochTime(deal.EndEpoch)) {
+			// group retention ends with the deal
+			continue
+		}
+
+		if deal.Verified {
+			extended, err := r.extendClaim(ctx, gw, head, deal)
+			if err != nil {
+				log.Warnw("extending verified claim failed, making new deals", "deal", deal.DealUUID, "group", deal.GroupID, "error", err)
+			}
+			if extended {
+				continue
+			}
+		}
+
+		if deal.GroupState == iface.GroupStateOffloaded {
+			// deals need local data, the deal is renewed once the group is back
+			if err := r.RehydrateGroup(ctx, deal.GroupID); err != nil {
+				log.Errorw("starting rehydration for deal renewal", "group", deal.GroupID, "error", err)
+			}
+			continue
+		}
+
+		log.Infow("renewing deal", "deal", deal.DealUUID, "group", deal.GroupID, "provider", deal.ProviderAddr, "end", deal.EndEpoch)
+
+		if err := r.db.MarkDealRenewed(deal.DealUUID); err != nil {
+			return xerrors.Errorf("marking deal renewed: %w", err)
+		}
+		toRenew[deal.GroupID] = struct{}{}
+	}
+
+	// renewed deals don't count towards replicas, and their providers can get
+	// the replacement deals
+	for gk := range toRenew {
+		if err := r.requestMoreDeals(gk); err != nil {
+			log.Errorw("requesting deals for renewal", "group", gk, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// extendClaim extends the term of the verified claim backing a deal, returns
+// false when there is no claim which can be extended
+func (r *ribs) extendClaim(ctx context.Context, gw ChainAPI, head *types2.TipSet, deal expiringDealMeta) (bool, error) {
+	var prop market.ClientDealProposal
+	if err := prop.UnmarshalCBOR(bytes.NewReader(deal.Proposal)); err != nil {
+		return false, xerrors.Errorf("unmarshaling proposal: %w", err)
+	}
+
+	clientAddr, err := gw.StateLookupID(ctx, prop.Proposal.Client, head.Key())
+	if err != nil {
+		return false, xerrors.Errorf("looking up client id: %w", err)
+	}
+	clientID, err := address.IDFromAddress(clientAddr)
+	if err != nil {
+		return false, xerrors.Errorf("client id: %w", err)
+	}
+
+	maddr, err := address.NewIDAddress(uint64(deal.ProviderAddr))
+	if err != nil {
+		return false, xerrors.Errorf("new id address: %w", err)
+	}
+
+	vst, err := loadVerifregState(ctx, gw, head.Key())
+	if err != nil {
+		return false, xerrors.Errorf("loading verifreg state: %w", err)
+	}
+
+	claims, err := vst.GetClaims(maddr)
+	if err != nil {
+		return false, xerrors.Errorf("getting provider claims: %w", err)
+	}
+
+	for id, claim := range claims {
+		if claim.Data != prop.Proposal.PieceCID || claim.Client != abi.ActorID(clientID) {
+			continue
+		}
+
+		policy := r.groupOpts.dealPolicy
+		if deal.GroupDealPolicy != nil {
+			policy = *deal.GroupDealPolicy
+		}
+
+		termMax := claim.TermMax + toEpochs(policy.MaxDuration)
+		if limit := head.Height() + verifregtypes.MaximumVerifiedAllocationTerm - claim.TermStart; termMax > limit {
+			termMax = limit
+		}
+		if termMax <= claim.TermMax {
+			return false, nil
+		}
+
+		params := &verifregtypes.ExtendClaimTermsParams{
+			Terms: []verifregtypes.ClaimTerm{{
+				Provider: claim.Provider,
+				ClaimId:  id,
+				TermMax:  termMax,
+			}},
+		}
+
+		lookup, err := r.sender.send(ctx, gw, verifreg.Address, verifreg.Methods.ExtendClaimTerms, big.Zero(), params, nil)
+		if err != nil {
+			return false, xerrors.Errorf("extending claim: %w", err)
+		}
+
+		var ret verifregtypes.ExtendClaimTermsReturn
+		if err := ret.UnmarshalCBOR(bytes.NewReader(lookup.Receipt.Return)); err != nil {
+			return false, xerrors.Errorf("unmarshaling extend claim return: %w", err)
+		}
+		if ret.SuccessCount != 1 {
+			return false, xerrors.Errorf("claim extension failed: %v", ret.FailCodes)
+		}
+
+		log.Infow("extended verified claim", "deal", deal.DealUUID, "group", deal.GroupID, "claim", id, "termEnd", claim.TermStart+termMax)
+
+		if err := r.db.UpdateDealClaimExtended(deal.DealUUID, uint64(id), claim.TermStart+termMax); err != nil {
+			return false, xerrors.Errorf("recording claim extension: %w", err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func loadVerifregState(ctx context.Context, gw ChainAPI, tsk types2.TipSetKey) (verifreg.State, error) {
+	act, err := gw.StateGetActor(ctx, verifreg.Address, tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("get verifreg actor: %w", err)
+	}
+
+	return verifreg.Load(adt.WrapStore(ctx, cbor.NewCborStore(blockstore.NewAPIBlockstore(gw))), act)
+}
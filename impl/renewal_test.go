@@ -0,0 +1,172 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealRenewal(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	gk, err := db.CreateGroup()
+	require.NoError(t, err)
+	require.NoError(t, db.SetGroupState(context.Background(), gk, iface.GroupStateDealsDone))
+
+	for i, end := range []abi.ChainEpoch{1000, 5000} {
+		insertTestDeal(t, db, testDeal{
+			UUID:     []string{"ending", "later"}[i],
+			Group:    gk,
+			Provider: int64(1000 + i),
+			DealID:   abi.DealID(i + 1),
+			EndEpoch: end,
+			Sealed:   true,
+		})
+	}
+
+	deals, err := db.ExpiringDeals(2000)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	require.Equal(t, "ending", deals[0].DealUUID)
+	require.Equal(t, iface.GroupStateDealsDone, deals[0].GroupState)
+	require.NotZero(t, deals[0].GroupCreatedAt)
+	require.Zero(t, deals[0].GroupRetainUntil)
+
+	// renewed deals don't count as replicas
+	require.NoError(t, db.MarkDealRenewed("ending"))
+
+	n, err := db.GetNonFailedDealCount(gk)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	deals, err = db.ExpiringDeals(2000)
+	require.NoError(t, err)
+	require.Empty(t, deals)
+
+	// retention
+	require.Error(t, db.SetGroupRetention(gk+1, 10))
+	require.NoError(t, db.SetGroupRetention(gk, 10))
+	deals, err = db.ExpiringDeals(6000)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	require.Equal(t, int64(10), deals[0].GroupRetainUntil)
+
+	created := time.Unix(1000, 0).Unix()
+	p := RenewalPolicy{Margin: minRenewalMargin}
+	require.True(t, p.retainUntil(created, 0).IsZero())
+	require.Equal(t, time.Unix(10, 0), p.retainUntil(created, 10))
+
+	p.DefaultRetention = time.Hour
+	require.Equal(t, time.Unix(1000+3600, 0), p.retainUntil(created, 0))
+	require.NoError(t, p.validate())
+
+	require.Error(t, RenewalPolicy{Margin: time.Hour}.validate())
+	require.NoError(t, RenewalPolicy{}.validate())
+}
+
+func TestRenewDeals(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMockChain()
+	mc.Advance(200)
+
+	r, client := testChainRibs(t, mc)
+
+	g := testOpenGroup(t, r)
+	require.NoError(t, g.advanceState(ctx, iface.GroupStateDealsDone))
+
+	head, err := mc.ChainHead(ctx)
+	require.NoError(t, err)
+	h := head.Height()
+
+	clientID, err := mc.StateLookupID(ctx, client, head.Key())
+	require.NoError(t, err)
+	clientActor, err := address.IDFromAddress(clientID)
+	require.NoError(t, err)
+
+	addDeal := func(uuid string, provider int64, end abi.ChainEpoch, verified bool) {
+		id, prop := publishTestDeal(t, mc, client, provider, testPieceCid, h-100, end)
+		require.NoError(t, mc.ActivateDeal(id))
+
+		insertTestDeal(t, r.db, testDeal{
+			UUID:       uuid,
+			Group:      g.id,
+			Provider:   provider,
+			DealID:     id,
+			StartEpoch: h - 100,
+			EndEpoch:   end,
+			Sealed:     true,
+			Verified:   verified,
+			Proposal:   prop,
+		})
+	}
+
+	// near the end epoch, within the renewal margin
+	addDeal("ending", 1000, h+100, false)
+	addDeal("ending-verified", 1001, h+100, true)
+	// verified, but the provider has no claim to extend
+	addDeal("ending-noclaim", 1002, h+100, true)
+	addDeal("later", 1003, h+toEpochs(r.renewalPolicy.Margin)+100, false)
+
+	claimID := mc.AddClaim(verifregtypes.Claim{
+		Provider:  1001,
+		Client:    abi.ActorID(clientActor),
+		Data:      testPieceCid,
+		Size:      1 << 20,
+		TermMin:   100,
+		TermMax:   200,
+		TermStart: h - 100,
+	})
+
+	require.NoError(t, r.renewDeals(ctx))
+
+	requireDeal := func(uuid string, renewed bool, claim uint64, end abi.ChainEpoch) {
+		var rn bool
+		var c uint64
+		var e abi.ChainEpoch
+		require.NoError(t, r.db.db.QueryRow(`select renewed, coalesce(claim_id, 0), end_epoch from deals where uuid = ?`, uuid).Scan(&rn, &c, &e))
+		require.Equal(t, renewed, rn, uuid)
+		require.Equal(t, claim, c, uuid)
+		require.Equal(t, end, e, uuid)
+	}
+
+	requireDeal("ending", true, 0, h+100)
+	requireDeal("ending-noclaim", true, 0, h+100)
+	requireDeal("later", false, 0, h+toEpochs(r.renewalPolicy.Margin)+100)
+
+	// the claim got extended on chain instead of making a new deal
+	termEnd := h - 100 + 200 + toEpochs(r.groupOpts.dealPolicy.MaxDuration)
+	requireDeal("ending-verified", false, uint64(claimID), termEnd)
+
+	// past the market deal end the extended claim keeps the deal healthy
+	mc.Advance(150)
+	head, err = mc.ChainHead(ctx)
+	require.NoError(t, err)
+	require.NoError(t, r.checkActiveDeals(ctx, mc, head))
+
+	var failed []string
+	rows, err := r.db.db.Query(`select uuid from deals where failed = 1 order by uuid`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var uuid string
+		require.NoError(t, rows.Scan(&uuid))
+		failed = append(failed, uuid)
+	}
+	require.NoError(t, rows.Err())
+	require.NoError(t, rows.Close())
+	require.Equal(t, []string{"ending", "ending-noclaim"}, failed)
+
+	// one task for the group
+	requireTask(t, r, task{tt: taskTypeMakeMoreDeals, group: g.id})
+	select {
+	case tk := <-r.tasks:
+		t.Fatalf("unexpected task %v", tk)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,162 @@
+package impl
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	reputationUpdateInterval = 10 * time.Minute
+
+	// deal outcomes lose half their weight every reputationHalfLife
+	reputationHalfLife = 30 * 24 * time.Hour
+
+	// providers failing this many deals in a row (in transfer or sealing,
+	// rejections don't count) aren't used for quarantineDuration after the
+	// last failure
+	quarantineFailures = 3
+	quarantineDuration = 7 * 24 * time.Hour
+
+	// time to seal at which the seal speed component is 0.5
+	referenceSealTime = 48 * time.Hour
+)
+
+// score component weights, sum to 1
+const (
+	reputationDealWeight      = 0.6
+	reputationSealSpeedWeight = 0.2
+	reputationRetrievalWeight = 0.2
+)
+
+type dealOutcome struct {
+	// unix timestamps
+	Started  int64
+	SealedAt int64
+	// when the deal was marked failed, deals can fail long after starting
+	FailedAt int64
+
+	Sealed, Failed, Rejected bool
+
+	// failed by running until its end epoch, which isn't the provider's fault
+	Expired bool
+}
+
+// failed is true for deals which count against the provider. Slashed deals
+// stay marked as sealed, so this must be checked before Sealed.
+func (d dealOutcome) failed() bool {
+	return d.Failed && !d.Rejected && !d.Expired
+}
+
+type providerHistory struct {
+	// oldest first
+	Deals []dealOutcome
+
+	RetrSuccess, RetrFail int64
+}
+
+// providerReputation computes a score in [0, 1] from provider history, and
+// when the provider's quarantine ends (zero time when not quarantined). With
+// no history the score is 0.5.
+func providerReputation(h *providerHistory, now time.Time) (float64, time.Time) {
+	var good, bad, speed, speedWeight float64
+
+	for _, d := range h.Deals {
+		age := now.Sub(time.Unix(d.Started, 0))
+		if age < 0 {
+			age = 0
+		}
+		w := math.Exp2(-float64(age) / float64(reputationHalfLife))
+
+		switch {
+		case d.Rejected:
+			// rejections are cheap, mostly ask mismatches
+			bad += w / 4
+		case d.failed():
+			bad += w
+		case d.Sealed:
+			good += w
+
+			if d.SealedAt > d.Started {
+				tts := time.Duration(d.SealedAt-d.Started) * time.Second
+				speed += w * float64(referenceSealTime) / float64(referenceSealTime+tts)
+				speedWeight += w
+			}
+		}
+	}
+
+	dealScore := (good + 1) / (good + bad + 2)
+
+	speedScore := 0.5
+	if speedWeight > 0 {
+		speedScore = speed / speedWeight
+	}
+
+	retrScore := float64(h.RetrSuccess+1) / float64(h.RetrSuccess+h.RetrFail+2)
+
+	score := reputationDealWeight*dealScore + reputationSealSpeedWeight*speedScore + reputationRetrievalWeight*retrScore
+
+	// quarantine on recent failure streaks
+	var streak int
+	var lastFailure int64
+	for i := len(h.Deals) - 1; i >= 0; i-- {
+		d := h.Deals[i]
+		if !d.failed() {
+			if d.Sealed {
+				break
+			}
+			continue
+		}
+
+		if d.FailedAt > lastFailure {
+			lastFailure = d.FailedAt
+		}
+		streak++
+	}
+
+	var quarantinedUntil time.Time
+	if streak >= quarantineFailures {
+		if until := time.Unix(lastFailure, 0).Add(quarantineDuration); until.After(now) {
+			quarantinedUntil = until
+		}
+	}
+
+	return score, quarantinedUntil
+}
+
+func (r *ribs) reputationWorker(ctx context.Context) {
+	for {
+		if err := r.updateReputations(); err != nil {
+			log.Errorw("updating provider reputations", "error", err)
+		}
+
+		select {
+		case <-r.close:
+			return
+		case <-time.After(reputationUpdateInterval):
+		}
+	}
+}
+
+func (r *ribs) updateReputations() error {
+	hs, err := r.db.ProviderHistories()
+	if err != nil {
+		return xerrors.Errorf("getting provider histories: %w", err)
+	}
+
+	now := time.Now()
+	for prov, h := range hs {
+		score, quarantinedUntil := providerReputation(h, now)
+		if !quarantinedUntil.IsZero() {
+			log.Debugw("provider quarantined", "provider", prov, "until", quarantinedUntil)
+		}
+
+		if err := r.db.UpdateProviderReputation(prov, score, quarantinedUntil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
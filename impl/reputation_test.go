@@ -0,0 +1,139 @@
+package impl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviderReputation(t *testing.T) {
+	now := time.Unix(100_000_000, 0)
+	at := func(ago time.Duration) int64 {
+		return now.Add(-ago).Unix()
+	}
+	sealed := func(ago, tts time.Duration) dealOutcome {
+		return dealOutcome{Started: at(ago), SealedAt: at(ago - tts), Sealed: true}
+	}
+	failed := func(ago time.Duration) dealOutcome {
+		return dealOutcome{Started: at(ago), FailedAt: at(ago), Failed: true}
+	}
+
+	score, q := providerReputation(&providerHistory{}, now)
+	require.InDelta(t, 0.5, score, 1e-9)
+	require.True(t, q.IsZero())
+
+	fast, _ := providerReputation(&providerHistory{Deals: []dealOutcome{sealed(time.Hour, time.Hour)}}, now)
+	slow, _ := providerReputation(&providerHistory{Deals: []dealOutcome{sealed(10*24*time.Hour, 9*24*time.Hour)}}, now)
+	require.Greater(t, fast, 0.5)
+	require.Greater(t, fast, slow)
+
+	// old failures matter less than recent ones
+	oldFail, _ := providerReputation(&providerHistory{Deals: []dealOutcome{failed(365 * 24 * time.Hour)}}, now)
+	newFail, _ := providerReputation(&providerHistory{Deals: []dealOutcome{failed(time.Hour)}}, now)
+	require.Less(t, newFail, oldFail)
+	require.Less(t, oldFail, 0.5)
+
+	// rejections are cheaper than failures
+	rejected, q := providerReputation(&providerHistory{Deals: []dealOutcome{{Started: at(time.Hour), Failed: true, Rejected: true}}}, now)
+	require.Greater(t, rejected, newFail)
+	require.True(t, q.IsZero())
+
+	// failure streaks quarantine
+	h := &providerHistory{Deals: []dealOutcome{
+		sealed(10*24*time.Hour, time.Hour),
+		failed(3 * time.Hour),
+		{Started: at(2 * time.Hour), Failed: true, Rejected: true},
+		failed(2 * time.Hour),
+		{Started: at(90 * time.Minute)}, // in progress
+		failed(time.Hour),
+	}}
+	_, q = providerReputation(h, now)
+	require.Equal(t, now.Add(-time.Hour).Add(quarantineDuration), q)
+
+	// quarantine ends
+	_, q = providerReputation(h, now.Add(quarantineDuration))
+	require.True(t, q.IsZero())
+
+	// quarantine counts from when deals failed, not when they started
+	var late []dealOutcome
+	for i := 0; i < quarantineFailures; i++ {
+		late = append(late, dealOutcome{Started: at(2 * quarantineDuration), FailedAt: at(time.Hour), Failed: true})
+	}
+	_, q = providerReputation(&providerHistory{Deals: late}, now)
+	require.Equal(t, now.Add(-time.Hour).Add(quarantineDuration), q)
+
+	// a sealed deal ends the streak
+	h.Deals = append(h.Deals[:2], sealed(90*time.Minute, time.Minute), failed(time.Hour))
+	_, q = providerReputation(h, now)
+	require.True(t, q.IsZero())
+
+	// slashed deals stay sealed, they still count as failures
+	slashed := func(ago time.Duration) dealOutcome {
+		d := sealed(ago, time.Hour)
+		d.Failed, d.FailedAt = true, at(time.Hour)
+		return d
+	}
+	var sh []dealOutcome
+	for i := 0; i < quarantineFailures; i++ {
+		sh = append(sh, slashed(30*24*time.Hour))
+	}
+	slashedScore, q := providerReputation(&providerHistory{Deals: sh}, now)
+	require.Less(t, slashedScore, 0.5)
+	require.Equal(t, now.Add(-time.Hour).Add(quarantineDuration), q)
+
+	// deals which ran until their end epoch are fine
+	for i := range sh {
+		sh[i].Expired = true
+	}
+	expiredScore, q := providerReputation(&providerHistory{Deals: sh}, now)
+	require.Greater(t, expiredScore, 0.5)
+	require.True(t, q.IsZero())
+
+	// and end failure streaks like other sealed deals
+	h = &providerHistory{Deals: []dealOutcome{failed(3 * time.Hour), failed(2 * time.Hour), sh[0], failed(time.Hour)}}
+	_, q = providerReputation(h, now)
+	require.True(t, q.IsZero())
+
+	// retrieval probes count
+	good, _ := providerReputation(&providerHistory{RetrSuccess: 10}, now)
+	bad, _ := providerReputation(&providerHistory{RetrFail: 10}, now)
+	require.Greater(t, good, 0.5)
+	require.Less(t, bad, 0.5)
+}
+
+func TestUpdateReputations(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = db.db.Exec(`insert into providers (id, in_market, ping_ok, ask_ok, retrprobe_success) values (1000, 1, 1, 1, 3)`)
+	require.NoError(t, err)
+
+	// deals started before the quarantine period, failing now
+	started := time.Now().Add(-2 * quarantineDuration).Unix()
+	for i := 0; i < quarantineFailures; i++ {
+		id := fmt.Sprintf("deal-%d", i)
+		insertTestDeal(t, db, testDeal{UUID: id, Group: 1, Provider: 1000, Sealed: true})
+		_, err = db.db.Exec(`update deals set start_time = ? where uuid = ?`, started, id)
+		require.NoError(t, err)
+		require.NoError(t, db.MarkDealFailed(id, dealFailureSlashed, "deal slashed"))
+	}
+
+	hs, err := db.ProviderHistories()
+	require.NoError(t, err)
+	require.Len(t, hs, 1)
+	require.Len(t, hs[1000].Deals, quarantineFailures)
+	require.Greater(t, hs[1000].Deals[0].FailedAt, started)
+	require.True(t, hs[1000].Deals[0].Sealed)
+	require.False(t, hs[1000].Deals[0].Expired)
+	require.Equal(t, int64(3), hs[1000].RetrSuccess)
+
+	r := &ribs{db: db}
+	require.NoError(t, r.updateReputations())
+
+	pms := db.ReachableProviders()
+	require.Len(t, pms, 1)
+	require.Less(t, pms[0].Reputation, 0.5)
+	require.Greater(t, pms[0].QuarantinedUntil, time.Now().Unix())
+}
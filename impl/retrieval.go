@@ -0,0 +1,245 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var (
+	retrievalTimeout  = 30 * time.Second
+	maxRetrievedBlock = int64(8 << 20)
+)
+
+// retriever fetches blocks of offloaded groups from providers which have
+// sealed deals for them, over trustless http (booster-http) or bitswap
+// (booster-bitswap)
+type retriever struct {
+	db *ribsDB
+
+	host    host.Host
+	bitswap *ributil.BitswapClient
+	http    *http.Client
+}
+
+func newRetriever(db *ribsDB, h host.Host) *retriever {
+	rt := &retriever{
+		db:   db,
+		host: h,
+		http: &http.Client{Timeout: retrievalTimeout},
+	}
+	if h != nil {
+		rt.bitswap = ributil.NewBitswapClient(h)
+	}
+	return rt
+}
+
+// FetchBlocks is a RemoteRetrievalFunc
+func (rt *retriever) FetchBlocks(ctx context.Context, group iface.GroupKey, c []mh.Multihash, cb func(cidx int, data []byte)) error {
+	cands, err := rt.db.RetrievalCandidates(group)
+	if err != nil {
+		return xerrors.Errorf("getting retrieval candidates: %w", err)
+	}
+
+	got := make([]bool, len(c))
+	remaining := len(c)
+
+	for _, cand := range cands {
+		if remaining == 0 {
+			break
+		}
+
+		var blocks, size int64
+		err := rt.fetchFrom(ctx, cand, c, got, func(i int, data []byte) {
+			got[i] = true
+			remaining--
+			blocks++
+			size += int64(len(data))
+
+			cb(i, data)
+		})
+		if err != nil {
+			log.Warnw("retrieval from provider failed", "provider", cand.id, "group", group, "error", err)
+		}
+
+		if err := rt.db.RecordRetrieval(cand.id, err == nil && blocks > 0, blocks, size); err != nil {
+			log.Errorw("recording retrieval stats", "provider", cand.id, "error", err)
+		}
+	}
+
+	if remaining > 0 {
+		return xerrors.Errorf("could not retrieve %d of %d blocks of group %d from %d providers", remaining, len(c), group, len(cands))
+	}
+
+	return nil
+}
+
+// fetchFrom tries to fetch blocks which aren't marked in got from a single
+// provider, http first, then bitswap
+func (rt *retriever) fetchFrom(ctx context.Context, cand retrievalCandidate, c []mh.Multihash, got []bool, cb func(i int, data []byte)) error {
+	var errs []string
+
+	for _, u := range cand.httpURLs {
+		if err := rt.fetchHttp(ctx, u, c, got, cb); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		return nil
+	}
+
+	if len(cand.bitswapAddrs) > 0 && rt.bitswap != nil {
+		if err := rt.fetchBitswap(ctx, cand.bitswapAddrs, c, got, cb); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			return nil
+		}
+	}
+
+	if len(errs) == 0 {
+		return xerrors.Errorf("no retrieval endpoints")
+	}
+	return xerrors.New(strings.Join(errs, "; "))
+}
+
+func (rt *retriever) fetchHttp(ctx context.Context, baseURL string, c []mh.Multihash, got []bool, cb func(i int, data []byte)) error {
+	for i, h := range c {
+		if got[i] {
+			continue
+		}
+
+		data, err := rt.fetchHttpBlock(ctx, baseURL, h)
+		if err != nil {
+			return xerrors.Errorf("fetching block %s from %s: %w", h.B58String(), baseURL, err)
+		}
+
+		cb(i, data)
+	}
+
+	return nil
+}
+
+func (rt *retriever) fetchHttpBlock(ctx context.Context, baseURL string, h mh.Multihash) ([]byte, error) {
+	// providers index by multihash, so the codec doesn't matter
+	u := fmt.Sprintf("%s/ipfs/%s?format=raw", strings.TrimSuffix(baseURL, "/"), cid.NewCidV1(cid.Raw, h))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+
+	resp, err := rt.http.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRetrievedBlock+1))
+	if err != nil {
+		return nil, xerrors.Errorf("reading response: %w", err)
+	}
+	if int64(len(data)) > maxRetrievedBlock {
+		return nil, xerrors.Errorf("block larger than %d bytes", maxRetrievedBlock)
+	}
+
+	if err := verifyBlock(h, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (rt *retriever) fetchBitswap(ctx context.Context, addrs []string, c []mh.Multihash, got []bool, cb func(i int, data []byte)) error {
+	mas := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return xerrors.Errorf("parsing bitswap address: %w", err)
+		}
+		mas = append(mas, ma)
+	}
+
+	ais, err := peer.AddrInfosFromP2pAddrs(mas...)
+	if err != nil {
+		return xerrors.Errorf("parsing bitswap peer addresses: %w", err)
+	}
+	if len(ais) == 0 {
+		return xerrors.Errorf("no bitswap peers")
+	}
+	ai := ais[0]
+
+	ctx, cancel := context.WithTimeout(ctx, retrievalTimeout)
+	defer cancel()
+
+	if err := rt.host.Connect(ctx, ai); err != nil {
+		return xerrors.Errorf("connecting to bitswap peer: %w", err)
+	}
+
+	var want []cid.Cid
+	var wantIdx []int
+	for i, h := range c {
+		if got[i] {
+			continue
+		}
+		want = append(want, cid.NewCidV1(cid.Raw, h))
+		wantIdx = append(wantIdx, i)
+	}
+
+	var missing = len(want)
+	err = rt.bitswap.Fetch(ctx, ai.ID, want, func(i int, data []byte) {
+		// bitswap client checks data against the hash, check again anyways
+		// in case the hash function parameters differ
+		if err := verifyBlock(c[wantIdx[i]], data); err != nil {
+			log.Warnw("bitswap block verification failed", "peer", ai.ID, "error", err)
+			return
+		}
+
+		missing--
+		cb(wantIdx[i], data)
+	})
+	if err != nil {
+		return xerrors.Errorf("bitswap fetch: %w", err)
+	}
+
+	if missing > 0 {
+		return xerrors.Errorf("peer didn't have %d blocks", missing)
+	}
+
+	return nil
+}
+
+// verifyBlock checks that data hashes to the given multihash
+func verifyBlock(h mh.Multihash, data []byte) error {
+	dec, err := mh.Decode(h)
+	if err != nil {
+		return xerrors.Errorf("decoding multihash: %w", err)
+	}
+
+	sum, err := mh.Sum(data, dec.Code, dec.Length)
+	if err != nil {
+		return xerrors.Errorf("hashing block: %w", err)
+	}
+
+	if !bytes.Equal(sum, h) {
+		return xerrors.Errorf("block data doesn't match multihash %s", h.B58String())
+	}
+
+	return nil
+}
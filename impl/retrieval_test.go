@@ -0,0 +1,121 @@
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// testHttpProvider is a stand-in for booster-http, serving raw blocks by cid
+func testHttpProvider(t *testing.T, blks map[string][]byte, corrupt bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, ok := blks[string(c.Hash())]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if corrupt {
+			data = append([]byte("bad"), data...)
+		}
+
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func addTestRetrievalProvider(t *testing.T, db *ribsDB, id int64, group int64, success int64, urls ...string) {
+	u, err := json.Marshal(urls)
+	require.NoError(t, err)
+
+	_, err = db.db.Exec(`insert into providers (id, in_market, booster_http, booster_http_urls, retrprobe_success) values (?, 1, 1, ?, ?)`, id, string(u), success)
+	require.NoError(t, err)
+
+	insertTestDeal(t, db, testDeal{UUID: fmt.Sprintf("deal-%d", id), Group: group, Provider: id, Sealed: true})
+}
+
+func TestRetrievalHttp(t *testing.T) {
+	db, err := openRibsDB(t.TempDir())
+	require.NoError(t, err)
+
+	blks := map[string][]byte{}
+	var hs []mh.Multihash
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		blks[string(b.Cid().Hash())] = b.RawData()
+		hs = append(hs, b.Cid().Hash())
+	}
+
+	// the corrupt provider has better stats, so it's tried first
+	bad := testHttpProvider(t, blks, true)
+	good := testHttpProvider(t, blks, false)
+	addTestRetrievalProvider(t, db, 1000, 1, 1, bad.URL)
+	addTestRetrievalProvider(t, db, 1001, 1, 0, good.URL)
+
+	rt := newRetriever(db, nil)
+
+	got := map[int][]byte{}
+	err = rt.FetchBlocks(context.Background(), 1, hs, func(i int, data []byte) {
+		got[i] = append([]byte{}, data...)
+	})
+	require.NoError(t, err)
+	require.Len(t, got, len(hs))
+	for i, h := range hs {
+		require.Equal(t, blks[string(h)], got[i])
+	}
+
+	var badFail, goodSuccess, goodBlocks int64
+	require.NoError(t, db.db.QueryRow(`select retrprobe_fail from providers where id = 1000`).Scan(&badFail))
+	require.NoError(t, db.db.QueryRow(`select retrprobe_success, retrprobe_blocks from providers where id = 1001`).Scan(&goodSuccess, &goodBlocks))
+	require.Equal(t, int64(1), badFail)
+	require.Equal(t, int64(1), goodSuccess)
+	require.Equal(t, int64(len(hs)), goodBlocks)
+
+	// the good provider now ranks first
+	cands, err := db.RetrievalCandidates(1)
+	require.NoError(t, err)
+	require.Len(t, cands, 2)
+	require.Equal(t, int64(1001), cands[0].id)
+
+	// blocks nobody has
+	missing := blocks.NewBlock([]byte("missing")).Cid().Hash()
+	err = rt.FetchBlocks(context.Background(), 1, []mh.Multihash{missing}, func(i int, data []byte) {
+		t.Fatal("unexpected block")
+	})
+	require.Error(t, err)
+
+	// no providers with deals for the group
+	err = rt.FetchBlocks(context.Background(), 2, hs[:1], func(i int, data []byte) {})
+	require.Error(t, err)
+}
+
+func TestMaToURL(t *testing.T) {
+	for ma, expect := range map[string]string{
+		"/dns/sp.example/tcp/443/https":      "https://sp.example:443",
+		"/ip4/1.2.3.4/tcp/8080/http":         "http://1.2.3.4:8080",
+		"/ip6/::1/tcp/80/http":               "http://[::1]:80",
+		"/dns4/sp.example/tcp/7777/tls/http": "https://sp.example:7777",
+	} {
+		u, err := maToURL(multiaddr.StringCast(ma))
+		require.NoError(t, err)
+		require.Equal(t, expect, u)
+	}
+}
@@ -3,16 +3,20 @@ package impl
 import (
 	"context"
 	"fmt"
+	"github.com/google/uuid"
 	blocks "github.com/ipfs/go-block-format"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
 	_ "github.com/mattn/go-sqlite3"
 	mh "github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,6 +27,29 @@ var log = logging.Logger("ribs")
 type openOptions struct {
 	workerGate chan struct{} // for testing
 	hostGetter func(...libp2p.Option) (host.Host, error)
+
+	mmapReads     bool
+	verifiedDeals bool
+
+	groupSizing *GroupSizePolicy
+	sealPolicy  GroupSealPolicy
+
+	offloadPolicy   OffloadPolicy
+	remoteRetrieval RemoteRetrievalFunc
+	rehydratePolicy RehydratePolicy
+
+	renewalPolicy *RenewalPolicy
+	dealPolicy    *iface.DealPolicy
+	escrowPolicy  *EscrowPolicy
+
+	chain      ChainAPI
+	walletPath string
+	carServer  CarServerConfig
+	libp2p     Libp2pConfig
+
+	carTransferPolicy *CarTransferPolicy
+
+	providerSelector ProviderSelector
 }
 
 type OpenOption func(*openOptions)
@@ -39,6 +66,44 @@ func WithHostGetter(hg func(...libp2p.Option) (host.Host, error)) OpenOption {
 	}
 }
 
+// WithMmapReads makes finalized groups serve reads from memory-mapped jbob data
+// and bsst index files instead of pread.
+func WithMmapReads(enable bool) OpenOption {
+	return func(o *openOptions) {
+		o.mmapReads = enable
+	}
+}
+
+// WithGroupSizePolicy overrides the default group size limits for this store
+func WithGroupSizePolicy(p GroupSizePolicy) OpenOption {
+	return func(o *openOptions) {
+		o.groupSizing = &p
+	}
+}
+
+// WithGroupSealPolicy makes partially filled groups get sealed and sent to
+// deals once they get too old or stop receiving writes
+func WithGroupSealPolicy(p GroupSealPolicy) OpenOption {
+	return func(o *openOptions) {
+		o.sealPolicy = p
+	}
+}
+
+// WithVerifiedDeals makes Filecoin Plus deals using the wallet DataCap. When
+// DataCap runs out unverified deals are made instead.
+func WithVerifiedDeals(enable bool) OpenOption {
+	return func(o *openOptions) {
+		o.verifiedDeals = enable
+	}
+}
+
+// WithWalletPath sets the keystore directory of the deal wallet
+func WithWalletPath(path string) OpenOption {
+	return func(o *openOptions) {
+		o.walletPath = path
+	}
+}
+
 func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
 		return nil, xerrors.Errorf("make root dir: %w", err)
@@ -52,6 +117,7 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	opt := &openOptions{
 		workerGate: make(chan struct{}),
 		hostGetter: libp2p.New,
+		walletPath: "~/.ribswallet",
 	}
 	close(opt.workerGate)
 
@@ -59,9 +125,77 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		o(opt)
 	}
 
-	walletPath := "~/.ribswallet"
+	sizing := defaultGroupSizePolicy()
+	if opt.groupSizing != nil {
+		sizing = *opt.groupSizing
+	}
+	if err := sizing.validate(); err != nil {
+		return nil, xerrors.Errorf("group size policy: %w", err)
+	}
+	if err := opt.sealPolicy.validate(); err != nil {
+		return nil, xerrors.Errorf("group seal policy: %w", err)
+	}
+	if err := opt.offloadPolicy.validate(); err != nil {
+		return nil, xerrors.Errorf("offload policy: %w", err)
+	}
+	if err := opt.rehydratePolicy.validate(); err != nil {
+		return nil, xerrors.Errorf("rehydrate policy: %w", err)
+	}
+	renewal := defaultRenewalPolicy()
+	if opt.renewalPolicy != nil {
+		renewal = *opt.renewalPolicy
+	}
+	if err := renewal.validate(); err != nil {
+		return nil, xerrors.Errorf("renewal policy: %w", err)
+	}
+
+	dealPolicy := defaultDealPolicy()
+	if opt.dealPolicy != nil {
+		dealPolicy = *opt.dealPolicy
+	}
+	if err := validateDealPolicy(dealPolicy); err != nil {
+		return nil, xerrors.Errorf("deal policy: %w", err)
+	}
+
+	escrowPolicy := defaultEscrowPolicy()
+	if opt.escrowPolicy != nil {
+		escrowPolicy = *opt.escrowPolicy
+	}
+	if err := escrowPolicy.validate(); err != nil {
+		return nil, xerrors.Errorf("escrow policy: %w", err)
+	}
+
+	if err := opt.libp2p.validate(); err != nil {
+		return nil, xerrors.Errorf("libp2p config: %w", err)
+	}
+
+	if err := opt.carServer.validate(); err != nil {
+		return nil, xerrors.Errorf("car server config: %w", err)
+	}
+
+	carTransferPolicy := defaultCarTransferPolicy()
+	if opt.carTransferPolicy != nil {
+		carTransferPolicy = *opt.carTransferPolicy
+	}
+	if err := carTransferPolicy.validate(); err != nil {
+		return nil, xerrors.Errorf("car transfer policy: %w", err)
+	}
+	carTransfers, err := newCarTransfers(carTransferPolicy)
+	if err != nil {
+		return nil, xerrors.Errorf("car transfers: %w", err)
+	}
+
+	carTokenKeys, err := openCarTokenKeys(root)
+	if err != nil {
+		return nil, xerrors.Errorf("car token keys: %w", err)
+	}
+
+	providerSelector := opt.providerSelector
+	if providerSelector == nil {
+		providerSelector = DefaultProviderSelector()
+	}
 
-	wallet, err := ributil.OpenWallet(walletPath)
+	wallet, err := ributil.OpenWallet(opt.walletPath)
 	if err != nil {
 		return nil, xerrors.Errorf("open wallet: %w", err)
 	}
@@ -89,11 +223,33 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 
 	fmt.Println("RIBS Wallet: ", defWallet)
 
-	h, err := opt.hostGetter()
+	hostOpts, err := hostOptions(root, opt.libp2p)
+	if err != nil {
+		return nil, xerrors.Errorf("host options: %w", err)
+	}
+
+	h, err := opt.hostGetter(hostOpts...)
 	if err != nil {
 		return nil, xerrors.Errorf("creating host: %w", err)
 	}
 
+	chainAPI, chainCloser := opt.chain, func() {}
+	if chainAPI == nil {
+		chainAPI, chainCloser, err = NewGatewayChainAPI(context.TODO(), DefaultChainURL)
+		if err != nil {
+			return nil, xerrors.Errorf("connecting to chain: %w", err)
+		}
+	}
+	chain := newChainClient(chainAPI)
+
+	remoteRetrieval := opt.remoteRetrieval
+	if remoteRetrieval == nil {
+		remoteRetrieval = newRetriever(db, h).FetchBlocks
+	}
+
+	// all messages from the wallet go through one sender
+	sender := &messageSender{wallet: wallet}
+
 	r := &ribs{
 		root:  root,
 		db:    db,
@@ -101,15 +257,49 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 
 		host:   h,
 		wallet: wallet,
+		sender: sender,
+
+		chain:       chain,
+		chainCloser: chainCloser,
+
+		sealPolicy:      opt.sealPolicy,
+		offloadPolicy:   opt.offloadPolicy,
+		rehydratePolicy: opt.rehydratePolicy,
+		renewalPolicy:   renewal,
+
+		groupOpts: groupOptions{
+			mmapReads:        opt.mmapReads,
+			verifiedDeals:    opt.verifiedDeals,
+			sizing:           sizing,
+			providerSelector: providerSelector,
+			dealPolicy:       dealPolicy,
+			renewalPolicy:    renewal,
+			chain:            chain,
+			carURLs:          opt.carServer.PublicURLs,
+			escrow: &escrowManager{
+				db:     db,
+				wallet: wallet,
+				sender: sender,
+				policy: escrowPolicy,
+			},
+		},
 
 		writableGroups: make(map[iface.GroupKey]*Group),
 
 		// all open groups (including all writable)
 		openGroups: make(map[iface.GroupKey]*Group),
 
+		carTransfers:    carTransfers,
+		carTokenKeys:    carTokenKeys,
 		uploadStats:     map[iface.GroupKey]*iface.UploadStats{},
 		uploadStatsSnap: map[iface.GroupKey]*iface.UploadStats{},
 
+		bandwidthInterval: transferBandwidthInterval,
+		bandwidthSamples:  transferBandwidthSamples,
+
+		rehydrating: map[iface.GroupKey]*iface.RehydrateProgress{},
+		remoteReads: map[iface.GroupKey]int64{},
+
 		tasks: make(chan task, 1024),
 
 		close:         make(chan struct{}),
@@ -117,17 +307,28 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		spCrawlClosed: make(chan struct{}),
 	}
 
+	r.groupOpts.remoteRetrieval = r.trackRemoteReads(remoteRetrieval)
+
 	// todo resume tasks
 
-	go r.groupWorker(opt.workerGate)
-	go r.spCrawler()
-	go r.resumeGroups()
-	go r.dealTracker(context.TODO())
+	r.workerCtx, r.workerCancel = context.WithCancel(context.Background())
 
-	if err := r.setupCarServer(context.TODO(), h); err != nil {
+	if err := r.setupCarServer(h, opt.carServer); err != nil {
+		r.workerCancel()
+		r.workers.Wait()
 		return nil, xerrors.Errorf("setup car server: %w", err)
 	}
 
+	go r.groupWorker(opt.workerGate)
+	go r.spCrawler()
+	go r.resumeGroups()
+	r.startWorker(r.dealTracker)
+	r.startWorker(r.groupSealWorker)
+	r.startWorker(r.offloadWorker)
+	r.startWorker(r.dealRepairWorker)
+	r.startWorker(r.renewalWorker)
+	r.startWorker(r.reputationWorker)
+
 	return r, nil
 }
 
@@ -199,19 +400,21 @@ func (r *ribs) workerExecTask(toExec task) {
 			return
 		}
 
-		dealInfo, err := r.db.GetDealParams(context.TODO(), toExec.group)
+		dealInfo, err := r.db.GetDealParams(r.workerCtx, toExec.group)
 		if err != nil {
 			log.Errorf("getting deal params: %s", err)
 			return
 		}
 
-		reqToken, err := r.makeCarRequestToken(context.TODO(), toExec.group, time.Hour*36, dealInfo.CarSize)
-		if err != nil {
-			log.Errorf("making car request token: %s", err)
+		// waits for pending escrow top-ups are cancelled on Close
+		err = g.MakeMoreDeals(r.workerCtx, r.host, r.wallet, func(dealUUID uuid.UUID, provider peer.ID) ([]byte, error) {
+			return r.makeCarRequestToken(context.TODO(), toExec.group, carTokenLifetime, dealInfo.CarSize, dealUUID, provider)
+		})
+		if xerrors.Is(err, ErrBudgetExhausted) {
+			// the deal repair loop retries later
+			log.Warnw("deal-making blocked", "group", toExec.group, "error", err)
 			return
 		}
-
-		err = g.MakeMoreDeals(context.TODO(), r.host, r.wallet, reqToken)
 		if err != nil {
 			log.Errorf("starting new deals: %s", err)
 		}
@@ -263,6 +466,21 @@ type ribs struct {
 
 	host   host.Host
 	wallet *ributil.LocalWallet
+	sender *messageSender
+
+	chain       ChainAPI
+	chainCloser func()
+
+	groupOpts       groupOptions
+	sealPolicy      GroupSealPolicy
+	offloadPolicy   OffloadPolicy
+	rehydratePolicy RehydratePolicy
+	renewalPolicy   RenewalPolicy
+
+	/* rehydration */
+	rehydrateLk sync.Mutex
+	rehydrating map[iface.GroupKey]*iface.RehydrateProgress
+	remoteReads map[iface.GroupKey]int64
 
 	/* storage */
 
@@ -270,6 +488,11 @@ type ribs struct {
 	workerClosed  chan struct{}
 	spCrawlClosed chan struct{}
 
+	// background workers, cancelled and awaited in Close
+	workerCtx    context.Context
+	workerCancel context.CancelFunc
+	workers      sync.WaitGroup
+
 	tasks chan task
 
 	openGroups     map[int64]*Group
@@ -283,6 +506,18 @@ type ribs struct {
 	uploadStatsSnap map[iface.GroupKey]*iface.UploadStats
 	uploadStatsLk   sync.Mutex
 
+	// upload bandwidth history, and bytes uploaded since bandwidthStart;
+	// guarded by uploadStatsLk
+	bandwidthInterval time.Duration
+	bandwidthSamples  int
+	bandwidth         []iface.BandwidthSample
+	bandwidthStart    time.Time
+	bandwidthBytes    int64
+
+	carServers   []*http.Server
+	carTransfers *carTransfers
+	carTokenKeys *carTokenKeys
+
 	// diag cache
 	diagLk sync.Mutex
 
@@ -290,13 +525,35 @@ type ribs struct {
 	lastWalletInfoUpdate time.Time
 }
 
+// startWorker runs a background worker until Close
+func (r *ribs) startWorker(w func(ctx context.Context)) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		w(r.workerCtx)
+	}()
+}
+
 func (r *ribs) Close() error {
 	close(r.close)
+	r.workerCancel()
+
+	// requests are cancelled with the worker context
+	r.shutdownCarServers()
+
 	<-r.workerClosed
 	<-r.spCrawlClosed
+	r.workers.Wait()
+
+	if err := r.host.Close(); err != nil {
+		log.Errorw("closing libp2p host", "error", err)
+	}
 
 	// todo close all open groups
 
+	// workers are done with the chain
+	r.chainCloser()
+
 	return nil
 }
 
@@ -338,7 +595,7 @@ func (r *ribs) withWritableGroup(prefer iface.GroupKey, cb func(group *Group) er
 		}
 
 		if selectedGroup != iface.UndefGroupKey {
-			g, err := OpenGroup(r.db, r.index, selectedGroup, blocks, bytes, r.root, state, false)
+			g, err := OpenGroup(r.db, r.index, selectedGroup, blocks, bytes, r.root, state, false, r.groupOpts)
 			if err != nil {
 				return iface.UndefGroupKey, xerrors.Errorf("opening group: %w", err)
 			}
@@ -356,7 +613,7 @@ func (r *ribs) withWritableGroup(prefer iface.GroupKey, cb func(group *Group) er
 		return iface.UndefGroupKey, xerrors.Errorf("creating group: %w", err)
 	}
 
-	g, err := OpenGroup(r.db, r.index, selectedGroup, 0, 0, r.root, iface.GroupStateWritable, true)
+	g, err := OpenGroup(r.db, r.index, selectedGroup, 0, 0, r.root, iface.GroupStateWritable, true, r.groupOpts)
 	if err != nil {
 		return iface.UndefGroupKey, xerrors.Errorf("opening group: %w", err)
 	}
@@ -383,7 +640,7 @@ func (r *ribs) withReadableGroup(group iface.GroupKey, cb func(group *Group) err
 		return xerrors.Errorf("getting group metadata: %w", err)
 	}
 
-	g, err := OpenGroup(r.db, r.index, group, blocks, bytes, r.root, state, false)
+	g, err := OpenGroup(r.db, r.index, group, blocks, bytes, r.root, state, false, r.groupOpts)
 	if err != nil {
 		r.lk.Unlock()
 		return xerrors.Errorf("opening group: %w", err)
@@ -568,7 +825,19 @@ func (r *ribs) resumeGroups() {
 		panic(err)
 	}
 
+	rehydrating, err := r.db.RehydratingGroups()
+	if err != nil {
+		panic(err)
+	}
+
 	for g, st := range gs {
+		if rehydrating[g] && st != iface.GroupStateOffloaded {
+			// rehydrated before the flag got cleared
+			if err := r.db.SetGroupRehydrating(g, false); err != nil {
+				log.Errorw("clearing group rehydrating flag", "group", g, "err", err)
+			}
+		}
+
 		switch st {
 		case iface.GroupStateFull, iface.GroupStateBSSTExists, iface.GroupStateLevelIndexDropped, iface.GroupStateVRCARDone, iface.GroupStateHasCommp, iface.GroupStateDealsInProgress:
 			if err := r.withReadableGroup(g, func(g *Group) error {
@@ -577,6 +846,17 @@ func (r *ribs) resumeGroups() {
 				log.Errorw("failed to resume group", "group", g, "err", err)
 				return
 			}
+		case iface.GroupStateOffloaded:
+			// resume interrupted rehydration, partial downloads from before
+			// rehydration was recorded in the db are resumed too
+			if !rehydrating[g] {
+				if _, err := os.Stat(filepath.Join(groupDir(r.root, g), rehydrateFile)); err != nil {
+					continue
+				}
+			}
+			if err := r.RehydrateGroup(context.TODO(), g); err != nil {
+				log.Errorw("failed to resume group rehydration", "group", g, "err", err)
+			}
 		}
 	}
 }
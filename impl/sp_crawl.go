@@ -9,14 +9,11 @@ import (
 	cborutil "github.com/filecoin-project/go-cbor-util"
 	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/lotus/api"
-	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/blockstore"
 	"github.com/filecoin-project/lotus/chain/actors/adt"
 	"github.com/filecoin-project/lotus/chain/actors/builtin/market"
 	"github.com/filecoin-project/lotus/chain/types"
 	cbor "github.com/ipfs/go-ipld-cbor"
-	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	inet "github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -29,6 +26,9 @@ import (
 
 const AskProtocolID = "/fil/storage/ask/1.1.0"
 
+// crawlRetryInterval is how long the crawler waits after a failed crawl
+var crawlRetryInterval = 30 * time.Second
+
 var (
 	crawlInit           = "init"
 	crawlLoadMarket     = "loading market actor"
@@ -44,17 +44,6 @@ func (r *ribs) spCrawler() {
 
 	ctx := context.TODO()
 
-	gw, closer, err := client.NewGatewayRPCV1(ctx, "http://api.chain.love/rpc/v1", nil)
-	if err != nil {
-		panic(err)
-	}
-	defer closer()
-
-	pingP2P, err := libp2p.New()
-	if err != nil {
-		panic(err)
-	}
-
 	for {
 		select {
 		case <-r.close:
@@ -62,14 +51,20 @@ func (r *ribs) spCrawler() {
 		default:
 		}
 
-		err := r.spCrawlLoop(ctx, gw, pingP2P)
+		err := r.spCrawlLoop(ctx, r.chain, r.host)
 		if err != nil {
 			log.Errorw("sp crawl loop", "err", err)
+
+			select {
+			case <-r.close:
+				return
+			case <-time.After(crawlRetryInterval):
+			}
 		}
 	}
 }
 
-func (r *ribs) spCrawlLoop(ctx context.Context, gw api.Gateway, pingP2P host.Host) error {
+func (r *ribs) spCrawlLoop(ctx context.Context, gw ChainAPI, pingP2P host.Host) error {
 	boostTptClient := lp2pimpl.NewTransportsClient(pingP2P)
 
 	r.crawlState.Store(&crawlLoadMarket)
@@ -168,91 +163,115 @@ func (r *ribs) spCrawlLoop(ctx context.Context, gw api.Gateway, pingP2P host.Hos
 				<-throttle
 			}()
 
-			var res providerResult
-			var err error
-
-			defer func() {
-				stlk.Lock()
-				defer stlk.Unlock()
-
-				if err != nil {
-					log.Debugw("error querying provider", "actor", actor, "err", err)
-				}
-
-				if err := r.db.UpdateProviderProtocols(actor, res); err != nil {
-					log.Errorw("error updating provider", "actor", actor, "err", err)
-				}
-			}()
-
-			maddr, err := address.NewIDAddress(uint64(actor))
-			if err != nil {
-				return
-			}
-
 			ctx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
-			pi, err := GetAddrInfo(ctx, gw, maddr)
+			res, err := r.queryProvider(ctx, gw, pingP2P, boostTptClient, actor)
 			if err != nil {
-				return
+				log.Debugw("error querying provider", "actor", actor, "err", err)
 			}
 
-			if err := pingP2P.Connect(ctx, *pi); err != nil {
-				return
+			if res.PingOk {
+				atomic.AddInt64(&reachable, 1)
+			}
+			if res.BoostDeals {
+				atomic.AddInt64(&boost, 1)
+			}
+			if res.BoosterHttp {
+				atomic.AddInt64(&http, 1)
+			}
+			if res.BoosterBitswap {
+				atomic.AddInt64(&bitswap, 1)
 			}
 
-			res.PingOk = true
-			atomic.AddInt64(&reachable, 1)
+			stlk.Lock()
+			defer stlk.Unlock()
 
-			boostTpt, err := boostTptClient.SendQuery(ctx, pi.ID)
-			if err != nil {
-				return
+			if err := r.db.UpdateProviderProtocols(actor, res); err != nil {
+				log.Errorw("error updating provider", "actor", actor, "err", err)
 			}
+		}(actor)
+	}
 
-			res.BoostDeals = true // todo this is technically not necesarily true, but for now it is good enough
-			atomic.AddInt64(&boost, 1)
-
-			for _, protocol := range boostTpt.Protocols {
-				switch protocol.Name {
-				case "libp2p":
-				case "http":
-					res.BoosterHttp = true
-					atomic.AddInt64(&http, 1)
-				case "bitswap":
-					res.BoosterBitswap = true
-					atomic.AddInt64(&bitswap, 1)
-				default:
-				}
-			}
+	for i := 0; i < parallel; i++ {
+		throttle <- struct{}{}
+	}
 
-			s, err := pingP2P.NewStream(ctx, pi.ID, AskProtocolID)
-			if err != nil {
-				return
-			}
-			defer s.Close()
+	return nil
+}
 
-			var resp network.AskResponse
+// queryProvider checks which protocols a provider supports, and stores its
+// storage ask
+func (r *ribs) queryProvider(ctx context.Context, gw ChainAPI, pingP2P host.Host, boostTptClient *lp2pimpl.TransportsClient, actor int64) (providerResult, error) {
+	var res providerResult
 
-			askRequest := network.AskRequest{
-				Miner: maddr,
-			}
+	maddr, err := address.NewIDAddress(uint64(actor))
+	if err != nil {
+		return res, err
+	}
 
-			if err := doRpc(ctx, s, &askRequest, &resp); err != nil {
-				return
+	pi, err := GetAddrInfo(ctx, gw, maddr)
+	if err != nil {
+		return res, err
+	}
+
+	if err := pingP2P.Connect(ctx, *pi); err != nil {
+		return res, err
+	}
+
+	res.PingOk = true
+
+	boostTpt, err := boostTptClient.SendQuery(ctx, pi.ID)
+	if err != nil {
+		return res, err
+	}
+
+	res.BoostDeals = true // todo this is technically not necesarily true, but for now it is good enough
+
+	for _, protocol := range boostTpt.Protocols {
+		switch protocol.Name {
+		case "libp2p":
+		case "http":
+			res.BoosterHttp = true
+
+			for _, a := range protocol.Addresses {
+				u, err := maToURL(a)
+				if err != nil {
+					continue
+				}
+				res.HttpURLs = append(res.HttpURLs, u)
 			}
+		case "bitswap":
+			res.BoosterBitswap = true
 
-			if err := r.db.UpdateProviderStorageAsk(actor, resp.Ask.Ask); err != nil {
-				log.Errorw("error updating provider ask", "actor", actor, "err", err)
+			for _, a := range protocol.Addresses {
+				res.BitswapAddrs = append(res.BitswapAddrs, a.String())
 			}
+		default:
+		}
+	}
 
-		}(actor)
+	s, err := pingP2P.NewStream(ctx, pi.ID, AskProtocolID)
+	if err != nil {
+		return res, err
 	}
+	defer s.Close()
 
-	for i := 0; i < parallel; i++ {
-		throttle <- struct{}{}
+	var resp network.AskResponse
+
+	askRequest := network.AskRequest{
+		Miner: maddr,
 	}
 
-	return nil
+	if err := doRpc(ctx, s, &askRequest, &resp); err != nil {
+		return res, err
+	}
+
+	if err := r.db.UpdateProviderStorageAsk(actor, resp.Ask.Ask); err != nil {
+		log.Errorw("error updating provider ask", "actor", actor, "err", err)
+	}
+
+	return res, nil
 }
 
 type providerResult struct {
@@ -260,13 +279,47 @@ type providerResult struct {
 	BoostDeals     bool
 	BoosterHttp    bool
 	BoosterBitswap bool
+
+	// retrieval endpoints
+	HttpURLs     []string
+	BitswapAddrs []string
+}
+
+// maToURL converts a booster-http multiaddr (e.g. /dns/sp.example/tcp/443/https)
+// to an url
+func maToURL(ma multiaddr.Multiaddr) (string, error) {
+	var host, port string
+	scheme := "http"
+
+	multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_IP6:
+			host = "[" + c.Value() + "]"
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_HTTPS, multiaddr.P_TLS:
+			scheme = "https"
+		}
+		return true
+	})
+
+	if host == "" {
+		return "", xerrors.Errorf("no host in multiaddr %s", ma)
+	}
+	if port != "" {
+		host += ":" + port
+	}
+
+	return scheme + "://" + host, nil
 }
 
 func toPtr[T any](v T) *T {
 	return &v
 }
 
-func GetAddrInfo(ctx context.Context, api api.Gateway, maddr address.Address) (*peer.AddrInfo, error) {
+func GetAddrInfo(ctx context.Context, api ChainAPI, maddr address.Address) (*peer.AddrInfo, error) {
 	minfo, err := api.StateMinerInfo(ctx, maddr, types.EmptyTSK)
 	if err != nil {
 		return nil, err
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
@@ -8,9 +9,12 @@ import (
 	"github.com/lotus-web3/ribs"
 	"net/http"
 	_ "net/http/pprof"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	txtempl "text/template"
+	"time"
 )
 
 var log = logging.Logger("ribsweb")
@@ -20,6 +24,19 @@ var dres embed.FS
 
 type RIBSWeb struct {
 	ribs ribs.RIBS
+
+	// server-side directory group CARs can be exported under, empty
+	// disables exports
+	exportRoot string
+}
+
+type ServeOption func(ri *RIBSWeb)
+
+// WithExportRoot enables CAR exports over the API, to directories under root
+func WithExportRoot(root string) ServeOption {
+	return func(ri *RIBSWeb) {
+		ri.exportRoot = root
+	}
 }
 
 func (ri *RIBSWeb) Index(w http.ResponseWriter, r *http.Request) {
@@ -114,16 +131,231 @@ func (ri *RIBSWeb) ApiGroup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func Serve(listen string, ribs ribs.RIBS) error {
+// ApiDealTransfers returns car requests made for the deal in "deal"
+func (ri *RIBSWeb) ApiDealTransfers(w http.ResponseWriter, r *http.Request) {
+	deal := r.FormValue("deal")
+	if deal == "" {
+		http.Error(w, "missing deal", 400)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	ts, err := ri.ribs.Diagnostics().DealTransfers(deal)
+	if err != nil {
+		log.Errorw("failed to get deal transfers", "deal", deal, "error", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(ts); err != nil {
+		log.Errorw("failed to encode deal transfers", "deal", deal, "error", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (ri *RIBSWeb) ApiTransferBandwidth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(ri.ribs.Diagnostics().TransferBandwidth()); err != nil {
+		log.Errorw("failed to encode transfer bandwidth", "error", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (ri *RIBSWeb) ApiSealGroup(w http.ResponseWriter, r *http.Request) {
+	ri.groupAdminCall(w, r, "seal", ri.ribs.Admin().SealGroup)
+}
+
+func (ri *RIBSWeb) ApiRehydrateGroup(w http.ResponseWriter, r *http.Request) {
+	ri.groupAdminCall(w, r, "rehydrate", ri.ribs.Admin().RehydrateGroup)
+}
+
+// ApiSetGroupRetention takes the retention end as unix seconds in "until", 0
+// resets to the store default
+func (ri *RIBSWeb) ApiSetGroupRetention(w http.ResponseWriter, r *http.Request) {
+	until, err := strconv.ParseInt(r.FormValue("until"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad until: "+err.Error(), 400)
+		return
+	}
+
+	var t time.Time
+	if until != 0 {
+		t = time.Unix(until, 0)
+	}
+
+	ri.groupAdminCall(w, r, "set retention of", func(ctx context.Context, gk ribs.GroupKey) error {
+		return ri.ribs.Admin().SetGroupRetention(ctx, gk, t)
+	})
+}
+
+// ApiSetGroupDealPolicy takes a json DealPolicy in "policy", empty resets to
+// the store default
+func (ri *RIBSWeb) ApiSetGroupDealPolicy(w http.ResponseWriter, r *http.Request) {
+	var p *ribs.DealPolicy
+	if ps := r.FormValue("policy"); ps != "" {
+		p = new(ribs.DealPolicy)
+		if err := json.Unmarshal([]byte(ps), p); err != nil {
+			http.Error(w, "bad policy: "+err.Error(), 400)
+			return
+		}
+	}
+
+	ri.groupAdminCall(w, r, "set deal policy of", func(ctx context.Context, gk ribs.GroupKey) error {
+		return ri.ribs.Admin().SetGroupDealPolicy(ctx, gk, p)
+	})
+}
+
+// ApiExportGroupCar writes the group CAR to "dir", a directory relative to
+// the export root, and returns the export manifest entry
+func (ri *RIBSWeb) ApiExportGroupCar(w http.ResponseWriter, r *http.Request) {
+	if ri.exportRoot == "" {
+		http.Error(w, "car exports disabled, no export root configured", 403)
+		return
+	}
+
+	dir, err := exportDir(ri.exportRoot, r.FormValue("dir"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ri.groupAdminCall(w, r, "export car of", func(ctx context.Context, gk ribs.GroupKey) error {
+		exp, err := ri.ribs.Admin().ExportGroupCar(ctx, gk, dir)
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(exp)
+	})
+}
+
+// exportDir resolves a directory relative to the export root, rejecting
+// paths which would leave it
+func exportDir(root, dir string) (string, error) {
+	if filepath.IsAbs(dir) {
+		return "", fmt.Errorf("dir must be relative to the export root")
+	}
+
+	dir = filepath.Clean(dir)
+	if dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dir must be inside the export root")
+	}
+
+	return filepath.Join(root, dir), nil
+}
+
+// ApiMakeOfflineDeals takes comma separated provider actor IDs in "providers"
+func (ri *RIBSWeb) ApiMakeOfflineDeals(w http.ResponseWriter, r *http.Request) {
+	var provs []int64
+	for _, ps := range strings.Split(r.FormValue("providers"), ",") {
+		ps = strings.TrimPrefix(strings.TrimSpace(ps), "f0")
+		if ps == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(ps, 10, 64)
+		if err != nil {
+			http.Error(w, "bad provider: "+err.Error(), 400)
+			return
+		}
+		provs = append(provs, id)
+	}
+	if len(provs) == 0 {
+		http.Error(w, "missing providers", 400)
+		return
+	}
+
+	ri.groupAdminCall(w, r, "make offline deals for", func(ctx context.Context, gk ribs.GroupKey) error {
+		return ri.ribs.Admin().MakeOfflineDeals(ctx, gk, provs)
+	})
+}
+
+func (ri *RIBSWeb) ApiRotateCarTokenKey(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r) {
+		return
+	}
+
+	if err := ri.ribs.Admin().RotateCarTokenKey(r.Context()); err != nil {
+		log.Errorw("failed to rotate car token key", "error", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+// adminHeader must be set on admin calls. Browsers only send custom headers
+// cross-origin after a CORS preflight, which admin endpoints don't allow, so
+// other sites can't make admin calls with plain form posts.
+const adminHeader = "X-Ribs-Admin"
+
+// adminRequest checks that r is a POST with adminHeader set, writing an error
+// response if not
+func adminRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return false
+	}
+	if r.Header.Get(adminHeader) == "" {
+		http.Error(w, "missing "+adminHeader+" header", 403)
+		return false
+	}
+	return true
+}
+
+func (ri *RIBSWeb) groupAdminCall(w http.ResponseWriter, r *http.Request, what string, call func(context.Context, ribs.GroupKey) error) {
+	if !adminRequest(w, r) {
+		return
+	}
+
+	grp := r.FormValue("group")
+	if grp == "" {
+		http.Error(w, "missing group", 400)
+		return
+	}
+	gint, err := strconv.ParseUint(grp, 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if err := call(r.Context(), ribs.GroupKey(gint)); err != nil {
+		log.Errorw("failed to "+what+" group", "group", gint, "error", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func Serve(listen string, ribs ribs.RIBS, opts ...ServeOption) error {
 	handlers := &RIBSWeb{
 		ribs: ribs,
 	}
+	for _, o := range opts {
+		o(handlers)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handlers.Index)
 
 	mux.HandleFunc("/api/v0/state", handlers.ApiState)
 	mux.HandleFunc("/api/v0/group", handlers.ApiGroup)
+	mux.HandleFunc("/api/v0/deal/transfers", handlers.ApiDealTransfers)
+	mux.HandleFunc("/api/v0/transfers/bandwidth", handlers.ApiTransferBandwidth)
+	mux.HandleFunc("/api/v0/group/seal", handlers.ApiSealGroup)
+	mux.HandleFunc("/api/v0/group/rehydrate", handlers.ApiRehydrateGroup)
+	mux.HandleFunc("/api/v0/group/retention", handlers.ApiSetGroupRetention)
+	mux.HandleFunc("/api/v0/group/dealpolicy", handlers.ApiSetGroupDealPolicy)
+	mux.HandleFunc("/api/v0/group/export", handlers.ApiExportGroupCar)
+	mux.HandleFunc("/api/v0/group/offlinedeals", handlers.ApiMakeOfflineDeals)
+	mux.HandleFunc("/api/v0/cartoken/rotate", handlers.ApiRotateCarTokenKey)
 
 	mux.Handle("/debug/", http.DefaultServeMux)
 
@@ -0,0 +1,75 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupAdminCall(t *testing.T) {
+	ri := &RIBSWeb{}
+
+	var called []ribs.GroupKey
+	call := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		ri.groupAdminCall(w, r, "test", func(ctx context.Context, gk ribs.GroupKey) error {
+			called = append(called, gk)
+			return nil
+		})
+		return w.Code
+	}
+
+	form := func(header bool) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/v0/group/seal", strings.NewReader(url.Values{"group": {"7"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header {
+			r.Header.Set(adminHeader, "1")
+		}
+		return r
+	}
+
+	// plain form posts, which any site can make, are rejected
+	require.Equal(t, http.StatusForbidden, call(form(false)))
+	require.Equal(t, http.StatusMethodNotAllowed, call(httptest.NewRequest(http.MethodGet, "/api/v0/group/seal?group=7", nil)))
+	require.Empty(t, called)
+
+	require.Equal(t, http.StatusOK, call(form(true)))
+	require.Equal(t, []ribs.GroupKey{7}, called)
+}
+
+func TestExportDir(t *testing.T) {
+	root := "/srv/exports"
+
+	for dir, expect := range map[string]string{
+		"":              root,
+		".":             root,
+		"drive-1":       filepath.Join(root, "drive-1"),
+		"a/../drive-1/": filepath.Join(root, "drive-1"),
+		"a/b":           filepath.Join(root, "a/b"),
+	} {
+		got, err := exportDir(root, dir)
+		require.NoError(t, err, dir)
+		require.Equal(t, expect, got, dir)
+	}
+
+	for _, dir := range []string{"..", "../etc", "a/../../etc", "/etc"} {
+		_, err := exportDir(root, dir)
+		require.Error(t, err, dir)
+	}
+
+	// exports are disabled without an export root
+	ri := &RIBSWeb{}
+	r := httptest.NewRequest(http.MethodPost, "/api/v0/group/export", strings.NewReader(url.Values{"group": {"7"}, "dir": {"x"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(adminHeader, "1")
+	w := httptest.NewRecorder()
+	ri.ApiExportGroupCar(w, r)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	blocks "github.com/ipfs/go-block-format"
 	"io"
+	"time"
 
 	"github.com/multiformats/go-multihash"
 )
@@ -100,10 +101,81 @@ type Session interface {
 type RIBS interface {
 	Session(ctx context.Context) Session
 	Diagnostics() Diag
+	Admin() Admin
 
 	io.Closer
 }
 
+type Admin interface {
+	// SealGroup stops writes to a partially filled writable group and starts
+	// finalizing it
+	SealGroup(ctx context.Context, gk GroupKey) error
+
+	// RehydrateGroup starts downloading the deal piece of an offloaded group
+	// back to local storage; progress is reported in GroupMeta
+	RehydrateGroup(ctx context.Context, gk GroupKey) error
+
+	// SetGroupRetention sets until when deals of the group get renewed, zero
+	// time means the store default
+	SetGroupRetention(ctx context.Context, gk GroupKey, until time.Time) error
+
+	// SetGroupDealPolicy overrides terms of new deals for the group, nil
+	// resets to the store default
+	SetGroupDealPolicy(ctx context.Context, gk GroupKey, p *DealPolicy) error
+
+	// ExportGroupCar writes the deal CAR of a group with commP to dir, for
+	// shipping to providers on drives, and records it in dir/manifest.json
+	ExportGroupCar(ctx context.Context, gk GroupKey, dir string) (CarExport, error)
+
+	// MakeOfflineDeals proposes offline deals for the group to the given
+	// providers. Providers import data from an exported CAR, deals are then
+	// tracked like any other
+	MakeOfflineDeals(ctx context.Context, gk GroupKey, providers []int64) error
+
+	// RotateCarTokenKey makes a new key for signing car request tokens,
+	// tokens signed with previous keys stay valid until they expire
+	RotateCarTokenKey(ctx context.Context) error
+}
+
+// CarExport is a manifest entry of an exported group CAR
+type CarExport struct {
+	Group GroupKey
+
+	PieceCid  string
+	PieceSize int64
+	Root      string
+
+	CarSize int64
+	// file name in the export directory
+	File string
+}
+
+// DealPolicy sets the terms of deals made for groups
+type DealPolicy struct {
+	// Deals last MaxDuration, or less when group retention ends sooner, but
+	// no less than MinDuration
+	MinDuration, MaxDuration time.Duration
+
+	// Time providers get to receive and seal data before the deal starts,
+	// scaled between min and max with the piece size
+	MinStartDelay, MaxStartDelay time.Duration
+
+	// Time providers get to import shipped data before offline deals start,
+	// 0 means 14 days
+	OfflineStartDelay time.Duration
+
+	// Provider collateral as a multiple of the market minimum, at least 1
+	CollateralMultiplier float64
+
+	// Prefer providers keeping an unsealed copy for fast retrieval. Recorded
+	// with deals, the v1.2.0 deal protocol has no way to request it
+	KeepUnsealed bool
+
+	// attoFIL/GiB/epoch, providers asking more don't get deals. 0 leaves
+	// price limits to the provider selector
+	MaxPrice int64
+}
+
 type GroupMeta struct {
 	State GroupState
 
@@ -116,6 +188,18 @@ type GroupMeta struct {
 	ReadBlocks, ReadBytes int64
 
 	Deals []DealMeta
+
+	// set while the group is being rehydrated
+	Rehydrate *RehydrateProgress
+}
+
+type RehydrateProgress struct {
+	Provider int64
+	Stage    string
+
+	Downloaded, Total int64
+
+	Error string
 }
 
 type DealMeta struct {
@@ -132,6 +216,9 @@ type DealMeta struct {
 	BytesRecv int64
 	TxSize    int64
 	PubCid    string
+
+	// data is shipped to the provider instead of transferred
+	Offline bool
 }
 
 type WalletInfo struct {
@@ -140,6 +227,17 @@ type WalletInfo struct {
 	Balance       string
 	MarketBalance string
 	MarketLocked  string
+
+	// remaining Filecoin Plus DataCap
+	DataCap string
+
+	// deal spending in the last day and 30 days
+	SpentDay   string
+	SpentMonth string
+
+	// why deal-making is blocked (exhausted budget, failed escrow top-up),
+	// empty when it isn't
+	DealsBlocked string
 }
 
 type Diag interface {
@@ -148,6 +246,13 @@ type Diag interface {
 
 	CarUploadStats() map[GroupKey]*UploadStats
 
+	// DealTransfers returns car requests made by the provider of a deal,
+	// oldest first
+	DealTransfers(dealUUID string) ([]TransferInfo, error)
+	// TransferBandwidth returns deal data upload rates over the last hour,
+	// oldest first
+	TransferBandwidth() []BandwidthSample
+
 	CrawlState() string
 	ReachableProviders() []ProviderMeta
 
@@ -159,6 +264,30 @@ type UploadStats struct {
 	Last250MsUploadBytes int64
 }
 
+// TransferInfo describes a car request served to a provider
+type TransferInfo struct {
+	// libp2p peer ID, or remote address of tcp requests
+	Peer string
+
+	RangeStart, RangeLength int64
+	BytesSent               int64
+
+	Started  time.Time
+	Duration time.Duration
+
+	// complete, interrupted (the provider went away), failed or busy (too
+	// many transfers)
+	Outcome string
+	Error   string
+}
+
+type BandwidthSample struct {
+	// unix timestamp of the start of the interval
+	Time int64
+	// average upload rate in the interval
+	BytesPerSecond int64
+}
+
 type ProviderMeta struct {
 	ID     int64
 	PingOk bool
@@ -186,4 +315,9 @@ type ProviderMeta struct {
 
 	AskMinPieceSize float64
 	AskMaxPieceSize float64
+
+	// decayed score from deal and retrieval history, 0 to 1
+	Reputation float64
+	// unix timestamp, providers aren't used for deals before it
+	QuarantinedUntil int64
 }
@@ -22,14 +22,6 @@ func (b *BSSTIndex) Close() error {
 	return b.bsi.Close()
 }
 
-func (b *BSSTIndex) Entries() (int64, error) {
-	panic("not supported")
-}
-
-func (b *BSSTIndex) List(f func(c mh.Multihash, offs []int64) error) error {
-	panic("not supported")
-}
-
 func OpenBSSTIndex(path string) (*BSSTIndex, error) {
 	bss, err := bsst.Open(path)
 	if err != nil {
@@ -40,12 +32,8 @@ func OpenBSSTIndex(path string) (*BSSTIndex, error) {
 	}, nil
 }
 
-func CreateBSSTIndex(path string, index ReadableIndex) (*BSSTIndex, error) {
-	ents, err := index.Entries()
-	if err != nil {
-		return nil, xerrors.Errorf("getting level index entries: %w", err)
-	}
-	bss, err := bsst.Create(path, ents, index)
+func CreateBSSTIndex(path string, source bsst.Source) (*BSSTIndex, error) {
+	bss, err := bsst.Create(path, source)
 	if err != nil {
 		return nil, xerrors.Errorf("bsst create: %w", err)
 	}
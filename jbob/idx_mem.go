@@ -0,0 +1,181 @@
+package jbob
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// memIndexRecordSize is the size of index log records, [key: 16][offset: u8]
+const memIndexRecordSize = 16 + 8
+
+type memIndexKey [16]byte
+
+// MemIndex is the index of writable jbobs. Entries are kept in memory, keyed
+// by a truncated hash of the multihash, and appended to an on-disk log on
+// Sync, which happens on every jbob commit. Unlike a LevelDB index there is no
+// compaction, the log is only read back when the jbob is reopened.
+type MemIndex struct {
+	lk   sync.RWMutex
+	keys map[memIndexKey]int64
+
+	log     *os.File
+	pending []byte
+}
+
+func memKey(c mh.Multihash) memIndexKey {
+	var k memIndexKey
+	h := sha256.Sum256(c)
+	copy(k[:], h[:])
+	return k
+}
+
+// OpenMemIndex opens the index log at path, creating it if create is set.
+// Records of entries at or past retiredAt were written for data which never
+// got committed, they are dropped.
+func OpenMemIndex(path string, create bool, retiredAt int64) (*MemIndex, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, xerrors.Errorf("opening index log: %w", err)
+	}
+
+	m := &MemIndex{
+		keys: map[memIndexKey]int64{},
+		log:  f,
+	}
+
+	buf, err := io.ReadAll(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("reading index log: %w", err)
+	}
+
+	// a torn record at the end is from an interrupted sync
+	valid := len(buf) - len(buf)%memIndexRecordSize
+	for at := 0; at < valid; at += memIndexRecordSize {
+		off := int64(binary.LittleEndian.Uint64(buf[at+16:]))
+		if off >= retiredAt {
+			valid = at
+			break
+		}
+
+		var k memIndexKey
+		copy(k[:], buf[at:at+16])
+		m.keys[k] = off
+	}
+
+	if valid != len(buf) {
+		if err := f.Truncate(int64(valid)); err != nil {
+			_ = f.Close()
+			return nil, xerrors.Errorf("truncating index log: %w", err)
+		}
+	}
+	if _, err := f.Seek(int64(valid), io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("seeking index log end: %w", err)
+	}
+
+	return m, nil
+}
+
+// lastOffset returns the highest indexed data offset, -1 when empty
+func (m *MemIndex) lastOffset() int64 {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	last := int64(-1)
+	for _, off := range m.keys {
+		if off > last {
+			last = off
+		}
+	}
+	return last
+}
+
+func (m *MemIndex) Has(c []mh.Multihash) ([]bool, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	out := make([]bool, len(c))
+	for i, h := range c {
+		_, out[i] = m.keys[memKey(h)]
+	}
+	return out, nil
+}
+
+// Get returns offsets to data, -1 if not found
+func (m *MemIndex) Get(c []mh.Multihash) ([]int64, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	out := make([]int64, len(c))
+	for i, h := range c {
+		off, ok := m.keys[memKey(h)]
+		if !ok {
+			off = -1
+		}
+		out[i] = off
+	}
+	return out, nil
+}
+
+func (m *MemIndex) Put(c []mh.Multihash, offs []int64) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	var rec [memIndexRecordSize]byte
+	for i, h := range c {
+		if offs[i] == -1 {
+			continue
+		}
+
+		k := memKey(h)
+		m.keys[k] = offs[i]
+
+		copy(rec[:16], k[:])
+		binary.LittleEndian.PutUint64(rec[16:], uint64(offs[i]))
+		m.pending = append(m.pending, rec[:]...)
+	}
+
+	return nil
+}
+
+// Sync appends entries put since the last sync to the index log
+func (m *MemIndex) Sync() error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if len(m.pending) == 0 {
+		return nil
+	}
+
+	if _, err := m.log.Write(m.pending); err != nil {
+		return xerrors.Errorf("writing index log: %w", err)
+	}
+	if err := m.log.Sync(); err != nil {
+		return xerrors.Errorf("syncing index log: %w", err)
+	}
+
+	m.pending = m.pending[:0]
+	return nil
+}
+
+func (m *MemIndex) Close() error {
+	if err := m.Sync(); err != nil {
+		return err
+	}
+
+	return m.log.Close()
+}
+
+var _ WritableIndex = &MemIndex{}
@@ -6,12 +6,15 @@ import (
 	"encoding/binary"
 	"errors"
 	blocks "github.com/ipfs/go-block-format"
+	logging "github.com/ipfs/go-log/v2"
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/lotus-web3/ribs/bsst"
+	"github.com/lotus-web3/ribs/ributil/mmap"
 	"io"
 	"math/bits"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"golang.org/x/xerrors"
 
@@ -22,16 +25,20 @@ const (
 	HeadName = "head"
 	HeadSize = 512
 
-	LevelIndex = "index.level"
-	BsstIndex  = "index.bsst"
+	LevelIndex  = "index.level"
+	MemIndexLog = "index.mem"
+	BsstIndex   = "index.bsst"
 )
 
 const jbobBufSize = 16 << 20
 
+var log = logging.Logger("jbob")
+
 // JBOB stands for "Just A Bunch Of Blocks"
 // * NOT THREAD SAFE FOR WRITING!!
 // * One tx at a time
 // * Not considered written until committed
+// * Reads are safe to run concurrently with the (single) writer
 type JBOB struct {
 	// index = dir, data = file
 	IndexPath, DataPath string
@@ -44,11 +51,26 @@ type JBOB struct {
 	// [[len: u4][logEntryType: u8][data]]..
 	data *os.File
 
-	dataBuffered *bufio.Writer
+	// lk guards the write buffer, data length and index swaps; writers take
+	// it exclusively, readers shared
+	lk sync.RWMutex
+
+	// dataBuf holds log entries which were appended, but not yet written to
+	// the data file. It starts at dataFlushed offset in the log, reads of
+	// entries at or after that offset are served from here.
+	dataBuf     []byte
+	dataFlushed int64
 
-	// current data file length
+	// current data file length, including buffered data
 	dataLen int64
 
+	// mm is a read-only mapping of the data file, only set on read-only jbobs
+	// with mmap reads enabled
+	mm []byte
+
+	// offloaded jbobs don't have the data log, only the index
+	offloaded bool
+
 	// index
 
 	wIdx WritableIndex
@@ -122,20 +144,22 @@ func Create(indexPath, dataPath string) (*JBOB, error) {
 		return nil, xerrors.Errorf("head sync (new head: %x): %w", headBuf[:], err)
 	}
 
-	// new index is always level
+	// writable jbobs are indexed in memory, the bsst index is built from the
+	// data log at finalize
 
-	idx, err := OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex), true)
+	idx, err := OpenMemIndex(filepath.Join(indexPath, MemIndexLog), true, 0)
 	if err != nil {
-		return nil, xerrors.Errorf("creating leveldb index: %w", err)
+		return nil, xerrors.Errorf("creating write index: %w", err)
 	}
 
 	return &JBOB{
-		IndexPath:    indexPath,
-		DataPath:     dataPath,
-		head:         headFile,
-		data:         dataFile,
-		dataBuffered: bufio.NewWriterSize(dataFile, jbobBufSize),
-		dataLen:      0,
+		IndexPath:   indexPath,
+		DataPath:    dataPath,
+		head:        headFile,
+		data:        dataFile,
+		dataBuf:     make([]byte, 0, jbobBufSize),
+		dataFlushed: 0,
+		dataLen:     0,
 
 		wIdx: idx,
 		rIdx: idx,
@@ -193,12 +217,13 @@ func Open(indexPath, dataPath string) (*JBOB, error) {
 	}
 
 	jb := &JBOB{
-		IndexPath:    indexPath,
-		DataPath:     dataPath,
-		head:         headFile,
-		data:         dataFile,
-		dataBuffered: bufio.NewWriterSize(dataFile, jbobBufSize),
-		dataLen:      dataInfo.Size(),
+		IndexPath:   indexPath,
+		DataPath:    dataPath,
+		head:        headFile,
+		data:        dataFile,
+		dataBuf:     make([]byte, 0, jbobBufSize),
+		dataFlushed: dataInfo.Size(),
+		dataLen:     dataInfo.Size(),
 	}
 
 	// open index
@@ -211,9 +236,9 @@ func Open(indexPath, dataPath string) (*JBOB, error) {
 
 		jb.rIdx = idx
 	} else {
-		idx, err := OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex), false)
+		idx, err := jb.openWriteIndex(h.RetiredAt)
 		if err != nil {
-			return nil, xerrors.Errorf("opening leveldb index: %w", err)
+			return nil, err
 		}
 
 		jb.rIdx = idx
@@ -229,6 +254,83 @@ func Open(indexPath, dataPath string) (*JBOB, error) {
 	return jb, nil
 }
 
+// openWriteIndex opens the index of a non-finalized jbob. jbobs created before
+// the in-memory write index was added keep using LevelDB.
+func (j *JBOB) openWriteIndex(retiredAt int64) (WritableReadableIndex, error) {
+	if _, err := os.Stat(filepath.Join(j.IndexPath, LevelIndex)); err == nil {
+		idx, err := OpenLevelDBIndex(filepath.Join(j.IndexPath, LevelIndex), false)
+		if err != nil {
+			return nil, xerrors.Errorf("opening leveldb index: %w", err)
+		}
+		return idx, nil
+	}
+
+	idx, err := OpenMemIndex(filepath.Join(j.IndexPath, MemIndexLog), false, retiredAt)
+	if err != nil {
+		return nil, xerrors.Errorf("opening write index: %w", err)
+	}
+
+	// index entries for committed data which didn't make it to the index log
+	last := idx.lastOffset()
+	start := last
+	if start < 0 {
+		start = 0
+	}
+	err = j.iterateHashes(start, func(off int64, c mh.Multihash) error {
+		if off == last {
+			return nil
+		}
+		return idx.Put([]mh.Multihash{c}, []int64{off})
+	})
+	if err == nil {
+		err = idx.Sync()
+	}
+	if err != nil {
+		_ = idx.Close()
+		return nil, xerrors.Errorf("replaying data log into write index: %w", err)
+	}
+
+	return idx, nil
+}
+
+// OpenOffloaded opens a finalized jbob which had its data log removed. Only
+// index lookups are possible, reads return ErrOffloaded.
+func OpenOffloaded(indexPath, dataPath string) (*JBOB, error) {
+	headFile, err := os.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+	if err != nil {
+		return nil, xerrors.Errorf("opening head: %w", err)
+	}
+
+	var headBuf [HeadSize]byte
+	if _, err := headFile.ReadAt(headBuf[:], 0); err != nil {
+		return nil, xerrors.Errorf("HEAD READ ERROR: %w", err)
+	}
+
+	var h Head
+	if err := h.UnmarshalCBOR(bytes.NewBuffer(headBuf[:])); err != nil {
+		return nil, xerrors.Errorf("unmarshal head: %w", err)
+	}
+
+	if !h.Finalized {
+		return nil, xerrors.Errorf("only finalized jbobs can be offloaded")
+	}
+
+	idx, err := OpenBSSTIndex(filepath.Join(indexPath, BsstIndex))
+	if err != nil {
+		return nil, xerrors.Errorf("opening bsst index: %w", err)
+	}
+
+	return &JBOB{
+		IndexPath:   indexPath,
+		DataPath:    dataPath,
+		head:        headFile,
+		dataFlushed: h.RetiredAt,
+		dataLen:     h.RetiredAt,
+		rIdx:        idx,
+		offloaded:   true,
+	}, nil
+}
+
 /* WRITE SIDE */
 
 type WritableIndex interface {
@@ -238,7 +340,9 @@ type WritableIndex interface {
 	Put(c []mh.Multihash, offs []int64) error
 	//Del(c []mh.Multihash, offs []int64) error
 
-	// todo Sync() error
+	// Sync makes index entries durable, it is called on commit before the
+	// head is updated
+	Sync() error
 
 	Close() error
 }
@@ -251,13 +355,14 @@ type ReadableIndex interface {
 	// Get returns offsets to data, -1 if not found
 	Get(c []mh.Multihash) ([]int64, error)
 
-	// bsst creation
-	Entries() (int64, error)
-	bsst.Source
-
 	Close() error
 }
 
+type WritableReadableIndex interface {
+	WritableIndex
+	ReadableIndex
+}
+
 func (j *JBOB) mutHead(mut func(h *Head) error) error {
 	// todo cache current
 	n, err := j.head.ReadAt(j.headBuf[:], 0)
@@ -305,6 +410,9 @@ func (j *JBOB) mutHead(mut func(h *Head) error) error {
 }
 
 func (j *JBOB) Put(c []mh.Multihash, b []blocks.Block) error {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+
 	if j.wIdx == nil {
 		return xerrors.Errorf("cannot write to read-only jbob")
 	}
@@ -321,8 +429,6 @@ func (j *JBOB) Put(c []mh.Multihash, b []blocks.Block) error {
 		return err
 	}
 
-	// todo optimize (at least buffer) writes
-
 	// first append to log
 	for i, blk := range b {
 		if hasList[i] {
@@ -335,20 +441,19 @@ func (j *JBOB) Put(c []mh.Multihash, b []blocks.Block) error {
 
 		binary.LittleEndian.PutUint32(entHead, 1+2+uint32(len(data))+uint32(len(c[i])))
 		binary.LittleEndian.PutUint16(entHead[6:], uint16(len(c[i])))
-		if _, err := j.dataBuffered.Write(entHead); err != nil {
-			return xerrors.Errorf("writing entry header: %w", err)
-		}
-
-		if _, err := j.dataBuffered.Write(data); err != nil {
-			return xerrors.Errorf("writing entry header: %w", err)
-		}
 
+		j.dataBuf = append(j.dataBuf, entHead...)
+		j.dataBuf = append(j.dataBuf, data...)
 		// todo separate 'unhashed' block type for small blocks
-		if _, err := j.dataBuffered.Write(c[i]); err != nil {
-			return xerrors.Errorf("writing entry header: %w", err)
-		}
+		j.dataBuf = append(j.dataBuf, c[i]...)
 
 		j.dataLen += int64(len(data)) + int64(len(entHead)) + int64(len(c[i]))
+
+		if len(j.dataBuf) >= jbobBufSize {
+			if err := j.flush(); err != nil {
+				return err
+			}
+		}
 	}
 
 	// log the write
@@ -361,31 +466,62 @@ func (j *JBOB) Put(c []mh.Multihash, b []blocks.Block) error {
 	return nil
 }
 
+// flush writes buffered log entries to the data file. Must be called with lk
+// held exclusively.
+func (j *JBOB) flush() error {
+	if len(j.dataBuf) == 0 {
+		return nil
+	}
+
+	n, err := j.data.Write(j.dataBuf)
+	j.dataFlushed += int64(n)
+	if err != nil {
+		// keep the unwritten part buffered so that reads still see it
+		j.dataBuf = append(j.dataBuf[:0], j.dataBuf[n:]...)
+		return xerrors.Errorf("flushing buffered data: %w", err)
+	}
+
+	if cap(j.dataBuf) > jbobBufSize {
+		// don't hold on to buffers grown by large blocks
+		j.dataBuf = make([]byte, 0, jbobBufSize)
+	} else {
+		j.dataBuf = j.dataBuf[:0]
+	}
+
+	return nil
+}
+
 var errNothingToCommit = errors.New("nothing to commit")
 
 func (j *JBOB) Commit() (int64, error) {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+
+	return j.commit()
+}
+
+func (j *JBOB) commit() (int64, error) {
 	// todo log commit?
 
-	var err error
-	for {
-		err = j.dataBuffered.Flush()
-		if err != io.ErrShortWrite {
-			break
-		}
+	if j.offloaded {
+		return j.dataLen, nil
 	}
 
-	if err != nil {
-		return 0, xerrors.Errorf("flushing buffered data: %w", err)
+	if err := j.flush(); err != nil {
+		return 0, err
 	}
 
 	if err := j.data.Sync(); err != nil {
 		return 0, xerrors.Errorf("sync data: %w", err)
 	}
 
-	// todo index is sync for now, and we're single threaded, so if there were any
-	// puts, just update head
+	if j.wIdx != nil {
+		if err := j.wIdx.Sync(); err != nil {
+			return 0, xerrors.Errorf("sync index: %w", err)
+		}
+	}
 
-	err = j.mutHead(func(h *Head) error {
+	err := j.mutHead(func(h *Head) error {
 		if h.RetiredAt == j.dataLen {
 			return errNothingToCommit
 		}
@@ -405,25 +541,21 @@ func (j *JBOB) Commit() (int64, error) {
 
 /* READ SIDE */
 
+// View calls the callback for each of the requested multihashes. Entries which
+// are still in the write buffer are read from memory.
 func (j *JBOB) View(c []mh.Multihash, cb func(cidx int, found bool, data []byte) error) error {
+	j.lk.RLock()
+	defer j.lk.RUnlock()
+
+	if j.offloaded {
+		return ErrOffloaded
+	}
+
 	locs, err := j.rIdx.Get(c)
 	if err != nil {
 		return xerrors.Errorf("getting value locations: %w", err)
 	}
 
-	if j.dataBuffered.Buffered() > 0 {
-		for {
-			err = j.dataBuffered.Flush()
-			if err != io.ErrShortWrite {
-				break
-			}
-		}
-
-		if err != nil {
-			return xerrors.Errorf("flushing buffered data: %w", err)
-		}
-	}
-
 	entBuf := pool.Get(1 << 20)
 	defer pool.Put(entBuf)
 
@@ -435,6 +567,35 @@ func (j *JBOB) View(c []mh.Multihash, cb func(cidx int, found bool, data []byte)
 			continue
 		}
 
+		if locs[i] >= j.dataFlushed {
+			data, err := j.bufferedEntry(locs[i])
+			if err != nil {
+				return err
+			}
+
+			if err := cb(i, true, data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if j.mm != nil {
+			if locs[i] >= int64(len(j.mm)) {
+				return xerrors.Errorf("entry offset %d outside of mapped data (%d)", locs[i], len(j.mm))
+			}
+
+			// zero-copy, data points into the mapping
+			data, _, _, err := parseEntry(j.mm[locs[i]:])
+			if err != nil {
+				return xerrors.Errorf("mapped entry at %d: %w", locs[i], err)
+			}
+
+			if err := cb(i, true, data); err != nil {
+				return err
+			}
+			continue
+		}
+
 		// todo: optimization: keep len in index
 		var entHead [8]byte
 		if _, err := j.data.ReadAt(entHead[:], locs[i]); err != nil {
@@ -465,17 +626,75 @@ func (j *JBOB) View(c []mh.Multihash, cb func(cidx int, found bool, data []byte)
 	return nil
 }
 
+// bufferedEntry returns block data of a log entry which is still in the write
+// buffer. The returned slice is only valid while lk is held.
+func (j *JBOB) bufferedEntry(at int64) ([]byte, error) {
+	if at-j.dataFlushed >= int64(len(j.dataBuf)) {
+		return nil, xerrors.Errorf("buffered entry at %d out of range (flushed %d, buffered %d)", at, j.dataFlushed, len(j.dataBuf))
+	}
+
+	data, _, _, err := parseEntry(j.dataBuf[at-j.dataFlushed:])
+	if err != nil {
+		return nil, xerrors.Errorf("buffered entry at %d (flushed %d, buffered %d): %w", at, j.dataFlushed, len(j.dataBuf), err)
+	}
+
+	return data, nil
+}
+
+// parseEntry parses a log entry at the start of buf, returning block data, the
+// multihash and the total entry length. Returned slices point into buf.
+func parseEntry(buf []byte) ([]byte, mh.Multihash, int64, error) {
+	if len(buf) < 8 {
+		return nil, nil, 0, xerrors.Errorf("entry header out of range")
+	}
+
+	entHead := buf[:8]
+	if entHead[4] != byte(entBlock) {
+		return nil, nil, 0, xerrors.Errorf("unexpected entry type %d, expected block (1)", entHead[4])
+	}
+	mhLen := int64(binary.LittleEndian.Uint16(entHead[6:]))
+	entLen := int64(binary.LittleEndian.Uint32(entHead[:4])) - 1 - 2
+
+	if 8+entLen > int64(len(buf)) || mhLen > entLen {
+		return nil, nil, 0, xerrors.Errorf("entry out of range (len %d, available %d)", entLen, len(buf))
+	}
+
+	return buf[8 : 8+entLen-mhLen], buf[8+entLen-mhLen : 8+entLen], 8 + entLen, nil
+}
+
 var ErrNotReadOnly = errors.New("not yet read-only")
 
 func (j *JBOB) Iterate(cb func(c mh.Multihash, data []byte) error) error {
+	return j.IterateFrom(0, func(_ int64, c mh.Multihash, data []byte) error {
+		return cb(c, data)
+	})
+}
+
+// IterateFrom iterates over blocks starting with the entry at the given data
+// offset, passing entry offsets to the callback. lk is held shared for the
+// whole iteration, so the data log can't be unmapped or offloaded under it.
+func (j *JBOB) IterateFrom(start int64, cb func(at int64, c mh.Multihash, data []byte) error) error {
+	j.lk.RLock()
+	defer j.lk.RUnlock()
+
 	if j.wIdx != nil {
 		return ErrNotReadOnly
 	}
+	if j.offloaded {
+		return ErrOffloaded
+	}
+	if start < 0 || start > j.dataLen {
+		return xerrors.Errorf("iterate start %d out of range (data len %d)", start, j.dataLen)
+	}
+
+	if j.mm != nil {
+		return j.iterateMapped(start, cb)
+	}
 
 	var entHeadBuf [8]byte
 	entBuf := make([]byte, 1<<20)
 
-	for at := int64(0); at < j.dataLen; {
+	for at := start; at < j.dataLen; {
 		if _, err := j.data.ReadAt(entHeadBuf[:], at); err != nil {
 			return xerrors.Errorf("reading entry header: %w", err)
 		}
@@ -497,7 +716,111 @@ func (j *JBOB) Iterate(cb func(c mh.Multihash, data []byte) error) error {
 			return xerrors.Errorf("reading entry: %w", err)
 		}
 
-		if err := cb(entBuf[entLen-mhLen:entLen], entBuf[:entLen-mhLen]); err != nil {
+		if err := cb(at, entBuf[entLen-mhLen:entLen], entBuf[:entLen-mhLen]); err != nil {
+			return err
+		}
+
+		at += int64(len(entHeadBuf)) + int64(entLen)
+	}
+
+	return nil
+}
+
+// iterateMapped iterates over the mapping, which is left with random access
+// advice as it is shared with concurrent reads. Must be called with lk held.
+func (j *JBOB) iterateMapped(start int64, cb func(at int64, c mh.Multihash, data []byte) error) error {
+	for at := start; at < j.dataLen; {
+		data, c, entLen, err := parseEntry(j.mm[at:])
+		if err != nil {
+			return xerrors.Errorf("mapped entry at %d: %w", at, err)
+		}
+
+		if err := cb(at, c, data); err != nil {
+			return err
+		}
+
+		at += entLen
+	}
+
+	return nil
+}
+
+// EnableMmap switches reads of a read-only jbob to a memory mapping of the data
+// file (and of the bsst index when finalized). Reads keep using pread if this
+// fails, e.g. when there isn't enough address space left.
+func (j *JBOB) EnableMmap() error {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+
+	if j.wIdx != nil {
+		return ErrNotReadOnly
+	}
+
+	if j.mm == nil && !j.offloaded {
+		mm, err := mmap.Map(j.data)
+		if err != nil {
+			return xerrors.Errorf("mmap data: %w", err)
+		}
+		if int64(len(mm)) < j.dataLen {
+			_ = mmap.Unmap(mm)
+			return xerrors.Errorf("mapped data shorter than log (%d < %d)", len(mm), j.dataLen)
+		}
+
+		if err := mmap.Advise(mm, mmap.AdviceRandom); err != nil {
+			_ = mmap.Unmap(mm)
+			return err
+		}
+
+		j.mm = mm
+	}
+
+	if bi, ok := j.rIdx.(*BSSTIndex); ok {
+		if err := bi.bsi.EnableMmap(); err != nil {
+			return xerrors.Errorf("mmap bsst index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *JBOB) unmap() error {
+	if j.mm == nil {
+		return nil
+	}
+
+	err := mmap.Unmap(j.mm)
+	j.mm = nil
+	return err
+}
+
+// iterateHashes walks the data log calling the callback with the offset and
+// multihash of each entry, without reading the block data
+func (j *JBOB) iterateHashes(start int64, cb func(off int64, c mh.Multihash) error) error {
+	var entHeadBuf [8]byte
+	mhBuf := make([]byte, 128)
+
+	for at := start; at < j.dataLen; {
+		if _, err := j.data.ReadAt(entHeadBuf[:], at); err != nil {
+			return xerrors.Errorf("reading entry header: %w", err)
+		}
+
+		entLen := binary.LittleEndian.Uint32(entHeadBuf[:4]) - 1 - 2
+		entType := entHeadBuf[4]
+		mhLen := uint32(binary.LittleEndian.Uint16(entHeadBuf[6:]))
+
+		if entType != byte(entBlock) {
+			return xerrors.Errorf("unexpected entry type %d, expected block (1)", entType)
+		}
+
+		if mhLen > uint32(len(mhBuf)) {
+			mhBuf = make([]byte, mhLen)
+		}
+
+		if _, err := j.data.ReadAt(mhBuf[:mhLen], at+int64(len(entHeadBuf))+int64(entLen-mhLen)); err != nil {
+			return xerrors.Errorf("reading entry multihash: %w", err)
+		}
+
+		if err := cb(at, mhBuf[:mhLen]); err != nil {
 			return err
 		}
 
@@ -507,15 +830,37 @@ func (j *JBOB) Iterate(cb func(c mh.Multihash, data []byte) error) error {
 	return nil
 }
 
+// logSource is a bsst.Source listing entries straight from the data log
+type logSource struct {
+	j *JBOB
+}
+
+func (l *logSource) List(f func(c mh.Multihash, offs []int64) error) error {
+	return l.j.iterateHashes(0, func(off int64, c mh.Multihash) error {
+		return f(c, []int64{off})
+	})
+}
+
+var _ bsst.Source = (*logSource)(nil)
+
 /* Finalization */
 
 var ErrReadOnly = errors.New("already read-only")
 
 func (j *JBOB) MarkReadOnly() error {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+
 	if j.wIdx == nil {
 		return ErrReadOnly
 	}
 
+	// read-only jbobs are read directly from the data file, and the write
+	// index must be synced before it stops being writable
+	if _, err := j.commit(); err != nil {
+		return err
+	}
+
 	err := j.mutHead(func(h *Head) error {
 		h.ReadOnly = true
 		return nil
@@ -536,7 +881,9 @@ func (j *JBOB) Finalize() error {
 		return xerrors.Errorf("cannot finalize read-write jbob")
 	}
 
-	bss, err := CreateBSSTIndex(filepath.Join(j.IndexPath, BsstIndex), j.rIdx)
+	// the bsst is built straight from the data log, so the read-write index
+	// is only needed until the jbob becomes read-only
+	bss, err := CreateBSSTIndex(filepath.Join(j.IndexPath, BsstIndex), &logSource{j: j})
 	if err != nil {
 		return xerrors.Errorf("creating bsst index: %w", err)
 	}
@@ -549,8 +896,15 @@ func (j *JBOB) Finalize() error {
 		return xerrors.Errorf("marking as finalized: %w", err)
 	}
 
+	j.lk.Lock()
 	err = j.rIdx.Close()
 	j.rIdx = bss
+	if j.mm != nil {
+		if err := bss.bsi.EnableMmap(); err != nil {
+			log.Warnw("mmap bsst index, using pread", "error", err)
+		}
+	}
+	j.lk.Unlock()
 	if err != nil {
 		return err
 	}
@@ -558,6 +912,176 @@ func (j *JBOB) Finalize() error {
 	return nil
 }
 
+// RebuildBSST re-creates the bsst index of a finalized jbob from the data log.
+// This is used to recover from a corrupted index.
+func (j *JBOB) RebuildBSST() error {
+	old, ok := j.rIdx.(*BSSTIndex)
+	if !ok {
+		return xerrors.Errorf("cannot rebuild bsst on non-finalized jbob")
+	}
+	if j.offloaded {
+		return ErrOffloaded
+	}
+
+	// build next to the old index, then atomically swap
+	tmpPath := filepath.Join(j.IndexPath, BsstIndex+".tmp")
+	bss, err := CreateBSSTIndex(tmpPath, &logSource{j: j})
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(j.IndexPath, BsstIndex)); err != nil {
+		_ = bss.Close()
+		return xerrors.Errorf("replacing bsst index: %w", err)
+	}
+
+	j.lk.Lock()
+	j.rIdx = bss
+	if j.mm != nil {
+		if err := bss.bsi.EnableMmap(); err != nil {
+			log.Warnw("mmap rebuilt bsst index, using pread", "error", err)
+		}
+	}
+	j.lk.Unlock()
+
+	if err := old.Close(); err != nil {
+		return xerrors.Errorf("closing old bsst index: %w", err)
+	}
+
+	return nil
+}
+
+// ErrOffloaded is returned when reading data of a jbob with its data log removed
+var ErrOffloaded = errors.New("jbob data offloaded")
+
+// Offload closes and removes the data log of a finalized jbob, keeping only
+// the head and the bsst index
+func (j *JBOB) Offload() error {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+
+	if _, ok := j.rIdx.(*BSSTIndex); !ok {
+		return xerrors.Errorf("cannot offload non-finalized jbob")
+	}
+
+	if !j.offloaded {
+		if err := j.unmap(); err != nil {
+			return xerrors.Errorf("unmapping data: %w", err)
+		}
+
+		if err := j.data.Close(); err != nil {
+			return xerrors.Errorf("closing data: %w", err)
+		}
+
+		j.data = nil
+		j.offloaded = true
+	}
+
+	if err := os.Remove(j.DataPath); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("removing data log: %w", err)
+	}
+
+	return nil
+}
+
+// Rehydrate rebuilds the data log of an offloaded jbob. src must produce blocks
+// in the original log order; blocks which aren't in the index are skipped. The
+// bsst index is reused when the rebuilt log matches the original one, and
+// rebuilt otherwise.
+func (j *JBOB) Rehydrate(src func(cb func(c mh.Multihash, data []byte) error) error) error {
+	if !j.offloaded {
+		return xerrors.Errorf("jbob not offloaded")
+	}
+
+	tmpPath := j.DataPath + ".rehydrate"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return xerrors.Errorf("creating data log: %w", err)
+	}
+	defer f.Close() // nolint
+
+	bw := bufio.NewWriterSize(f, jbobBufSize)
+	entHead := []byte{0, 0, 0, 0, byte(entBlock), 0, 0, 0}
+	var dataLen int64
+
+	err = src(func(c mh.Multihash, data []byte) error {
+		has, err := j.rIdx.Has([]mh.Multihash{c})
+		if err != nil {
+			return xerrors.Errorf("checking index: %w", err)
+		}
+		if !has[0] {
+			return nil
+		}
+
+		binary.LittleEndian.PutUint32(entHead, 1+2+uint32(len(data))+uint32(len(c)))
+		binary.LittleEndian.PutUint16(entHead[6:], uint16(len(c)))
+
+		for _, b := range [][]byte{entHead, data, c} {
+			if _, err := bw.Write(b); err != nil {
+				return xerrors.Errorf("writing data log: %w", err)
+			}
+		}
+
+		dataLen += int64(len(entHead)) + int64(len(data)) + int64(len(c))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return xerrors.Errorf("flushing data log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("syncing data log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("closing data log: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, j.DataPath); err != nil {
+		return xerrors.Errorf("moving data log into place: %w", err)
+	}
+
+	dataFile, err := os.OpenFile(j.DataPath, os.O_RDWR|os.O_SYNC, 0666)
+	if err != nil {
+		return xerrors.Errorf("opening data: %w", err)
+	}
+
+	var rebuild bool
+	err = j.mutHead(func(h *Head) error {
+		if h.RetiredAt == dataLen {
+			return errNothingToCommit
+		}
+
+		h.RetiredAt = dataLen
+		rebuild = true
+		return nil
+	})
+	if err != nil && err != errNothingToCommit {
+		_ = dataFile.Close()
+		return xerrors.Errorf("updating head: %w", err)
+	}
+
+	j.lk.Lock()
+	j.data = dataFile
+	j.dataLen = dataLen
+	j.dataFlushed = dataLen
+	j.offloaded = false
+	j.lk.Unlock()
+
+	if rebuild {
+		log.Warnw("rehydrated data log differs from the original, rebuilding bsst index", "path", j.DataPath)
+		if err := j.RebuildBSST(); err != nil {
+			return xerrors.Errorf("rebuilding bsst index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DropLevel removes the write index of a finalized jbob, LevelDB on jbobs
+// created before the in-memory write index
 func (j *JBOB) DropLevel() error {
 	if j.wIdx != nil {
 		return xerrors.Errorf("cannot drop level on read-write jbob")
@@ -566,6 +1090,9 @@ func (j *JBOB) DropLevel() error {
 	if err := os.RemoveAll(filepath.Join(j.IndexPath, LevelIndex)); err != nil {
 		return xerrors.Errorf("removing leveldb index: %w", err)
 	}
+	if err := os.Remove(filepath.Join(j.IndexPath, MemIndexLog)); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("removing write index: %w", err)
+	}
 
 	return nil
 }
@@ -573,17 +1100,25 @@ func (j *JBOB) DropLevel() error {
 /* MISC */
 
 func (j *JBOB) Close() (int64, error) {
-	// sync / close log first
-	if err := j.data.Close(); err != nil {
-		return 0, xerrors.Errorf("closing data: %w", err)
-	}
+	j.lk.Lock()
+	defer j.lk.Unlock()
 
-	// then head
-	at, err := j.Commit()
+	// sync log and head first
+	at, err := j.commit()
 	if err != nil {
 		return 0, xerrors.Errorf("committing head: %w", err)
 	}
 
+	if err := j.unmap(); err != nil {
+		return 0, xerrors.Errorf("unmapping data: %w", err)
+	}
+
+	if j.data != nil {
+		if err := j.data.Close(); err != nil {
+			return 0, xerrors.Errorf("closing data: %w", err)
+		}
+	}
+
 	if err := j.head.Close(); err != nil {
 		return 0, xerrors.Errorf("closing head: %w", err)
 	}
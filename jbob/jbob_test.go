@@ -1,11 +1,18 @@
 package jbob
 
 import (
+	"bytes"
+	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/lotus-web3/ribs/bsst"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
@@ -85,3 +92,469 @@ func TestJbobBasic(t *testing.T) {
 		return nil
 	})
 }
+
+func TestJbobRebuildBSST(t *testing.T) {
+	td := t.TempDir()
+
+	jb, err := Create(filepath.Join(td, "index"), filepath.Join(td, "data"))
+	require.NoError(t, err)
+
+	var hs []multihash.Multihash
+	var bs []blocks.Block
+	for i := 0; i < 1000; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		hs = append(hs, b.Cid().Hash())
+		bs = append(bs, b)
+	}
+
+	require.NoError(t, jb.Put(hs, bs))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize())
+	require.NoError(t, jb.DropLevel())
+
+	// corrupt every bucket of the index
+	bsstPath := filepath.Join(td, "index", BsstIndex)
+	f, err := os.OpenFile(bsstPath, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	for off := int64(bsst.BucketSize); off < fi.Size(); off += bsst.BucketSize {
+		_, err = f.WriteAt([]byte{0xff}, off+bsst.BucketChecksumOff)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+
+	jb, err = Open(filepath.Join(td, "index"), filepath.Join(td, "data"))
+	require.NoError(t, err)
+
+	err = jb.View(hs[:1], func(i int, found bool, b []byte) error {
+		return nil
+	})
+	var cerr *bsst.CorruptionError
+	require.ErrorAs(t, err, &cerr)
+
+	require.NoError(t, jb.RebuildBSST())
+
+	err = jb.View(hs, func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.Equal(t, bs[i].RawData(), b)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func TestJbobConcurrentPutView(t *testing.T) {
+	td := t.TempDir()
+
+	jb, err := Create(filepath.Join(td, "index"), filepath.Join(td, "data"))
+	require.NoError(t, err)
+
+	const n = 2000
+
+	var hs []multihash.Multihash
+	var bs []blocks.Block
+	for i := 0; i < n; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		hs = append(hs, b.Cid().Hash())
+		bs = append(bs, b)
+	}
+
+	var written int64
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				upTo := atomic.LoadInt64(&written)
+				if upTo == 0 {
+					continue
+				}
+
+				// read the most recent writes, which are likely still buffered
+				from := upTo - 64
+				if from < 0 {
+					from = 0
+				}
+
+				err := jb.View(hs[from:upTo], func(i int, found bool, b []byte) error {
+					if !found {
+						return fmt.Errorf("block %d not found", from+int64(i))
+					}
+					if !bytes.Equal(bs[from+int64(i)].RawData(), b) {
+						return fmt.Errorf("block %d data mismatch", from+int64(i))
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, jb.Put(hs[i:i+1], bs[i:i+1]))
+		atomic.StoreInt64(&written, int64(i+1))
+
+		if i%500 == 0 {
+			_, err := jb.Commit()
+			require.NoError(t, err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	// nothing was flushed by reads, the tail is still buffered
+	require.Greater(t, jb.dataLen, jb.dataFlushed)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func createFinalizedJbob(t testing.TB, n int) (*JBOB, []multihash.Multihash, []blocks.Block) {
+	td := t.TempDir()
+
+	jb, err := Create(filepath.Join(td, "index"), filepath.Join(td, "data"))
+	require.NoError(t, err)
+
+	var hs []multihash.Multihash
+	var bs []blocks.Block
+	for i := 0; i < n; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("block %d %s", i, bytes.Repeat([]byte{'x'}, i%4096))))
+		hs = append(hs, b.Cid().Hash())
+		bs = append(bs, b)
+	}
+
+	require.NoError(t, jb.Put(hs, bs))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize())
+	require.NoError(t, jb.DropLevel())
+
+	return jb, hs, bs
+}
+
+func TestJbobMmap(t *testing.T) {
+	jb, hs, bs := createFinalizedJbob(t, 1000)
+
+	require.NoError(t, jb.EnableMmap())
+	require.NotNil(t, jb.mm)
+
+	err := jb.View(hs, func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.Equal(t, bs[i].RawData(), b)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var i int
+	err = jb.Iterate(func(c multihash.Multihash, data []byte) error {
+		require.Equal(t, hs[i], c)
+		require.Equal(t, bs[i].RawData(), data)
+		i++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(hs), i)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func TestJbobIterateFrom(t *testing.T) {
+	jb, hs, bs := createFinalizedJbob(t, 100)
+
+	var offs []int64
+	require.NoError(t, jb.IterateFrom(0, func(at int64, c multihash.Multihash, data []byte) error {
+		offs = append(offs, at)
+		return nil
+	}))
+	require.Len(t, offs, len(hs))
+
+	check := func() {
+		i := 40
+		require.NoError(t, jb.IterateFrom(offs[i], func(at int64, c multihash.Multihash, data []byte) error {
+			require.Equal(t, offs[i], at)
+			require.Equal(t, hs[i], c)
+			require.Equal(t, bs[i].RawData(), data)
+			i++
+			return nil
+		}))
+		require.Equal(t, len(hs), i)
+	}
+
+	check()
+	require.NoError(t, jb.EnableMmap())
+	check()
+
+	require.Error(t, jb.IterateFrom(-1, func(at int64, c multihash.Multihash, data []byte) error { return nil }))
+
+	_, err := jb.Close()
+	require.NoError(t, err)
+}
+
+func TestJbobOffloadWaitsForIterate(t *testing.T) {
+	jb, _, bs := createFinalizedJbob(t, 100)
+	require.NoError(t, jb.EnableMmap())
+
+	inIter, release := make(chan struct{}), make(chan struct{})
+	iterDone := make(chan error)
+	go func() {
+		var i int
+		iterDone <- jb.Iterate(func(c multihash.Multihash, data []byte) error {
+			if i == 0 {
+				close(inIter)
+				<-release
+			}
+			require.Equal(t, bs[i].RawData(), data)
+			i++
+			return nil
+		})
+	}()
+
+	<-inIter
+	offloaded := make(chan error)
+	go func() {
+		offloaded <- jb.Offload()
+	}()
+
+	select {
+	case <-offloaded:
+		t.Fatal("offload didn't wait for iteration")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-iterDone)
+	require.NoError(t, <-offloaded)
+}
+
+func TestJbobOffload(t *testing.T) {
+	jb, hs, _ := createFinalizedJbob(t, 100)
+	require.NoError(t, jb.EnableMmap())
+
+	require.NoError(t, jb.Offload())
+
+	_, err := os.Stat(jb.DataPath)
+	require.True(t, os.IsNotExist(err))
+
+	err = jb.View(hs, func(i int, found bool, b []byte) error {
+		return nil
+	})
+	require.ErrorIs(t, err, ErrOffloaded)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+
+	// the index is still usable after reopening
+	jb, err = OpenOffloaded(jb.IndexPath, jb.DataPath)
+	require.NoError(t, err)
+
+	has, err := jb.rIdx.Has(hs)
+	require.NoError(t, err)
+	for _, h := range has {
+		require.True(t, h)
+	}
+
+	require.ErrorIs(t, jb.Iterate(func(c multihash.Multihash, data []byte) error { return nil }), ErrOffloaded)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func TestJbobRehydrate(t *testing.T) {
+	jb, hs, bs := createFinalizedJbob(t, 100)
+
+	var orig [][]byte
+	require.NoError(t, jb.Iterate(func(c multihash.Multihash, data []byte) error {
+		orig = append(orig, append([]byte{}, data...))
+		return nil
+	}))
+
+	require.NoError(t, jb.Offload())
+
+	// blocks which aren't in the index get skipped
+	extra := blocks.NewBlock([]byte("not in jbob"))
+
+	err := jb.Rehydrate(func(cb func(c multihash.Multihash, data []byte) error) error {
+		for i := range hs {
+			if err := cb(hs[i], bs[i].RawData()); err != nil {
+				return err
+			}
+			if i == 10 {
+				if err := cb(extra.Cid().Hash(), extra.RawData()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = jb.View(hs, func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.Equal(t, bs[i].RawData(), b)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var i int
+	require.NoError(t, jb.Iterate(func(c multihash.Multihash, data []byte) error {
+		require.Equal(t, orig[i], data)
+		i++
+		return nil
+	}))
+	require.Equal(t, len(orig), i)
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+
+	// reopens as a normal jbob
+	jb, err = Open(jb.IndexPath, jb.DataPath)
+	require.NoError(t, err)
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func benchmarkJbobView(b *testing.B, useMmap bool) {
+	jb, hs, _ := createFinalizedJbob(b, 100_000)
+	defer jb.Close()
+
+	if useMmap {
+		require.NoError(b, jb.EnableMmap())
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := jb.View(hs[i%len(hs):i%len(hs)+1], func(i int, found bool, b []byte) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJbobViewPread(b *testing.B) {
+	benchmarkJbobView(b, false)
+}
+
+func BenchmarkJbobViewMmap(b *testing.B) {
+	benchmarkJbobView(b, true)
+}
+
+func TestJbobWriteIndexReopen(t *testing.T) {
+	td := t.TempDir()
+	indexPath, dataPath := filepath.Join(td, "index"), filepath.Join(td, "data")
+
+	jb, err := Create(indexPath, dataPath)
+	require.NoError(t, err)
+
+	var hs []multihash.Multihash
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			b := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+			hs = append(hs, b.Cid().Hash())
+			require.NoError(t, jb.Put([]multihash.Multihash{b.Cid().Hash()}, []blocks.Block{b}))
+		}
+	}
+	check := func(n int) {
+		err := jb.View(hs[:n], func(i int, found bool, b []byte) error {
+			require.True(t, found, "block %d", i)
+			require.Equal(t, fmt.Sprintf("block %d", i), string(b))
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	put(0, 100)
+	_, err = jb.Close()
+	require.NoError(t, err)
+
+	// no leveldb index for new jbobs
+	_, err = os.Stat(filepath.Join(indexPath, LevelIndex))
+	require.True(t, os.IsNotExist(err))
+
+	jb, err = Open(indexPath, dataPath)
+	require.NoError(t, err)
+	check(100)
+
+	// duplicates aren't written again
+	before := jb.dataLen
+	put(0, 1)
+	require.Equal(t, before, jb.dataLen)
+	hs = hs[:100]
+
+	put(100, 200)
+	_, err = jb.Close()
+	require.NoError(t, err)
+
+	// index log entries of the last commit are lost, they get replayed from
+	// the data log
+	ip := filepath.Join(indexPath, MemIndexLog)
+	fi, err := os.Stat(ip)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(ip, fi.Size()-50*memIndexRecordSize-3))
+
+	jb, err = Open(indexPath, dataPath)
+	require.NoError(t, err)
+	check(200)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize())
+	require.NoError(t, jb.DropLevel())
+	check(200)
+
+	_, err = os.Stat(ip)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = jb.Close()
+	require.NoError(t, err)
+}
+
+func TestMemIndexDropsUncommitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idx")
+
+	idx, err := OpenMemIndex(path, true, 0)
+	require.NoError(t, err)
+
+	a, b := multihash.Multihash("a-hash"), multihash.Multihash("b-hash")
+	require.NoError(t, idx.Put([]multihash.Multihash{a, b}, []int64{0, 100}))
+	require.NoError(t, idx.Close())
+
+	// the head was only updated past the first entry
+	idx, err = OpenMemIndex(path, false, 100)
+	require.NoError(t, err)
+
+	offs, err := idx.Get([]multihash.Multihash{a, b})
+	require.NoError(t, err)
+	require.Equal(t, []int64{0, -1}, offs)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.EqualValues(t, memIndexRecordSize, fi.Size())
+	require.NoError(t, idx.Close())
+}
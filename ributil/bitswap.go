@@ -0,0 +1,200 @@
+package ributil
+
+import (
+	"context"
+	"sync"
+
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// Minimal bitswap client, just enough to fetch known blocks from a single
+// peer (e.g. booster-bitswap). Only wants blocks, never serves them. Wire
+// encoding and streams are handled by the go-bitswap network.
+
+type BitswapClient struct {
+	net bsnet.BitSwapNetwork
+
+	lk sync.Mutex
+	// multihash bytes -> pending wants
+	wants map[string][]*bsWant
+}
+
+type bsWant struct {
+	from peer.ID
+	idx  int
+	res  chan<- bsResult
+}
+
+type bsResult struct {
+	idx  int
+	data []byte // nil means don't have
+}
+
+// NewBitswapClient registers bitswap stream handlers on the host; responses
+// to wants arrive on streams opened by the remote peer
+func NewBitswapClient(h host.Host) *BitswapClient {
+	bc := &BitswapClient{
+		// no content routing, blocks are only fetched from known peers
+		net:   bsnet.NewFromIpfsHost(h, nil),
+		wants: map[string][]*bsWant{},
+	}
+
+	bc.net.Start((*bsReceiver)(bc))
+
+	return bc
+}
+
+// Fetch requests blocks from the peer, calling cb for each received block
+// (in arbitrary order). Received data is verified against the wanted
+// multihash. Returns when all blocks were received, when the peer said it
+// doesn't have the remaining blocks, or when ctx is done; blocks which weren't
+// received are not reported.
+func (bc *BitswapClient) Fetch(ctx context.Context, p peer.ID, c []cid.Cid, cb func(i int, data []byte)) error {
+	if len(c) == 0 {
+		return nil
+	}
+
+	res := make(chan bsResult, 2*len(c))
+	ws := make([]*bsWant, len(c))
+
+	bc.lk.Lock()
+	for i, ci := range c {
+		ws[i] = &bsWant{from: p, idx: i, res: res}
+		k := string(ci.Hash())
+		bc.wants[k] = append(bc.wants[k], ws[i])
+	}
+	bc.lk.Unlock()
+
+	defer func() {
+		bc.lk.Lock()
+		for i, ci := range c {
+			k := string(ci.Hash())
+			l := bc.wants[k]
+			for j, w := range l {
+				if w == ws[i] {
+					l = append(l[:j], l[j+1:]...)
+					break
+				}
+			}
+			if len(l) == 0 {
+				delete(bc.wants, k)
+			} else {
+				bc.wants[k] = l
+			}
+		}
+		bc.lk.Unlock()
+	}()
+
+	if err := bc.send(ctx, p, c, false); err != nil {
+		return xerrors.Errorf("sending wantlist: %w", err)
+	}
+
+	done := make([]bool, len(c))
+	remaining := len(c)
+
+	for remaining > 0 {
+		select {
+		case r := <-res:
+			if done[r.idx] {
+				continue
+			}
+			done[r.idx] = true
+			remaining--
+
+			if r.data != nil {
+				cb(r.idx, r.data)
+			}
+		case <-ctx.Done():
+			var cancel []cid.Cid
+			for i, d := range done {
+				if !d {
+					cancel = append(cancel, c[i])
+				}
+			}
+
+			// best-effort, use a fresh context as ours is done
+			if err := bc.send(context.Background(), p, cancel, true); err != nil {
+				log.Debugw("sending bitswap cancel", "peer", p, "error", err)
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// wantMessage builds a wantlist update asking for blocks, with don't-have
+// responses, or cancelling wants
+func wantMessage(c []cid.Cid, cancel bool) bsmsg.BitSwapMessage {
+	msg := bsmsg.New(false)
+	for _, ci := range c {
+		if cancel {
+			msg.Cancel(ci)
+		} else {
+			msg.AddEntry(ci, 1, pb.Message_Wantlist_Block, true)
+		}
+	}
+	return msg
+}
+
+func (bc *BitswapClient) send(ctx context.Context, p peer.ID, c []cid.Cid, cancel bool) error {
+	return bc.net.SendMessage(ctx, p, wantMessage(c, cancel))
+}
+
+// received hands blocks and don't-haves of a message to pending wants. Blocks
+// were verified against their CIDs when the message was decoded.
+func (bc *BitswapClient) received(from peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, b := range msg.Blocks() {
+		data := b.RawData()
+		if data == nil {
+			data = []byte{} // empty block, nil means don't have
+		}
+		bc.deliver(from, b.Cid().Hash(), data)
+	}
+
+	for _, c := range msg.DontHaves() {
+		bc.deliver(from, c.Hash(), nil)
+	}
+}
+
+func (bc *BitswapClient) deliver(from peer.ID, h mh.Multihash, data []byte) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	for _, w := range bc.wants[string(h)] {
+		// don't-haves only count from the peer we asked, blocks are verified
+		// so they are fine from anyone
+		if data == nil && w.from != from {
+			continue
+		}
+
+		select {
+		case w.res <- bsResult{idx: w.idx, data: data}:
+		default:
+		}
+	}
+}
+
+// bsReceiver gets messages from the bitswap network
+type bsReceiver BitswapClient
+
+func (r *bsReceiver) ReceiveMessage(ctx context.Context, from peer.ID, msg bsmsg.BitSwapMessage) {
+	(*BitswapClient)(r).received(from, msg)
+}
+
+func (r *bsReceiver) ReceiveError(err error) {
+	log.Debugw("bitswap receive error", "error", err)
+}
+
+func (r *bsReceiver) PeerConnected(peer.ID) {}
+
+func (r *bsReceiver) PeerDisconnected(peer.ID) {}
+
+var _ bsnet.Receiver = &bsReceiver{}
@@ -0,0 +1,107 @@
+package ributil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-bitswap"
+	bsmsg "github.com/ipfs/go-bitswap/message"
+	pb "github.com/ipfs/go-bitswap/message/pb"
+	bsnet "github.com/ipfs/go-bitswap/network"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitswapWantMessage(t *testing.T) {
+	c := []cid.Cid{
+		blocks.NewBlock([]byte("a")).Cid(),
+		blocks.NewBlock([]byte("b")).Cid(),
+	}
+
+	roundTrip := func(msg bsmsg.BitSwapMessage) bsmsg.BitSwapMessage {
+		var buf bytes.Buffer
+		require.NoError(t, msg.ToNetV1(&buf))
+		out, err := bsmsg.FromNet(&buf)
+		require.NoError(t, err)
+		return out
+	}
+
+	// want-block with don't-have responses, as a wantlist update
+	msg := roundTrip(wantMessage(c, false))
+	require.False(t, msg.Full())
+	require.Len(t, msg.Wantlist(), 2)
+	for i, e := range msg.Wantlist() {
+		require.Equal(t, c[i], e.Cid)
+		require.Equal(t, pb.Message_Wantlist_Block, e.WantType)
+		require.True(t, e.SendDontHave)
+		require.False(t, e.Cancel)
+	}
+
+	msg = roundTrip(wantMessage(c[:1], true))
+	require.Len(t, msg.Wantlist(), 1)
+	require.Equal(t, c[0], msg.Wantlist()[0].Cid)
+	require.True(t, msg.Wantlist()[0].Cancel)
+}
+
+func TestBitswapFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close() // nolint
+
+	client, err := mn.GenPeer()
+	require.NoError(t, err)
+	server, err := mn.GenPeer()
+	require.NoError(t, err)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+
+	// a go-bitswap node serving some blocks
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		b := blocks.NewBlock([]byte(fmt.Sprintf("bitswap block %d", i)))
+		require.NoError(t, bs.Put(ctx, b))
+		blks = append(blks, b)
+	}
+	blks = append(blks, blocks.NewBlock([]byte{}))
+	require.NoError(t, bs.Put(ctx, blks[len(blks)-1]))
+
+	bsn := bitswap.New(ctx, bsnet.NewFromIpfsHost(server, nil), bs, bitswap.ProvideEnabled(false))
+	defer bsn.Close() // nolint
+
+	bc := NewBitswapClient(client)
+
+	want := make([]cid.Cid, 0, len(blks)+1)
+	for _, b := range blks {
+		want = append(want, b.Cid())
+	}
+	missing := blocks.NewBlock([]byte("not on the server")).Cid()
+	want = append(want, missing)
+
+	got := map[int][]byte{}
+	require.NoError(t, bc.Fetch(ctx, server.ID(), want, func(i int, data []byte) {
+		got[i] = data
+	}))
+
+	// blocks the server doesn't have are not reported
+	require.Len(t, got, len(blks))
+	for i, b := range blks {
+		require.Equal(t, b.RawData(), got[i])
+		require.NotNil(t, got[i])
+	}
+
+	// no wants left behind
+	bc.lk.Lock()
+	require.Empty(t, bc.wants)
+	bc.lk.Unlock()
+}
@@ -0,0 +1,132 @@
+// Package mmap implements read-only file memory mappings with a global
+// address space budget, so that callers can fall back to regular reads when
+// mapping more files isn't possible.
+package mmap
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+type Advice int
+
+const (
+	AdviceNormal Advice = iota
+	AdviceRandom
+	AdviceSequential
+)
+
+var (
+	ErrUnsupported  = errors.New("mmap not supported on this platform")
+	ErrAddressSpace = errors.New("not enough address space left for mmap")
+)
+
+var (
+	budgetLk sync.Mutex
+	mapped   int64
+	limit    = defaultLimit()
+)
+
+// SetLimit sets the maximum number of bytes which can be mapped at the same
+// time across all mappings
+func SetLimit(l int64) {
+	budgetLk.Lock()
+	defer budgetLk.Unlock()
+
+	limit = l
+}
+
+// Mapped returns the number of bytes currently mapped
+func Mapped() int64 {
+	budgetLk.Lock()
+	defer budgetLk.Unlock()
+
+	return mapped
+}
+
+func defaultLimit() int64 {
+	if strconv.IntSize == 32 {
+		return 1 << 30
+	}
+
+	if l, ok := addressSpaceLimit(); ok {
+		// leave half of the limit for the heap and everything else
+		return l / 2
+	}
+
+	return 1 << 46
+}
+
+func reserve(n int64) error {
+	budgetLk.Lock()
+	defer budgetLk.Unlock()
+
+	if mapped+n > limit {
+		return xerrors.Errorf("mapping %d bytes (%d mapped, limit %d): %w", n, mapped, limit, ErrAddressSpace)
+	}
+
+	mapped += n
+	return nil
+}
+
+func release(n int64) {
+	budgetLk.Lock()
+	defer budgetLk.Unlock()
+
+	mapped -= n
+}
+
+// Map maps the whole file read-only. The mapping must be released with Unmap.
+func Map(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, xerrors.Errorf("stat file: %w", err)
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		return []byte{}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, xerrors.Errorf("file size %d: %w", size, ErrAddressSpace)
+	}
+
+	if err := reserve(size); err != nil {
+		return nil, err
+	}
+
+	b, err := mapFile(f, int(size))
+	if err != nil {
+		release(size)
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Unmap releases a mapping created with Map
+func Unmap(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if err := unmapFile(b); err != nil {
+		return err
+	}
+
+	release(int64(len(b)))
+	return nil
+}
+
+// Advise hints the kernel about the expected access pattern of the mapping
+func Advise(b []byte, a Advice) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	return advise(b, a)
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package mmap
+
+import (
+	"os"
+)
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func unmapFile(b []byte) error {
+	return ErrUnsupported
+}
+
+func advise(b []byte, a Advice) error {
+	return nil
+}
+
+func addressSpaceLimit() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin
+
+package mmap
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
+)
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	b, err := unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		if err == unix.ENOMEM {
+			return nil, xerrors.Errorf("mmap: %s: %w", err, ErrAddressSpace)
+		}
+		return nil, xerrors.Errorf("mmap: %w", err)
+	}
+
+	return b, nil
+}
+
+func unmapFile(b []byte) error {
+	if err := unix.Munmap(b); err != nil {
+		return xerrors.Errorf("munmap: %w", err)
+	}
+
+	return nil
+}
+
+func advise(b []byte, a Advice) error {
+	adv := unix.MADV_NORMAL
+	switch a {
+	case AdviceRandom:
+		adv = unix.MADV_RANDOM
+	case AdviceSequential:
+		adv = unix.MADV_SEQUENTIAL
+	}
+
+	if err := unix.Madvise(b, adv); err != nil {
+		return xerrors.Errorf("madvise: %w", err)
+	}
+
+	return nil
+}
+
+func addressSpaceLimit() (int64, bool) {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_AS, &rl); err != nil {
+		return 0, false
+	}
+
+	if rl.Cur == unix.RLIM_INFINITY || rl.Cur > 1<<62 {
+		return 0, false
+	}
+
+	return int64(rl.Cur), true
+}